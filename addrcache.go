@@ -0,0 +1,129 @@
+package tsig
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// lookupHost resolves the host, unless its addresses are cached, emits an
+// EventResolve and then drops any address outside the AllowedNetworks.
+// It returns the addresses, how long it took and any error that occurred.
+func (c *Client) lookupHost(ctx context.Context, hostname string) ([]string, time.Duration, error) {
+
+	start := time.Now()
+
+	addrs, ok := c.cachedAddresses(hostname)
+
+	var err error
+	if !ok {
+		if addrs, err = resolveHost(ctx, c.resolver(), hostname); err == nil {
+			c.cacheAddresses(hostname, addrs)
+		}
+	}
+
+	resolve := time.Since(start)
+
+	c.emit(ctx, Event{
+		Type:      EventResolve,
+		Host:      hostname,
+		Addresses: addrs,
+		Duration:  resolve,
+		Err:       err,
+	})
+
+	if err != nil {
+		return nil, resolve, err
+	}
+
+	addrs, err = c.allowAddresses(hostname, addrs)
+
+	return addrs, resolve, err
+}
+
+// resolveHost looks up the addresses of the host with LookupIPAddr if the
+// resolver implements IPAddrResolver, keeping any IPv6 zone, otherwise with
+// LookupHost.
+// It returns the addresses and any error that occurred.
+func resolveHost(ctx context.Context, r Resolver, hostname string) ([]string, error) {
+
+	ir, ok := r.(IPAddrResolver)
+	if !ok {
+		return r.LookupHost(ctx, hostname)
+	}
+
+	ips, err := ir.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+
+	return addrs, nil
+}
+
+// cachedAddrs is what a host resolved to and when that expires.
+type cachedAddrs struct {
+	addrs  []string
+	expiry time.Time
+}
+
+// cachedAddresses returns the addresses cached for the host, if they
+// haven't expired.
+func (c *Client) cachedAddresses(hostname string) ([]string, bool) {
+
+	if c.AddressCacheTTL <= 0 {
+		return nil, false
+	}
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	cached, ok := c.addrCache[strings.ToLower(hostname)]
+	if !ok || !c.now().Before(cached.expiry) {
+		return nil, false
+	}
+
+	return append([]string{}, cached.addrs...), true
+}
+
+// cacheAddresses caches what the host resolved to for AddressCacheTTL.
+func (c *Client) cacheAddresses(hostname string, addrs []string) {
+
+	if c.AddressCacheTTL <= 0 || len(addrs) == 0 {
+		return
+	}
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if c.addrCache == nil {
+		c.addrCache = make(map[string]cachedAddrs)
+	}
+
+	c.addrCache[strings.ToLower(hostname)] = cachedAddrs{
+		addrs:  append([]string{}, addrs...),
+		expiry: c.now().Add(c.AddressCacheTTL),
+	}
+}
+
+// InvalidateAddresses removes the cached addresses of each host so the next
+// exchange resolves it again, or of every host if none are given.
+func (c *Client) InvalidateAddresses(hosts ...string) {
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if len(hosts) == 0 {
+		c.addrCache = nil
+		return
+	}
+
+	for _, host := range hosts {
+		hostname, _ := SplitHostPort(host)
+		delete(c.addrCache, strings.ToLower(hostname))
+	}
+}
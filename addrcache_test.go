@@ -0,0 +1,138 @@
+package tsig
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// CountingResolver counts the lookups made with the embedded FakeResolver
+type CountingResolver struct {
+	FakeResolver
+	lookups int
+}
+
+func (r *CountingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+
+	r.lookups++
+
+	return r.FakeResolver.LookupHost(ctx, host)
+}
+
+func TestAddressCache(t *testing.T) {
+
+	now := time.Unix(1600000000, 0)
+	resolver := &CountingResolver{FakeResolver: FakeResolver{Addrs: []string{"192.0.2.1"}}}
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver:        resolver,
+		AddressCacheTTL: time.Minute,
+		Now:             func() time.Time { return now },
+	}
+
+	exchange := func(host string) {
+		_, err := client.Exchange(context.Background(), &Request{
+			Host:      host,
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+		})
+		assert.Nil(t, err)
+	}
+
+	exchange("ns.example.com")
+	exchange("NS.example.com:53")
+	assert.Equal(t, 1, resolver.lookups)
+
+	// Answers from the resolver are copied
+	resolver.Addrs[0] = "192.0.2.2"
+	addrs, ok := client.cachedAddresses("ns.example.com")
+	if assert.True(t, ok) {
+		assert.Equal(t, []string{"192.0.2.1"}, addrs)
+	}
+
+	// Other hosts are resolved separately
+	exchange("ns2.example.com")
+	assert.Equal(t, 2, resolver.lookups)
+
+	client.InvalidateAddresses("ns.example.com:53")
+	exchange("ns.example.com")
+	exchange("ns2.example.com")
+	assert.Equal(t, 3, resolver.lookups)
+
+	client.InvalidateAddresses()
+	exchange("ns.example.com")
+	exchange("ns2.example.com")
+	assert.Equal(t, 5, resolver.lookups)
+
+	// The cache expires
+	now = now.Add(time.Minute)
+	exchange("ns.example.com")
+	assert.Equal(t, 6, resolver.lookups)
+
+	// Nothing is cached by default
+	client.AddressCacheTTL = 0
+	exchange("ns.example.com")
+	exchange("ns.example.com")
+	assert.Equal(t, 8, resolver.lookups)
+}
+
+// IPAddrFakeResolver returns structured addresses
+type IPAddrFakeResolver struct {
+	FakeResolver
+	IPAddrs []net.IPAddr
+}
+
+func (r *IPAddrFakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+
+	return r.IPAddrs, r.Err
+}
+
+func TestResolveIPv6Zone(t *testing.T) {
+
+	var attempted []string
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			attempted = append(attempted, address)
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver: &IPAddrFakeResolver{
+			// LookupHost mustn't be used
+			FakeResolver: FakeResolver{Addrs: []string{"192.0.2.1"}},
+			IPAddrs:      []net.IPAddr{{IP: net.ParseIP("fe80::1"), Zone: "eth0"}},
+		},
+	}
+
+	resp, err := client.Exchange(context.Background(), &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "[fe80::1%eth0]:53", resp.Address)
+	}
+	assert.Equal(t, []string{"[fe80::1%eth0]:53"}, attempted)
+
+	// The default resolver keeps the zone of a literal address
+	addrs, err := resolveHost(context.Background(), net.DefaultResolver, "fe80::1%lo")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"fe80::1%lo"}, addrs)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = resolveHost(ctx, net.DefaultResolver, "ns.example.com")
+	assert.NotNil(t, err)
+}
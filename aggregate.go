@@ -0,0 +1,120 @@
+package tsig
+
+import (
+	"errors"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// ErrorAggregator combines the errors of several failed attempts, such as
+// each address, transport or key of a batch, into the one error returned.
+type ErrorAggregator interface {
+	// Aggregate returns an error holding the errors, there is always at
+	// least one
+	Aggregate(errs []error) error
+}
+
+// MultiErrorAggregator aggregates the errors in a *multierror.Error with its
+// usual format. It is the default. errors.Is and errors.As look inside it.
+type MultiErrorAggregator struct{}
+
+// Aggregate returns a *multierror.Error holding the errors.
+func (MultiErrorAggregator) Aggregate(errs []error) error {
+
+	return multierror.Append(nil, errs...)
+}
+
+// JoinAggregator aggregates the errors in a JoinError, for callers that would
+// rather not depend on go-multierror to inspect them.
+type JoinAggregator struct{}
+
+// Aggregate returns a *JoinError holding the errors.
+func (JoinAggregator) Aggregate(errs []error) error {
+
+	return &JoinError{Errors: errs}
+}
+
+// JoinError holds the errors aggregated by JoinAggregator, formatted one per
+// line like errors.Join. errors.Is and errors.As look inside it.
+type JoinError struct {
+	Errors []error
+}
+
+func (e *JoinError) Error() string {
+
+	s := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		s = append(s, err.Error())
+	}
+
+	return strings.Join(s, "\n")
+}
+
+// Is returns whether any of the errors matches the target.
+func (e *JoinError) Is(target error) bool {
+
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// As finds the first of the errors that matches the target and if so sets
+// the target to it.
+func (e *JoinError) As(target interface{}) bool {
+
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Unwrap returns the errors.
+func (e *JoinError) Unwrap() []error {
+
+	return e.Errors
+}
+
+// Errors returns the errors aggregated in the error, or any error it wraps,
+// whether by go-multierror, JoinAggregator or any other error with an
+// Unwrap() []error method, such as those returned by errors.Join. It is nil
+// if the error doesn't aggregate any.
+func Errors(err error) []error {
+
+	var merr *multierror.Error
+	if errors.As(err, &merr) {
+		return merr.Errors
+	}
+
+	var jerr interface {
+		Unwrap() []error
+	}
+	if errors.As(err, &jerr) {
+		return jerr.Unwrap()
+	}
+
+	return nil
+}
+
+// aggregate combines the errors with the ErrorAggregator of the Client,
+// MultiErrorAggregator by default.
+// It returns the error, which is nil if there are no errors.
+func (c *Client) aggregate(errs []error) error {
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	if c.ErrorAggregator != nil {
+		return c.ErrorAggregator.Aggregate(errs)
+	}
+
+	return MultiErrorAggregator{}.Aggregate(errs)
+}
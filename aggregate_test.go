@@ -0,0 +1,70 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorAggregator(t *testing.T) {
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			if address == "192.0.2.1:53" {
+				return nil, errors.New("failed")
+			}
+			return nil, &net.OpError{Op: "dial", Net: "udp", Err: errors.New("refused")}
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2"}},
+	}
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	// go-multierror is the default
+	_, err := client.Exchange(context.Background(), request)
+	if assert.IsType(t, &multierror.Error{}, err) {
+		assert.Len(t, Errors(err), 2)
+		assert.Equal(t, err.(*multierror.Error).Errors, Errors(err))
+
+		var operr *net.OpError
+		if assert.True(t, errors.As(err, &operr)) {
+			assert.Equal(t, "dial", operr.Op)
+		}
+
+		var aerr *AddressError
+		if assert.True(t, errors.As(err, &aerr)) {
+			assert.Equal(t, "192.0.2.1:53", aerr.Address)
+		}
+	}
+
+	client.ErrorAggregator = JoinAggregator{}
+
+	_, err = client.Exchange(context.Background(), request)
+	if assert.IsType(t, &JoinError{}, err) {
+		assert.Len(t, Errors(err), 2)
+		assert.Equal(t, "ns.example.com (192.0.2.1:53): failed\nns.example.com (192.0.2.2:53): dial udp: refused", err.Error())
+
+		var operr *net.OpError
+		if assert.True(t, errors.As(err, &operr)) {
+			assert.Equal(t, "dial", operr.Op)
+		}
+	}
+
+	assert.Nil(t, Errors(errors.New("failed")))
+
+	unknown := &JoinError{Errors: []error{errors.New("failed"), &KeyNameError{}}}
+	assert.True(t, IsUnknownKey(unknown))
+	assert.True(t, errors.Is(&JoinError{Errors: []error{errors.New("failed"), ErrNoAddresses}}, ErrNoAddresses))
+	assert.False(t, errors.Is(unknown, ErrNoAddresses))
+}
@@ -0,0 +1,75 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// probeToken is the placeholder GSS token sent when probing algorithms, a
+// server only gets as far as rejecting it if it accepts the algorithm
+var probeToken = []byte{0x60, 0x00}
+
+// QuerySupportedAlgorithms discovers which of the candidate algorithms,
+// SupportedAlgorithms if none are given, the server host accepts for TKEY
+// queries with the key name, so a compatible algorithm can be chosen before
+// negotiating a key. There is no standard way for a server to advertise
+// them so each candidate is probed in turn with a TKEY query carrying a
+// placeholder key, in GSS-API mode for GSS and LegacyGSS and Diffie-Hellman
+// mode otherwise. A candidate is accepted unless the server answers with
+// BADALG, FORMERR or NOTIMP; a server refusing the placeholder key, for
+// example with BADKEY, got past the algorithm. The error is only set if a
+// probe got no answer at all.
+// It returns the accepted algorithms in candidate order and any error that
+// occurred.
+func (c *Client) QuerySupportedAlgorithms(ctx context.Context, host, keyname string, candidates ...string) ([]string, error) {
+
+	if len(candidates) == 0 {
+		candidates = SupportedAlgorithms()
+	}
+
+	supported := []string{}
+
+	for _, algorithm := range candidates {
+		req := &Request{
+			Host:      host,
+			KeyName:   dns.Fqdn(keyname),
+			Algorithm: dns.Fqdn(algorithm),
+			Mode:      TkeyModeDH,
+			Lifetime:  c.minLifetime(),
+		}
+		if IsGSS(req.Algorithm) {
+			req.Mode = TkeyModeGSS
+			req.Input = probeToken
+		}
+
+		_, err := c.Exchange(ctx, req)
+		if err != nil && transportFailed(err) {
+			return nil, err
+		}
+
+		if !rejectsAlgorithm(err) {
+			supported = append(supported, algorithm)
+		}
+	}
+
+	return supported, nil
+}
+
+// rejectsAlgorithm reports whether the response to a probe means the server
+// doesn't accept the algorithm.
+func rejectsAlgorithm(err error) bool {
+
+	var uerr *UnsupportedError
+	var tkerr *TKEYError
+
+	switch {
+	case errors.As(err, &uerr):
+		return true
+	case errors.As(err, &tkerr):
+		return tkerr.Code == dns.RcodeBadAlg
+	default:
+		return false
+	}
+}
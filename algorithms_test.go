@@ -0,0 +1,57 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuerySupportedAlgorithms(t *testing.T) {
+
+	var probed []uint16
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			tkey := m.Extra[0].(*dns.TKEY)
+			probed = append(probed, tkey.Mode)
+
+			r := tkeyReply(m, m.Question[0].Name)
+			r.Answer[0].(*dns.TKEY).Algorithm = tkey.Algorithm
+
+			switch tkey.Algorithm {
+			case dns.HmacMD5:
+				r.Answer[0].(*dns.TKEY).Error = dns.RcodeBadAlg
+			case LegacyGSS:
+				r.Rcode = dns.RcodeNotImplemented
+			case dns.HmacSHA1:
+				// The placeholder key is refused
+				r.Answer[0].(*dns.TKEY).Error = dns.RcodeBadKey
+			}
+
+			return r, nil
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+	}
+
+	supported, err := client.QuerySupportedAlgorithms(context.Background(), "ns.example.com", "test.example.com")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{GSS, dns.HmacSHA1, dns.HmacSHA256, dns.HmacSHA512}, supported)
+	}
+	assert.Equal(t, []uint16{TkeyModeGSS, TkeyModeGSS, TkeyModeDH, TkeyModeDH, TkeyModeDH, TkeyModeDH}, probed)
+
+	supported, err = client.QuerySupportedAlgorithms(context.Background(), "ns.example.com", "test.example.com", dns.HmacMD5)
+	if assert.Nil(t, err) {
+		assert.Len(t, supported, 0)
+	}
+
+	client.Exchanger = FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	})
+
+	_, err = client.QuerySupportedAlgorithms(context.Background(), "ns.example.com", "test.example.com")
+	assert.NotNil(t, err)
+}
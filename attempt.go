@@ -0,0 +1,120 @@
+package tsig
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bodgit/tsig/client"
+)
+
+// AttemptFunc sends the query to one address, signing it afresh and
+// retrying once after a BADTIME error like Exchange does.
+// It returns the response and any error that occurred.
+type AttemptFunc func(ctx context.Context) (*Response, error)
+
+// Attempt is one address the host of a request resolves to along with the
+// function that sends the query to it.
+type Attempt struct {
+	Address  string
+	Exchange AttemptFunc
+}
+
+// Attempts resolves the host of the request and returns an Attempt for each
+// address in the order set by AddressOrder, up to MaxAddresses, leaving the
+// caller to decide which to try and whether to carry on after a failure
+// rather than Exchange trying each in turn. The outcome of each attempt is
+// reported to AddressOrder. TotalTimeout and Parallel are not applied, the
+// caller bounds the attempts with their contexts, however Timeout still
+// bounds each one. The context only bounds resolving the host.
+// It returns the attempts and any error that occurred.
+func (c *Client) Attempts(ctx context.Context, req *Request) ([]Attempt, error) {
+
+	if err := c.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	hostname, port := SplitHostPort(req.Host)
+
+	msg, err := c.newMsg(req)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, resolve, err := c.lookupHost(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoAddresses, hostname)
+	}
+
+	ex := c.Exchanger
+	if ex == nil {
+		ex = c.dnsClient(req)
+	}
+
+	addrs = c.orderAddresses(hostname, addrs)
+	addrs, _ = c.limitAddresses(addrs)
+	attempts := make([]Attempt, 0, len(addrs))
+
+	for i, addr := range addrs {
+		addr, address, m := addr, c.formatAddress(ex, addr, port), c.attemptMsg(msg, i)
+
+		attempts = append(attempts, Attempt{
+			Address: address,
+			Exchange: func(ctx context.Context) (*Response, error) {
+
+				if err := c.checkClosed(); err != nil {
+					return nil, err
+				}
+
+				ctx = withCorrelation(ctx, req)
+
+				rr, info, err := c.exchangeSigned(ctx, ex, req, m, address, c.now())
+
+				// Don't blame the address if the attempt was cancelled
+				if err == nil || ctx.Err() == nil {
+					c.report(addr, err)
+				}
+
+				if err != nil {
+					return nil, err
+				}
+
+				if err := c.checkCookie(m, rr, address); err != nil {
+					return nil, err
+				}
+
+				if err := c.checkEDNS(m, rr, address); err != nil {
+					return nil, err
+				}
+
+				resp, err := c.newResponse(req, rr, address)
+				if err != nil {
+					return nil, err
+				}
+
+				c.emitClamped(ctx, resp)
+
+				// There's no telling what a custom Exchanger verified
+				if c.Exchanger != nil && resp.TSIG != TSIGUnsigned {
+					resp.TSIG = TSIGUnchecked
+				}
+
+				info.timings.Resolve = resolve
+				resp.Timings = info.timings
+				resp.TLS = info.tls
+				resp.RequestSize, resp.ResponseSize = info.requestSize, info.responseSize
+
+				if cl, ok := ex.(*client.Client); ok {
+					resp.Transport = cl.Net
+				}
+
+				return resp, nil
+			},
+		})
+	}
+
+	return attempts, nil
+}
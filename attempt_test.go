@@ -0,0 +1,71 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttempts(t *testing.T) {
+
+	var attempted []string
+
+	order := &LeastRecentFailure{}
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			attempted = append(attempted, address)
+			if address == "192.0.2.1:53" {
+				return nil, errors.New("failed")
+			}
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver:     &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		AddressOrder: order,
+	}
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	attempts, err := client.Attempts(context.Background(), request)
+	if !assert.Nil(t, err) || !assert.Len(t, attempts, 3) {
+		return
+	}
+
+	assert.Equal(t, "192.0.2.1:53", attempts[0].Address)
+	assert.Equal(t, "192.0.2.2:53", attempts[1].Address)
+	assert.Equal(t, "192.0.2.3:53", attempts[2].Address)
+
+	// Nothing is sent until an attempt is made
+	assert.Len(t, attempted, 0)
+
+	var resp *Response
+	for _, attempt := range attempts {
+		if resp, err = attempt.Exchange(context.Background()); err == nil {
+			break
+		}
+	}
+
+	if assert.Nil(t, err) {
+		assert.Equal(t, "192.0.2.2:53", resp.Address)
+		assert.Equal(t, TSIGUnsigned, resp.TSIG)
+	}
+
+	// The caller stopped after the first success
+	assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, attempted)
+
+	// The failure was reported
+	assert.Equal(t, []string{"192.0.2.2", "192.0.2.3", "192.0.2.1"}, order.Order("ns.example.com", []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}))
+
+	client.Resolver = &FakeResolver{}
+
+	_, err = client.Attempts(context.Background(), request)
+	assert.True(t, errors.Is(err, ErrNoAddresses))
+}
@@ -0,0 +1,152 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// NetAuto is the value of Net that probes which transport each server
+// accepts, see AutoTransports.
+const NetAuto = "auto"
+
+// DefaultAutoTransports is the order transports are probed in when Net is
+// NetAuto and AutoTransports is empty, TCP first as TKEY responses can
+// exceed what fits in a UDP datagram.
+var DefaultAutoTransports = []string{"tcp", "udp"}
+
+// DefaultProbeTimeout bounds each probe when Net is NetAuto and
+// ProbeTimeout is zero.
+const DefaultProbeTimeout = 2 * time.Second
+
+func (c *Client) autoTransports() []string {
+
+	if len(c.AutoTransports) > 0 {
+		return c.AutoTransports
+	}
+
+	return DefaultAutoTransports
+}
+
+func (c *Client) probeTimeout() time.Duration {
+
+	if c.ProbeTimeout > 0 {
+		return c.ProbeTimeout
+	}
+
+	return DefaultProbeTimeout
+}
+
+// network returns the network to send the request over, the transport
+// cached for the host or the first to probe when Net is NetAuto.
+func (c *Client) network(req *Request) string {
+
+	if c.Net == "" {
+		return "tcp"
+	}
+
+	if c.Net != NetAuto {
+		return c.Net
+	}
+
+	hostname, _ := SplitHostPort(req.Host)
+	if network, ok := c.cachedTransport(hostname); ok {
+		return network
+	}
+
+	return c.autoTransports()[0]
+}
+
+// exchangeAuto sends the request over the transport cached for the host,
+// otherwise it tries each of AutoTransports in turn, each bounded by
+// ProbeTimeout, and caches the first the server answers over. A cached
+// transport that stops working is forgotten and the transports probed
+// again.
+// It returns the response and any error that occurred.
+func (c *Client) exchangeAuto(ctx context.Context, req *Request) (*Response, error) {
+
+	hostname, _ := SplitHostPort(req.Host)
+
+	if network, ok := c.cachedTransport(hostname); ok {
+		resp, err := c.exchange(ctx, c.dnsClientNet(req, network), req)
+		if err == nil || !transportFailed(err) || ctx.Err() != nil {
+			return resp, err
+		}
+		c.forgetTransport(hostname)
+	}
+
+	var errs []error
+
+	for _, network := range c.autoTransports() {
+		pctx, cancel := context.WithTimeout(ctx, c.probeTimeout())
+		resp, err := c.exchange(pctx, c.dnsClientNet(req, network), req)
+		cancel()
+
+		// The server answered, even if it was to refuse the query
+		if err == nil || !transportFailed(err) {
+			c.cacheTransport(hostname, network)
+			return resp, err
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", network, err))
+	}
+
+	return nil, c.aggregate(errs)
+}
+
+// transportFailed reports whether the error means the server couldn't be
+// reached over the transport rather than it answering.
+func transportFailed(err error) bool {
+
+	if errs := Errors(err); errs != nil {
+		for _, err := range errs {
+			if !transportFailed(err) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var terr *TimeoutError
+	var nerr net.Error
+
+	return errors.As(err, &terr) || errors.As(err, &nerr) || isReset(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// cachedTransport returns the transport the host was last answered over.
+func (c *Client) cachedTransport(hostname string) (string, bool) {
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	network, ok := c.transportCache[strings.ToLower(hostname)]
+
+	return network, ok
+}
+
+func (c *Client) cacheTransport(hostname, network string) {
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if c.transportCache == nil {
+		c.transportCache = make(map[string]string)
+	}
+
+	c.transportCache[strings.ToLower(hostname)] = network
+}
+
+func (c *Client) forgetTransport(hostname string) {
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	delete(c.transportCache, strings.ToLower(hostname))
+}
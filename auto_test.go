@@ -0,0 +1,106 @@
+package tsig
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveUDPTKEY answers every TKEY query over UDP on the loopback, the
+// returned function stops the server.
+func serveUDPTKEY(tb testing.TB) (string, func()) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			w.WriteMsg(tkeyReply(m, m.Question[0].Name))
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go server.ActivateAndServe()
+	<-started
+
+	return pc.LocalAddr().String(), func() {
+		server.Shutdown()
+	}
+}
+
+func TestAutoTransport(t *testing.T) {
+
+	tables := map[string]struct {
+		serve      func(testing.TB) (string, func())
+		transports []string
+		transport  string
+	}{
+		"tcp only": {
+			serve:      func(tb testing.TB) (string, func()) { return serveLargeTKEY(tb, 16) },
+			transports: []string{"udp", "tcp"},
+			transport:  "tcp",
+		},
+		"udp only": {
+			serve:     serveUDPTKEY,
+			transport: "udp",
+		},
+	}
+
+	for name, table := range tables {
+		t.Run(name, func(t *testing.T) {
+
+			address, stop := table.serve(t)
+			defer stop()
+
+			host, port, _ := net.SplitHostPort(address)
+
+			client := &Client{
+				Net:            NetAuto,
+				AutoTransports: table.transports,
+				ProbeTimeout:   500 * time.Millisecond,
+				Resolver:       &FakeResolver{Addrs: []string{host}},
+			}
+
+			request := &Request{
+				Host:      net.JoinHostPort("ns.example.com", port),
+				KeyName:   "test.example.com.",
+				Algorithm: GSS,
+				Mode:      TkeyModeGSS,
+				Lifetime:  3600,
+			}
+
+			resp, err := client.Exchange(context.Background(), request)
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Equal(t, table.transport, resp.Transport)
+
+			network, ok := client.cachedTransport("NS.example.com")
+			assert.True(t, ok)
+			assert.Equal(t, table.transport, network)
+			assert.Equal(t, table.transport, client.dnsClient(request).Net)
+
+			resp, err = client.Exchange(context.Background(), request)
+			if assert.Nil(t, err) {
+				assert.Equal(t, table.transport, resp.Transport)
+			}
+
+			// A cached transport that stops working is forgotten
+			stop()
+
+			_, err = client.Exchange(context.Background(), request)
+			assert.NotNil(t, err)
+
+			_, ok = client.cachedTransport("ns.example.com")
+			assert.False(t, ok)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package tsig
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff decides how long to wait before each retry, such as resending a
+// query rejected as BADTIME or whose connection was reset.
+type Backoff interface {
+	// Next returns the wait before the retry, attempt is zero for the
+	// first retry of an operation and counts up for each further one
+	Next(attempt int) time.Duration
+}
+
+// ConstantBackoff waits the same time before every retry.
+type ConstantBackoff time.Duration
+
+// Next returns the constant wait.
+func (b ConstantBackoff) Next(attempt int) time.Duration {
+
+	return time.Duration(b)
+}
+
+// ExponentialBackoff waits a random time before each retry of up to Initial
+// for the first, doubling for each retry after that up to Max, so retries
+// from many clients are spread out rather than arriving together. There is
+// no limit if Max is zero.
+type ExponentialBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// Next returns a random wait of up to the limit for the attempt.
+func (b *ExponentialBackoff) Next(attempt int) time.Duration {
+
+	limit := b.Initial
+	for i := 0; i < attempt && limit > 0 && limit <= math.MaxInt64/2 && (b.Max == 0 || limit < b.Max); i++ {
+		limit *= 2
+	}
+
+	if b.Max > 0 && limit > b.Max {
+		limit = b.Max
+	}
+
+	if limit <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// DefaultBackoff is the Backoff used unless Backoff is set, the first retry
+// waits up to DefaultBadTimeJitter.
+var DefaultBackoff Backoff = &ExponentialBackoff{Initial: DefaultBadTimeJitter, Max: time.Second}
+
+func (c *Client) backoff() Backoff {
+
+	if c.Backoff != nil {
+		return c.Backoff
+	}
+
+	return DefaultBackoff
+}
+
+// retryWait returns how long to wait before the retry, zero if the Backoff
+// returns a negative wait.
+func (c *Client) retryWait(attempt int) time.Duration {
+
+	if wait := c.backoff().Next(attempt); wait > 0 {
+		return wait
+	}
+
+	return 0
+}
+
+// sleep waits for the duration unless the context is cancelled first.
+// It returns the error of the context if it was cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,141 @@
+package tsig
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// RecordingBackoff records each attempt it is asked about and always waits
+// the same time
+type RecordingBackoff struct {
+	Wait     time.Duration
+	attempts []int
+}
+
+func (b *RecordingBackoff) Next(attempt int) time.Duration {
+
+	b.attempts = append(b.attempts, attempt)
+
+	return b.Wait
+}
+
+func TestConstantBackoff(t *testing.T) {
+
+	b := ConstantBackoff(time.Second)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, time.Second, b.Next(i))
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+
+	b := &ExponentialBackoff{Initial: time.Millisecond, Max: 4 * time.Millisecond}
+
+	tables := []struct {
+		attempt int
+		limit   time.Duration
+	}{
+		{0, time.Millisecond},
+		{1, 2 * time.Millisecond},
+		{2, 4 * time.Millisecond},
+		{10, 4 * time.Millisecond},
+		{1000, 4 * time.Millisecond},
+	}
+
+	for _, table := range tables {
+		for i := 0; i < 100; i++ {
+			wait := b.Next(table.attempt)
+			assert.True(t, wait >= 0 && wait <= table.limit, table.attempt)
+		}
+	}
+
+	// Without a maximum the limit doesn't overflow
+	b.Max = 0
+	assert.True(t, b.Next(1000) >= 0)
+
+	assert.Equal(t, time.Duration(0), (&ExponentialBackoff{}).Next(5))
+}
+
+func TestBackoffHonoured(t *testing.T) {
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	// Each connection reset waits before it is retried
+	backoff := &RecordingBackoff{Wait: 10 * time.Millisecond}
+	sent := 0
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			sent++
+			if sent <= 2 {
+				return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", errConnReset)}
+			}
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver:     &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		ResetRetries: 2,
+		Backoff:      backoff,
+	}
+
+	start := time.Now()
+	_, err := client.Exchange(context.Background(), request)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	assert.Equal(t, []int{0, 1}, backoff.attempts)
+
+	// As does each BADTIME retry, the wait is added to the time of the
+	// server
+	backoff = &RecordingBackoff{Wait: 2 * time.Second}
+	var signed []uint64
+
+	client = &Client{
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		Now: func() time.Time {
+			return time.Unix(1600000000, 0)
+		},
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			signed = append(signed, m.IsTsig().TimeSigned)
+			return badTimeReply(m, 1600000000, "00005f5e1e10"), nil
+		}),
+		BadTimeRetries: 2,
+		// Ignored in favour of the Backoff
+		BadTimeJitter: time.Hour,
+		Backoff:       backoff,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// The first wait outlasts the context
+	_, err = client.Exchange(ctx, request)
+	assert.NotNil(t, err)
+	assert.Equal(t, []int{0}, backoff.attempts)
+	assert.Equal(t, []uint64{1600000000}, signed)
+
+	backoff.Wait, backoff.attempts, signed = time.Millisecond, nil, nil
+
+	_, err = client.Exchange(context.Background(), request)
+	assert.NotNil(t, err)
+	assert.Equal(t, []int{0, 1}, backoff.attempts)
+	assert.Equal(t, []uint64{1600000000, 1600003600, 1600003600}, signed)
+
+	assert.Equal(t, DefaultBackoff, (&Client{}).backoff())
+	assert.Equal(t, time.Duration(0), (&Client{Backoff: ConstantBackoff(-time.Second)}).retryWait(0))
+}
@@ -0,0 +1,114 @@
+package tsig
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// serverTime returns the time of the server if the response rejected the
+// TSIG of the query as BADTIME. RFC 8945 has the server put its time in the
+// other data of the TSIG as a 48-bit number of seconds, the time signed of
+// the TSIG is used if that is missing.
+func serverTime(rr *dns.Msg) (time.Time, bool) {
+
+	if rr == nil {
+		return time.Time{}, false
+	}
+
+	t := rr.IsTsig()
+	if t == nil || t.Error != dns.RcodeBadTime {
+		return time.Time{}, false
+	}
+
+	if other, err := hex.DecodeString(t.OtherData); err == nil && len(other) == 6 {
+		var seconds int64
+		for _, b := range other {
+			seconds = seconds<<8 | int64(b)
+		}
+		return time.Unix(seconds, 0), true
+	}
+
+	return time.Unix(int64(t.TimeSigned), 0), true
+}
+
+// DefaultBadTimeRetries is the number of times a query rejected as BADTIME
+// is resent unless BadTimeRetries is set.
+const DefaultBadTimeRetries = 1
+
+// DefaultBadTimeJitter is the longest a BADTIME retry waits before it is
+// sent unless BadTimeJitter is set.
+const DefaultBadTimeJitter = 50 * time.Millisecond
+
+func (c *Client) badTimeRetries() int {
+
+	switch {
+	case c.BadTimeRetries < 0:
+		return 0
+	case c.BadTimeRetries > 0:
+		return c.BadTimeRetries
+	default:
+		return DefaultBadTimeRetries
+	}
+}
+
+func (c *Client) badTimeJitter() time.Duration {
+
+	max := c.BadTimeJitter
+	if max == 0 {
+		max = DefaultBadTimeJitter
+	}
+
+	if max < 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// badTimeWait returns how long to wait before the BADTIME retry, a random
+// jitter of up to BadTimeJitter if it is set and Backoff isn't, otherwise
+// the wait chosen by the Backoff.
+func (c *Client) badTimeWait(attempt int) time.Duration {
+
+	if c.Backoff == nil && c.BadTimeJitter != 0 {
+		return c.badTimeJitter()
+	}
+
+	return c.retryWait(attempt)
+}
+
+// retryAfterBadTime resends the query, signed at the time of the server, for
+// as long as the response rr rejects the TSIG as BADTIME up to the number of
+// BadTimeRetries. Each retry waits first, see badTimeWait, and the wait is
+// added to the time of the server, so a server whose clock is unstable isn't
+// resent to in a tight loop. send signs a fresh copy of the query at the given time
+// and sends it.
+// It returns the response and any error of the last attempt, or a TSIGError
+// if it was still rejected as BADTIME.
+func (c *Client) retryAfterBadTime(ctx context.Context, rr *dns.Msg, err error, send func(now time.Time) (*dns.Msg, error)) (*dns.Msg, error) {
+
+	for i := 0; i < c.badTimeRetries(); i++ {
+		now, ok := serverTime(rr)
+		if !ok {
+			return rr, err
+		}
+
+		wait := c.badTimeWait(i)
+
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+
+		rr, err = send(now.Add(wait))
+	}
+
+	if _, ok := serverTime(rr); ok {
+		return checkTSIGError(rr, err)
+	}
+
+	return rr, err
+}
@@ -0,0 +1,183 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// badTimeReply returns a reply to the query rejecting its TSIG as BADTIME,
+// other is the hex encoded server time if not empty.
+func badTimeReply(m *dns.Msg, signed uint64, other string) *dns.Msg {
+
+	r := new(dns.Msg)
+	r.SetRcode(m, dns.RcodeNotAuth)
+	r.Extra = append(r.Extra, &dns.TSIG{
+		Hdr: dns.RR_Header{
+			Name:   m.IsTsig().Hdr.Name,
+			Rrtype: dns.TypeTSIG,
+			Class:  dns.ClassANY,
+		},
+		Algorithm:  m.IsTsig().Algorithm,
+		TimeSigned: signed,
+		Fudge:      300,
+		OrigId:     m.Id,
+		Error:      dns.RcodeBadTime,
+		OtherLen:   uint16(len(other) / 2),
+		OtherData:  other,
+	})
+
+	return r
+}
+
+func TestServerTime(t *testing.T) {
+
+	m := new(dns.Msg)
+	m.SetQuestion("test.example.com.", dns.TypeTKEY)
+	m.SetTsig("tsig.example.com.", dns.HmacMD5, 300, 1600000000)
+
+	now, ok := serverTime(badTimeReply(m, 1600000000, "00005f5e1e10"))
+	if assert.True(t, ok) {
+		assert.Equal(t, time.Unix(1600003600, 0), now)
+	}
+
+	// Falls back to the time signed
+	now, ok = serverTime(badTimeReply(m, 1600001000, ""))
+	if assert.True(t, ok) {
+		assert.Equal(t, time.Unix(1600001000, 0), now)
+	}
+
+	_, ok = serverTime(tkeyReply(m, "test.example.com."))
+	assert.False(t, ok)
+
+	_, ok = serverTime(nil)
+	assert.False(t, ok)
+}
+
+func TestExchangeRetryBadTime(t *testing.T) {
+
+	var signed []uint64
+
+	client := &Client{
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		Now: func() time.Time {
+			return time.Unix(1600000000, 0)
+		},
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			signed = append(signed, m.IsTsig().TimeSigned)
+			if len(signed) == 1 {
+				// The server is an hour ahead
+				return badTimeReply(m, 1600000000, "00005f5e1e10"), nil
+			}
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+	}
+
+	resp, err := client.Exchange(context.Background(), &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "test.example.com.", resp.KeyName)
+	}
+
+	// The retry is signed with the server time
+	assert.Equal(t, []uint64{1600000000, 1600003600}, signed)
+}
+
+func TestExchangeRetryBadTimeFails(t *testing.T) {
+
+	tables := []struct {
+		retries  int
+		attempts int
+	}{
+		{0, 2},
+		{-1, 1},
+		{3, 4},
+	}
+
+	for _, table := range tables {
+		var signed []uint64
+
+		client := &Client{
+			Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+			Now: func() time.Time {
+				return time.Unix(1600000000, 0)
+			},
+			BadTimeRetries: table.retries,
+			BadTimeJitter:  -1,
+			Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+				signed = append(signed, m.IsTsig().TimeSigned)
+				// The server time keeps moving
+				return badTimeReply(m, 1600000000, fmt.Sprintf("%012x", 1600003600+len(signed))), nil
+			}),
+		}
+
+		_, err := client.Exchange(context.Background(), &Request{
+			Host:      "ns.example.com.",
+			KeyName:   "test.example.com.",
+			Algorithm: dns.HmacMD5,
+			Mode:      TkeyModeDH,
+			Lifetime:  3600,
+			TSIG: &TSIGKey{
+				Name:      "tsig.example.com.",
+				Algorithm: dns.HmacMD5,
+				Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+			},
+		})
+
+		assert.Len(t, signed, table.attempts)
+
+		// Every retry is signed with the latest server time
+		for i := 1; i < len(signed); i++ {
+			assert.Equal(t, uint64(1600003600+i), signed[i])
+		}
+
+		if !assert.IsType(t, &multierror.Error{}, err) {
+			continue
+		}
+		var terr *TSIGError
+		if assert.True(t, errors.As(err.(*multierror.Error).Errors[0], &terr)) {
+			assert.Equal(t, uint16(dns.RcodeBadTime), terr.Code)
+		}
+	}
+}
+
+func TestBadTimeJitter(t *testing.T) {
+
+	client := &Client{BadTimeJitter: time.Millisecond}
+	for i := 0; i < 100; i++ {
+		wait := client.badTimeJitter()
+		assert.True(t, wait >= 0 && wait <= time.Millisecond)
+	}
+
+	assert.Equal(t, time.Duration(0), (&Client{BadTimeJitter: -1}).badTimeJitter())
+
+	// A cancelled context stops the retry
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	m := new(dns.Msg)
+	m.SetQuestion("test.example.com.", dns.TypeTKEY)
+	m.SetTsig("tsig.example.com.", dns.HmacMD5, 300, 1600000000)
+
+	_, err := (&Client{}).retryAfterBadTime(ctx, badTimeReply(m, 1600000000, ""), nil, func(now time.Time) (*dns.Msg, error) {
+		t.Fatal("retry sent")
+		return nil, nil
+	})
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,262 @@
+package tsig
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxConcurrency is the number of exchanges a Client allows in flight
+// at once for batches unless MaxConcurrency is set.
+const DefaultMaxConcurrency = 4
+
+// BatchResult is the outcome of one request sent by ExchangeBatch.
+type BatchResult struct {
+	Request  *Request
+	Response *Response
+	Err      error
+}
+
+// ExchangeBatch sends each request to the same server, the Host of each
+// request is ignored in favour of host. At most limit requests are in flight
+// at once, each using its own connection which is reused for the following
+// requests rather than dialing again; a connection is only replaced when it
+// fails, an error response from the server leaves it in use. Only the
+// connection setup is shared, any GSS token in the Input of each request must
+// already have been generated by the caller. A limit less than one means the
+// requests are sent one at a time, the limit is further capped by
+// MaxConcurrency, or DefaultMaxConcurrency if that is zero, which also
+// applies across concurrent batches.
+// It returns the result for each request, in the same order, and an error
+// aggregating the error for each key that failed.
+func (c *Client) ExchangeBatch(ctx context.Context, host string, reqs []*Request, limit int) ([]BatchResult, error) {
+
+	results := make([]BatchResult, len(reqs))
+
+	c.batch(ctx, host, reqs, limit, func(i int, result BatchResult) {
+		results[i] = result
+	})
+
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", result.Request.KeyName, result.Err))
+		}
+	}
+
+	return results, c.aggregate(errs)
+}
+
+// ExchangeBatchStream is like ExchangeBatch except the result for each
+// request is sent on the returned channel as soon as its key is established
+// or fails, in the order they complete rather than the order of the
+// requests. Once the context is cancelled no more requests are sent, each
+// one remaining is reported with the error of the context. There is exactly
+// one result per request and the channel is closed once they have all been
+// sent; it is buffered to hold them all so the batch is never blocked by a
+// caller who stops receiving.
+func (c *Client) ExchangeBatchStream(ctx context.Context, host string, reqs []*Request, limit int) <-chan BatchResult {
+
+	results := make(chan BatchResult, len(reqs))
+
+	go func() {
+		defer close(results)
+
+		c.batch(ctx, host, reqs, limit, func(_ int, result BatchResult) {
+			results <- result
+		})
+	}()
+
+	return results
+}
+
+// batch sends each request to the same server as described by ExchangeBatch,
+// calling done with the index and result of each request as it completes.
+// Calls to done may be concurrent and batch returns once every request has
+// been passed to it.
+func (c *Client) batch(ctx context.Context, host string, reqs []*Request, limit int, done func(int, BatchResult)) {
+
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > len(reqs) {
+		limit = len(reqs)
+	}
+	if max := c.maxConcurrency(); limit > max {
+		limit = max
+	}
+
+	work := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var conn net.Conn
+			var expires time.Time
+			defer func() {
+				if conn != nil {
+					conn.Close()
+				}
+			}()
+
+			for i := range work {
+				done(i, c.batchRequest(ctx, host, &conn, &expires, reqs[i]))
+			}
+		}()
+	}
+
+	// Stop handing out requests once the context is cancelled
+	sent := 0
+feed:
+	for ; sent < len(reqs) && ctx.Err() == nil; sent++ {
+		select {
+		case work <- sent:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+
+	for i := sent; i < len(reqs); i++ {
+		done(i, BatchResult{Request: reqs[i], Err: ctx.Err()})
+	}
+
+	wg.Wait()
+}
+
+// batchRequest sends one request of a batch using the connection of the
+// worker, replacing it as necessary.
+// It returns the result of the request.
+func (c *Client) batchRequest(ctx context.Context, host string, conn *net.Conn, expires *time.Time, req *Request) BatchResult {
+
+	result := BatchResult{Request: req}
+
+	ctx = withCorrelation(ctx, req)
+
+	if result.Err = c.checkClosed(); result.Err != nil {
+		if *conn != nil {
+			(*conn).Close()
+			*conn = nil
+		}
+		return result
+	}
+
+	if result.Err = c.acquire(ctx); result.Err != nil {
+		return result
+	}
+	defer c.release()
+
+	// Don't reuse a connection the server is about to close
+	if *conn != nil && !expires.IsZero() && c.now().After(*expires) {
+		(*conn).Close()
+		*conn = nil
+	}
+	if *conn == nil {
+		*expires = time.Time{}
+	}
+
+	c.profile(ctx, host, req.Mode, func(ctx context.Context) {
+		*conn, result.Response, result.Err = c.exchangeBatchRequest(ctx, host, *conn, req)
+	})
+	if result.Response != nil && result.Response.KeepAlive > 0 {
+		*expires = keepaliveExpiry(c.now(), result.Response.KeepAlive)
+	}
+
+	return result
+}
+
+// exchangeBatchRequest sends one request of a batch over the connection,
+// dialing first if there isn't one.
+// It returns the connection to use for the next request, which is nil if it
+// failed, along with the response and any error that occurred.
+func (c *Client) exchangeBatchRequest(ctx context.Context, host string, conn net.Conn, req *Request) (net.Conn, *Response, error) {
+
+	var timings Timings
+
+	if conn == nil {
+		var err error
+		if conn, timings, err = c.dialHostTimed(ctx, host); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	msg, err := c.newMsg(req)
+	if err != nil {
+		return conn, nil, err
+	}
+
+	start := time.Now()
+
+	rr, info, err := c.exchangeConn(ctx, conn, msg, req)
+	if err != nil {
+		// The connection may be in an unknown state
+		conn.Close()
+		return nil, nil, err
+	}
+
+	timings.Exchange = time.Since(start)
+
+	address := remoteAddress(conn)
+
+	if err := c.checkCookie(msg, rr, address); err != nil {
+		return conn, nil, err
+	}
+
+	if err := c.checkEDNS(msg, rr, address); err != nil {
+		return conn, nil, err
+	}
+
+	resp, err := c.newResponse(req, rr, address)
+	if err != nil {
+		return conn, nil, err
+	}
+
+	c.emitClamped(ctx, resp)
+
+	resp.Timings = timings
+	resp.TLS = connTLS(conn)
+	resp.RequestSize, resp.ResponseSize = info.requestSize, info.responseSize
+
+	return conn, resp, nil
+}
+
+func (c *Client) maxConcurrency() int {
+
+	if c.MaxConcurrency > 0 {
+		return c.MaxConcurrency
+	}
+
+	return DefaultMaxConcurrency
+}
+
+// acquire waits for one of the MaxConcurrency slots shared by every batch
+// using the Client.
+func (c *Client) acquire(ctx context.Context) error {
+
+	c.semOnce.Do(func() {
+		c.sem = make(chan struct{}, c.maxConcurrency())
+	})
+
+	// A free slot shouldn't win over an already cancelled context
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case c.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) release() {
+
+	<-c.sem
+}
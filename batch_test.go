@@ -0,0 +1,329 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveTKEY answers TKEY queries on the connection until it is closed,
+// queries for "bad.example.com." are refused.
+func serveTKEY(conn net.Conn) {
+
+	defer conn.Close()
+
+	co := &dns.Conn{Conn: conn}
+
+	for {
+		m, err := co.ReadMsg()
+		if err != nil {
+			return
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(m)
+
+		if m.Question[0].Name == "bad.example.com." {
+			r.Rcode = dns.RcodeRefused
+		} else {
+			r.Answer = append(r.Answer, &dns.TKEY{
+				Hdr: dns.RR_Header{
+					Name:   m.Question[0].Name,
+					Rrtype: dns.TypeTKEY,
+					Class:  dns.ClassANY,
+				},
+				Algorithm: GSS,
+				Mode:      TkeyModeGSS,
+			})
+		}
+
+		if err := co.WriteMsg(r); err != nil {
+			return
+		}
+	}
+}
+
+func TestExchangeBatch(t *testing.T) {
+
+	var m sync.Mutex
+	dials := 0
+
+	client := &Client{
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			m.Lock()
+			defer m.Unlock()
+			dials++
+			c, s := net.Pipe()
+			go serveTKEY(s)
+			return c, nil
+		},
+	}
+
+	names := []string{"one.example.com.", "two.example.com.", "bad.example.com.", "three.example.com.", "four.example.com."}
+	reqs := make([]*Request, len(names))
+	for i, name := range names {
+		reqs[i] = &Request{
+			KeyName:   name,
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+		}
+	}
+
+	results, err := client.ExchangeBatch(context.Background(), "ns.example.com", reqs, 2)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bad.example.com.")
+
+	if assert.Len(t, results, len(names)) {
+		for i, result := range results {
+			assert.Equal(t, reqs[i], result.Request)
+			if names[i] == "bad.example.com." {
+				assert.NotNil(t, result.Err)
+				assert.Nil(t, result.Response)
+			} else if assert.Nil(t, result.Err) {
+				assert.Equal(t, names[i], result.Response.KeyName)
+			}
+		}
+	}
+
+	// One connection per worker, the refused request doesn't replace its
+	// connection
+	assert.LessOrEqual(t, dials, 2)
+}
+
+func TestExchangeBatchMaxConcurrency(t *testing.T) {
+
+	var m sync.Mutex
+	inflight, peak := 0, 0
+
+	client := &Client{
+		Resolver:       &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		MaxConcurrency: 2,
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, s := net.Pipe()
+			go func() {
+				defer s.Close()
+
+				co := &dns.Conn{Conn: s}
+
+				for {
+					q, err := co.ReadMsg()
+					if err != nil {
+						return
+					}
+
+					m.Lock()
+					inflight++
+					if inflight > peak {
+						peak = inflight
+					}
+					m.Unlock()
+
+					time.Sleep(5 * time.Millisecond)
+
+					m.Lock()
+					inflight--
+					m.Unlock()
+
+					if err := co.WriteMsg(tkeyReply(q, q.Question[0].Name)); err != nil {
+						return
+					}
+				}
+			}()
+			return c, nil
+		},
+	}
+
+	reqs := make([]*Request, 8)
+	for i := range reqs {
+		reqs[i] = &Request{
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+		}
+	}
+
+	// Two batches each asking for more than the limit
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.ExchangeBatch(context.Background(), "ns.example.com", reqs, 4)
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, peak, 2)
+	assert.Equal(t, 4, (&Client{}).maxConcurrency())
+
+	// The slots are sized by the first batch
+	client.MaxConcurrency = 8
+	assert.Equal(t, 2, cap(client.sem))
+}
+
+func TestExchangeBatchDialError(t *testing.T) {
+
+	client := &Client{
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+
+	results, err := client.ExchangeBatch(context.Background(), "ns.example.com", []*Request{{KeyName: "test.example.com."}}, 0)
+	assert.NotNil(t, err)
+	if assert.Len(t, results, 1) {
+		assert.NotNil(t, results[0].Err)
+	}
+}
+
+func TestExchangeBatchRedial(t *testing.T) {
+
+	dials := 0
+
+	client := &Client{
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dials++
+			c, s := net.Pipe()
+			if dials == 1 {
+				// The first connection fails before answering
+				s.Close()
+			} else {
+				go serveTKEY(s)
+			}
+			return c, nil
+		},
+	}
+
+	reqs := []*Request{
+		{KeyName: "one.example.com.", Algorithm: GSS, Mode: TkeyModeGSS, Lifetime: 3600},
+		{KeyName: "two.example.com.", Algorithm: GSS, Mode: TkeyModeGSS, Lifetime: 3600},
+	}
+
+	results, err := client.ExchangeBatch(context.Background(), "ns.example.com", reqs, 1)
+	assert.NotNil(t, err)
+	if assert.Len(t, results, 2) {
+		assert.NotNil(t, results[0].Err)
+		if assert.Nil(t, results[1].Err) {
+			assert.Equal(t, "two.example.com.", results[1].Response.KeyName)
+		}
+	}
+	assert.Equal(t, 2, dials)
+}
+
+func TestExchangeBatchStream(t *testing.T) {
+
+	client := &Client{
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, s := net.Pipe()
+			go serveTKEY(s)
+			return c, nil
+		},
+	}
+
+	names := []string{"one.example.com.", "bad.example.com.", "two.example.com.", "three.example.com."}
+	reqs := make([]*Request, len(names))
+	for i, name := range names {
+		reqs[i] = &Request{
+			KeyName:   name,
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+		}
+	}
+
+	seen := map[string]error{}
+	for result := range client.ExchangeBatchStream(context.Background(), "ns.example.com", reqs, 2) {
+		seen[result.Request.KeyName] = result.Err
+		if result.Err == nil {
+			assert.Equal(t, result.Request.KeyName, result.Response.KeyName)
+		}
+	}
+
+	if assert.Len(t, seen, len(names)) {
+		for _, name := range names {
+			if name == "bad.example.com." {
+				assert.NotNil(t, seen[name])
+			} else {
+				assert.Nil(t, seen[name])
+			}
+		}
+	}
+
+	// Nothing is sent once the context is cancelled
+	dials := 0
+	client.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		return nil, errors.New("connection refused")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	count := 0
+	for result := range client.ExchangeBatchStream(ctx, "ns.example.com", reqs, 1) {
+		count++
+		assert.True(t, errors.Is(result.Err, context.Canceled))
+	}
+	assert.Equal(t, len(reqs), count)
+	assert.Equal(t, 0, dials)
+
+	results, err := client.ExchangeBatch(ctx, "ns.example.com", reqs, 1)
+	assert.NotNil(t, err)
+	if assert.Len(t, results, len(reqs)) {
+		for i, result := range results {
+			assert.Equal(t, reqs[i], result.Request)
+			assert.True(t, errors.Is(result.Err, context.Canceled))
+		}
+	}
+}
+
+// anonymousConn is a connection with no remote address
+type anonymousConn struct {
+	net.Conn
+}
+
+func (c anonymousConn) RemoteAddr() net.Addr {
+
+	return nil
+}
+
+func TestExchangeConnReuse(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go serveTKEY(server)
+
+	conn := anonymousConn{client}
+
+	for _, name := range []string{"one.example.com.", "two.example.com."} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		resp, err := (&Client{}).ExchangeConn(ctx, conn, &Request{
+			KeyName:   name,
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+		})
+		if assert.Nil(t, err) {
+			assert.Equal(t, name, resp.KeyName)
+			assert.Equal(t, "", resp.Address)
+		}
+
+		// Cancelling afterwards mustn't leave a deadline on the connection
+		cancel()
+	}
+}
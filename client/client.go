@@ -3,7 +3,11 @@ package client
 // A client implementation.
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"net"
 	"time"
 
@@ -18,14 +22,38 @@ const (
 type Conn struct {
 	dns.Conn
 	TsigAlgorithm  map[string]*TsigAlgorithm
+	TsigSigner     TsigSigner // if set, signs every message with a TSIG RR
+	MaxMsgSize     int        // if set, larger messages read over TCP are rejected
 	tsigRequestMAC string
+	// written and read are the sizes of the last message written and read
+	written, read int
+}
+
+// MsgSizeError is returned when a message read over TCP is larger than the
+// MaxMsgSize of the connection.
+type MsgSizeError struct {
+	Size int
+	Max  int
+}
+
+func (e *MsgSizeError) Error() string {
+	return fmt.Sprintf("dns: message of %d bytes exceeds the maximum of %d bytes", e.Size, e.Max)
 }
 
 // A Client defines parameters for a DNS client.
 type Client struct {
 	dns.Client
 	TsigAlgorithm map[string]*TsigAlgorithm
-	group         singleflight
+	TsigSigner    TsigSigner // if set, signs every message with a TSIG RR
+	MaxMsgSize    int        // if set, larger messages read over TCP are rejected
+	ReadBuffer    int        // if set, the socket receive buffer size of each connection
+	WriteBuffer   int        // if set, the socket send buffer size of each connection
+	NoDelay       bool       // if set, Nagle's algorithm is disabled on each TCP connection
+	// VerifyTLS, if set, is called with the state of each TLS connection
+	// once the handshake is complete, an error closes the connection
+	// before anything is sent
+	VerifyTLS func(tls.ConnectionState) error
+	group     singleflight
 }
 
 func (c *Client) dialTimeout() time.Duration {
@@ -54,6 +82,12 @@ func (c *Client) writeTimeout() time.Duration {
 
 // Dial connects to the address on the named network.
 func (c *Client) Dial(address string) (conn *Conn, err error) {
+	return c.DialContext(context.Background(), address)
+}
+
+// DialContext connects to the address on the named network, the dial is
+// abandoned if the context is cancelled or its deadline passes.
+func (c *Client) DialContext(ctx context.Context, address string) (conn *Conn, err error) {
 	// create a new dialer with the appropriate timeout
 	var d net.Dialer
 	if c.Dialer == nil {
@@ -83,17 +117,109 @@ func (c *Client) Dial(address string) (conn *Conn, err error) {
 	}
 
 	conn = new(Conn)
+	conn.Conn.Conn, err = d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err = SetBuffers(conn.Conn.Conn, c.ReadBuffer, c.WriteBuffer); err != nil {
+		conn.Conn.Conn.Close()
+		return nil, err
+	}
+	if c.NoDelay {
+		if err = SetNoDelay(conn.Conn.Conn); err != nil {
+			conn.Conn.Conn.Close()
+			return nil, err
+		}
+	}
 	if useTLS {
-		conn.Conn.Conn, err = tls.DialWithDialer(&d, network, address, c.TLSConfig)
-	} else {
-		conn.Conn.Conn, err = d.Dial(network, address)
+		if conn.Conn.Conn, err = TLSHandshake(ctx, conn.Conn.Conn, address, c.TLSConfig, d.Timeout); err != nil {
+			return nil, err
+		}
+		if err = VerifyTLS(conn.Conn.Conn, c.VerifyTLS); err != nil {
+			return nil, err
+		}
 	}
-	if err != nil {
+	return conn, nil
+}
+
+// SetBuffers sets the socket receive and send buffer sizes of the connection,
+// a size of zero leaves the operating system default. Connections without
+// socket buffers, such as those from net.Pipe, are left alone.
+func SetBuffers(conn net.Conn, read, write int) error {
+	if read > 0 {
+		if c, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+			if err := c.SetReadBuffer(read); err != nil {
+				return err
+			}
+		}
+	}
+	if write > 0 {
+		if c, ok := conn.(interface{ SetWriteBuffer(int) error }); ok {
+			if err := c.SetWriteBuffer(write); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetNoDelay disables Nagle's algorithm on the connection, setting
+// TCP_NODELAY, so small messages are sent without waiting. It does nothing
+// if the connection isn't TCP.
+func SetNoDelay(conn net.Conn) error {
+	if c, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+		return c.SetNoDelay(true)
+	}
+	return nil
+}
+
+// TLSHandshake wraps the already dialed connection to address with TLS,
+// mirroring tls.DialWithDialer but honouring the context as well as the
+// timeout. The raw connection is closed if the handshake fails.
+func TLSHandshake(ctx context.Context, raw net.Conn, address string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if config == nil {
+		config = new(tls.Config)
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config.ServerName = host
+	}
+
+	deadline, ok := ctx.Deadline()
+	if timeout != 0 && (!ok || time.Now().Add(timeout).Before(deadline)) {
+		deadline = time.Now().Add(timeout)
+	}
+	raw.SetDeadline(deadline)
+
+	conn := tls.Client(raw, config)
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
 		return nil, err
 	}
+	raw.SetDeadline(time.Time{})
 	return conn, nil
 }
 
+// VerifyTLS calls verify, if set, with the state of the TLS connection,
+// closing it if verify returns an error. It does nothing if the connection
+// doesn't use TLS.
+func VerifyTLS(conn net.Conn, verify func(tls.ConnectionState) error) error {
+	if verify == nil {
+		return nil
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := verify(tc.ConnectionState()); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	return nil
+}
+
 // Exchange performs a synchronous query. It sends the message m to the address
 // contained in a and waits for a reply. Basic use pattern with a *dns.Client:
 //
@@ -109,8 +235,15 @@ func (c *Client) Dial(address string) (conn *Conn, err error) {
 // To specify a local address or a timeout, the caller has to set the `Client.Dialer`
 // attribute appropriately
 func (c *Client) Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.ExchangeContext(context.Background(), m, address)
+}
+
+// ExchangeContext performs a synchronous query like Exchange. It additionally
+// obeys deadlines and cancellation from the passed Context, whichever of the
+// context deadline or the configured timeouts is sooner is used.
+func (c *Client) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
 	if !c.SingleInflight {
-		return c.exchange(m, address)
+		return c.exchange(ctx, m, address)
 	}
 
 	t := "nop"
@@ -122,7 +255,7 @@ func (c *Client) Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Dura
 		cl = cl1
 	}
 	r, rtt, err, shared := c.group.Do(m.Question[0].Name+t+cl, func() (*dns.Msg, time.Duration, error) {
-		return c.exchange(m, address)
+		return c.exchange(ctx, m, address)
 	})
 	if r != nil && shared {
 		r = r.Copy()
@@ -130,16 +263,92 @@ func (c *Client) Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Dura
 	return r, rtt, err
 }
 
-func (c *Client) exchange(m *dns.Msg, a string) (r *dns.Msg, rtt time.Duration, err error) {
+type dialTraceKey struct{}
+
+// WithDialTrace returns a copy of ctx that makes ExchangeContext call f with
+// how long it took to dial the server, including any TLS handshake.
+func WithDialTrace(ctx context.Context, f func(time.Duration)) context.Context {
+	return context.WithValue(ctx, dialTraceKey{}, f)
+}
+
+type tlsTraceKey struct{}
+
+type sizeTraceKey struct{}
+
+// WithSizeTrace returns a copy of ctx that makes ExchangeContext and
+// ExchangeWithConnContext call f with the packed size in bytes of the query
+// written and the response read, which is zero if none was read, once the
+// exchange is complete.
+func WithSizeTrace(ctx context.Context, f func(request, response int)) context.Context {
+	return context.WithValue(ctx, sizeTraceKey{}, f)
+}
+
+// WithTLSTrace returns a copy of ctx that makes ExchangeContext call f with
+// the state of the TLS connection to the server once the handshake is
+// complete, it isn't called if the connection doesn't use TLS.
+func WithTLSTrace(ctx context.Context, f func(tls.ConnectionState)) context.Context {
+	return context.WithValue(ctx, tlsTraceKey{}, f)
+}
+
+func (c *Client) exchange(ctx context.Context, m *dns.Msg, a string) (r *dns.Msg, rtt time.Duration, err error) {
 	var co *Conn
 
-	co, err = c.Dial(a)
+	t := time.Now()
+	co, err = c.DialContext(ctx, a)
+	if f, ok := ctx.Value(dialTraceKey{}).(func(time.Duration)); ok {
+		f(time.Since(t))
+	}
 
 	if err != nil {
 		return nil, 0, err
 	}
 	defer co.Close()
 
+	if f, ok := ctx.Value(tlsTraceKey{}).(func(tls.ConnectionState)); ok {
+		if tc, ok := co.Conn.Conn.(*tls.Conn); ok {
+			f(tc.ConnectionState())
+		}
+	}
+
+	return c.exchangeConn(ctx, m, co)
+}
+
+// ExchangeWithConn performs a synchronous query like Exchange but uses the
+// already established connection conn rather than dialing a new one. The
+// connection is not closed afterwards.
+func (c *Client) ExchangeWithConn(m *dns.Msg, conn *Conn) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.ExchangeWithConnContext(context.Background(), m, conn)
+}
+
+// ExchangeWithConnContext performs a synchronous query like ExchangeWithConn
+// but additionally obeys deadlines and cancellation from the passed Context.
+// Any deadlines set on the connection are cleared afterwards so it can be
+// reused.
+func (c *Client) ExchangeWithConnContext(ctx context.Context, m *dns.Msg, conn *Conn) (r *dns.Msg, rtt time.Duration, err error) {
+	defer conn.SetDeadline(time.Time{})
+	return c.exchangeConn(ctx, m, conn)
+}
+
+func (c *Client) exchangeConn(ctx context.Context, m *dns.Msg, co *Conn) (r *dns.Msg, rtt time.Duration, err error) {
+	// Unblock any pending read or write if the context is cancelled, wait
+	// for the goroutine to exit so it can't touch the connection afterwards
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		exited := make(chan struct{})
+		defer func() {
+			close(done)
+			<-exited
+		}()
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				co.SetDeadline(time.Now())
+			case <-done:
+			}
+		}()
+	}
+
 	opt := m.IsEdns0()
 	// If EDNS0 is used use that for size.
 	if opt != nil && opt.UDPSize() >= dns.MinMsgSize {
@@ -152,20 +361,45 @@ func (c *Client) exchange(m *dns.Msg, a string) (r *dns.Msg, rtt time.Duration,
 
 	co.TsigSecret = c.TsigSecret
 	co.TsigAlgorithm = c.TsigAlgorithm
+	co.TsigSigner = c.TsigSigner
+	co.MaxMsgSize = c.MaxMsgSize
+	co.written, co.read = 0, 0
+	if f, ok := ctx.Value(sizeTraceKey{}).(func(int, int)); ok {
+		defer func() {
+			f(co.written, co.read)
+		}()
+	}
 	t := time.Now()
 	// write with the appropriate write timeout
-	co.SetWriteDeadline(t.Add(c.getTimeoutForRequest(c.writeTimeout())))
+	co.SetWriteDeadline(deadline(ctx, t.Add(c.getTimeoutForRequest(c.writeTimeout()))))
 	if err = co.WriteMsg(m); err != nil {
-		return nil, 0, err
+		return nil, 0, contextError(ctx, err)
 	}
 
-	co.SetReadDeadline(time.Now().Add(c.getTimeoutForRequest(c.readTimeout())))
+	co.SetReadDeadline(deadline(ctx, time.Now().Add(c.getTimeoutForRequest(c.readTimeout()))))
 	r, err = co.ReadMsg()
 	if err == nil && r.Id != m.Id {
 		err = dns.ErrId
 	}
 	rtt = time.Since(t)
-	return r, rtt, err
+	return r, rtt, contextError(ctx, err)
+}
+
+// deadline returns the earlier of t and the context deadline.
+func deadline(ctx context.Context, t time.Time) time.Time {
+	if d, ok := ctx.Deadline(); ok && d.Before(t) {
+		return d
+	}
+	return t
+}
+
+// contextError prefers the context error if the context has finished as that
+// is the reason any I/O error occurred.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
 // ReadMsg reads a message from the connection co.
@@ -174,10 +408,11 @@ func (c *Client) exchange(m *dns.Msg, a string) (r *dns.Msg, rtt time.Duration,
 // error is returned there are no guarantees that the returned message is a
 // valid representation of the packet read.
 func (co *Conn) ReadMsg() (*dns.Msg, error) {
-	p, err := co.ReadMsgHeader(nil)
+	p, err := co.readMsg()
 	if err != nil {
 		return nil, err
 	}
+	co.read = len(p)
 
 	m := new(dns.Msg)
 	if err := m.Unpack(p); err != nil {
@@ -205,6 +440,36 @@ func (co *Conn) ReadMsg() (*dns.Msg, error) {
 	return m, err
 }
 
+// readMsg reads the raw message from the connection co. Over TCP the length
+// prefix is checked against MaxMsgSize before anything is allocated for the
+// message.
+func (co *Conn) readMsg() ([]byte, error) {
+	if _, ok := co.Conn.Conn.(net.PacketConn); ok || co.Conn.Conn == nil || co.MaxMsgSize <= 0 {
+		return co.ReadMsgHeader(nil)
+	}
+
+	var length uint16
+	if err := binary.Read(co.Conn.Conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	if int(length) > co.MaxMsgSize {
+		return nil, &MsgSizeError{Size: int(length), Max: co.MaxMsgSize}
+	}
+
+	p := make([]byte, length)
+	if _, err := io.ReadFull(co.Conn.Conn, p); err != nil {
+		return nil, err
+	}
+
+	// Too short to hold the 12 byte header
+	if len(p) < 12 {
+		return nil, dns.ErrShortRead
+	}
+
+	return p, nil
+}
+
 // WriteMsg sends a message through the connection co.
 // If the message m contains a TSIG record the transaction
 // signature is calculated.
@@ -212,7 +477,9 @@ func (co *Conn) WriteMsg(m *dns.Msg) (err error) {
 	var out []byte
 	if t := m.IsTsig(); t != nil {
 		mac := ""
-		if a, ok := co.TsigAlgorithm[t.Algorithm]; ok {
+		if co.TsigSigner != nil {
+			out, mac, err = TsigGenerateWithSigner(m, co.TsigSigner, co.tsigRequestMAC, false)
+		} else if a, ok := co.TsigAlgorithm[t.Algorithm]; ok {
 			if a.Generate != nil {
 				if _, ok := co.TsigSecret[t.Hdr.Name]; !ok {
 					return dns.ErrSecret
@@ -236,6 +503,7 @@ func (co *Conn) WriteMsg(m *dns.Msg) (err error) {
 	if _, err = co.Write(out); err != nil {
 		return err
 	}
+	co.written = len(out)
 	return nil
 }
 
@@ -25,6 +25,39 @@ type TsigAlgorithm struct {
 	Verify   tsigAlgorithmVerify
 }
 
+// TsigSigner computes the transaction signature of a message. The message
+// passed to Sign is the wiredata the MAC covers as described in RFC 2845,
+// section 3.4, so for the second and subsequent messages of a chain it
+// already carries the previous MAC. The TSIG RR holds the key name,
+// algorithm and timers being signed.
+type TsigSigner interface {
+	Sign(msg []byte, rr *dns.TSIG) ([]byte, error)
+}
+
+// HmacSigner is the TsigSigner for the HMAC algorithms, the secret is base64
+// encoded.
+type HmacSigner struct {
+	Secret string
+}
+
+// Sign implements TsigSigner.
+func (s HmacSigner) Sign(msg []byte, rr *dns.TSIG) ([]byte, error) {
+	return tsigGenerateHmac(msg, rr.Algorithm, rr.Hdr.Name, s.Secret)
+}
+
+// AlgorithmSigner adapts the Generate callback of a TsigAlgorithm, such as
+// GSS, to a TsigSigner.
+type AlgorithmSigner struct {
+	Generate tsigAlgorithmGenerate
+	Name     string
+	Secret   string
+}
+
+// Sign implements TsigSigner.
+func (s AlgorithmSigner) Sign(msg []byte, rr *dns.TSIG) ([]byte, error) {
+	return s.Generate(msg, rr.Algorithm, s.Name, s.Secret)
+}
+
 // TSIG is the RR the holds the transaction signature of a message.
 // See RFC 2845 and RFC 4635.
 type TSIG struct {
@@ -93,7 +126,7 @@ func tsigGenerateHmac(msg []byte, algorithm, name, secret string) ([]byte, error
 // timersOnly is false.
 // If something goes wrong an error is returned, otherwise it is nil.
 func TsigGenerate(m *dns.Msg, secret, requestMAC string, timersOnly bool) ([]byte, string, error) {
-	return TsigGenerateByAlgorithm(m, tsigGenerateHmac, "", secret, requestMAC, timersOnly)
+	return TsigGenerateWithSigner(m, HmacSigner{Secret: secret}, requestMAC, timersOnly)
 }
 
 // TsigGenerateByAlgorithm fills out the TSIG record attached to the message
@@ -106,6 +139,19 @@ func TsigGenerate(m *dns.Msg, secret, requestMAC string, timersOnly bool) ([]byt
 // timersOnly is false.
 // If something goes wrong an error is returned, otherwise it is nil.
 func TsigGenerateByAlgorithm(m *dns.Msg, cb tsigAlgorithmGenerate, name, secret, requestMAC string, timersOnly bool) ([]byte, string, error) {
+	return TsigGenerateWithSigner(m, AlgorithmSigner{Generate: cb, Name: name, Secret: secret}, requestMAC, timersOnly)
+}
+
+// TsigGenerateWithSigner fills out the TSIG record attached to the message
+// using the signer to calculate the MAC.
+// The message should contain
+// a "stub" TSIG RR with the algorithm, key name (owner name of the RR),
+// time fudge (defaults to 300 seconds) and the current time
+// The TSIG MAC is saved in that Tsig RR.
+// When TsigGenerateWithSigner is called for the first time requestMAC is set
+// to the empty string and timersOnly is false.
+// If something goes wrong an error is returned, otherwise it is nil.
+func TsigGenerateWithSigner(m *dns.Msg, signer TsigSigner, requestMAC string, timersOnly bool) ([]byte, string, error) {
 	if m.IsTsig() == nil {
 		panic("dns: TSIG not last RR in additional")
 	}
@@ -120,7 +166,7 @@ func TsigGenerateByAlgorithm(m *dns.Msg, cb tsigAlgorithmGenerate, name, secret,
 
 	t := new(TSIG)
 
-	h, err := cb(buf, rr.Algorithm, name, secret)
+	h, err := signer.Sign(buf, rr)
 	if err != nil {
 		return nil, "", err
 	}
@@ -198,6 +244,15 @@ func TsigVerifyByAlgorithm(msg []byte, cb tsigAlgorithmVerify, name, secret, req
 
 	buf := tsigBuffer(stripped, tsig, requestMAC, timersOnly)
 
+	if err := checkTsigTime(tsig); err != nil {
+		return err
+	}
+
+	return cb(buf, tsig, name, secret)
+}
+
+// checkTsigTime checks the message was signed within the fudge of now.
+func checkTsigTime(tsig *dns.TSIG) error {
 	// Fudge factor works both ways. A message can arrive before it was signed because
 	// of clock skew.
 	now := uint64(time.Now().Unix())
@@ -208,8 +263,48 @@ func TsigVerifyByAlgorithm(msg []byte, cb tsigAlgorithmVerify, name, secret, req
 	if uint64(tsig.Fudge) < ti {
 		return dns.ErrTime
 	}
+	return nil
+}
 
-	return cb(buf, tsig, name, secret)
+// tsigVerifyChain verifies the TSIG on a message of the response to a zone
+// transfer as described in RFC 8945, section 5.3.1. The MAC covers the
+// previous MAC, any unsigned messages since the previous signed message and
+// the message itself, once chained only the timers of the TSIG RR are
+// covered.
+func (co *Conn) tsigVerifyChain(msg, unsigned []byte, previousMAC string, chained bool) error {
+	stripped, tsig, err := stripTsig(msg)
+	if err != nil {
+		return err
+	}
+
+	buf := tsigBuffer(stripped, tsig, "", chained)
+
+	if previousMAC != "" {
+		m := new(macWireFmt)
+		m.MACSize = uint16(len(previousMAC) / 2)
+		m.MAC = previousMAC
+		mac := make([]byte, len(previousMAC)) // long enough
+		n, _ := packMacWire(m, mac)
+		buf = append(append(mac[:n], unsigned...), buf...)
+	}
+
+	if err := checkTsigTime(tsig); err != nil {
+		return err
+	}
+
+	if a, ok := co.TsigAlgorithm[tsig.Algorithm]; ok {
+		if a.Verify == nil {
+			return nil
+		}
+		if _, ok := co.TsigSecret[tsig.Hdr.Name]; !ok {
+			return dns.ErrSecret
+		}
+		return a.Verify(buf, tsig, tsig.Hdr.Name, co.TsigSecret[tsig.Hdr.Name])
+	}
+	if _, ok := co.TsigSecret[tsig.Hdr.Name]; !ok {
+		return dns.ErrSecret
+	}
+	return tsigVerifyHmac(buf, tsig, "", co.TsigSecret[tsig.Hdr.Name])
 }
 
 // Create a wiredata buffer for the MAC calculation.
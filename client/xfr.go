@@ -0,0 +1,276 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MaxUnsignedMessages is the most consecutive messages of the response to a
+// signed zone transfer that may arrive without a TSIG record, RFC 8945,
+// section 5.3.1.
+const MaxUnsignedMessages = 99
+
+// TransferContext performs an incoming AXFR or IXFR zone transfer of the
+// query m with the server in address and obeys deadlines and cancellation
+// from the passed Context. Net must be a TCP network. If the query carries a
+// TSIG record every message of the response is verified as a chain as
+// described in RFC 8945, section 5.3.1, a message may be unsigned as long as
+// the first and last are signed and no more than MaxUnsignedMessages in a
+// row aren't. The envelopes are delivered on the returned channel which is
+// closed once the transfer completes, an envelope with an error ends it. If
+// the context is cancelled the last envelope has its error, replacing any
+// the caller has yet to receive, so a caller that stops reading doesn't
+// block the transfer from finishing.
+func (c *Client) TransferContext(ctx context.Context, m *dns.Msg, address string) (chan *dns.Envelope, error) {
+	if len(m.Question) == 0 {
+		return nil, &Error{err: "no question"}
+	}
+	switch m.Question[0].Qtype {
+	case dns.TypeAXFR:
+	case dns.TypeIXFR:
+		if len(m.Ns) == 0 {
+			return nil, &Error{err: "no SOA in IXFR query"}
+		}
+		if _, ok := m.Ns[0].(*dns.SOA); !ok {
+			return nil, &Error{err: "no SOA in IXFR query"}
+		}
+	default:
+		return nil, &Error{err: "unsupported question type"}
+	}
+	if c.Net == "" || strings.HasPrefix(c.Net, "udp") {
+		return nil, &Error{err: "zone transfers require TCP"}
+	}
+
+	co, err := c.DialContext(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	co.TsigSecret = c.TsigSecret
+	co.TsigAlgorithm = c.TsigAlgorithm
+	co.TsigSigner = c.TsigSigner
+	co.MaxMsgSize = c.MaxMsgSize
+
+	// Signing removes the TSIG RR from the query
+	signed := m.IsTsig() != nil
+
+	co.SetWriteDeadline(deadline(ctx, time.Now().Add(c.getTimeoutForRequest(c.writeTimeout()))))
+	if err = co.WriteMsg(m); err != nil {
+		co.Close()
+		return nil, contextError(ctx, err)
+	}
+
+	// The buffer leaves room for the error when the context is cancelled
+	env := make(chan *dns.Envelope, 1)
+	go c.transferIn(ctx, co, m, signed, env)
+
+	return env, nil
+}
+
+func (c *Client) transferIn(ctx context.Context, co *Conn, q *dns.Msg, signed bool, env chan *dns.Envelope) {
+	defer close(env)
+	defer co.Close()
+
+	// Unblock a pending read if the context is cancelled
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				co.SetDeadline(time.Now())
+			case <-done:
+			}
+		}()
+	}
+
+	send := func(e *dns.Envelope) bool {
+		select {
+		case env <- e:
+			return e.Error == nil
+		case <-ctx.Done():
+		}
+		select {
+		case <-env:
+		default:
+		}
+		env <- &dns.Envelope{Error: ctx.Err()}
+		return false
+	}
+
+	last := axfrLast()
+	if q.Question[0].Qtype == dns.TypeIXFR {
+		last = ixfrLast(q.Ns[0].(*dns.SOA).Serial)
+	}
+
+	x := &xfrReader{
+		co:     co,
+		signed: signed,
+		mac:    co.tsigRequestMAC,
+	}
+
+	for {
+		co.SetReadDeadline(deadline(ctx, time.Now().Add(c.getTimeoutForRequest(c.readTimeout()))))
+
+		// A cancellation before the deadline was set would be overwritten
+		if err := ctx.Err(); err != nil {
+			send(&dns.Envelope{Error: err})
+			return
+		}
+
+		in, signed, err := x.readMsg()
+		if err == nil && in.Id != q.Id {
+			err = dns.ErrId
+		}
+		if err == nil && in.Rcode != dns.RcodeSuccess {
+			err = &Error{err: fmt.Sprintf("bad xfr rcode: %d", in.Rcode)}
+		}
+		done := false
+		if err == nil {
+			done, err = last(in)
+		}
+		// The last message must be signed so nothing can be appended
+		if err == nil && done && !signed {
+			err = dns.ErrNoSig
+		}
+		if err != nil {
+			send(&dns.Envelope{Error: contextError(ctx, err)})
+			return
+		}
+
+		if !send(&dns.Envelope{RR: in.Answer}) || done {
+			return
+		}
+	}
+}
+
+// xfrReader reads the messages of the response to a zone transfer, verifying
+// their TSIG records as a chain if the query was signed.
+type xfrReader struct {
+	co     *Conn
+	signed bool
+	// mac is the MAC of the query or the last signed message
+	mac string
+	// unsigned holds the messages read since the last signed message
+	unsigned []byte
+	count    int
+	// chained is set once the first message has been verified, only the
+	// timers of those after it are covered
+	chained bool
+}
+
+// readMsg reads the next message.
+// It returns the message, whether it was signed, or the query wasn't, and
+// any error that occurred.
+func (x *xfrReader) readMsg() (*dns.Msg, bool, error) {
+	p, err := x.co.readMsg()
+	if err != nil {
+		return nil, false, err
+	}
+	x.co.read = len(p)
+
+	m := new(dns.Msg)
+	if err := m.Unpack(p); err != nil {
+		return nil, false, err
+	}
+
+	// An error needn't be signed, it ends the transfer regardless
+	if !x.signed || m.Rcode != dns.RcodeSuccess {
+		return m, !x.signed, nil
+	}
+
+	t := m.IsTsig()
+	if t == nil {
+		if !x.chained {
+			return nil, false, dns.ErrNoSig
+		}
+		if x.count++; x.count > MaxUnsignedMessages {
+			return nil, false, &Error{err: fmt.Sprintf("more than %d unsigned xfr messages", MaxUnsignedMessages)}
+		}
+		x.unsigned = append(x.unsigned, p...)
+		return m, false, nil
+	}
+
+	if err := x.co.tsigVerifyChain(p, x.unsigned, x.mac, x.chained); err != nil {
+		return nil, false, err
+	}
+
+	x.mac, x.unsigned, x.count, x.chained = t.MAC, nil, 0, true
+
+	return m, true, nil
+}
+
+// axfrLast returns a function reporting whether each message of an AXFR
+// response is the last, the first must start with the SOA of the zone and
+// the last ends with it.
+func axfrLast() func(*dns.Msg) (bool, error) {
+	first := true
+	return func(in *dns.Msg) (bool, error) {
+		if first {
+			if !isSOAFirst(in) {
+				return false, dns.ErrSoa
+			}
+			first = false
+			// Only the SOA, there's more to come
+			if len(in.Answer) == 1 {
+				return false, nil
+			}
+		}
+		return isSOALast(in), nil
+	}
+}
+
+// ixfrLast returns a function reporting whether each message of an IXFR
+// response for changes since the serial is the last. The response ends at
+// once if the server has no newer serial, after the SOA of the current serial
+// is seen twice if the server sent the whole zone or three times if it sent
+// the differences.
+func ixfrLast(qser uint32) func(*dns.Msg) (bool, error) {
+	var serial uint32
+	axfr := true
+	n := 0
+	first := true
+	return func(in *dns.Msg) (bool, error) {
+		if first {
+			if !isSOAFirst(in) {
+				return false, dns.ErrSoa
+			}
+			soa, ok := in.Answer[0].(*dns.SOA)
+			if !ok {
+				return false, dns.ErrSoa
+			}
+			first = false
+			serial = soa.Serial
+			if qser >= serial {
+				return true, nil
+			}
+		}
+		for _, rr := range in.Answer {
+			if v, ok := rr.(*dns.SOA); ok {
+				if v.Serial == serial {
+					n++
+					if axfr && n == 2 || n == 3 {
+						return true, nil
+					}
+				} else if axfr {
+					axfr = false
+				}
+			}
+		}
+		return false, nil
+	}
+}
+
+func isSOAFirst(in *dns.Msg) bool {
+	return len(in.Answer) > 0 &&
+		in.Answer[0].Header().Rrtype == dns.TypeSOA
+}
+
+func isSOALast(in *dns.Msg) bool {
+	return len(in.Answer) > 0 &&
+		in.Answer[len(in.Answer)-1].Header().Rrtype == dns.TypeSOA
+}
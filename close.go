@@ -0,0 +1,38 @@
+package tsig
+
+import "errors"
+
+// ErrClosed is returned by a Client that has been closed.
+var ErrClosed = errors.New("Client is closed")
+
+// Close stops the Client from sending any more queries, Exchange and the
+// other methods that send queries return ErrClosed once it has been called.
+// A batch in progress finishes the requests already sent and closes each
+// connection it holds rather than reusing it, the remaining requests fail
+// with ErrClosed. The Client holds no other resources, GSS credentials and
+// contexts belong to the gss package which has its own Close. It is safe to
+// call more than once and from multiple goroutines, DefaultClient must not be
+// closed while the gss package may be using it.
+// It returns any error that occurred.
+func (c *Client) Close() error {
+
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	c.closed = true
+
+	return nil
+}
+
+// checkClosed returns ErrClosed if the Client has been closed.
+func (c *Client) checkClosed() error {
+
+	c.closeMu.RLock()
+	defer c.closeMu.RUnlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package tsig
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClose(t *testing.T) {
+
+	client := &Client{
+		Exchanger: &FakeClient{Msg: tkeyReply(nil, "test.example.com.")},
+		Resolver:  &FakeResolver{Addrs: []string{"192.0.2.1"}},
+	}
+
+	request := &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	_, err := client.Exchange(context.Background(), request)
+	assert.Nil(t, err)
+
+	attempts, err := client.Attempts(context.Background(), request)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, client.Close())
+		}()
+	}
+	wg.Wait()
+
+	_, err = client.Exchange(context.Background(), request)
+	assert.Equal(t, ErrClosed, err)
+
+	_, err = client.Attempts(context.Background(), request)
+	assert.Equal(t, ErrClosed, err)
+
+	if assert.Len(t, attempts, 1) {
+		_, err = attempts[0].Exchange(context.Background())
+		assert.Equal(t, ErrClosed, err)
+	}
+
+	_, err = client.ExchangeConn(context.Background(), nil, request)
+	assert.Equal(t, ErrClosed, err)
+
+	results, err := client.ExchangeBatch(context.Background(), "ns.example.com.", []*Request{request, request}, 2)
+	assert.NotNil(t, err)
+	for _, result := range results {
+		assert.Equal(t, ErrClosed, result.Err)
+	}
+
+	_, err = client.ServerForZone(context.Background(), "example.com.")
+	assert.Equal(t, ErrClosed, err)
+
+	assert.Nil(t, client.Close())
+}
@@ -0,0 +1,125 @@
+package tsig
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	clientCookieLength    = 8
+	minServerCookieLength = 8
+	maxServerCookieLength = 32
+)
+
+// Cookie configures the RFC 7873 DNS Cookie sent with each TKEY query, for
+// servers or middleboxes that enforce cookies.
+type Cookie struct {
+	// Client is the 8 byte client cookie, a random one is generated for
+	// each query if it is nil
+	Client []byte
+	// Server is a server cookie learned from an earlier response, it is
+	// sent after the client cookie if set
+	Server []byte
+	// Validate requires each response to carry a cookie that echoes the
+	// client cookie that was sent followed by a server cookie of a valid
+	// length
+	Validate bool
+}
+
+// CookieError is returned when Cookie.Validate is set and the response
+// doesn't carry a valid cookie.
+type CookieError struct {
+	Address string
+	Reason  string
+}
+
+func (e *CookieError) Error() string {
+
+	return fmt.Sprintf("Invalid DNS cookie from %s: %s", e.Address, e.Reason)
+}
+
+// option returns the EDNS0 cookie option to send.
+func (c *Cookie) option() (*dns.EDNS0_COOKIE, error) {
+
+	client := c.Client
+	if client == nil {
+		client = make([]byte, clientCookieLength)
+		if _, err := rand.Read(client); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(client) != clientCookieLength {
+		return nil, fmt.Errorf("Client cookie must be %d bytes", clientCookieLength)
+	}
+
+	if c.Server != nil && (len(c.Server) < minServerCookieLength || len(c.Server) > maxServerCookieLength) {
+		return nil, fmt.Errorf("Server cookie must be between %d and %d bytes", minServerCookieLength, maxServerCookieLength)
+	}
+
+	return &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(append(append([]byte{}, client...), c.Server...)),
+	}, nil
+}
+
+// setCookie attaches a cookie to the OPT record of the query.
+func (c *Cookie) setCookie(msg *dns.Msg) error {
+
+	option, err := c.option()
+	if err != nil {
+		return err
+	}
+
+	opt := edns0(msg)
+	opt.Option = append(opt.Option, option)
+
+	return nil
+}
+
+func findCookie(msg *dns.Msg) []byte {
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
+			b, err := hex.DecodeString(cookie.Cookie)
+			if err != nil {
+				return nil
+			}
+			return b
+		}
+	}
+
+	return nil
+}
+
+// checkCookie validates the cookie in the response against the one sent in
+// the query, it does nothing unless validation is enabled.
+func (c *Client) checkCookie(msg, rr *dns.Msg, address string) error {
+
+	if c.Cookie == nil || !c.Cookie.Validate {
+		return nil
+	}
+
+	sent := findCookie(msg)
+	received := findCookie(rr)
+
+	switch {
+	case received == nil:
+		return &CookieError{Address: address, Reason: "no cookie in response"}
+	case len(received) < clientCookieLength+minServerCookieLength || len(received) > clientCookieLength+maxServerCookieLength:
+		return &CookieError{Address: address, Reason: "server cookie has an invalid length"}
+	case len(sent) < clientCookieLength || !bytes.Equal(sent[:clientCookieLength], received[:clientCookieLength]):
+		return &CookieError{Address: address, Reason: "client cookie does not match"}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package tsig
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// CookieServer answers TKEY queries echoing the client cookie followed by
+// Server. If Client is set it is echoed instead of the client cookie sent
+type CookieServer struct {
+	Client []byte
+	Server []byte
+	sent   []byte
+}
+
+func (s *CookieServer) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	s.sent = findCookie(m)
+
+	r := tkeyReply(m, m.Question[0].Name)
+
+	if s.Server != nil {
+		client := s.Client
+		if client == nil && len(s.sent) >= clientCookieLength {
+			client = s.sent[:clientCookieLength]
+		}
+
+		opt := &dns.OPT{
+			Hdr: dns.RR_Header{
+				Name:   ".",
+				Rrtype: dns.TypeOPT,
+			},
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(append(append([]byte{}, client...), s.Server...)),
+		})
+		r.Extra = append(r.Extra, opt)
+	}
+
+	return r, 0, nil
+}
+
+func TestCookieOption(t *testing.T) {
+
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	server := []byte{9, 10, 11, 12, 13, 14, 15, 16}
+
+	cases := []struct {
+		cookie *Cookie
+		want   string
+		err    bool
+	}{
+		{&Cookie{Client: client}, "0102030405060708", false},
+		{&Cookie{Client: client, Server: server}, "0102030405060708090a0b0c0d0e0f10", false},
+		{&Cookie{Client: client[:4]}, "", true},
+		{&Cookie{Client: client, Server: server[:4]}, "", true},
+	}
+
+	for _, tc := range cases {
+		option, err := tc.cookie.option()
+		if tc.err {
+			assert.NotNil(t, err)
+			continue
+		}
+		if assert.Nil(t, err) {
+			assert.Equal(t, uint16(dns.EDNS0COOKIE), option.Code)
+			assert.Equal(t, tc.want, option.Cookie)
+		}
+	}
+
+	// A random client cookie is generated for each query
+	first, err := (&Cookie{}).option()
+	assert.Nil(t, err)
+	second, err := (&Cookie{}).option()
+	assert.Nil(t, err)
+	assert.Len(t, first.Cookie, 2*clientCookieLength)
+	assert.NotEqual(t, first.Cookie, second.Cookie)
+}
+
+func TestCookieExchange(t *testing.T) {
+
+	server := []byte{9, 10, 11, 12, 13, 14, 15, 16}
+
+	cases := []struct {
+		cookie *Cookie
+		server *CookieServer
+		err    bool
+	}{
+		// No validation, the server ignores cookies
+		{&Cookie{}, &CookieServer{}, false},
+		{&Cookie{Validate: true}, &CookieServer{Server: server}, false},
+		{&Cookie{Validate: true}, &CookieServer{}, true},
+		{&Cookie{Validate: true}, &CookieServer{Server: server[:4]}, true},
+		{&Cookie{Validate: true}, &CookieServer{Client: []byte{0, 0, 0, 0, 0, 0, 0, 0}, Server: server}, true},
+	}
+
+	for _, tc := range cases {
+		client := &Client{
+			Exchanger: tc.server,
+			Resolver:  &FakeResolver{Addrs: []string{"192.0.2.1"}},
+			Cookie:    tc.cookie,
+		}
+
+		_, err := client.Exchange(context.Background(), &Request{
+			Host:      "ns.example.com.",
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+		})
+
+		assert.Len(t, tc.server.sent, clientCookieLength)
+
+		if tc.err {
+			var cerr *CookieError
+			assert.True(t, errors.As(err, &cerr))
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+}
@@ -27,6 +27,8 @@ Example client:
                         panic(err)
                 }
 
+                algorithm := d.Algorithm(*keyname)
+
                 client := &dns.Client{
                         Net:        "tcp",
                         TsigSecret: map[string]string{*keyname: *mac},
@@ -43,7 +45,7 @@ Example client:
                 }
                 msg.Insert([]dns.RR{insert})
 
-                msg.SetTsig(*keyname, dns.HmacMD5, 300, time.Now().Unix())
+                msg.SetTsig(*keyname, algorithm, 300, time.Now().Unix())
 
                 rr, _, err := client.Exchange(msg, net.JoinHostPort(host, "53"))
                 if err != nil {
@@ -65,14 +67,16 @@ package dh
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -93,8 +97,41 @@ const (
 		"FFFFFFFFFFFFFFFF"
 )
 
-type context struct {
-	host, algorithm, mac string
+const (
+	// DefaultGroup is the Diffie-Hellman group used unless WithGroup is
+	// given, the 2048-bit MODP group of RFC 3526
+	DefaultGroup = 14
+	// DefaultAlgorithm is the algorithm of the negotiated key unless
+	// WithAlgorithm is given
+	DefaultAlgorithm = dns.HmacSHA256
+	// DefaultNonceSize is the size in bytes of the random nonce sent in
+	// the key data of each query unless WithNonce gives the first
+	DefaultNonceSize = 16
+)
+
+// algorithms are the algorithms a key negotiated with Diffie-Hellman can
+// use, RFC 2930 only allows HMAC
+var algorithms = []string{
+	dns.HmacMD5,
+	dns.HmacSHA1,
+	dns.HmacSHA224,
+	dns.HmacSHA256,
+	dns.HmacSHA384,
+	dns.HmacSHA512,
+}
+
+type keyContext struct {
+	host, algorithm string
+	secret          *tsig.Secret
+	expiry          time.Time
+	// nonce is the nonce sent when negotiating the key, nil for a restored
+	// key
+	nonce []byte
+	// tsigName, tsigAlgorithm and tsigSecret are the TSIG key that signed
+	// the negotiation so Refresh can sign another, tsigSecret is nil for a
+	// restored key
+	tsigName, tsigAlgorithm string
+	tsigSecret              *tsig.Secret
 }
 
 type dhkey struct {
@@ -105,7 +142,124 @@ type dhkey struct {
 // well as any other internal state.
 type DH struct {
 	m   sync.Mutex
-	ctx map[string]*context
+	ctx map[string]*keyContext
+	// now returns the current time, nil means time.Now
+	now func() time.Time
+	// events is the stream key events are emitted to
+	events *tsig.EventStream
+	// group and algorithm are the Diffie-Hellman group and the algorithm
+	// of each key negotiated
+	group     int
+	algorithm string
+	// nonce is sent by the next negotiation rather than a random nonce if
+	// set, it is only used once
+	nonce []byte
+}
+
+// Option is used to configure the context handle returned by New.
+type Option func(*DH) error
+
+// WithClock sets the function returning the current time that key expiry
+// times are compared against rather than time.Now, for example to test
+// behaviour near an expiry with a fake clock.
+func WithClock(now func() time.Time) Option {
+
+	return func(c *DH) error {
+		c.now = now
+		return nil
+	}
+}
+
+// WithEvents sets the stream each key established or deleted is emitted to,
+// along with the events of the exchanges deleting keys unless the context
+// passed to DeleteAllKeys carries another, see tsig.ContextWithEvents. The
+// exchanges negotiating keys are emitted to the Events of
+// tsig.DefaultClient.
+func WithEvents(stream *tsig.EventStream) Option {
+
+	return func(c *DH) error {
+		c.events = stream
+		return nil
+	}
+}
+
+// WithGroup sets the Diffie-Hellman group used to negotiate keys rather
+// than DefaultGroup, either 2 for the 1024-bit MODP group of RFC 2409 that
+// older servers may require or 14, 15 or 16 for the 2048, 3072 or 4096-bit
+// MODP groups of RFC 3526. A larger group derives a longer secret.
+func WithGroup(group int) Option {
+
+	return func(c *DH) error {
+		if _, err := dhGroup(group); err != nil {
+			return err
+		}
+		c.group = group
+		return nil
+	}
+}
+
+// WithAlgorithm sets the algorithm requested for each key negotiated rather
+// than DefaultAlgorithm, it must be one of the HMAC algorithms. The server
+// must agree to the algorithm or the negotiation fails.
+func WithAlgorithm(algorithm string) Option {
+
+	return func(c *DH) error {
+		for _, a := range algorithms {
+			if strings.EqualFold(algorithm, a) {
+				c.algorithm = a
+				return nil
+			}
+		}
+		return fmt.Errorf("Unsupported algorithm %s", algorithm)
+	}
+}
+
+// WithNonce sets the nonce sent in the key data of the first query rather
+// than a random nonce of DefaultNonceSize bytes, it is mixed into the derived
+// key along with the nonce of the server, for example to reproduce a key
+// while debugging. As a nonce should never be reused it is only sent by the
+// first negotiation, later ones go back to random nonces. It must not be
+// empty and fit in the key data of the TKEY record.
+func WithNonce(nonce []byte) Option {
+
+	return func(c *DH) error {
+		if len(nonce) == 0 || len(nonce) > math.MaxUint16 {
+			return fmt.Errorf("Nonce must be between 1 and %d bytes, not %d", math.MaxUint16, len(nonce))
+		}
+		c.nonce = append([]byte(nil), nonce...)
+		return nil
+	}
+}
+
+// newNonce returns the nonce set by WithNonce if it hasn't been used yet or
+// else a random one.
+// It returns the nonce and any error that occurred.
+func (c *DH) newNonce() ([]byte, error) {
+
+	c.m.Lock()
+	nonce := c.nonce
+	c.nonce = nil
+	c.m.Unlock()
+
+	if nonce != nil {
+		return nonce, nil
+	}
+
+	nonce = make([]byte, DefaultNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return nonce, nil
+}
+
+func (c *DH) clock() time.Time {
+
+	if c.now != nil {
+		return c.now()
+	}
+
+	return time.Now()
 }
 
 func dhGroup(group int) (*dh.Group, error) {
@@ -118,6 +272,12 @@ func dhGroup(group int) (*dh.Group, error) {
 			P: p,
 			G: new(big.Int).SetInt64(2),
 		}, nil
+	case 14:
+		return dh.RFC3526_2048(), nil
+	case 15:
+		return dh.RFC3526_3072(), nil
+	case 16:
+		return dh.RFC3526_4096(), nil
 	default:
 		return nil, fmt.Errorf("Unsupported DH group %v", group)
 	}
@@ -126,10 +286,18 @@ func dhGroup(group int) (*dh.Group, error) {
 // New performs any library initialization necessary.
 // It returns a context handle for any further functions along with any error
 // that occurred.
-func New() (*DH, error) {
+func New(options ...Option) (*DH, error) {
 
 	c := &DH{
-		ctx: make(map[string]*context),
+		ctx:       make(map[string]*keyContext),
+		group:     DefaultGroup,
+		algorithm: DefaultAlgorithm,
+	}
+
+	for _, option := range options {
+		if err := option(c); err != nil {
+			return nil, err
+		}
 	}
 
 	return c, nil
@@ -149,7 +317,9 @@ func (c *DH) Close() error {
 
 	var errs error
 	for _, k := range keys {
-		errs = multierror.Append(errs, c.DeleteKey(&k))
+		if err := c.DeleteKey(&k); err != nil {
+			errs = multierror.Append(errs, err)
+		}
 	}
 
 	return errs
@@ -199,6 +369,31 @@ func writeDHKey(key *dhkey) ([]byte, error) {
 	return w.Bytes(), nil
 }
 
+// expandDHKey replaces a well-known prime in the key, which RFC 2539 allows
+// to be given as its index in a prime of length 1 or 2 with no generator,
+// with the prime and generator of that group as BIND does for the 1024-bit
+// MODP group. Only index 2, the group of WithGroup(2), is supported.
+func expandDHKey(key *dhkey) error {
+
+	if (len(key.prime) != 1 && len(key.prime) != 2) || len(key.generator) != 0 {
+		return nil
+	}
+
+	index := new(big.Int).SetBytes(key.prime).Int64()
+	if index != 2 {
+		return fmt.Errorf("Unsupported well-known DH prime %d", index)
+	}
+
+	g, err := dhGroup(2)
+	if err != nil {
+		return err
+	}
+
+	key.prime, key.generator = g.P.Bytes(), g.G.Bytes()
+
+	return nil
+}
+
 func computeMD5(nonce, secret []byte) []byte {
 
 	checksum := md5.Sum(append(nonce, secret...))
@@ -230,23 +425,100 @@ func computeDHKey(ourNonce, peerNonce, secret []byte) []byte {
 
 // NegotiateKey exchanges RFC 2930 TKEY records with the indicated DNS
 // server to establish a TSIG key for further using an existing TSIG key name,
-// algorithm and MAC.
+// algorithm and MAC. The negotiated key uses the algorithm set by
+// WithAlgorithm, see Algorithm.
 // It returns the negotiated TKEY name, MAC, expiry time, and any error that
 // occurred.
 func (c *DH) NegotiateKey(host, name, algorithm, mac string) (*string, *string, *time.Time, error) {
 
-	keyname := "."
+	keyname, secret, expiry, err := c.negotiateKey(context.Background(), host, name, algorithm, mac)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	g, err := dhGroup(2)
+	key := base64.StdEncoding.EncodeToString(secret)
+	tsig.NewSecret(secret).Zero()
+
+	return &keyname, &key, expiry, nil
+}
+
+// NegotiateKeySecret is like NegotiateKey however the MAC is returned as a
+// tsig.Secret that can be zeroed as soon as it is no longer needed rather
+// than as a string. A separate copy of the MAC is kept until the key is
+// revoked with DeleteKey or Close as it is needed to sign the deletion, it is
+// zeroed once the key has been deleted.
+// It returns the negotiated TKEY name, MAC, expiry time, and any error that
+// occurred.
+func (c *DH) NegotiateKeySecret(host, name, algorithm, mac string) (*string, *tsig.Secret, *time.Time, error) {
+
+	keyname, secret, expiry, err := c.negotiateKey(context.Background(), host, name, algorithm, mac)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	ax, ay, err := g.GenerateKey(nil)
+	return &keyname, tsig.NewSecret(secret), expiry, nil
+}
+
+// Refresh negotiates a new key with the server of the active key associated
+// with the given TKEY name, signed with the same TSIG key that signed its
+// negotiation, to replace it before it expires. Diffie-Hellman keys can't be
+// extended so a new key is derived, the server chooses its name. Once it is
+// established the old key is revoked as DeleteAllKeys does. Keys restored
+// with RestoreKey can't be refreshed.
+// It returns the new TKEY name, MAC, expiry time, and any error that
+// occurred. If only revoking the old key failed the new key is returned along
+// with the error.
+func (c *DH) Refresh(ctx context.Context, keyname string) (*string, *tsig.Secret, *time.Time, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	lower := strings.ToLower(keyname)
+
+	c.m.Lock()
+	kc, ok := c.ctx[lower]
+	var host, name, algorithm, mac string
+	if ok && kc.tsigSecret != nil {
+		host, name, algorithm, mac = kc.host, kc.tsigName, kc.tsigAlgorithm, kc.tsigSecret.Base64()
+	}
+	c.m.Unlock()
+
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("No such context")
+	}
+
+	if mac == "" {
+		return nil, nil, nil, fmt.Errorf("Key %s was restored and can't be refreshed", keyname)
+	}
+
+	newname, secret, expiry, err := c.negotiateKey(ctx, host, name, algorithm, mac)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
+	// The server could hand out the same name again
+	if newname != lower {
+		err = c.deleteKey(ctx, lower, true)
+	}
+
+	return &newname, tsig.NewSecret(secret), expiry, err
+}
+
+func (c *DH) negotiateKey(ctx context.Context, host, name, algorithm, mac string) (string, []byte, *time.Time, error) {
+
+	keyname := "."
+
+	g, err := dhGroup(c.group)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	ax, ay, err := g.GenerateKey(nil)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
 	adh := &dhkey{
 		prime:     g.P.Bytes(),
 		generator: g.G.Bytes(),
@@ -255,14 +527,12 @@ func (c *DH) NegotiateKey(host, name, algorithm, mac string) (*string, *string,
 
 	akey, err := writeDHKey(adh)
 	if err != nil {
-		return nil, nil, nil, err
+		return "", nil, nil, err
 	}
 
-	// Generate our nonce
-	an := make([]byte, 16) // FIXME I suspect it just is
-	_, err = rand.Read(an)
+	an, err := c.newNonce()
 	if err != nil {
-		return nil, nil, nil, err
+		return "", nil, nil, err
 	}
 
 	extra := make([]dns.RR, 1)
@@ -280,9 +550,28 @@ func (c *DH) NegotiateKey(host, name, algorithm, mac string) (*string, *string,
 		PublicKey: base64.StdEncoding.EncodeToString(akey),
 	}
 
-	tkey, keys, err := tsig.ExchangeTKEY(host, keyname, dns.HmacMD5, tsig.TkeyModeDH, 3600, an, extra, &name, &algorithm, &mac)
+	resp, err := tsig.DefaultClient.Exchange(ctx, &tsig.Request{
+		Host:      host,
+		KeyName:   keyname,
+		Algorithm: c.algorithm,
+		Mode:      tsig.TkeyModeDH,
+		Lifetime:  3600,
+		Input:     an,
+		Extra:     extra,
+		TSIG: &tsig.TSIGKey{
+			Name:      name,
+			Algorithm: algorithm,
+			Secret:    mac,
+		},
+	})
 	if err != nil {
-		return nil, nil, nil, err
+		return "", nil, nil, err
+	}
+
+	tkey, keys := resp.TKEY, resp.Additional
+
+	if !strings.EqualFold(tkey.Algorithm, c.algorithm) {
+		return "", nil, nil, fmt.Errorf("Server negotiated algorithm %s rather than %s", tkey.Algorithm, c.algorithm)
 	}
 
 	var bkey []byte
@@ -292,70 +581,257 @@ func (c *DH) NegotiateKey(host, name, algorithm, mac string) (*string, *string,
 			if key.Header().Name != keyname && key.Algorithm == dns.DH {
 				bkey, err = base64.StdEncoding.DecodeString(key.PublicKey)
 				if err != nil {
-					return nil, nil, nil, err
+					return "", nil, nil, err
 				}
 			}
 		}
 	}
 
 	if bkey == nil {
-		return nil, nil, nil, fmt.Errorf("No peer KEY record")
+		return "", nil, nil, fmt.Errorf("No peer KEY record")
 	}
 
 	bdh, err := readDHKey(bkey)
 	if err != nil {
-		return nil, nil, nil, err
+		return "", nil, nil, err
+	}
+
+	if err := expandDHKey(bdh); err != nil {
+		return "", nil, nil, err
+	}
+
+	// The shared secret is only as strong as the group the server used
+	if !bytes.Equal(bdh.prime, adh.prime) || !bytes.Equal(bdh.generator, adh.generator) {
+		return "", nil, nil, fmt.Errorf("Server did not use DH group %d", c.group)
 	}
 	by := new(big.Int).SetBytes(bdh.key)
 
 	err = g.Check(by)
 	if err != nil {
-		return nil, nil, nil, err
+		return "", nil, nil, err
 	}
 
 	secret := g.ComputeSecret(ax, by).Bytes()
 
 	// The peer nonce is in the TKEY response
-	bn, err := hex.DecodeString(tkey.Key)
+	bn, err := tsig.DecodeTKEYKey(tkey.Key)
 	if err != nil {
-		return nil, nil, nil, err
+		return "", nil, nil, err
 	}
 
 	lower := strings.ToLower(tkey.Header().Name)
-	key := base64.StdEncoding.EncodeToString(computeDHKey(an, bn, secret))
+	key := computeDHKey(an, bn, secret)
+	tsig.NewSecret(secret).Zero()
+
 	expiry := time.Unix(int64(tkey.Expiration), 0)
 
+	// The MAC is valid base64 or the query couldn't have been signed
+	tsigSecret, _ := base64.StdEncoding.DecodeString(mac)
+
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	c.ctx[lower] = &context{
-		host:      host,
-		algorithm: dns.HmacMD5,
-		mac:       key,
+	c.ctx[lower] = &keyContext{
+		host:          host,
+		algorithm:     c.algorithm,
+		secret:        tsig.NewSecret(append([]byte(nil), key...)),
+		expiry:        expiry,
+		nonce:         an,
+		tsigName:      name,
+		tsigAlgorithm: algorithm,
+		tsigSecret:    tsig.NewSecret(tsigSecret),
 	}
 
-	return &lower, &key, &expiry, nil
+	c.events.Emit(tsig.Event{
+		Type:    tsig.EventKeyEstablished,
+		KeyName: lower,
+		Expiry:  expiry,
+	})
+
+	return lower, key, &expiry, nil
+}
+
+// Algorithm returns the algorithm of the active key associated with the
+// given TKEY name, the one to sign with, or an empty string if there isn't
+// one.
+func (c *DH) Algorithm(keyname string) string {
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if kc, ok := c.ctx[strings.ToLower(keyname)]; ok {
+		return kc.algorithm
+	}
+
+	return ""
+}
+
+// Nonce returns the nonce sent when negotiating the active key associated
+// with the given TKEY name, or nil if there isn't one or the key was
+// restored with RestoreKey.
+func (c *DH) Nonce(keyname string) []byte {
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if kc, ok := c.ctx[strings.ToLower(keyname)]; ok && kc.nonce != nil {
+		return append([]byte(nil), kc.nonce...)
+	}
+
+	return nil
+}
+
+// SaveKey returns the active key associated with the given TKEY name along
+// with its server and expiry, which can be marshaled with MarshalBinary and
+// passed to RestoreKey after a restart to carry on using it.
+// It returns the key and any error that occurred.
+func (c *DH) SaveKey(keyname string) (*tsig.SavedKey, error) {
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	lower := strings.ToLower(keyname)
+
+	kc, ok := c.ctx[lower]
+	if !ok {
+		return nil, fmt.Errorf("No such context")
+	}
+
+	// A copy, so zeroing either the saved or the active key leaves the
+	// other alone
+	secret := make([]byte, len(kc.secret.Bytes()))
+	copy(secret, kc.secret.Bytes())
+
+	return &tsig.SavedKey{
+		Name:      lower,
+		Algorithm: kc.algorithm,
+		Secret:    tsig.NewSecret(secret),
+		Host:      kc.host,
+		Expiry:    kc.expiry,
+	}, nil
+}
+
+// RestoreKey makes a key returned by SaveKey active again, so it can be
+// deleted with DeleteKey or Close as if it had been negotiated by this
+// handle, and emits it as established. The secret is copied so the saved key
+// can be zeroed afterwards.
+// It returns any error that occurred, including if the key has expired or
+// a key with the same name is already active.
+func (c *DH) RestoreKey(key *tsig.SavedKey) error {
+
+	if key.Secret == nil || len(key.Secret.Bytes()) == 0 {
+		return fmt.Errorf("Key %s has no secret", key.Name)
+	}
+
+	if !c.clock().Before(key.Expiry) {
+		return fmt.Errorf("Key %s expired at %s", key.Name, key.Expiry)
+	}
+
+	lower := strings.ToLower(key.Name)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if _, ok := c.ctx[lower]; ok {
+		return fmt.Errorf("Key %s is already active", key.Name)
+	}
+
+	secret := make([]byte, len(key.Secret.Bytes()))
+	copy(secret, key.Secret.Bytes())
+
+	c.ctx[lower] = &keyContext{
+		host:      key.Host,
+		algorithm: key.Algorithm,
+		secret:    tsig.NewSecret(secret),
+		expiry:    key.Expiry,
+	}
+
+	c.events.Emit(tsig.Event{
+		Type:    tsig.EventKeyEstablished,
+		KeyName: lower,
+		Expiry:  key.Expiry,
+	})
+
+	return nil
 }
 
 // DeleteKey revokes the active key associated with the given TKEY name.
 // It returns any error that occurred.
 func (c *DH) DeleteKey(keyname *string) error {
 
+	return c.deleteKey(context.Background(), *keyname, false)
+}
+
+// DeleteAllKeys revokes every active key as DeleteKey does, for example when
+// shutting down. Keys that have expired are forgotten without contacting the
+// server, as are keys the server no longer knows about.
+// It returns an error aggregating the error for each key that couldn't be
+// revoked, those keys remain active.
+func (c *DH) DeleteAllKeys(ctx context.Context) error {
+
+	c.m.Lock()
+	keys := make([]string, 0, len(c.ctx))
+	for k := range c.ctx {
+		keys = append(keys, k)
+	}
+	c.m.Unlock()
+
+	sort.Strings(keys)
+
+	var errs error
+	for _, k := range keys {
+		if err := c.deleteKey(ctx, k, true); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", k, err))
+		}
+	}
+
+	return errs
+}
+
+// deleteKey revokes the key, if ignoreUnknown is set an expired key or one
+// the server doesn't know is forgotten without error.
+func (c *DH) deleteKey(ctx context.Context, keyname string, ignoreUnknown bool) error {
+
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	ctx, ok := c.ctx[*keyname]
+	kc, ok := c.ctx[keyname]
 	if !ok {
 		return fmt.Errorf("No such context")
 	}
 
-	// Delete the key, signing the query with the key itself
-	_, _, err := tsig.ExchangeTKEY(ctx.host, *keyname, ctx.algorithm, tsig.TkeyModeDelete, 0, nil, nil, keyname, &ctx.algorithm, &ctx.mac)
-	if err != nil {
-		return err
+	if _, ok := tsig.EventsFromContext(ctx); !ok && c.events != nil {
+		ctx = tsig.ContextWithEvents(ctx, c.events)
+	}
+
+	if !ignoreUnknown || c.clock().Before(kc.expiry) {
+		// Delete the key, signing the query with the key itself
+		_, err := tsig.DefaultClient.Exchange(ctx, &tsig.Request{
+			Host:      kc.host,
+			KeyName:   keyname,
+			Algorithm: kc.algorithm,
+			Mode:      tsig.TkeyModeDelete,
+			TSIG: &tsig.TSIGKey{
+				Name:      keyname,
+				Algorithm: kc.algorithm,
+				Secret:    kc.secret.Base64(),
+			},
+		})
+		if err != nil && !(ignoreUnknown && tsig.IsUnknownKey(err)) {
+			return err
+		}
+	}
+
+	kc.secret.Zero()
+	if kc.tsigSecret != nil {
+		kc.tsigSecret.Zero()
 	}
+	delete(c.ctx, keyname)
 
-	delete(c.ctx, *keyname)
+	c.events.Emit(tsig.Event{
+		Type:    tsig.EventKeyDeleted,
+		KeyName: keyname,
+	})
 
 	return nil
 }
@@ -0,0 +1,398 @@
+package dh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/bodgit/tsig"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// FakeServer completes a Diffie-Hellman exchange for each TKEY query and
+// records the key it derived. If Group is set the server uses that group
+// rather than the one in the query, if Algorithm is set the server chooses
+// that algorithm rather than the requested one. The nonce of the last query
+// is also recorded
+type FakeServer struct {
+	Group     int
+	Algorithm string
+	// WellKnown sends the 1024-bit MODP group as its RFC 2539 index
+	WellKnown bool
+	key       []byte
+	nonce     []byte
+	// Name is the name of the key, "server.example.com." if empty
+	Name string
+	// deleted are the keys the server was asked to delete
+	deleted []string
+}
+
+func (s *FakeServer) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	query := m.Extra[0].(*dns.TKEY)
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+
+	reply := &dns.TKEY{
+		Hdr: dns.RR_Header{
+			Name:   "server.example.com.",
+			Rrtype: dns.TypeTKEY,
+			Class:  dns.ClassANY,
+		},
+		Algorithm:  query.Algorithm,
+		Mode:       query.Mode,
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	r.Answer = append(r.Answer, reply)
+
+	if s.Name != "" {
+		reply.Hdr.Name = s.Name
+	}
+
+	if query.Mode == tsig.TkeyModeDelete {
+		s.deleted = append(s.deleted, query.Hdr.Name)
+	}
+
+	if query.Mode != tsig.TkeyModeDH {
+		return r, 0, nil
+	}
+
+	if s.Algorithm != "" {
+		reply.Algorithm = s.Algorithm
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(m.Extra[1].(*dns.DNSKEY).PublicKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	akey, err := readDHKey(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	g, err := dhGroup(2)
+	if err != nil {
+		return nil, 0, err
+	}
+	g.P, g.G = new(big.Int).SetBytes(akey.prime), new(big.Int).SetBytes(akey.generator)
+	if s.Group != 0 {
+		if g, err = dhGroup(s.Group); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	bx, by, err := g.GenerateKey(nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bdh := &dhkey{
+		prime:     g.P.Bytes(),
+		generator: g.G.Bytes(),
+		key:       (*big.Int)(by).Bytes(),
+	}
+	if s.WellKnown {
+		bdh.prime, bdh.generator = []byte{2}, nil
+	}
+
+	bkey, err := writeDHKey(bdh)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	an, err := tsig.DecodeTKEYKey(query.Key)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.nonce = an
+
+	bn := make([]byte, 16)
+	if _, err := rand.Read(bn); err != nil {
+		return nil, 0, err
+	}
+
+	secret := g.ComputeSecret(bx, new(big.Int).SetBytes(akey.key)).Bytes()
+	s.key = computeDHKey(an, bn, secret)
+
+	reply.Key = tsig.EncodeTKEYKey(bn)
+	reply.KeySize = uint16(len(bn))
+
+	r.Answer = append(r.Answer, &dns.KEY{
+		DNSKEY: dns.DNSKEY{
+			Hdr: dns.RR_Header{
+				Name:   "server.example.com.",
+				Rrtype: dns.TypeKEY,
+				Class:  dns.ClassANY,
+			},
+			Flags:     512,
+			Protocol:  3,
+			Algorithm: dns.DH,
+			PublicKey: base64.StdEncoding.EncodeToString(bkey),
+		},
+	})
+
+	return r, 0, nil
+}
+
+// withFakeServer points tsig.DefaultClient at a FakeServer, the returned
+// function restores it
+func withFakeServer() (*FakeServer, func()) {
+
+	s := &FakeServer{}
+
+	client := tsig.DefaultClient
+	tsig.DefaultClient = &tsig.Client{Exchanger: s}
+
+	return s, func() {
+		tsig.DefaultClient = client
+	}
+}
+
+func TestNegotiateKeyStrength(t *testing.T) {
+
+	s, restore := withFakeServer()
+	defer restore()
+
+	tables := []struct {
+		options   []Option
+		algorithm string
+		size      int
+	}{
+		{nil, DefaultAlgorithm, 256},
+		{[]Option{WithGroup(2), WithAlgorithm(dns.HmacMD5)}, dns.HmacMD5, 128},
+		{[]Option{WithGroup(15), WithAlgorithm("HMAC-SHA512.")}, dns.HmacSHA512, 384},
+	}
+
+	for _, table := range tables {
+		d, err := New(table.options...)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		keyname, mac, _, err := d.NegotiateKey("192.0.2.1", "tsig.example.com.", dns.HmacMD5, "k9uK5qsPfbBxvVuldwzYww==")
+		if assert.Nil(t, err) {
+			assert.Equal(t, base64.StdEncoding.EncodeToString(s.key), *mac)
+			assert.Equal(t, table.algorithm, d.Algorithm(*keyname))
+			// The secret can lose a leading zero byte
+			assert.InDelta(t, table.size, len(s.key), 1)
+		}
+
+		assert.Nil(t, d.Close())
+		assert.Equal(t, "", d.Algorithm("server.example.com."))
+	}
+
+	_, err := New(WithGroup(5))
+	assert.NotNil(t, err)
+
+	_, err = New(WithAlgorithm(tsig.GSS))
+	assert.NotNil(t, err)
+
+	// BIND sends the 1024-bit group as its well-known index
+	*s = FakeServer{WellKnown: true}
+
+	d, err := New(WithGroup(2))
+	if assert.Nil(t, err) {
+		_, mac, _, err := d.NegotiateKey("192.0.2.1", "tsig.example.com.", dns.HmacMD5, "k9uK5qsPfbBxvVuldwzYww==")
+		if assert.Nil(t, err) {
+			assert.Equal(t, base64.StdEncoding.EncodeToString(s.key), *mac)
+		}
+		assert.Nil(t, d.Close())
+	}
+
+	// The server must honour the group and algorithm
+	for _, server := range []FakeServer{{Group: 2}, {Algorithm: dns.HmacMD5}, {WellKnown: true}} {
+		*s = server
+
+		d, err := New()
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		_, _, _, err = d.NegotiateKey("192.0.2.1", "tsig.example.com.", dns.HmacMD5, "k9uK5qsPfbBxvVuldwzYww==")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestNonce(t *testing.T) {
+
+	s, restore := withFakeServer()
+	defer restore()
+
+	var nonces [][]byte
+
+	for i := 0; i < 2; i++ {
+		d, err := New()
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		keyname, _, _, err := d.NegotiateKey("192.0.2.1", "tsig.example.com.", dns.HmacMD5, "k9uK5qsPfbBxvVuldwzYww==")
+		if assert.Nil(t, err) {
+			nonce := d.Nonce(*keyname)
+			assert.Len(t, nonce, DefaultNonceSize)
+			assert.Equal(t, s.nonce, nonce)
+			nonces = append(nonces, nonce)
+		}
+
+		assert.Nil(t, d.Close())
+		assert.Nil(t, d.Nonce(*keyname))
+	}
+
+	// Each is random
+	if assert.Len(t, nonces, 2) {
+		assert.NotEqual(t, nonces[0], nonces[1])
+	}
+
+	nonce := []byte("0123456789abcdef0123456789abcdef")
+
+	d, err := New(WithNonce(nonce))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	keyname, mac, _, err := d.NegotiateKey("192.0.2.1", "tsig.example.com.", dns.HmacMD5, "k9uK5qsPfbBxvVuldwzYww==")
+	if assert.Nil(t, err) {
+		assert.Equal(t, nonce, s.nonce)
+		assert.Equal(t, nonce, d.Nonce(*keyname))
+		assert.Equal(t, base64.StdEncoding.EncodeToString(s.key), *mac)
+	}
+
+	// The nonce is only used once
+	keyname, _, _, err = d.NegotiateKey("192.0.2.1", "tsig.example.com.", dns.HmacMD5, "k9uK5qsPfbBxvVuldwzYww==")
+	if assert.Nil(t, err) {
+		assert.Len(t, d.Nonce(*keyname), DefaultNonceSize)
+		assert.NotEqual(t, nonce, s.nonce)
+	}
+
+	assert.Nil(t, d.Close())
+
+	_, err = New(WithNonce(nil))
+	assert.NotNil(t, err)
+
+	_, err = New(WithNonce(make([]byte, 65536)))
+	assert.NotNil(t, err)
+}
+
+func TestRefresh(t *testing.T) {
+
+	s, restore := withFakeServer()
+	defer restore()
+
+	d, err := New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer d.Close()
+
+	keyname, _, _, err := d.NegotiateKey("192.0.2.1", "tsig.example.com.", dns.HmacMD5, "k9uK5qsPfbBxvVuldwzYww==")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	s.Name = "refreshed.example.com."
+
+	newname, secret, expiry, err := d.Refresh(context.Background(), *keyname)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "refreshed.example.com.", *newname)
+		assert.Equal(t, s.key, secret.Bytes())
+		assert.NotNil(t, expiry)
+		assert.Equal(t, DefaultAlgorithm, d.Algorithm(*newname))
+	}
+
+	// The old key was revoked
+	assert.Equal(t, []string{*keyname}, s.deleted)
+	assert.Equal(t, "", d.Algorithm(*keyname))
+
+	_, _, _, err = d.Refresh(context.Background(), *keyname)
+	assert.NotNil(t, err)
+
+	// A restored key has no TSIG key to sign the negotiation with
+	saved, err := d.SaveKey(*newname)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	e, err := New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer e.Close()
+
+	if assert.Nil(t, e.RestoreKey(saved)) {
+		_, _, _, err = e.Refresh(context.Background(), *newname)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestSaveKey(t *testing.T) {
+
+	_, restore := withFakeServer()
+	defer restore()
+
+	d, err := New()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	keyname, mac, expiry, err := d.NegotiateKey("192.0.2.1", "tsig.example.com.", dns.HmacMD5, "k9uK5qsPfbBxvVuldwzYww==")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	saved, err := d.SaveKey(*keyname)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, *mac, saved.Secret.Base64())
+	assert.Equal(t, "192.0.2.1", saved.Host)
+	assert.Equal(t, *expiry, saved.Expiry)
+
+	b, err := saved.MarshalBinary()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// The key is still active so can't be restored twice
+	assert.NotNil(t, d.RestoreKey(saved))
+
+	// Zeroing the saved key leaves the active one alone
+	saved.Secret.Zero()
+	if again, err := d.SaveKey(*keyname); assert.Nil(t, err) {
+		assert.Equal(t, *mac, again.Secret.Base64())
+	}
+
+	// A new handle, as after a restart
+	restored := new(tsig.SavedKey)
+	if !assert.Nil(t, restored.UnmarshalBinary(b)) {
+		return
+	}
+
+	e, err := New()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	if assert.Nil(t, e.RestoreKey(restored)) {
+		assert.Equal(t, DefaultAlgorithm, e.Algorithm(*keyname))
+		assert.Nil(t, e.DeleteKey(keyname))
+	}
+
+	_, err = e.SaveKey(*keyname)
+	assert.NotNil(t, err)
+
+	// An expired key can't be restored
+	e, err = New(WithClock(func() time.Time {
+		return expiry.Add(time.Second)
+	}))
+	if assert.Nil(t, err) {
+		assert.NotNil(t, e.RestoreKey(restored))
+	}
+
+	assert.Nil(t, d.Close())
+}
@@ -0,0 +1,291 @@
+package tsig
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/bodgit/tsig/client"
+	"github.com/miekg/dns"
+)
+
+// CheckStatus is the outcome of one of the checks made by Diagnose.
+type CheckStatus int
+
+const (
+	// StatusPass means the check found no problem
+	StatusPass CheckStatus = iota
+	// StatusFail means the check found a problem, see the hint
+	StatusFail
+	// StatusSkip means the check couldn't be made, usually because an
+	// earlier one failed
+	StatusSkip
+)
+
+func (s CheckStatus) String() string {
+
+	switch s {
+	case StatusPass:
+		return "pass"
+	case StatusFail:
+		return "fail"
+	default:
+		return "skip"
+	}
+}
+
+// The names of the checks made by Diagnose, in the order they are made
+const (
+	CheckResolve = "resolve"
+	CheckTCP     = "tcp"
+	CheckUDP     = "udp"
+	CheckTKEY    = "tkey"
+	CheckClock   = "clock"
+)
+
+// Check is the result of one diagnostic check.
+type Check struct {
+	Name   string
+	Status CheckStatus
+	// Detail describes what the check found
+	Detail string
+	// Hint suggests how to fix a failure
+	Hint string
+	// Err is the error behind a failure, if any
+	Err error
+}
+
+// Report is the result of Diagnose, each check in the order it was made.
+type Report struct {
+	Host   string
+	Checks []Check
+}
+
+// Add appends the result of a check to the report, for example from a check
+// of GSS credentials.
+func (r *Report) Add(check Check) {
+
+	r.Checks = append(r.Checks, check)
+}
+
+// Check returns the result of the named check and whether it was made.
+func (r *Report) Check(name string) (Check, bool) {
+
+	for _, check := range r.Checks {
+		if check.Name == name {
+			return check, true
+		}
+	}
+
+	return Check{}, false
+}
+
+// Failed reports whether any check failed.
+func (r *Report) Failed() bool {
+
+	for _, check := range r.Checks {
+		if check.Status == StatusFail {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Report) String() string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s:\n", r.Host)
+	for _, check := range r.Checks {
+		fmt.Fprintf(&b, "  %-8s %s: %s\n", check.Name, check.Status, check.Detail)
+		if check.Status == StatusFail && check.Hint != "" {
+			fmt.Fprintf(&b, "           %s\n", check.Hint)
+		}
+	}
+
+	return b.String()
+}
+
+// Diagnose checks for the common reasons negotiating a key with the server
+// host fails, for someone setting up GSS-TSIG for the first time. In turn it
+// checks the host resolves, the first address answers DNS queries over TCP
+// and over UDP, the server accepts GSS-TSIG TKEY queries, see
+// QuerySupportedAlgorithms, and if a TSIG key the server knows is given the
+// clock skew with the server, from the time it reports when deliberately
+// sent a query signed a day ago. Each probe is bounded by ProbeTimeout.
+// Checks that can't be made after an earlier one failed are skipped, as is
+// the clock check without a key. See the gss package for a check of the GSS
+// credentials.
+// It returns the report.
+func (c *Client) Diagnose(ctx context.Context, host string, key *TSIGKey) *Report {
+
+	report := &Report{Host: host}
+
+	hostname, port := SplitHostPort(host)
+
+	addrs, _, err := c.lookupHost(ctx, hostname)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("%w for %s", ErrNoAddresses, hostname)
+	}
+	if err != nil {
+		report.Add(Check{Name: CheckResolve, Status: StatusFail, Detail: "The host did not resolve", Hint: "Check the host name is correct and resolves from here", Err: err})
+		for _, name := range []string{CheckTCP, CheckUDP, CheckTKEY, CheckClock} {
+			report.Add(Check{Name: name, Status: StatusSkip, Detail: "The host did not resolve"})
+		}
+		return report
+	}
+
+	report.Add(Check{Name: CheckResolve, Status: StatusPass, Detail: fmt.Sprintf("Resolved to %s", strings.Join(addrs, ", "))})
+
+	address := c.formatAddress(nil, addrs[0], port)
+
+	var network string
+	for _, n := range []string{"tcp", "udp"} {
+		check := c.checkTransport(ctx, n, hostname, address)
+		if check.Status == StatusPass && network == "" {
+			network = n
+		}
+		report.Add(check)
+	}
+
+	if network == "" {
+		report.Add(Check{Name: CheckTKEY, Status: StatusSkip, Detail: "The server is unreachable"})
+		report.Add(Check{Name: CheckClock, Status: StatusSkip, Detail: "The server is unreachable"})
+		return report
+	}
+
+	report.Add(c.checkTKEY(ctx, host, hostname))
+	report.Add(c.checkClock(ctx, network, hostname, address, key))
+
+	return report
+}
+
+// checkTransport sends an ordinary query over the network, any answer at all
+// shows the server is reachable over it.
+func (c *Client) checkTransport(ctx context.Context, network, hostname, address string) Check {
+
+	check := Check{Name: network}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(hostname), dns.TypeSOA)
+
+	ctx, cancel := context.WithTimeout(ctx, c.probeTimeout())
+	defer cancel()
+
+	cl := &client.Client{}
+	cl.Net = network
+
+	rr, _, err := cl.ExchangeContext(ctx, msg, address)
+	if err != nil {
+		check.Status = StatusFail
+		check.Detail = fmt.Sprintf("No answer from %s over %s", address, strings.ToUpper(network))
+		check.Err = err
+		_, port := SplitHostPort(address)
+		if network == "tcp" {
+			check.Hint = fmt.Sprintf("Check a firewall allows TCP port %s to the server, TKEY responses are often too large for UDP", port)
+		} else {
+			check.Hint = fmt.Sprintf("Check a firewall allows UDP port %s to the server, or use TCP", port)
+		}
+		return check
+	}
+
+	check.Status = StatusPass
+	check.Detail = fmt.Sprintf("%s answered over %s with %s", address, strings.ToUpper(network), dns.RcodeToString[rr.Rcode])
+
+	return check
+}
+
+// checkTKEY probes whether the server accepts GSS-TSIG TKEY queries.
+func (c *Client) checkTKEY(ctx context.Context, host, hostname string) Check {
+
+	check := Check{Name: CheckTKEY}
+
+	keyname := fmt.Sprintf("%d.sig-%s", rand.Int31(), hostname)
+
+	ctx, cancel := context.WithTimeout(ctx, c.probeTimeout())
+	defer cancel()
+
+	supported, err := c.QuerySupportedAlgorithms(ctx, host, keyname, GSS, LegacyGSS)
+	switch {
+	case err != nil:
+		check.Status = StatusFail
+		check.Detail = "The TKEY query got no answer"
+		check.Hint = "Check TKEY queries can reach the server over the transport in Net"
+		check.Err = err
+	case len(supported) == 0:
+		check.Status = StatusFail
+		check.Detail = "The server rejected GSS-TSIG"
+		check.Hint = "Check the server supports secure dynamic updates, for BIND that tkey-gssapi-keytab or tkey-gssapi-credential is set"
+	default:
+		check.Status = StatusPass
+		check.Detail = fmt.Sprintf("The server accepts %s", strings.Join(supported, ", "))
+	}
+
+	return check
+}
+
+// checkClock measures the clock skew with the server by sending a query
+// signed with the key a day ago, which the server rejects as BADTIME along
+// with its own time.
+func (c *Client) checkClock(ctx context.Context, network, hostname, address string, key *TSIGKey) Check {
+
+	check := Check{Name: CheckClock}
+
+	if key == nil {
+		check.Status = StatusSkip
+		check.Detail = "No TSIG key to probe the server time with"
+		return check
+	}
+
+	now := c.now()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(hostname), dns.TypeSOA)
+	msg.SetTsig(dns.Fqdn(key.Name), key.Algorithm, 300, now.Add(-24*time.Hour).Unix())
+
+	ex := c.Exchanger
+	if ex == nil {
+		cl := &client.Client{}
+		cl.Net = network
+		cl.TsigSecret = map[string]string{dns.Fqdn(key.Name): key.Secret}
+		ex = cl
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.probeTimeout())
+	defer cancel()
+
+	// The response TSIG fails to verify, what matters is the time in it
+	rr, err := c.exchangeAddress(ctx, ex, msg, address)
+
+	server, ok := serverTime(rr)
+	if !ok {
+		check.Status = StatusSkip
+		check.Detail = "The server didn't report its time"
+		if rr != nil {
+			if t := rr.IsTsig(); t != nil && t.Error == dns.RcodeBadKey {
+				check.Detail = "The server doesn't know the TSIG key"
+			}
+		} else {
+			check.Err = err
+		}
+		return check
+	}
+
+	skew := server.Sub(now).Round(time.Second)
+
+	check.Detail = fmt.Sprintf("The server clock is %v ahead", skew)
+	if skew < 0 {
+		check.Detail = fmt.Sprintf("The server clock is %v behind", -skew)
+	}
+
+	check.Status = StatusPass
+	if skew > 300*time.Second || skew < -300*time.Second {
+		check.Status = StatusFail
+		check.Hint = "Synchronise the clocks, for example with NTP, signatures and Kerberos tickets are rejected beyond a skew of five minutes"
+	}
+
+	return check
+}
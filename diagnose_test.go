@@ -0,0 +1,91 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func statuses(report *Report) map[string]CheckStatus {
+
+	m := make(map[string]CheckStatus)
+	for _, check := range report.Checks {
+		m[check.Name] = check.Status
+	}
+
+	return m
+}
+
+func TestDiagnose(t *testing.T) {
+
+	client := &Client{
+		Resolver: &FakeResolver{Err: errors.New("no such host")},
+	}
+
+	report := client.Diagnose(context.Background(), "ns.example.com", nil)
+	assert.True(t, report.Failed())
+	assert.Equal(t, map[string]CheckStatus{
+		CheckResolve: StatusFail,
+		CheckTCP:     StatusSkip,
+		CheckUDP:     StatusSkip,
+		CheckTKEY:    StatusSkip,
+		CheckClock:   StatusSkip,
+	}, statuses(report))
+
+	check, ok := report.Check(CheckResolve)
+	if assert.True(t, ok) {
+		assert.NotEmpty(t, check.Hint)
+		assert.NotNil(t, check.Err)
+	}
+
+	// The server only listens on TCP
+	address, stop := serveLargeTKEY(t, 16)
+	defer stop()
+
+	host, port, _ := net.SplitHostPort(address)
+
+	client = &Client{
+		Resolver:     &FakeResolver{Addrs: []string{host}},
+		ProbeTimeout: time.Second,
+	}
+
+	report = client.Diagnose(context.Background(), net.JoinHostPort("ns.example.com", port), nil)
+	assert.True(t, report.Failed())
+	assert.Equal(t, map[string]CheckStatus{
+		CheckResolve: StatusPass,
+		CheckTCP:     StatusPass,
+		CheckUDP:     StatusFail,
+		CheckTKEY:    StatusPass,
+		CheckClock:   StatusSkip,
+	}, statuses(report))
+	assert.Contains(t, report.String(), "udp      fail")
+
+	now := time.Unix(1600000000, 0)
+	key := &TSIGKey{Name: "tsig.example.com.", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0"}
+
+	client.Now = func() time.Time { return now }
+	client.Exchanger = FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		if m.IsTsig() != nil {
+			// The server is an hour ahead
+			return badTimeReply(m, uint64(now.Unix()), "00005f5e1e10"), nil
+		}
+		r := tkeyReply(m, m.Question[0].Name)
+		r.Answer[0].(*dns.TKEY).Error = dns.RcodeBadAlg
+		return r, nil
+	})
+
+	report = client.Diagnose(context.Background(), net.JoinHostPort("ns.example.com", port), key)
+	assert.Equal(t, StatusFail, statuses(report)[CheckTKEY])
+
+	check, ok = report.Check(CheckClock)
+	if assert.True(t, ok) {
+		assert.Equal(t, StatusFail, check.Status)
+		assert.Equal(t, "The server clock is 1h0m0s ahead", check.Detail)
+		assert.NotEmpty(t, check.Hint)
+	}
+}
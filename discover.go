@@ -0,0 +1,221 @@
+package tsig
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bodgit/tsig/client"
+	"github.com/miekg/dns"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+func (c *Client) nameserver() (string, error) {
+
+	if c.Nameserver != "" {
+		hostname, port := SplitHostPort(c.Nameserver)
+		return net.JoinHostPort(hostname, port), nil
+	}
+
+	config, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil {
+		return "", err
+	}
+
+	if len(config.Servers) == 0 {
+		return "", fmt.Errorf("No nameservers in %s", resolvConf)
+	}
+
+	return net.JoinHostPort(config.Servers[0], config.Port), nil
+}
+
+// query performs an ordinary recursive query used to discover servers.
+func (c *Client) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+
+	if err := c.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	server, err := c.nameserver()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	ex := c.Exchanger
+	if ex == nil {
+		ex = &client.Client{}
+	}
+
+	rr, err := c.exchangeAddress(ctx, ex, msg, server)
+	if err == nil && rr.Truncated && c.Exchanger == nil {
+		tcp := &client.Client{}
+		tcp.Net = "tcp"
+		rr, err = c.exchangeAddress(ctx, tcp, msg, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if rr.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("DNS error querying %s %s: %s (%d)", name, dns.TypeToString[qtype], dns.RcodeToString[rr.Rcode], rr.Rcode)
+	}
+
+	return rr, nil
+}
+
+// dialHost resolves the server host and returns a connection to the first
+// address that accepts one.
+func (c *Client) dialHost(ctx context.Context, host string) (net.Conn, error) {
+
+	conn, _, err := c.dialHostTimed(ctx, host)
+
+	return conn, err
+}
+
+// dialHostTimed is dialHost that also returns how long resolving and dialing
+// took.
+func (c *Client) dialHostTimed(ctx context.Context, host string) (net.Conn, Timings, error) {
+
+	var timings Timings
+
+	hostname, port := SplitHostPort(host)
+
+	addrs, resolve, err := c.lookupHost(ctx, hostname)
+	if err != nil {
+		return nil, timings, err
+	}
+
+	timings.Resolve = resolve
+
+	addrs = c.orderAddresses(hostname, addrs)
+
+	network := c.Net
+	if network == "" || network == NetAuto {
+		network = "tcp"
+	}
+
+	useTLS := strings.HasSuffix(network, "-tls")
+	network = strings.TrimSuffix(network, "-tls")
+
+	dial := c.dial
+	if dial == nil {
+		d := &net.Dialer{Timeout: c.Timeout}
+		dial = d.DialContext
+	}
+
+	var errs []error
+	for _, addr := range addrs {
+		address := c.formatAddress(nil, addr, port)
+		start := time.Now()
+		conn, err := dial(ctx, network, address)
+		if err == nil {
+			if err = client.SetBuffers(conn, c.ReadBufferSize, c.WriteBufferSize); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil && c.TCPNoDelay {
+			if err = client.SetNoDelay(conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil && useTLS {
+			conn, err = client.TLSHandshake(ctx, conn, net.JoinHostPort(strings.TrimSuffix(hostname, "."), port), c.tlsConfig(), c.Timeout)
+			if err == nil {
+				err = client.VerifyTLS(conn, c.verifyTLS())
+			}
+		}
+		c.emit(ctx, Event{
+			Type:     EventDial,
+			Address:  address,
+			Duration: time.Since(start),
+			Err:      err,
+		})
+		if err == nil {
+			c.report(addr, nil)
+			timings.Dial = time.Since(start)
+			return conn, timings, nil
+		}
+		if ctx.Err() == nil {
+			c.report(addr, err)
+		}
+		errs = append(errs, err)
+	}
+
+	if errs == nil {
+		return nil, timings, fmt.Errorf("%w for %s", ErrNoAddresses, hostname)
+	}
+
+	return nil, timings, c.aggregate(errs)
+}
+
+// reachable checks the server host resolves and accepts a connection.
+func (c *Client) reachable(ctx context.Context, host string) error {
+
+	conn, err := c.dialHost(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// ServerForZone finds the DNS server to send TKEY queries and updates for the
+// zone to. The primary master named in the SOA record is preferred however if
+// it isn't reachable then each server in the NS records is tried in turn.
+// The port of the returned server is taken from the zone if it has a ":port"
+// suffix.
+// It returns the chosen server and any error that occurred.
+func (c *Client) ServerForZone(ctx context.Context, zone string) (string, error) {
+
+	zone, port := SplitHostPort(zone)
+	zone = dns.Fqdn(zone)
+
+	rr, err := c.query(ctx, zone, dns.TypeSOA)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := []string{}
+
+	for _, ans := range append(rr.Answer, rr.Ns...) {
+		if soa, ok := ans.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, zone) {
+			candidates = append(candidates, soa.Ns)
+			break
+		}
+	}
+
+	rr, err = c.query(ctx, zone, dns.TypeNS)
+	if err != nil && len(candidates) == 0 {
+		return "", err
+	}
+
+	if err == nil {
+		for _, ans := range rr.Answer {
+			if ns, ok := ans.(*dns.NS); ok && (len(candidates) == 0 || !strings.EqualFold(ns.Ns, candidates[0])) {
+				candidates = append(candidates, ns.Ns)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("No servers found for zone %s", zone)
+	}
+
+	var errs []error
+	for _, candidate := range candidates {
+		server := net.JoinHostPort(candidate, port)
+		err := c.reachable(ctx, server)
+		if err == nil {
+			return server, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", candidate, err))
+	}
+
+	return "", c.aggregate(errs)
+}
@@ -0,0 +1,96 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// FuncClient answers each query using a function.
+type FuncClient func(m *dns.Msg, address string) (*dns.Msg, error)
+
+func (f FuncClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	r, err := f(m, address)
+
+	return r, 0, err
+}
+
+type MapResolver map[string][]string
+
+func (r MapResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+
+	addrs, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return addrs, nil
+}
+
+func zoneServers(t *testing.T) FuncClient {
+
+	return func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		switch m.Question[0].Qtype {
+		case dns.TypeSOA:
+			r.Answer = append(r.Answer, mustRR(t, "example.com. 300 SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300"))
+		case dns.TypeNS:
+			r.Answer = append(r.Answer, mustRR(t, "example.com. 300 NS ns1.example.com."))
+			r.Answer = append(r.Answer, mustRR(t, "example.com. 300 NS ns2.example.com."))
+		}
+		return r, nil
+	}
+}
+
+func TestServerForZone(t *testing.T) {
+
+	dialed := []string{}
+
+	client := &Client{
+		Nameserver: "192.0.2.53",
+		Exchanger:  zoneServers(t),
+		Resolver: MapResolver{
+			"ns1.example.com.": {"192.0.2.1"},
+			"ns2.example.com.": {"192.0.2.2"},
+		},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			if address == "192.0.2.1:53" {
+				return nil, errors.New("connection refused")
+			}
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		},
+	}
+
+	// The primary master isn't reachable so the next NS is used
+	server, err := client.ServerForZone(context.Background(), "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "ns2.example.com.:53", server)
+	assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, dialed)
+
+	// The primary master is reachable
+	dialed = dialed[:0]
+	client.Resolver = MapResolver{
+		"ns1.example.com.": {"192.0.2.3"},
+	}
+
+	server, err = client.ServerForZone(context.Background(), "example.com:8053")
+	assert.Nil(t, err)
+	assert.Equal(t, "ns1.example.com.:8053", server)
+	assert.Equal(t, []string{"192.0.2.3:8053"}, dialed)
+
+	// Nothing is reachable
+	client.Resolver = MapResolver{}
+
+	_, err = client.ServerForZone(context.Background(), "example.com")
+	assert.NotNil(t, err)
+}
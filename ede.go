@@ -0,0 +1,71 @@
+package tsig
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// edeCode is the EDNS0 option code of an RFC 8914 Extended DNS Error, the
+// dns package has no type for it so it is unpacked as dns.EDNS0_LOCAL.
+const edeCode = 15
+
+// edeNames are the names of the Extended DNS Error codes from RFC 8914.
+var edeNames = map[uint16]string{
+	0:  "Other Error",
+	1:  "Unsupported DNSKEY Algorithm",
+	2:  "Unsupported DS Digest Type",
+	3:  "Stale Answer",
+	4:  "Forged Answer",
+	5:  "DNSSEC Indeterminate",
+	6:  "DNSSEC Bogus",
+	7:  "Signature Expired",
+	8:  "Signature Not Yet Valid",
+	9:  "DNSKEY Missing",
+	10: "RRSIGs Missing",
+	11: "No Zone Key Bit Set",
+	12: "NSEC Missing",
+	13: "Cached Error",
+	14: "Not Ready",
+	15: "Blocked",
+	16: "Censored",
+	17: "Filtered",
+	18: "Prohibited",
+	19: "Stale NXDomain Answer",
+	20: "Not Authoritative",
+	21: "Not Supported",
+	22: "No Reachable Authority",
+	23: "Network Error",
+	24: "Invalid Data",
+}
+
+// extendedError returns the Extended DNS Error in the response, if any.
+func extendedError(rr *dns.Msg) (uint16, string, bool) {
+
+	opt := rr.IsEdns0()
+	if opt == nil {
+		return 0, "", false
+	}
+
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == edeCode && len(local.Data) >= 2 {
+			return binary.BigEndian.Uint16(local.Data), string(local.Data[2:]), true
+		}
+	}
+
+	return 0, "", false
+}
+
+// dnsError returns the DNSError for the response code of the response along
+// with any Extended DNS Error it carries.
+func dnsError(rr *dns.Msg) *DNSError {
+
+	code, text, extended := extendedError(rr)
+
+	return &DNSError{
+		Rcode:        rr.Rcode,
+		Extended:     extended,
+		ExtendedCode: code,
+		ExtraText:    text,
+	}
+}
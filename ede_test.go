@@ -0,0 +1,98 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtendedError(t *testing.T) {
+
+	refused := new(dns.Msg)
+	refused.Rcode = dns.RcodeRefused
+
+	withEDE := refused.Copy()
+	opt := edns0(withEDE)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: edeCode,
+		Data: append([]byte{0x00, 0x12}, "TKEY not allowed from this address"...),
+	})
+
+	// Round trip through the wire format as that's how the option is seen
+	b, err := withEDE.Pack()
+	if !assert.Nil(t, err) {
+		return
+	}
+	withEDE = new(dns.Msg)
+	if !assert.Nil(t, withEDE.Unpack(b)) {
+		return
+	}
+
+	cases := []struct {
+		msg  *dns.Msg
+		want DNSError
+		text string
+	}{
+		{refused, DNSError{Rcode: dns.RcodeRefused}, "DNS error: REFUSED (5)"},
+		{withEDE, DNSError{Rcode: dns.RcodeRefused, Extended: true, ExtendedCode: 18, ExtraText: "TKEY not allowed from this address"}, "DNS error: REFUSED (5), extended error: Prohibited (18): TKEY not allowed from this address"},
+	}
+
+	for _, tc := range cases {
+		client := &Client{
+			Exchanger: &FakeClient{Msg: tc.msg},
+			Resolver:  &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		}
+
+		_, err := client.Exchange(context.Background(), &Request{
+			Host:      "ns.example.com.",
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+		})
+
+		var derr *DNSError
+		if assert.True(t, errors.As(err, &derr)) {
+			assert.Equal(t, tc.want, *derr)
+			assert.Equal(t, tc.text, err.Error())
+		}
+	}
+
+	// The failures reported as their own errors carry it too
+	for _, rcode := range []int{dns.RcodeFormatError, dns.RcodeNameError} {
+		msg := withEDE.Copy()
+		msg.Rcode = rcode
+
+		client := &Client{
+			Exchanger: &FakeClient{Msg: msg},
+			Resolver:  &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		}
+
+		_, err := client.Exchange(context.Background(), &Request{
+			Host:      "ns.example.com.",
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+		})
+
+		var derr *DNSError
+		if assert.True(t, errors.As(err, &derr)) {
+			assert.Equal(t, DNSError{Rcode: rcode, Extended: true, ExtendedCode: 18, ExtraText: "TKEY not allowed from this address"}, *derr)
+			assert.Contains(t, err.Error(), ", extended error: Prohibited (18): TKEY not allowed from this address")
+		}
+
+		var uerr *UnsupportedError
+		var kerr *KeyNameError
+		if rcode == dns.RcodeFormatError {
+			assert.True(t, errors.As(err, &uerr))
+		} else {
+			assert.True(t, errors.As(err, &kerr))
+		}
+	}
+
+	assert.Equal(t, "DNS error: REFUSED (5), extended error: Unknown (999)", (&DNSError{Rcode: dns.RcodeRefused, Extended: true, ExtendedCode: 999}).Error())
+}
@@ -0,0 +1,398 @@
+package tsig
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNoAddresses is returned, wrapped with the name of the host, when the host
+// resolves without error but to no addresses. Use errors.Is to detect it.
+var ErrNoAddresses = errors.New("No addresses")
+
+// ErrResponseNotSigned is returned, wrapped with the address of the server,
+// when VerifyResponseTSIG is set and the answer to a query signed with a TSIG
+// key has no TSIG record. Use errors.Is to detect it.
+var ErrResponseNotSigned = errors.New("Response is not signed")
+
+// ErrUnauthenticated is returned when RequireAuthentication is set and a
+// query would be sent without being authenticated.
+var ErrUnauthenticated = errors.New("Query is not authenticated")
+
+// TimeoutError is returned when the overall time budget for an exchange runs
+// out before any address answered.
+type TimeoutError struct {
+	Host string
+	// Addresses is every address that was attempted
+	Addresses []string
+	// Err holds the errors from the attempted addresses, if any
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+
+	return fmt.Sprintf("Timed out exchanging with %s after trying [%s]", e.Host, strings.Join(e.Addresses, ", "))
+}
+
+// Timeout is always true, it allows TimeoutError to be treated like a
+// net.Error.
+func (e *TimeoutError) Timeout() bool {
+
+	return true
+}
+
+// Unwrap returns context.DeadlineExceeded.
+func (e *TimeoutError) Unwrap() error {
+
+	return context.DeadlineExceeded
+}
+
+// AddressLimitError is returned when every address attempted failed but the
+// host resolved to more than MaxAddresses so some were never tried.
+type AddressLimitError struct {
+	Host string
+	// Limit is MaxAddresses
+	Limit int
+	// Addresses is every address that was attempted
+	Addresses []string
+	// Err holds the errors from the attempted addresses
+	Err error
+}
+
+func (e *AddressLimitError) Error() string {
+
+	return fmt.Sprintf("No answer from %s after trying the limit of %d addresses [%s]: %v", e.Host, e.Limit, strings.Join(e.Addresses, ", "), e.Err)
+}
+
+// Unwrap returns the errors from the attempted addresses.
+func (e *AddressLimitError) Unwrap() error {
+
+	return e.Err
+}
+
+// AddressError is a failure to exchange with one of the addresses a host
+// resolves to, each error aggregated by Exchange after every address failed
+// is one so the message names the address it pertains to while errors.Is
+// and errors.As still reach the original error.
+type AddressError struct {
+	Host string
+	// Address is the address and port the query was sent to
+	Address string
+	Err     error
+}
+
+func (e *AddressError) Error() string {
+
+	return fmt.Sprintf("%s (%s): %v", e.Host, e.Address, e.Err)
+}
+
+// Unwrap returns the error from the address.
+func (e *AddressError) Unwrap() error {
+
+	return e.Err
+}
+
+// NotAllowedError is returned when AllowedNetworks is set and none of the
+// addresses the host resolves to are within the allowed networks. It wraps
+// ErrNoAddresses.
+type NotAllowedError struct {
+	Host string
+	// Addresses is every address that was skipped
+	Addresses []string
+}
+
+func (e *NotAllowedError) Error() string {
+
+	return fmt.Sprintf("No allowed addresses for %s, skipped [%s]", e.Host, strings.Join(e.Addresses, ", "))
+}
+
+// Unwrap returns ErrNoAddresses.
+func (e *NotAllowedError) Unwrap() error {
+
+	return ErrNoAddresses
+}
+
+// UnsupportedError is returned when the server answers a TKEY query with
+// FORMERR or NOTIMP. Servers that don't understand the requested algorithm or
+// mode, for example a server without GSS-TSIG support, tend to respond this
+// way rather than with a TKEY error.
+type UnsupportedError struct {
+	Algorithm string
+	Mode      uint16
+	// Rcode is the response code, either dns.RcodeFormatError or
+	// dns.RcodeNotImplemented
+	Rcode int
+	// Err is the response code along with any Extended DNS Error the
+	// response carries
+	Err *DNSError
+}
+
+func (e *UnsupportedError) Error() string {
+
+	return fmt.Sprintf("DNS error: %s (%d), the server may not support the %s algorithm in %s mode%s", dns.RcodeToString[e.Rcode], e.Rcode, e.Algorithm, ModeString(e.Mode), e.Err.extended())
+}
+
+// Unwrap returns the DNSError of the response, if known.
+func (e *UnsupportedError) Unwrap() error {
+
+	if e.Err == nil {
+		return nil
+	}
+
+	return e.Err
+}
+
+// ModeError is returned when the TKEY answer uses a different mode to the
+// query, for example server assigned keying when GSS-API was requested,
+// unless AllowModeChange is set.
+type ModeError struct {
+	Requested uint16
+	Returned  uint16
+}
+
+func (e *ModeError) Error() string {
+
+	return fmt.Sprintf("TKEY mode %s was requested but the server returned %s", ModeString(e.Requested), ModeString(e.Returned))
+}
+
+// DNSError is returned when the server answers a TKEY query with an error
+// response code. If the response carries an RFC 8914 Extended DNS Error
+// explaining why then that is included.
+type DNSError struct {
+	Rcode int
+	// Extended is set if the response carries an Extended DNS Error
+	Extended bool
+	// ExtendedCode is the Extended DNS Error info code
+	ExtendedCode uint16
+	// ExtraText is the optional explanation that came with it
+	ExtraText string
+}
+
+func (e *DNSError) Error() string {
+
+	return fmt.Sprintf("DNS error: %s (%d)", dns.RcodeToString[e.Rcode], e.Rcode) + e.extended()
+}
+
+// extended describes the Extended DNS Error to be appended to a message, it
+// is empty if there is none.
+func (e *DNSError) extended() string {
+
+	if e == nil || !e.Extended {
+		return ""
+	}
+
+	name, ok := edeNames[e.ExtendedCode]
+	if !ok {
+		name = "Unknown"
+	}
+	msg := fmt.Sprintf(", extended error: %s (%d)", name, e.ExtendedCode)
+
+	if e.ExtraText != "" {
+		msg += ": " + e.ExtraText
+	}
+
+	return msg
+}
+
+// KeyNameError is returned when the server answers a TKEY query with
+// NXDOMAIN. This tends to mean the key name is not within a zone the server
+// is authoritative for, or the server is not configured to accept TKEY
+// queries for it.
+type KeyNameError struct {
+	KeyName string
+	// Err is the response code along with any Extended DNS Error the
+	// response carries
+	Err *DNSError
+}
+
+func (e *KeyNameError) Error() string {
+
+	return fmt.Sprintf("DNS error: %s (%d) for key name %s, check the key name is within a zone the server is authoritative for and the server accepts TKEY queries for it%s", dns.RcodeToString[dns.RcodeNameError], dns.RcodeNameError, e.KeyName, e.Err.extended())
+}
+
+// Unwrap returns the DNSError of the response, if known.
+func (e *KeyNameError) Unwrap() error {
+
+	if e.Err == nil {
+		return nil
+	}
+
+	return e.Err
+}
+
+// TKEYError is returned when the TKEY answer carries an error, such as
+// BADKEY. Any OtherData in the answer is included as servers can use it to
+// give further context, for example a GSS minor status.
+type TKEYError struct {
+	// Code is the TKEY error, typically one of dns.RcodeBadSig and friends
+	Code      uint16
+	OtherData []byte
+}
+
+func (e *TKEYError) Error() string {
+
+	if len(e.OtherData) > 0 {
+		return fmt.Sprintf("TKEY error: %s (%d), other data: %x", dns.RcodeToString[int(e.Code)], e.Code, e.OtherData)
+	}
+
+	return fmt.Sprintf("TKEY error: %s (%d)", dns.RcodeToString[int(e.Code)], e.Code)
+}
+
+// MinorStatus interprets OtherData as a 32-bit GSS minor status code.
+// It returns the code and whether OtherData is the correct length.
+func (e *TKEYError) MinorStatus() (uint32, bool) {
+
+	if len(e.OtherData) != 4 {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(e.OtherData), true
+}
+
+// TSIGKeyError is returned by TSIGKey.Validate for an invalid field.
+type TSIGKeyError struct {
+	// Field is the name of the invalid field, one of "Name", "Algorithm"
+	// or "Secret"
+	Field  string
+	Reason string
+}
+
+func (e *TSIGKeyError) Error() string {
+
+	return fmt.Sprintf("Invalid TSIG key %s: %s", e.Field, e.Reason)
+}
+
+// TSIGError is returned when CheckTSIGError is set and the TSIG record of
+// the response carries an error, such as BADSIG, regardless of the response
+// code. Some servers report a failure to authenticate the query only this
+// way.
+type TSIGError struct {
+	// Code is the TSIG error, one of dns.RcodeBadSig, dns.RcodeBadKey,
+	// dns.RcodeBadTime or dns.RcodeBadTrunc
+	Code uint16
+	// OtherData is the other data of the TSIG, for BADTIME it holds the
+	// time of the server
+	OtherData []byte
+}
+
+func (e *TSIGError) Error() string {
+
+	return fmt.Sprintf("TSIG error: %s (%d)", dns.RcodeToString[int(e.Code)], e.Code)
+}
+
+// checkTSIGError returns a TSIGError if the response rr has a TSIG record
+// with an error, in place of err which is usually a failure to verify it,
+// otherwise it returns rr and err unchanged.
+func checkTSIGError(rr *dns.Msg, err error) (*dns.Msg, error) {
+
+	if rr == nil {
+		return rr, err
+	}
+
+	t := rr.IsTsig()
+	if t == nil || t.Error == dns.RcodeSuccess {
+		return rr, err
+	}
+
+	other, _ := hex.DecodeString(t.OtherData)
+
+	return nil, &TSIGError{
+		Code:      t.Error,
+		OtherData: other,
+	}
+}
+
+// LifetimeError is returned when MinRemainingLifetime is set and the key
+// granted by the server expires too soon.
+type LifetimeError struct {
+	Expiration time.Time
+	// Remaining is how long the key was still valid for when the response
+	// was received, it is negative if the key had already expired
+	Remaining time.Duration
+	Minimum   time.Duration
+}
+
+func (e *LifetimeError) Error() string {
+
+	return fmt.Sprintf("TKEY expires at %s leaving %s, less than the minimum of %s", e.Expiration.UTC(), e.Remaining, e.Minimum)
+}
+
+// CipherSuiteError is returned when TLSCipherSuites is set and the TLS
+// connection to the server negotiated a cipher suite that isn't one of them.
+type CipherSuiteError struct {
+	Version     uint16
+	CipherSuite uint16
+}
+
+func (e *CipherSuiteError) Error() string {
+
+	return fmt.Sprintf("TLS cipher suite %#04x negotiated with version %#04x is not allowed", e.CipherSuite, e.Version)
+}
+
+// KeyValidityError is returned when the key granted by a TKEY answer isn't
+// valid now, allowing for the Skew either way. NotYetValid and Expired tell
+// the two cases apart.
+type KeyValidityError struct {
+	Inception  time.Time
+	Expiration time.Time
+	Now        time.Time
+	Skew       time.Duration
+}
+
+// NotYetValid returns whether the inception of the key is in the future by
+// more than the skew.
+func (e *KeyValidityError) NotYetValid() bool {
+
+	return e.Inception.After(e.Now.Add(e.Skew))
+}
+
+// Expired returns whether the key has already expired.
+func (e *KeyValidityError) Expired() bool {
+
+	return !e.Expiration.After(e.Now)
+}
+
+func (e *KeyValidityError) Error() string {
+
+	if e.NotYetValid() {
+		return fmt.Sprintf("TKEY is not yet valid, inception %s is more than %s after %s", e.Inception.UTC(), e.Skew, e.Now.UTC())
+	}
+
+	return fmt.Sprintf("TKEY already expired at %s", e.Expiration.UTC())
+}
+
+// IsUnknownKey returns whether the error, or any of the errors aggregated in
+// it by Client.Exchange, is the server saying it has no such key, as happens
+// when deleting a key that has already expired or been deleted.
+func IsUnknownKey(err error) bool {
+
+	if errs := Errors(err); errs != nil {
+		for _, err := range errs {
+			if IsUnknownKey(err) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var knerr *KeyNameError
+	var tkerr *TKEYError
+	var tserr *TSIGError
+
+	switch {
+	case errors.As(err, &knerr):
+		return true
+	case errors.As(err, &tkerr):
+		return tkerr.Code == dns.RcodeBadKey || tkerr.Code == dns.RcodeBadName
+	case errors.As(err, &tserr):
+		return tserr.Code == dns.RcodeBadKey
+	default:
+		return false
+	}
+}
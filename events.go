@@ -0,0 +1,280 @@
+package tsig
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// EventType identifies the step of a negotiation an Event describes.
+type EventType int
+
+const (
+	// EventResolve is the host being resolved to its addresses
+	EventResolve EventType = iota
+	// EventDial is a connection being dialed to an address
+	EventDial
+	// EventSign is a TSIG record being added to a query
+	EventSign
+	// EventSend is a query about to be sent to an address
+	EventSend
+	// EventReceive is the response to a query, or why there wasn't one
+	EventReceive
+	// EventToken is a GSS token sent to or received from the server
+	EventToken
+	// EventKeyEstablished is a key or security context being negotiated
+	EventKeyEstablished
+	// EventKeyDeleted is a key or security context being deleted
+	EventKeyDeleted
+	// EventLifetimeClamped is the server granting a key a shorter lifetime
+	// than requested, Duration is the lifetime granted and Expiry when the
+	// key expires, see Response.LifetimeClamped
+	EventLifetimeClamped
+)
+
+func (t EventType) String() string {
+
+	switch t {
+	case EventResolve:
+		return "resolve"
+	case EventDial:
+		return "dial"
+	case EventSign:
+		return "sign"
+	case EventSend:
+		return "send"
+	case EventReceive:
+		return "receive"
+	case EventToken:
+		return "token"
+	case EventKeyEstablished:
+		return "key established"
+	case EventKeyDeleted:
+		return "key deleted"
+	case EventLifetimeClamped:
+		return "lifetime clamped"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is one step of a negotiation, only the fields relevant to the type
+// are set. Msg is a copy so it can be kept.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Client is the Name of the Client the event came from
+	Client string
+	// Correlation is the correlation value of the exchange, see
+	// Request.Correlation
+	Correlation string
+	// Host and Addresses are the host resolved and what it resolved to
+	Host      string
+	Addresses []string
+	// Address is the address dialed, sent to or received from
+	Address string
+	// KeyName is the name of the TSIG key signing the query or the name
+	// of the key established or deleted
+	KeyName string
+	// Msg is the query sent or the response received
+	Msg *dns.Msg
+	// Token, Incoming and Round are the GSS token, whether it was received
+	// from the server and the zero-based round trip it belongs to
+	Token    []byte
+	Incoming bool
+	Round    int
+	// Expiry is when the established key expires
+	Expiry time.Time
+	// Duration is how long resolving, dialing or the exchange took
+	Duration time.Duration
+	Err      error
+}
+
+// DefaultEventBuffer is the number of events an EventStream buffers unless
+// a size is given.
+const DefaultEventBuffer = 64
+
+// EventStream delivers the events of every negotiation it is attached to,
+// with the Events field of a Client, ContextWithEvents, or the WithEvents
+// options of the gss and dh packages, as one stream. Events are buffered
+// and an event emitted while the buffer is full is dropped rather than
+// stalling the negotiation, see Dropped. The stream is never closed.
+type EventStream struct {
+	c       chan Event
+	dropped uint64
+}
+
+// NewEventStream returns a stream that buffers up to size events,
+// DefaultEventBuffer is used if size is zero or less.
+func NewEventStream(size int) *EventStream {
+
+	if size <= 0 {
+		size = DefaultEventBuffer
+	}
+
+	return &EventStream{
+		c: make(chan Event, size),
+	}
+}
+
+// Events returns the channel the events are delivered on.
+func (s *EventStream) Events() <-chan Event {
+
+	return s.c
+}
+
+// Dropped returns how many events have been dropped because the buffer was
+// full.
+func (s *EventStream) Dropped() uint64 {
+
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Emit delivers the event without blocking, setting its time if it isn't
+// set. It does nothing if the stream is nil.
+func (s *EventStream) Emit(e Event) {
+
+	if s == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	select {
+	case s.c <- e:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+type eventsKey struct{}
+
+// ContextWithEvents returns a copy of ctx that makes a Client emit the
+// events of exchanges using it to the stream instead of its Events.
+func ContextWithEvents(ctx context.Context, s *EventStream) context.Context {
+
+	return context.WithValue(ctx, eventsKey{}, s)
+}
+
+// EventsFromContext returns the stream carried by ctx, if any.
+func EventsFromContext(ctx context.Context) (*EventStream, bool) {
+
+	s, ok := ctx.Value(eventsKey{}).(*EventStream)
+
+	return s, ok && s != nil
+}
+
+type correlationKey struct{}
+
+// ContextWithCorrelation returns a copy of ctx carrying the correlation
+// value, such as a request or trace Id, given to the events of exchanges
+// using it whose request has no Correlation of its own. This lets the
+// exchanges made by the gss and dh packages be correlated too.
+func ContextWithCorrelation(ctx context.Context, correlation string) context.Context {
+
+	return context.WithValue(ctx, correlationKey{}, correlation)
+}
+
+// CorrelationFromContext returns the correlation value carried by ctx, if
+// any.
+func CorrelationFromContext(ctx context.Context) (string, bool) {
+
+	correlation, ok := ctx.Value(correlationKey{}).(string)
+
+	return correlation, ok && correlation != ""
+}
+
+// withCorrelation returns ctx carrying the Correlation of the request, if it
+// has one.
+func withCorrelation(ctx context.Context, req *Request) context.Context {
+
+	if req.Correlation == "" {
+		return ctx
+	}
+
+	return ContextWithCorrelation(ctx, req.Correlation)
+}
+
+// events returns the stream for the exchange, nil if there isn't one.
+func (c *Client) events(ctx context.Context) *EventStream {
+
+	if s, ok := EventsFromContext(ctx); ok {
+		return s
+	}
+
+	return c.Events
+}
+
+// emit emits the event, tagged with the Name of the Client and the
+// correlation value of the context, to the stream carried by the context or
+// set in Events.
+func (c *Client) emit(ctx context.Context, e Event) {
+
+	e.Client = c.Name
+	e.Correlation, _ = CorrelationFromContext(ctx)
+	c.events(ctx).Emit(e)
+}
+
+// emitClamped emits an EventLifetimeClamped if the server granted less than
+// the requested lifetime.
+func (c *Client) emitClamped(ctx context.Context, resp *Response) {
+
+	if !resp.LifetimeClamped {
+		return
+	}
+
+	c.emit(ctx, Event{
+		Type:     EventLifetimeClamped,
+		Address:  resp.Address,
+		KeyName:  resp.KeyName,
+		Expiry:   time.Unix(int64(resp.TKEY.Expiration), 0),
+		Duration: time.Duration(resp.GrantedLifetime) * time.Second,
+	})
+}
+
+// emitSend emits an EventSign if the query is signed and then an EventSend.
+func (c *Client) emitSend(ctx context.Context, m *dns.Msg, address string) {
+
+	if c.events(ctx) == nil {
+		return
+	}
+
+	if t := m.IsTsig(); t != nil {
+		c.emit(ctx, Event{
+			Type:    EventSign,
+			Address: address,
+			KeyName: t.Hdr.Name,
+		})
+	}
+
+	c.emit(ctx, Event{
+		Type:    EventSend,
+		Address: address,
+		Msg:     m.Copy(),
+	})
+}
+
+// emitReceive emits an EventReceive for the response or error of an
+// exchange that took d.
+func (c *Client) emitReceive(ctx context.Context, rr *dns.Msg, err error, address string, d time.Duration) {
+
+	if c.events(ctx) == nil {
+		return
+	}
+
+	if rr != nil {
+		rr = rr.Copy()
+	}
+
+	c.emit(ctx, Event{
+		Type:     EventReceive,
+		Address:  address,
+		Msg:      rr,
+		Duration: d,
+		Err:      err,
+	})
+}
@@ -0,0 +1,143 @@
+package tsig
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// drain returns the types of every event buffered by the stream.
+func drain(s *EventStream) []EventType {
+
+	var types []EventType
+	for {
+		select {
+		case e := <-s.Events():
+			types = append(types, e.Type)
+		default:
+			return types
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+
+	stream := NewEventStream(0)
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		Events:   stream,
+	}
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	_, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []EventType{EventResolve, EventSign, EventSend, EventReceive}, drain(stream))
+	}
+
+	// The context takes precedence
+	other := NewEventStream(0)
+
+	_, err = client.Exchange(ContextWithEvents(context.Background(), other), request)
+	if assert.Nil(t, err) {
+		assert.Len(t, drain(stream), 0)
+		assert.Len(t, drain(other), 4)
+	}
+
+	// A full buffer drops events rather than blocking
+	client.Events = NewEventStream(1)
+
+	_, err = client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []EventType{EventResolve}, drain(client.Events))
+		assert.Equal(t, uint64(3), client.Events.Dropped())
+	}
+
+	// No stream is a no-op
+	var s *EventStream
+	s.Emit(Event{Type: EventSend})
+}
+
+func TestCorrelation(t *testing.T) {
+
+	stream := NewEventStream(0)
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		Events:   stream,
+	}
+
+	request := &Request{
+		Host:        "ns.example.com",
+		KeyName:     "test.example.com.",
+		Algorithm:   GSS,
+		Mode:        TkeyModeGSS,
+		Lifetime:    3600,
+		Correlation: "req-1234",
+	}
+
+	correlations := func() []string {
+		var c []string
+		for {
+			select {
+			case e := <-stream.Events():
+				c = append(c, e.Correlation)
+			default:
+				return c
+			}
+		}
+	}
+
+	resp, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "req-1234", resp.Correlation)
+		assert.Equal(t, []string{"req-1234", "req-1234", "req-1234"}, correlations())
+	}
+
+	// The request takes precedence over the context
+	ctx := ContextWithCorrelation(context.Background(), "trace-5678")
+
+	_, err = client.Exchange(ctx, request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"req-1234", "req-1234", "req-1234"}, correlations())
+	}
+
+	request.Correlation = ""
+
+	resp, err = client.Exchange(ctx, request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "", resp.Correlation)
+		assert.Equal(t, []string{"trace-5678", "trace-5678", "trace-5678"}, correlations())
+	}
+
+	_, ok := CorrelationFromContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestEventTypeString(t *testing.T) {
+
+	assert.Equal(t, "resolve", EventResolve.String())
+	assert.Equal(t, "key deleted", EventKeyDeleted.String())
+	assert.Equal(t, "lifetime clamped", EventLifetimeClamped.String())
+	assert.Equal(t, "unknown", EventType(-1).String())
+}
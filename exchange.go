@@ -0,0 +1,1816 @@
+package tsig
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bodgit/tsig/client"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+)
+
+// Resolver is the interface used to resolve the DNS server host name to the
+// addresses to try, it is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// IPAddrResolver is the interface a Resolver implements if it can return
+// structured addresses, it is also satisfied by *net.Resolver. It is used in
+// preference to LookupHost so the zone of an IPv6 link-local address, such
+// as "fe80::1%eth0", is always kept.
+type IPAddrResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// AddressFormatter is the interface an Exchanger implements if it needs the
+// address it is given for each attempt built from what the host resolves to
+// and the port differently, for example for a transport that doesn't use
+// "host:port" addresses.
+type AddressFormatter interface {
+	FormatAddress(addr, port string) string
+}
+
+// ContextExchanger is the interface a DNS client that obeys deadlines and
+// cancellation from a context is expected to implement.
+type ContextExchanger interface {
+	ExchangeContext(context.Context, *dns.Msg, string) (*dns.Msg, time.Duration, error)
+}
+
+// TSIGKey is an existing TSIG key used to sign a request.
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	Secret    string
+}
+
+// Validate checks the key can be used before it is sent anywhere. The name
+// must be a fully qualified domain name and the algorithm one of
+// SupportedAlgorithms. HMAC keys need a base64 encoded secret whereas GSS
+// keys are backed by a security context so the secret is expected to be
+// empty.
+// It returns a *TSIGKeyError for the first invalid field.
+func (k *TSIGKey) Validate() error {
+
+	if _, ok := dns.IsDomainName(k.Name); !ok || !dns.IsFqdn(k.Name) {
+		return &TSIGKeyError{Field: "Name", Reason: fmt.Sprintf("%q is not a fully qualified domain name", k.Name)}
+	}
+
+	supported := false
+	for _, algorithm := range SupportedAlgorithms() {
+		if strings.EqualFold(k.Algorithm, algorithm) {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return &TSIGKeyError{Field: "Algorithm", Reason: fmt.Sprintf("%q is not supported", k.Algorithm)}
+	}
+
+	if IsGSS(k.Algorithm) {
+		if k.Secret != "" {
+			return &TSIGKeyError{Field: "Secret", Reason: "must be empty for GSS"}
+		}
+		return nil
+	}
+
+	if k.Secret == "" {
+		return &TSIGKeyError{Field: "Secret", Reason: "is empty"}
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil {
+		return &TSIGKeyError{Field: "Secret", Reason: fmt.Sprintf("is not valid base64: %v", err)}
+	}
+
+	return nil
+}
+
+// Request describes a TKEY query to send to a DNS server.
+type Request struct {
+	// Host is the DNS server, optionally with a ":port" suffix
+	Host      string
+	KeyName   string
+	Algorithm string
+	Mode      uint16
+	Lifetime  uint32
+	// Input is the raw key data, for example the GSS token
+	Input []byte
+	// Extra is any additional DNS records to send, it must not include a
+	// TSIG record
+	Extra []dns.RR
+	// ExtraFirst places Extra before the TKEY record in the additional
+	// section rather than after it, for servers sensitive to the order
+	ExtraFirst bool
+	// TSIG optionally signs the request, it is ignored for GSS. The TSIG
+	// record is always the last record in the message as RFC 8945 requires.
+	// Its owner name is the name of the TSIG key which needn't be KeyName,
+	// a query for a new key can be signed with an existing one, but if the
+	// Name is empty it is KeyName as for a key deleting itself. A GSS
+	// context is only known by the key name it was negotiated with, the
+	// name of a GSS TSIG key must be that
+	TSIG *TSIGKey
+	// ID is the message Id to use, a random Id is generated if zero
+	ID uint16
+	// Correlation is an opaque value, such as a request or trace Id, that
+	// is echoed in the Response and in every Event of the exchange so it
+	// can be picked out of the logs of a larger system. If empty the value
+	// of the context is used, see ContextWithCorrelation
+	Correlation string
+}
+
+// Response is the result of a successful TKEY exchange.
+type Response struct {
+	TKEY *dns.TKEY
+	// KeyName is the name of the key chosen by the server which can differ
+	// from the requested name, any further messages must be signed with it
+	KeyName string
+	// Additional is any other DNS records in the answer section
+	Additional []dns.RR
+	// AdditionalDiscarded is how many of the other records were discarded
+	// for exceeding MaxAdditional or MaxAdditionalSize
+	AdditionalDiscarded int
+	// Msg is the complete response message
+	Msg *dns.Msg
+	// Address is the server address that answered
+	Address string
+	// TSIG reports whether the TSIG record of the response, if any, was
+	// verified
+	TSIG TSIGStatus
+	// KeepAlive is the RFC 7828 idle timeout the server set for the TCP
+	// connection, zero if it didn't set one
+	KeepAlive time.Duration
+	// OPT is the EDNS0 OPT record of the response, nil if there isn't
+	// one, so its flags such as the DO bit and its options such as the
+	// keepalive, extended DNS errors and cookies can be inspected in one
+	// place
+	OPT *dns.OPT
+	// Correlation is the Correlation of the request
+	Correlation string
+	// RequestedLifetime is the lifetime in seconds the request asked for
+	// and GrantedLifetime the window from inception to expiration the
+	// server granted, LifetimeClamped is set if that is shorter, such as
+	// when the server applies its own policy maximum, and an
+	// EventLifetimeClamped is emitted. It doesn't fail the exchange, see
+	// MinRemainingLifetime for that. They are only set for DH and GSS
+	// keys, the server giving no expiration isn't counted as clamping
+	RequestedLifetime, GrantedLifetime uint32
+	LifetimeClamped                    bool
+	// TKEYs is every TKEY answer in the response in order when the Client
+	// uses TKEYAll, otherwise it is nil
+	TKEYs []*dns.TKEY
+	// Timings is where the time went for the attempt that answered
+	Timings Timings
+	// TLS is the state of the TLS connection the response was received
+	// over when using DNS over TLS, such as the negotiated version and the
+	// certificates of the server, so callers can check it met their policy.
+	// It is nil for plain UDP or TCP and when a custom Exchanger sent the
+	// query. TLSConfig.MinVersion refuses older versions outright and
+	// TLSCipherSuites weaker cipher suites
+	TLS *tls.ConnectionState
+	// RequestSize and ResponseSize are the packed sizes in bytes of the
+	// query as sent and the response as received by the attempt that
+	// answered, for example to see how close they came to the UDP limit.
+	// They are zero when a custom Exchanger sent the query
+	RequestSize, ResponseSize int
+	// Transport is the network the query was sent over, such as "tcp", or
+	// the transport found to work when Net is NetAuto. It is empty when a
+	// custom Exchanger sent the query
+	Transport string
+	// Failures is each address that was tried and failed before Address
+	// answered, in the order they failed, so a degrading server is visible
+	// even though the exchange succeeded. It is nil if the first address
+	// answered
+	Failures []AttemptFailure
+}
+
+// AttemptFailure is an address that failed to answer during an exchange.
+type AttemptFailure struct {
+	Address string
+	Err     error
+}
+
+// Timings breaks down the time taken by an exchange. Dial is only known when
+// the Client does the dialing, with a custom Exchanger it is included in
+// Exchange.
+type Timings struct {
+	// Resolve is how long it took to resolve the server host name
+	Resolve time.Duration
+	// Dial is how long it took to connect to the server, including any TLS
+	// handshake
+	Dial time.Duration
+	// Exchange is how long it took to send the query and read the response
+	Exchange time.Duration
+}
+
+// TSIGStatus describes how far the response to an exchange is authenticated
+// by its TSIG record.
+type TSIGStatus int
+
+const (
+	// TSIGUnsigned means the response had no TSIG record
+	TSIGUnsigned TSIGStatus = iota
+	// TSIGVerified means the TSIG record of the response was verified
+	TSIGVerified
+	// TSIGIgnored means the response was signed with GSS but the TSIG
+	// record wasn't verified, as with IgnoreResponseTSIG, or with an
+	// algorithm in TsigAlgorithm that has no Verify callback
+	TSIGIgnored
+	// TSIGUnchecked means the response was signed but it was received by a
+	// custom Exchanger so whether it was verified is unknown
+	TSIGUnchecked
+)
+
+func (s TSIGStatus) String() string {
+
+	switch s {
+	case TSIGVerified:
+		return "verified"
+	case TSIGIgnored:
+		return "not verified (GSS ignore)"
+	case TSIGUnchecked:
+		return "not verified (custom exchanger)"
+	default:
+		return "unsigned"
+	}
+}
+
+// Client defines parameters for exchanging TKEY records with a DNS server.
+// The zero value is usable and sends queries over TCP, trying each address
+// the server host name resolves to in turn until one answers.
+type Client struct {
+	// Name, if set, tells this Client apart from any others in the same
+	// program. It is the Client of each Event emitted and the LabelName
+	// pprof label with ProfileLabels
+	Name string
+	// Net is the network to use, "tcp" if empty as TKEY queries can be in
+	// the range of ~ 1800 bytes. The address of each attempt is built from
+	// what the host resolves to and the port, "host:port" with any IPv6
+	// address in brackets for "udp", "tcp" and the "-tls" variants, and
+	// for "unix" the host resolves to the path of the socket, which is the
+	// address, and the port is ignored. An Exchanger that implements
+	// AddressFormatter builds the address itself. NetAuto probes whether
+	// each server accepts TCP or UDP and remembers the answer, see
+	// AutoTransports
+	Net string
+	// AutoTransports is the order transports are probed in when Net is
+	// NetAuto, DefaultAutoTransports if empty. The first the server answers
+	// over is cached for the host until it stops working, and is reported
+	// as Response.Transport. It only applies when the Client sends the
+	// queries itself rather than through an Exchanger
+	AutoTransports []string
+	// ProbeTimeout bounds each transport probed when Net is NetAuto so a
+	// transport that is silently dropped doesn't hold up the next,
+	// DefaultProbeTimeout if zero
+	ProbeTimeout time.Duration
+	// Timeout bounds the attempt against each individual address
+	Timeout time.Duration
+	// TotalTimeout bounds the whole exchange regardless of how many
+	// addresses are tried
+	TotalTimeout time.Duration
+	// Resolver is used to resolve the host, net.DefaultResolver if nil
+	Resolver Resolver
+	// Exchanger, if set, is used to send the queries instead of a DNS client
+	// configured by the Client. Timeouts are only enforced between
+	// attempts unless it also implements ContextExchanger
+	Exchanger Exchanger
+	// GSSResponseTSIG returns the TSIG algorithm and secret maps used when
+	// reading the response to a GSS TKEY query, IgnoreResponseTSIG is used
+	// if nil
+	GSSResponseTSIG func(keyname string) (map[string]*client.TsigAlgorithm, map[string]string)
+	// TsigAlgorithm and TsigSecret are merged into the maps the DNS client
+	// verifies the TSIG of each response with, those from GSSResponseTSIG
+	// for a GSS request or the TSIG key of any other, rather than replacing
+	// them. Their entries take precedence, so a server that answers with a
+	// different key or algorithm can be verified, or ignored with an
+	// algorithm that has no Verify callback. Algorithm and key names must be
+	// fully qualified, every algorithm must be non-nil and every secret
+	// either empty or base64. They are only used when the Client sends the
+	// queries itself rather than through an Exchanger
+	TsigAlgorithm map[string]*client.TsigAlgorithm
+	TsigSecret    map[string]string
+	// Nameserver is the recursive server used for discovery queries such as
+	// ServerForZone, the first server in /etc/resolv.conf is used if empty
+	Nameserver string
+	// SRVSelector orders the targets of the SRV records ServerForSRV finds,
+	// WeightedSRV is used if nil
+	SRVSelector SRVSelector
+	// ForbidAliasTargets makes ServerForSRV skip SRV targets that are a
+	// CNAME with an AliasError rather than following the alias
+	ForbidAliasTargets bool
+	// Strict enables strict RFC 3645 checking. In addition to the checks
+	// always made, (a successful response with exactly one TKEY answer with
+	// no error), the request must use the GSS algorithm and mode and the
+	// TKEY answer must:
+	//
+	//  * be owned by the requested key name
+	//  * use the GSS algorithm and mode
+	//  * have an expiration time later than its inception time
+	//  * not have expired already
+	//  * not have an inception time more than the fudge of 300 seconds in
+	//    the future
+	//
+	// The response must also not carry an EDNS0 OPT record unless the query
+	// did, RFC 6891 section 7, otherwise an unexpected OPT is kept in
+	// Response.OPT like any other
+	Strict bool
+	// RequireAuthentication refuses to send a query that isn't
+	// authenticated with ErrUnauthenticated rather than sending it in the
+	// clear. A query in GSS mode using a GSS algorithm is authenticated by
+	// the GSS token it carries; a query in any other mode, such as DH or
+	// delete, must be signed with the TSIG key of the request and so can't
+	// use a GSS algorithm as GSS requests are never signed
+	RequireAuthentication bool
+	// Times derives the inception and expiration times of each query,
+	// DefaultTimes is used if nil
+	Times TimesFunc
+	// MinLifetime is the shortest lifetime in seconds accepted for a DH or
+	// GSS request, DefaultMinLifetime is used if zero. Deletion requests
+	// have no lifetime so are never checked
+	MinLifetime uint32
+	// MinRemainingLifetime is the shortest time in seconds the key granted
+	// by a DH or GSS response must still be valid for, from the time the
+	// response is received, for example so that it outlasts a long batch
+	// of updates. A shorter grant is rejected with a LifetimeError, the
+	// caller can request a longer lifetime and try again. It isn't checked
+	// if zero
+	MinRemainingLifetime uint32
+	// ClockSkew is how far in the future the inception of the key granted
+	// by a TKEY answer, other than to a deletion, may be by the Client
+	// clock before the answer is rejected with a *KeyValidityError as the
+	// key couldn't be used yet. DefaultClockSkew is used if zero and it
+	// isn't checked if negative
+	ClockSkew time.Duration
+	// Now returns the current time used for the inception and expiration
+	// times, signing with TSIG and the strict checks, time.Now is used if
+	// nil. Fixing it makes the output of Pack stable
+	Now func() time.Time
+	// Parallel sends the query to every address the host resolves to at
+	// once rather than in turn. The first successful response wins and the
+	// remaining attempts are cancelled, the exchange returns once they have
+	// all finished. An Exchanger that doesn't implement ContextExchanger
+	// can't be cancelled so holds up the exchange until it completes
+	Parallel bool
+	// TLSConfig is used when Net is "tcp-tls", "tcp4-tls" or "tcp6-tls" for
+	// DNS over TLS
+	TLSConfig *tls.Config
+	// VerifyPeerCertificate, if set, is called during the TLS handshake to
+	// allow custom checks of the server certificate such as pinning, it
+	// replaces any VerifyPeerCertificate in TLSConfig. It runs after the
+	// standard verification, which still applies, unless InsecureSkipVerify
+	// is set in which case the hook is the only check made and it is called
+	// with no verified chains
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+	// TLSCipherSuites, if set, are the only cipher suites accepted for DNS
+	// over TLS, replacing any CipherSuites in TLSConfig, otherwise the
+	// defaults of the crypto/tls package apply. The TLS 1.3 suites can't
+	// be configured so the suite negotiated is also checked once the
+	// handshake is complete, a connection using any other suite is closed
+	// with a *CipherSuiteError before the query is sent
+	TLSCipherSuites []uint16
+	// RequireAuthoritative rejects any response without the AA bit set,
+	// which can indicate a caching or forwarding server in front of the
+	// authoritative one has interfered
+	RequireAuthoritative bool
+	// VerifyResponseTSIG rejects a successful answer to a query signed
+	// with the TSIG key of a non-GSS request with ErrResponseNotSigned if it
+	// has no TSIG record, otherwise an unsigned answer is accepted as the DNS
+	// client only verifies a TSIG record that is present
+	VerifyResponseTSIG bool
+	// CheckTKEYName rejects a response whose TKEY owner name doesn't match
+	// the key name of the query, which may indicate a confused or spoofed
+	// response, unless the mode is one of TKEYNameModes. Together with the
+	// check the DNS client makes that the response Id matches the query
+	// this guards against off-path spoofing over UDP
+	CheckTKEYName bool
+	// CheckTSIGName rejects a request signed with a TSIG key whose name
+	// isn't the key name of the query, for servers that require them to
+	// match, rather than sending a query the server will refuse
+	CheckTSIGName bool
+	// AllowModeChange accepts a TKEY answer using a different mode to the
+	// query, leaving the caller to handle the mode the server chose from
+	// the TKEY record of the response. By default it fails with a ModeError
+	AllowModeChange bool
+	// TKEYNameModes are the modes in which the server may choose a key name
+	// different to the query, DefaultTKEYNameModes is used if nil
+	TKEYNameModes []uint16
+	// TSIGSigner, if set, calculates the MAC of each query signed with the
+	// TSIG key in the request instead of HMAC, for example to use a key held
+	// elsewhere. The secret in the TSIG key is ignored
+	TSIGSigner client.TsigSigner
+	// TKEYSelection decides which TKEY answer is used when the response
+	// has more than one, by default it is an error. TKEYAll returns them
+	// all for the caller to choose from
+	TKEYSelection TKEYSelection
+	// AdditionalFunc, if set, is called in order with each record of the
+	// answer section other than the TKEY records once the response has
+	// passed every check, in place of collecting them in
+	// Response.Additional which is then nil. An error stops the calls and
+	// fails the exchange with it. It helps callers that process or filter a
+	// large number of records as they go rather than keeping a second slice
+	// of them, however it doesn't reduce peak memory otherwise, a DNS
+	// message is at most 64 KiB and is unpacked whole and kept in
+	// Response.Msg
+	AdditionalFunc func(rr dns.RR) error
+	// Cookie, if set, attaches an RFC 7873 DNS Cookie to each query and
+	// optionally validates the cookie in each response
+	Cookie *Cookie
+	// AddressOrder, if set, orders the addresses the host resolves to
+	// before they are tried and is told the outcome of each attempt, by
+	// default they are tried in the order the resolver returns them
+	AddressOrder AddressOrder
+	// MaxAddresses, if set, limits how many of the addresses the host
+	// resolves to are attempted, those first in the order set by
+	// AddressOrder, so a host resolving to a large pool doesn't have every
+	// address tried. Exchange fails with an AddressLimitError if none of
+	// them answer. It is unlimited by default
+	MaxAddresses int
+	// AllowedNetworks, if set, restricts the addresses the host resolves
+	// to that are attempted to those within one of the networks, guarding
+	// against resolution being manipulated to point at a rogue server.
+	// Other addresses are skipped before anything is dialed, and the host
+	// fails with a NotAllowedError if none remain
+	AllowedNetworks []*net.IPNet
+
+	// TCPKeepalive advertises RFC 7828 EDNS TCP keepalive in each query sent
+	// over TCP. The idle timeout the server returns is reported in the
+	// response and ExchangeBatch closes a connection before it lapses
+	// rather than reusing it
+	TCPKeepalive bool
+	// MaxConcurrency bounds how many exchanges for batches are in flight at
+	// once across every batch using the Client, so a large provisioning run
+	// doesn't overwhelm the server. DefaultMaxConcurrency is used if zero,
+	// so the limit passed to ExchangeBatch is capped at that even if
+	// MaxConcurrency was never set. It is read when the Client sends its
+	// first batch request, later changes are ignored
+	MaxConcurrency int
+	// FreshRetryID gives each attempt after the first a fresh random
+	// message Id, even if the request sets ID, so a middlebox caching
+	// responses by Id and question can't answer a retry against another
+	// address with a stale response. Each response must still match the
+	// Id of the query it answers
+	FreshRetryID bool
+	// MaxResponseSize is the largest response in bytes accepted over TCP,
+	// a larger one is rejected with a *client.MsgSizeError before it is
+	// read. Responses carrying large GSS tokens can approach the protocol
+	// limit of 65535 bytes which is all that applies if zero
+	MaxResponseSize int
+	// MaxAdditional and MaxAdditionalSize, if set, cap how many records of
+	// the answer section other than the TKEY records, and how many bytes
+	// of them uncompressed, are kept. Those past either cap are removed
+	// from the response, Response.Msg included so they can be freed, and
+	// counted in Response.AdditionalDiscarded while the TKEY is still
+	// returned. Unlike MaxResponseSize they don't fail the exchange. They
+	// are unlimited if zero
+	MaxAdditional, MaxAdditionalSize int
+	// ForceEDNS0 always adds an EDNS version 0 OPT record to the query
+	// even if no other EDNS feature needs one, some strict servers and
+	// middleboxes answer FORMERR without it. A request whose Extra RRs
+	// carry an OPT record of another version or more than one is rejected
+	ForceEDNS0 bool
+	// PreSend, if set, is called with each query once it is fully built,
+	// including any TSIG record, just before it is packed and sent, as an
+	// escape hatch for servers needing changes nothing else covers. The MAC
+	// is only calculated as the query is packed so it covers any change,
+	// however changing or removing the TSIG record itself can invalidate it
+	// and PreSend is then responsible for signing it again, for example with
+	// ResetTSIG. It is called for each attempt
+	PreSend func(*dns.Msg)
+	// ReadBufferSize and WriteBufferSize set the socket receive and send
+	// buffer sizes in bytes of each connection the Client dials, which can
+	// help throughput when large GSS tokens are exchanged frequently over
+	// TCP. The operating system defaults are used if zero
+	ReadBufferSize  int
+	WriteBufferSize int
+	// TCPNoDelay disables Nagle's algorithm on each TCP connection the
+	// Client dials so the small TKEY messages are sent without waiting. The
+	// Go runtime already does so for connections it dials, otherwise the
+	// system default is left alone, so this guarantees it for any dialer
+	TCPNoDelay bool
+	// Compress enables name compression in each query. Queries are sent
+	// uncompressed by default as some servers misparse a compressed TKEY or
+	// TSIG record
+	Compress bool
+	// CheckTSIGError rejects any response whose TSIG record carries an
+	// error with a TSIGError, even if the response code is NOERROR, rather
+	// than however the DNS client reacts to it, usually a failure to verify
+	// the empty MAC. A BADTIME error is still retried first, see
+	// BadTimeRetries
+	CheckTSIGError bool
+	// BadTimeRetries is how many times a query whose TSIG the server
+	// rejects as BADTIME is resent signed at the time of the server,
+	// DefaultBadTimeRetries is used if zero and it is never resent if
+	// negative. A query still rejected after the last retry fails with a
+	// TSIGError
+	BadTimeRetries int
+	// BadTimeJitter is the longest each BADTIME retry waits, for a random
+	// time, before it is sent, there is no wait if negative. It is ignored
+	// if Backoff is set and the Backoff is used if zero
+	BadTimeJitter time.Duration
+	// ResetRetries is how many times a query to an address is resent after
+	// the connection was reset or closed by the server before an answer,
+	// an io.EOF, io.ErrUnexpectedEOF or ECONNRESET error, before moving on
+	// to the next address. DefaultResetRetries is used if zero and it is
+	// never resent if negative. Connections given to ExchangeConn or used
+	// by batches are never retried
+	ResetRetries int
+	// Backoff decides how long each BADTIME and connection reset retry
+	// waits before it is sent, DefaultBackoff is used if nil
+	Backoff Backoff
+	// ErrorAggregator combines the errors when several attempts fail, such
+	// as each address, transport, SRV target or key of a batch, into the
+	// error returned, MultiErrorAggregator is used if nil. Errors returns
+	// the aggregated errors whichever is used, for each address they are
+	// an AddressError
+	ErrorAggregator ErrorAggregator
+	// Events, if set, is the stream the events of each exchange are
+	// emitted to, such as resolving the host and each query sent and
+	// response received, unless the context carries another, see
+	// ContextWithEvents
+	Events *EventStream
+	// AddressCacheTTL, if set, caches the addresses each host resolves to
+	// for that long, so a burst of exchanges with the same host resolves
+	// it once and keeps using the same addresses. Failed lookups aren't
+	// cached. See InvalidateAddresses
+	AddressCacheTTL time.Duration
+	// ProfileLabels runs the work of each exchange under the pprof labels
+	// LabelHost and LabelMode, including any goroutines it starts, so CPU
+	// and allocation profiles can be broken down by host and mode, for
+	// example with the -tagfocus option of go tool pprof or runtime/pprof
+	// Label within a custom handler
+	ProfileLabels bool
+
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	sem     chan struct{}
+	semOnce sync.Once
+
+	closeMu sync.RWMutex
+	closed  bool
+
+	cacheMu   sync.Mutex
+	addrCache map[string]cachedAddrs
+
+	transportCache map[string]string
+}
+
+// DefaultMinLifetime is the shortest lifetime in seconds a Client accepts
+// for a DH or GSS request unless MinLifetime is set, it only rejects a zero
+// lifetime which would create a key that has already expired.
+const DefaultMinLifetime = 1
+
+// DefaultClient is the Client used by ExchangeTKEY.
+var DefaultClient = &Client{}
+
+// formatAddress returns the address to send the query to for one of the
+// addresses the host resolved to, ex is the Exchanger that sends it.
+func (c *Client) formatAddress(ex Exchanger, addr, port string) string {
+
+	if f, ok := ex.(AddressFormatter); ok {
+		return f.FormatAddress(addr, port)
+	}
+
+	if strings.HasPrefix(c.Net, "unix") {
+		return addr
+	}
+
+	return net.JoinHostPort(addr, port)
+}
+
+func (c *Client) resolver() Resolver {
+
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+
+	return net.DefaultResolver
+}
+
+// IgnoreResponseTSIG returns the TSIG algorithm and secret maps that accept
+// the response to a GSS TKEY query without verifying its TSIG. The GSS and
+// LegacyGSS algorithms are registered with no callbacks and the key name with
+// an empty secret so the response TSIG is recognised but never checked.
+//
+// This mirrors nsupdate(1) which intentionally ignores the TSIG on the TKEY
+// response; the security context isn't usable to verify it until the token
+// it carries has been processed.
+func IgnoreResponseTSIG(keyname string) (map[string]*client.TsigAlgorithm, map[string]string) {
+
+	return map[string]*client.TsigAlgorithm{GSS: {Generate: nil, Verify: nil}, LegacyGSS: {Generate: nil, Verify: nil}}, map[string]string{keyname: ""}
+}
+
+func (c *Client) tlsConfig() *tls.Config {
+
+	if c.VerifyPeerCertificate == nil && c.TLSCipherSuites == nil {
+		return c.TLSConfig
+	}
+
+	config := new(tls.Config)
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	}
+	if c.VerifyPeerCertificate != nil {
+		config.VerifyPeerCertificate = c.VerifyPeerCertificate
+	}
+	if c.TLSCipherSuites != nil {
+		config.CipherSuites = append([]uint16(nil), c.TLSCipherSuites...)
+	}
+
+	return config
+}
+
+// verifyTLS returns the check made of each TLS connection once the handshake
+// is complete, nil if there isn't one.
+func (c *Client) verifyTLS() func(tls.ConnectionState) error {
+
+	if c.TLSCipherSuites == nil {
+		return nil
+	}
+
+	return func(state tls.ConnectionState) error {
+		for _, suite := range c.TLSCipherSuites {
+			if state.CipherSuite == suite {
+				return nil
+			}
+		}
+		return &CipherSuiteError{Version: state.Version, CipherSuite: state.CipherSuite}
+	}
+}
+
+func (c *Client) dnsClient(req *Request) *client.Client {
+
+	return c.dnsClientNet(req, c.network(req))
+}
+
+func (c *Client) dnsClientNet(req *Request, network string) *client.Client {
+
+	cl := &client.Client{}
+
+	cl.Net = network
+
+	if strings.HasSuffix(cl.Net, "-tls") {
+		cl.TLSConfig = c.tlsConfig()
+		cl.VerifyTLS = c.verifyTLS()
+	}
+
+	cl.MaxMsgSize = c.MaxResponseSize
+	cl.ReadBuffer = c.ReadBufferSize
+	cl.WriteBuffer = c.WriteBufferSize
+	cl.NoDelay = c.TCPNoDelay
+
+	cl.TsigAlgorithm, cl.TsigSecret = c.responseTSIG(req)
+
+	if !IsGSS(req.Algorithm) && req.TSIG != nil {
+		cl.TsigSigner = c.TSIGSigner
+	}
+
+	return cl
+}
+
+// responseTSIG returns the TSIG algorithm and secret maps the response to the
+// request is read with, TsigAlgorithm and TsigSecret merged over those of
+// GSSResponseTSIG for a GSS request or the TSIG key of any other.
+func (c *Client) responseTSIG(req *Request) (map[string]*client.TsigAlgorithm, map[string]string) {
+
+	var algorithms map[string]*client.TsigAlgorithm
+	var secrets map[string]string
+
+	if IsGSS(req.Algorithm) {
+		f := c.GSSResponseTSIG
+		if f == nil {
+			f = IgnoreResponseTSIG
+		}
+		algorithms, secrets = f(req.KeyName)
+	} else if req.TSIG != nil {
+		secrets = map[string]string{req.tsigName(): req.TSIG.Secret}
+	}
+
+	if len(c.TsigAlgorithm) > 0 {
+		merged := make(map[string]*client.TsigAlgorithm, len(algorithms)+len(c.TsigAlgorithm))
+		for name, algorithm := range algorithms {
+			merged[name] = algorithm
+		}
+		for name, algorithm := range c.TsigAlgorithm {
+			merged[name] = algorithm
+		}
+		algorithms = merged
+	}
+
+	if len(c.TsigSecret) > 0 {
+		merged := make(map[string]string, len(secrets)+len(c.TsigSecret))
+		for name, secret := range secrets {
+			merged[name] = secret
+		}
+		for name, secret := range c.TsigSecret {
+			merged[name] = secret
+		}
+		secrets = merged
+	}
+
+	return algorithms, secrets
+}
+
+// validateTSIGMaps checks TsigAlgorithm and TsigSecret.
+func (c *Client) validateTSIGMaps() error {
+
+	for name, algorithm := range c.TsigAlgorithm {
+		if !dns.IsFqdn(name) {
+			return fmt.Errorf("TsigAlgorithm name %q is not fully qualified", name)
+		}
+		if algorithm == nil {
+			return fmt.Errorf("TsigAlgorithm %s is nil", name)
+		}
+	}
+
+	for name, secret := range c.TsigSecret {
+		if !dns.IsFqdn(name) {
+			return fmt.Errorf("TsigSecret key name %q is not fully qualified", name)
+		}
+		if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+			return fmt.Errorf("TsigSecret for %s is not valid base64: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func newMsg(req *Request, times TimesFunc, now time.Time) (*dns.Msg, error) {
+
+	msg := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			RecursionDesired: false,
+		},
+		Question: make([]dns.Question, 1),
+	}
+
+	msg.Question[0] = dns.Question{
+		Name:   req.KeyName,
+		Qtype:  dns.TypeTKEY,
+		Qclass: dns.ClassANY,
+	}
+
+	msg.Id = req.ID
+	if msg.Id == 0 {
+		msg.Id = dns.Id()
+	}
+
+	if len(req.Input) > math.MaxUint16 {
+		return nil, fmt.Errorf("Key data of %d bytes exceeds the TKEY maximum of %d bytes", len(req.Input), math.MaxUint16)
+	}
+
+	inception, expiration, err := calculateTimesWith(times, req.Mode, now, req.Lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	tkey := &dns.TKEY{
+		Hdr: dns.RR_Header{
+			Name:   req.KeyName,
+			Rrtype: dns.TypeTKEY,
+			Class:  dns.ClassANY,
+			Ttl:    0,
+		},
+		Algorithm:  req.Algorithm,
+		Mode:       req.Mode,
+		Inception:  inception,
+		Expiration: expiration,
+		KeySize:    uint16(len(req.Input)),
+		Key:        EncodeTKEYKey(req.Input),
+	}
+
+	if err := validateTKEY(tkey, req.Input); err != nil {
+		return nil, err
+	}
+
+	for _, rr := range req.Extra {
+		if rr.Header().Rrtype == dns.TypeTSIG {
+			return nil, fmt.Errorf("Extra records must not include a TSIG record, it is added when the request is signed")
+		}
+	}
+
+	if req.ExtraFirst {
+		msg.Extra = append(msg.Extra, req.Extra...)
+		msg.Extra = append(msg.Extra, tkey)
+	} else {
+		msg.Extra = append(msg.Extra, tkey)
+		msg.Extra = append(msg.Extra, req.Extra...)
+	}
+
+	return msg, nil
+}
+
+// newMsg builds the query for the request, rejecting any request that isn't
+// RFC 3645 GSS negotiation if strict checking is enabled.
+func (c *Client) newMsg(req *Request) (*dns.Msg, error) {
+
+	if c.Strict && (strings.ToLower(req.Algorithm) != GSS || req.Mode != TkeyModeGSS) {
+		return nil, fmt.Errorf("Strict mode requires the %s algorithm and GSS mode", GSS)
+	}
+
+	if min := c.minLifetime(); (req.Mode == TkeyModeDH || req.Mode == TkeyModeGSS) && req.Lifetime < min {
+		return nil, fmt.Errorf("Lifetime of %d seconds is below the minimum of %d seconds", req.Lifetime, min)
+	}
+
+	if err := c.validateTSIGMaps(); err != nil {
+		return nil, err
+	}
+
+	if c.RequireAuthentication && !authenticated(req) {
+		return nil, ErrUnauthenticated
+	}
+
+	if c.CheckTSIGName && !IsGSS(req.Algorithm) && req.TSIG != nil && !strings.EqualFold(req.tsigName(), req.KeyName) {
+		return nil, fmt.Errorf("TSIG name %s does not match key name %s", req.tsigName(), req.KeyName)
+	}
+
+	msg, err := newMsg(req, c.Times, c.now())
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Compress = c.Compress
+
+	if c.Cookie != nil {
+		if err := c.Cookie.setCookie(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.keepaliveNet() {
+		setKeepalive(msg)
+	}
+
+	if c.ForceEDNS0 {
+		if err := forceEdns0(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+func (c *Client) minLifetime() uint32 {
+
+	if c.MinLifetime > 0 {
+		return c.MinLifetime
+	}
+
+	return DefaultMinLifetime
+}
+
+func (c *Client) now() time.Time {
+
+	if c.Now != nil {
+		return c.Now()
+	}
+
+	return time.Now()
+}
+
+// checkEDNS rejects a response with an OPT record to a query without one in
+// strict mode, RFC 6891 section 7.
+func (c *Client) checkEDNS(msg, rr *dns.Msg, address string) error {
+
+	if c.Strict && msg.IsEdns0() == nil && rr.IsEdns0() != nil {
+		return fmt.Errorf("Response from %s has an EDNS0 OPT record but the query did not", address)
+	}
+
+	return nil
+}
+
+// checkStrict applies the additional RFC 3645 checks of strict mode to the
+// TKEY answer, now is the current time.
+func checkStrict(req *Request, tkey *dns.TKEY, now time.Time) error {
+
+	if !strings.EqualFold(tkey.Hdr.Name, req.KeyName) {
+		return fmt.Errorf("TKEY name %s does not match %s", tkey.Hdr.Name, req.KeyName)
+	}
+
+	if strings.ToLower(tkey.Algorithm) != GSS {
+		return fmt.Errorf("TKEY algorithm %s is not %s", tkey.Algorithm, GSS)
+	}
+
+	if tkey.Mode != TkeyModeGSS {
+		return fmt.Errorf("TKEY mode %s is not %s", ModeString(tkey.Mode), ModeString(TkeyModeGSS))
+	}
+
+	inception := time.Unix(int64(tkey.Inception), 0)
+	expiration := time.Unix(int64(tkey.Expiration), 0)
+
+	if !expiration.After(inception) {
+		return fmt.Errorf("TKEY expiration %s is not after inception %s", expiration.UTC(), inception.UTC())
+	}
+
+	err := &KeyValidityError{
+		Inception:  inception,
+		Expiration: expiration,
+		Now:        now,
+		Skew:       lifetimeFudge,
+	}
+
+	if err.Expired() || err.NotYetValid() {
+		return err
+	}
+
+	return nil
+}
+
+// DefaultClockSkew is how far in the future the inception of a key granted
+// by a TKEY answer may be unless ClockSkew is set, the fudge queries are
+// signed with.
+const DefaultClockSkew = lifetimeFudge
+
+func (c *Client) clockSkew() time.Duration {
+
+	if c.ClockSkew != 0 {
+		return c.ClockSkew
+	}
+
+	return DefaultClockSkew
+}
+
+// checkInception checks the key granted by the TKEY answer is already valid,
+// allowing for the clock skew.
+// It returns a *KeyValidityError if it isn't.
+func checkInception(tkey *dns.TKEY, now time.Time, skew time.Duration) error {
+
+	err := &KeyValidityError{
+		Inception:  time.Unix(int64(tkey.Inception), 0),
+		Expiration: time.Unix(int64(tkey.Expiration), 0),
+		Now:        now,
+		Skew:       skew,
+	}
+
+	if err.NotYetValid() {
+		return err
+	}
+
+	return nil
+}
+
+// DefaultTKEYNameModes are the modes in which the server may choose a key
+// name different to the query unless TKEYNameModes is set. With server
+// assigned keying and Diffie-Hellman exchanged keying, RFC 2930 sections
+// 4.1 and 4.2, the server picks the name, and with GSS-API the server may
+// pick it in its first response, RFC 3645.
+var DefaultTKEYNameModes = []uint16{TkeyModeServer, TkeyModeDH, TkeyModeGSS}
+
+func (c *Client) tkeyNameMode(mode uint16) bool {
+
+	modes := c.TKEYNameModes
+	if modes == nil {
+		modes = DefaultTKEYNameModes
+	}
+
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRemaining checks the key granted by the TKEY answer is valid for at
+// least min seconds from now.
+func checkRemaining(tkey *dns.TKEY, now time.Time, min uint32) error {
+
+	expiration := time.Unix(int64(tkey.Expiration), 0)
+	minimum := time.Duration(min) * time.Second
+
+	if remaining := expiration.Sub(now); remaining < minimum {
+		return &LifetimeError{
+			Expiration: expiration,
+			Remaining:  remaining,
+			Minimum:    minimum,
+		}
+	}
+
+	return nil
+}
+
+// validateTKEY checks the key of an outgoing TKEY record is consistent with
+// the input it was built from so a malformed message is never sent.
+func validateTKEY(tkey *dns.TKEY, input []byte) error {
+
+	if int(tkey.KeySize) != len(input) {
+		return fmt.Errorf("Internal error: TKEY key size %d does not match key length %d", tkey.KeySize, len(input))
+	}
+
+	key, err := DecodeTKEYKey(tkey.Key)
+	if err != nil {
+		return fmt.Errorf("Internal error: %v", err)
+	}
+
+	if !bytes.Equal(key, input) {
+		return fmt.Errorf("Internal error: TKEY key does not match input")
+	}
+
+	return nil
+}
+
+// VerifyExchange checks a TKEY answer returned by a server has the wanted
+// mode and algorithm, names are compared canonically, and that its key and
+// other data agree with their sizes. It is meant for test suites checking
+// the behaviour of a server.
+// It returns an error listing each discrepancy, or nil if there are none.
+func VerifyExchange(tkey *dns.TKEY, wantMode uint16, wantAlgo string) error {
+
+	if tkey == nil {
+		return fmt.Errorf("No TKEY record")
+	}
+
+	var errs *multierror.Error
+
+	if tkey.Mode != wantMode {
+		errs = multierror.Append(errs, fmt.Errorf("TKEY mode %s is not %s", ModeString(tkey.Mode), ModeString(wantMode)))
+	}
+
+	if dns.CanonicalName(tkey.Algorithm) != dns.CanonicalName(wantAlgo) {
+		errs = multierror.Append(errs, fmt.Errorf("TKEY algorithm %s is not %s", tkey.Algorithm, wantAlgo))
+	}
+
+	if key, err := DecodeTKEYKey(tkey.Key); err != nil {
+		errs = multierror.Append(errs, err)
+	} else if int(tkey.KeySize) != len(key) {
+		errs = multierror.Append(errs, fmt.Errorf("TKEY key size %d does not match key length %d", tkey.KeySize, len(key)))
+	}
+
+	if other, err := hex.DecodeString(tkey.OtherData); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("TKEY other data is not valid hex: %v", err))
+	} else if int(tkey.OtherLen) != len(other) {
+		errs = multierror.Append(errs, fmt.Errorf("TKEY other size %d does not match other data length %d", tkey.OtherLen, len(other)))
+	}
+
+	if tkey.Error != 0 {
+		errs = multierror.Append(errs, &TKEYError{Code: tkey.Error})
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// Exchange sends the TKEY query described by the request to each address the
+// host resolves to until one answers.
+// It returns the response and any error that occurred.
+func (c *Client) Exchange(ctx context.Context, req *Request) (*Response, error) {
+
+	if err := c.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	var resp *Response
+	var err error
+
+	ctx = withCorrelation(ctx, req)
+
+	c.profile(ctx, req.Host, req.Mode, func(ctx context.Context) {
+		switch {
+		case c.Exchanger != nil:
+			resp, err = c.exchange(ctx, c.Exchanger, req)
+		case c.Net == NetAuto:
+			resp, err = c.exchangeAuto(ctx, req)
+		default:
+			resp, err = c.exchange(ctx, c.dnsClient(req), req)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// There's no telling what a custom Exchanger verified
+	if c.Exchanger != nil && resp.TSIG != TSIGUnsigned {
+		resp.TSIG = TSIGUnchecked
+	}
+
+	return resp, nil
+}
+
+func (c *Client) exchangeAddress(ctx context.Context, ex Exchanger, msg *dns.Msg, address string) (*dns.Msg, error) {
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var rr *dns.Msg
+	var err error
+
+	if cex, ok := ex.(ContextExchanger); ok {
+		rr, _, err = cex.ExchangeContext(ctx, msg, address)
+	} else {
+		rr, _, err = ex.Exchange(msg, address)
+	}
+
+	return rr, err
+}
+
+func (c *Client) exchange(ctx context.Context, ex Exchanger, req *Request) (*Response, error) {
+
+	hostname, port := SplitHostPort(req.Host)
+
+	msg, err := c.newMsg(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.TotalTimeout)
+		defer cancel()
+	}
+
+	addrs, resolve, err := c.lookupHost(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoAddresses, hostname)
+	}
+
+	addrs = c.orderAddresses(hostname, addrs)
+	addrs, limited := c.limitAddresses(addrs)
+
+	var rr *dns.Msg
+	var address string
+	var attempted []string
+	var failures []AttemptFailure
+	var info attemptInfo
+
+	if c.Parallel && len(addrs) > 1 {
+		rr, address, attempted, info, failures = c.exchangeParallel(ctx, ex, req, msg, addrs, port)
+	} else {
+		rr, address, attempted, info, failures = c.exchangeSerial(ctx, ex, req, msg, addrs, port)
+	}
+
+	if rr == nil {
+		errs := make([]error, 0, len(failures))
+		for _, f := range failures {
+			errs = append(errs, &AddressError{Host: hostname, Address: f.Address, Err: f.Err})
+		}
+		err := c.aggregate(errs)
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &TimeoutError{
+				Host:      hostname,
+				Addresses: attempted,
+				Err:       err,
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if limited {
+			return nil, &AddressLimitError{
+				Host:      hostname,
+				Limit:     c.MaxAddresses,
+				Addresses: attempted,
+				Err:       err,
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("%w for %s", ErrNoAddresses, hostname)
+		}
+		return nil, err
+	}
+
+	if err := c.checkCookie(msg, rr, address); err != nil {
+		return nil, err
+	}
+
+	if err := c.checkEDNS(msg, rr, address); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.newResponse(req, rr, address)
+	if err != nil {
+		return nil, err
+	}
+
+	c.emitClamped(ctx, resp)
+
+	info.timings.Resolve = resolve
+	resp.Timings = info.timings
+	resp.TLS = info.tls
+	resp.RequestSize, resp.ResponseSize = info.requestSize, info.responseSize
+	resp.Failures = failures
+
+	if cl, ok := ex.(*client.Client); ok {
+		resp.Transport = cl.Net
+	}
+
+	return resp, nil
+}
+
+// exchangeSerial tries each address in turn until one answers.
+func (c *Client) exchangeSerial(ctx context.Context, ex Exchanger, req *Request, msg *dns.Msg, addrs []string, port string) (*dns.Msg, string, []string, attemptInfo, []AttemptFailure) {
+
+	var failures []AttemptFailure
+
+	attempted := make([]string, 0, len(addrs))
+
+	for i, addr := range addrs {
+		if ctx.Err() != nil {
+			break
+		}
+
+		address := c.formatAddress(ex, addr, port)
+		attempted = append(attempted, address)
+
+		rr, info, err := c.exchangeSigned(ctx, ex, req, c.attemptMsg(msg, i), address, c.now())
+		if err == nil {
+			c.report(addr, nil)
+			return rr, address, attempted, info, failures
+		}
+
+		// Don't blame the address if the exchange as a whole was cancelled
+		if ctx.Err() == nil {
+			c.report(addr, err)
+		}
+
+		failures = append(failures, AttemptFailure{Address: address, Err: err})
+	}
+
+	return nil, "", attempted, attemptInfo{}, failures
+}
+
+// attemptMsg returns the message to send for the attempt against the i'th
+// address, which has a fresh Id if FreshRetryID is set and it isn't the
+// first attempt.
+func (c *Client) attemptMsg(msg *dns.Msg, i int) *dns.Msg {
+
+	if !c.FreshRetryID || i == 0 {
+		return msg
+	}
+
+	m := msg.Copy()
+	m.Id = dns.Id()
+
+	return m
+}
+
+// exchangeSigned signs a copy of the message at the given time and sends it
+// to the address, retrying if the server rejects the time or resets the
+// connection. Sending the message strips the TSIG RR however a failed attempt
+// may not have got that far so each attempt signs a fresh copy.
+// It returns the response, the time spent dialing and exchanging along with
+// any TLS connection state, and any error that occurred.
+func (c *Client) exchangeSigned(ctx context.Context, ex Exchanger, req *Request, msg *dns.Msg, address string, now time.Time) (*dns.Msg, attemptInfo, error) {
+
+	var info attemptInfo
+
+	send := func(now time.Time) (*dns.Msg, error) {
+		m := msg.Copy()
+		c.prepare(m, req, now)
+
+		var dial time.Duration
+		start := time.Now()
+
+		trace := client.WithDialTrace(ctx, func(d time.Duration) {
+			dial = d
+			c.emit(ctx, Event{
+				Type:     EventDial,
+				Address:  address,
+				Duration: d,
+			})
+		})
+		trace = client.WithTLSTrace(trace, func(state tls.ConnectionState) {
+			info.tls = &state
+		})
+		trace = client.WithSizeTrace(trace, func(request, response int) {
+			info.requestSize, info.responseSize = request, response
+		})
+
+		c.emitSend(ctx, m, address)
+
+		rr, err := c.exchangeAddress(trace, ex, m, address)
+
+		info.timings.Dial += dial
+		info.timings.Exchange += time.Since(start) - dial
+
+		c.emitReceive(ctx, rr, err, address, time.Since(start)-dial)
+
+		return rr, err
+	}
+
+	send = c.retryResets(ctx, send)
+
+	rr, err := send(now)
+	rr, err = c.retryAfterBadTime(ctx, rr, err, send)
+
+	if c.CheckTSIGError {
+		rr, err = checkTSIGError(rr, err)
+	}
+
+	return rr, info, err
+}
+
+// attemptInfo is what is known about an attempt besides its response.
+type attemptInfo struct {
+	timings                   Timings
+	tls                       *tls.ConnectionState
+	requestSize, responseSize int
+}
+
+// connTLS returns the TLS connection state of the connection, if it uses TLS.
+func connTLS(conn net.Conn) *tls.ConnectionState {
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+
+	return nil
+}
+
+// exchangeParallel tries every address at once, the first to answer wins and
+// the other attempts are cancelled.
+func (c *Client) exchangeParallel(ctx context.Context, ex Exchanger, req *Request, msg *dns.Msg, addrs []string, port string) (*dns.Msg, string, []string, attemptInfo, []AttemptFailure) {
+
+	type result struct {
+		rr      *dns.Msg
+		addr    string
+		address string
+		info    attemptInfo
+		err     error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	attempted := make([]string, 0, len(addrs))
+	results := make(chan result, len(addrs))
+
+	for i, addr := range addrs {
+		address := c.formatAddress(ex, addr, port)
+		attempted = append(attempted, address)
+
+		go func(addr string, msg *dns.Msg, now time.Time) {
+			rr, info, err := c.exchangeSigned(ctx, ex, req, msg, address, now)
+			results <- result{rr, addr, address, info, err}
+		}(addr, c.attemptMsg(msg, i), c.now())
+	}
+
+	var failures []AttemptFailure
+
+	// Wait for every attempt so none outlive the exchange, once there is a
+	// winner the rest are cancelled and their errors ignored
+	var winner *result
+	for range addrs {
+		r := <-results
+		switch {
+		case winner != nil:
+		case r.err == nil:
+			winner = &r
+			cancel()
+			c.report(r.addr, nil)
+		default:
+			if ctx.Err() == nil {
+				c.report(r.addr, r.err)
+			}
+			failures = append(failures, AttemptFailure{Address: r.address, Err: r.err})
+		}
+	}
+
+	if winner == nil {
+		return nil, "", attempted, attemptInfo{}, failures
+	}
+
+	return winner.rr, winner.address, attempted, winner.info, failures
+}
+
+// ExchangeConn sends the TKEY query described by the request over an existing
+// connection instead of resolving and dialing the host, which is ignored. The
+// connection is left open for the caller to reuse or close. The address in
+// the response is the remote address of the connection, if it has one.
+// It returns the response and any error that occurred.
+func (c *Client) ExchangeConn(ctx context.Context, conn net.Conn, req *Request) (*Response, error) {
+
+	if err := c.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	ctx = withCorrelation(ctx, req)
+
+	msg, err := c.newMsg(req)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	var rr *dns.Msg
+	var info attemptInfo
+
+	c.profile(ctx, remoteAddress(conn), req.Mode, func(ctx context.Context) {
+		rr, info, err = c.exchangeConn(ctx, conn, msg, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exchange := time.Since(start)
+
+	address := remoteAddress(conn)
+
+	if err := c.checkCookie(msg, rr, address); err != nil {
+		return nil, err
+	}
+
+	if err := c.checkEDNS(msg, rr, address); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.newResponse(req, rr, address)
+	if err != nil {
+		return nil, err
+	}
+
+	c.emitClamped(ctx, resp)
+
+	resp.Timings.Exchange = exchange
+	resp.TLS = connTLS(conn)
+	resp.RequestSize, resp.ResponseSize = info.requestSize, info.responseSize
+
+	return resp, nil
+}
+
+// exchangeConn signs and sends the message over the connection, retrying
+// once if the server rejects the time. Any error returned means the
+// connection has failed rather than the server rejecting the query. The
+// sizes of the last query and response are returned alongside.
+func (c *Client) exchangeConn(ctx context.Context, conn net.Conn, msg *dns.Msg, req *Request) (*dns.Msg, attemptInfo, error) {
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	co := new(client.Conn)
+	co.Conn.Conn = conn
+
+	dc := c.dnsClient(req)
+
+	var info attemptInfo
+
+	trace := client.WithSizeTrace(ctx, func(request, response int) {
+		info.requestSize, info.responseSize = request, response
+	})
+
+	address := remoteAddress(conn)
+
+	send := func(now time.Time) (*dns.Msg, error) {
+		m := msg.Copy()
+		c.prepare(m, req, now)
+		c.emitSend(ctx, m, address)
+		rr, rtt, err := dc.ExchangeWithConnContext(trace, m, co)
+		c.emitReceive(ctx, rr, err, address, rtt)
+		return rr, err
+	}
+
+	rr, err := send(c.now())
+	rr, err = c.retryAfterBadTime(ctx, rr, err, send)
+
+	if c.CheckTSIGError {
+		rr, err = checkTSIGError(rr, err)
+	}
+
+	return rr, info, err
+}
+
+func remoteAddress(conn net.Conn) string {
+
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+
+	return ""
+}
+
+// Pack returns the exact bytes that would be written to the wire for the
+// request, including the TSIG record as signed when it is sent. The message
+// Id is random unless the request sets ID and the TKEY times and any TSIG
+// record use the current time unless Now is set, golden tests should fix
+// both.
+// It returns the message bytes and any error that occurred.
+func (c *Client) Pack(req *Request) ([]byte, error) {
+
+	msg, err := c.newMsg(req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.prepare(msg, req, c.now())
+
+	if msg.IsTsig() == nil {
+		return msg.Pack()
+	}
+
+	var signer client.TsigSigner
+	switch {
+	case c.TSIGSigner != nil:
+		signer = c.TSIGSigner
+	case req.TSIG != nil:
+		signer = client.HmacSigner{Secret: req.TSIG.Secret}
+	default:
+		return nil, fmt.Errorf("Query has a TSIG record but there is no TSIGSigner or TSIG key to sign it with")
+	}
+
+	// This is what client.Conn.WriteMsg does
+	b, _, err := client.TsigGenerateWithSigner(msg, signer, "", false)
+
+	return b, err
+}
+
+// ResetTSIG removes any TSIG record from the message and signs it again with
+// the TSIG key of the request as of the Client clock, using the same fudge as
+// Exchange. Sending a message with a DNS client strips its TSIG record, and
+// a failed attempt may or may not have got that far, so this is needed
+// before each send when retrying the same message in a loop built on Pack,
+// a custom Exchanger or a DNS client used directly. GSS requests are never
+// signed so their messages are only stripped.
+func (c *Client) ResetTSIG(msg *dns.Msg, req *Request) {
+
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeTSIG {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+
+	sign(msg, req, c.now())
+}
+
+// prepare signs the query at the given time and then passes it to PreSend,
+// if set.
+func (c *Client) prepare(msg *dns.Msg, req *Request, now time.Time) {
+
+	sign(msg, req, now)
+
+	if c.PreSend != nil {
+		c.PreSend(msg)
+	}
+}
+
+// sign attaches a TSIG record for the key in the request signed at the given
+// time, if any. GSS requests are never signed.
+func sign(msg *dns.Msg, req *Request, now time.Time) {
+
+	if !IsGSS(req.Algorithm) && req.TSIG != nil {
+		msg.SetTsig(req.tsigName(), req.TSIG.Algorithm, 300, now.Unix())
+	}
+}
+
+// authenticated reports whether the query for the request is authenticated,
+// either by the GSS token of GSS negotiation or by being signed.
+func authenticated(req *Request) bool {
+
+	if IsGSS(req.Algorithm) {
+		return req.Mode == TkeyModeGSS
+	}
+
+	return req.TSIG != nil
+}
+
+// tsigName returns the owner name of the TSIG record signing the request,
+// an empty name is the key name.
+func (r *Request) tsigName() string {
+
+	if r.TSIG.Name == "" {
+		return r.KeyName
+	}
+
+	return r.TSIG.Name
+}
+
+func (c *Client) newResponse(req *Request, rr *dns.Msg, address string) (*Response, error) {
+
+	switch rr.Rcode {
+	case dns.RcodeFormatError, dns.RcodeNotImplemented:
+		return nil, &UnsupportedError{
+			Algorithm: req.Algorithm,
+			Mode:      req.Mode,
+			Rcode:     rr.Rcode,
+			Err:       dnsError(rr),
+		}
+	case dns.RcodeNameError:
+		return nil, &KeyNameError{
+			KeyName: req.KeyName,
+			Err:     dnsError(rr),
+		}
+	}
+
+	tkey, additional, err := parseResponse(rr, c.TKEYSelection)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only a successful answer is required to be authoritative so any error
+	// from the server is reported as such
+	if c.RequireAuthoritative && !rr.Authoritative {
+		return nil, fmt.Errorf("Response from %s is not authoritative", address)
+	}
+
+	if c.VerifyResponseTSIG && !IsGSS(req.Algorithm) && req.TSIG != nil && rr.IsTsig() == nil {
+		return nil, fmt.Errorf("%w from %s", ErrResponseNotSigned, address)
+	}
+
+	if !c.AllowModeChange && tkey.Mode != req.Mode {
+		return nil, &ModeError{Requested: req.Mode, Returned: tkey.Mode}
+	}
+
+	if c.CheckTKEYName && !c.tkeyNameMode(req.Mode) && !strings.EqualFold(tkey.Hdr.Name, req.KeyName) {
+		return nil, fmt.Errorf("TKEY name %s from %s does not match %s", tkey.Hdr.Name, address, req.KeyName)
+	}
+
+	if c.Strict {
+		if err := checkStrict(req, tkey, c.now()); err != nil {
+			return nil, err
+		}
+	}
+
+	// A deletion grants no key to check
+	if tkey.Mode != TkeyModeDelete && c.ClockSkew >= 0 {
+		if err := checkInception(tkey, c.now(), c.clockSkew()); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.MinRemainingLifetime > 0 && (req.Mode == TkeyModeDH || req.Mode == TkeyModeGSS) {
+		if err := checkRemaining(tkey, c.now(), c.MinRemainingLifetime); err != nil {
+			return nil, err
+		}
+	}
+
+	additional, discarded := c.capAdditional(rr, additional)
+
+	resp := &Response{
+		TKEY:                tkey,
+		KeyName:             tkey.Header().Name,
+		Additional:          additional,
+		AdditionalDiscarded: discarded,
+		Msg:                 rr,
+		Address:             address,
+		TSIG:                c.tsigStatus(req, rr),
+		KeepAlive:           keepalive(rr),
+		OPT:                 rr.IsEdns0(),
+		Correlation:         req.Correlation,
+	}
+
+	if req.Mode == TkeyModeDH || req.Mode == TkeyModeGSS {
+		resp.RequestedLifetime = req.Lifetime
+		resp.GrantedLifetime = grantedLifetime(tkey)
+		resp.LifetimeClamped = tkey.Expiration != 0 && resp.GrantedLifetime < req.Lifetime
+	}
+
+	if c.TKEYSelection == TKEYAll {
+		for _, ans := range rr.Answer {
+			if t, ok := ans.(*dns.TKEY); ok {
+				resp.TKEYs = append(resp.TKEYs, t)
+			}
+		}
+	}
+
+	if c.AdditionalFunc != nil {
+		resp.Additional = nil
+		for _, ans := range additional {
+			if err := c.AdditionalFunc(ans); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+// capAdditional keeps the records of the answer section other than the TKEY
+// records within MaxAdditional and MaxAdditionalSize, in order, removing the
+// rest from the message.
+// It returns the records kept and how many were discarded.
+func (c *Client) capAdditional(rr *dns.Msg, additional []dns.RR) ([]dns.RR, int) {
+
+	if c.MaxAdditional <= 0 && c.MaxAdditionalSize <= 0 {
+		return additional, 0
+	}
+
+	n, size := 0, 0
+	for ; n < len(additional); n++ {
+		if c.MaxAdditional > 0 && n >= c.MaxAdditional {
+			break
+		}
+		l := dns.Len(additional[n])
+		if c.MaxAdditionalSize > 0 && size+l > c.MaxAdditionalSize {
+			break
+		}
+		size += l
+	}
+
+	if n == len(additional) {
+		return additional, 0
+	}
+
+	// The other records are in the same order in the answer section
+	answer := make([]dns.RR, 0, len(rr.Answer)-len(additional)+n)
+	kept := 0
+	for _, ans := range rr.Answer {
+		if _, ok := ans.(*dns.TKEY); !ok {
+			if kept == n {
+				continue
+			}
+			kept++
+		}
+		answer = append(answer, ans)
+	}
+	rr.Answer = answer
+
+	return additional[:n:n], len(additional) - n
+}
+
+// tsigStatus works out what the DNS client did with the TSIG record of the
+// response, any verification failure has already been returned as an error.
+func (c *Client) tsigStatus(req *Request, rr *dns.Msg) TSIGStatus {
+
+	t := rr.IsTsig()
+	if t == nil {
+		return TSIGUnsigned
+	}
+
+	algorithms, _ := c.responseTSIG(req)
+	if a, ok := algorithms[t.Algorithm]; ok && a.Verify == nil {
+		return TSIGIgnored
+	}
+
+	return TSIGVerified
+}
+
+// TKEYSelection is the strategy for choosing the TKEY answer in a response
+// that nonconformingly has more than one.
+type TKEYSelection int
+
+const (
+	// TKEYStrict rejects a response with more than one TKEY answer
+	TKEYStrict TKEYSelection = iota
+	// TKEYFirst uses the first TKEY answer in the response
+	TKEYFirst
+	// TKEYLast uses the last TKEY answer in the response
+	TKEYLast
+	// TKEYAll returns every TKEY answer in Response.TKEYs for servers that
+	// offer several, for example one per algorithm. The caller is
+	// responsible for selecting one and checking it for errors, TKEY is the
+	// first answer and is the only one checked
+	TKEYAll
+)
+
+func parseResponse(rr *dns.Msg, selection TKEYSelection) (*dns.TKEY, []dns.RR, error) {
+
+	if rr.Rcode != dns.RcodeSuccess {
+		return nil, nil, dnsError(rr)
+	}
+
+	additional := []dns.RR{}
+
+	var tkey *dns.TKEY
+
+	for _, ans := range rr.Answer {
+		switch t := ans.(type) {
+		case *dns.TKEY:
+			switch {
+			case tkey == nil, selection == TKEYLast:
+				tkey = t
+			case selection == TKEYFirst, selection == TKEYAll:
+			default:
+				// There mustn't be more than one TKEY answer RR
+				return nil, nil, fmt.Errorf("Multiple TKEY responses")
+			}
+		default:
+			additional = append(additional, ans)
+		}
+	}
+
+	// There should always be at least a TKEY answer RR
+	if tkey == nil {
+		return nil, nil, fmt.Errorf("Received no TKEY response")
+	}
+
+	if tkey.Error != 0 {
+		// Don't let malformed OtherData mask the actual error
+		other, _ := hex.DecodeString(tkey.OtherData)
+		return nil, nil, &TKEYError{
+			Code:      tkey.Error,
+			OtherData: other,
+		}
+	}
+
+	return tkey, additional, nil
+}
@@ -0,0 +1,101 @@
+// +build go1.18
+
+package tsig
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fuzzSeeds returns packed responses covering the known good and bad cases.
+func fuzzSeeds(t testing.TB) [][]byte {
+
+	query := new(dns.Msg)
+	query.SetQuestion("test.example.com.", dns.TypeTKEY)
+	query.SetTsig("test.example.com.", dns.HmacMD5, 300, 1600000000)
+
+	good := tkeyReply(query, "test.example.com.")
+	good.Answer[0].(*dns.TKEY).Key = "deadbeef"
+	good.Answer[0].(*dns.TKEY).KeySize = 4
+	good.Answer[0].(*dns.TKEY).Expiration = 1600003600
+
+	tkeyError := tkeyReply(query, "test.example.com.")
+	tkeyError.Answer[0].(*dns.TKEY).Error = dns.RcodeBadKey
+	tkeyError.Answer[0].(*dns.TKEY).OtherData = "0102"
+	tkeyError.Answer[0].(*dns.TKEY).OtherLen = 2
+
+	multiple := tkeyReply(query, "test.example.com.")
+	multiple.Answer = append(multiple.Answer, multiple.Answer[0])
+
+	missing := new(dns.Msg)
+	missing.SetReply(query)
+
+	refused := new(dns.Msg)
+	refused.SetRcode(query, dns.RcodeRefused)
+
+	var seeds [][]byte
+	for _, m := range []*dns.Msg{good, tkeyError, multiple, missing, refused, badTimeReply(query, 1600000000, "00005f5e1000")} {
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds = append(seeds, b)
+	}
+
+	return seeds
+}
+
+func FuzzParseTKEYResponse(f *testing.F) {
+
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		rr := new(dns.Msg)
+		if err := rr.Unpack(b); err != nil {
+			return
+		}
+
+		for _, selection := range []TKEYSelection{TKEYStrict, TKEYFirst, TKEYLast, TKEYAll} {
+			tkey, _, err := parseResponse(rr, selection)
+			if err == nil && tkey == nil {
+				t.Fatalf("no error but no TKEY with selection %d", selection)
+			}
+		}
+
+		for _, client := range []*Client{{}, {Strict: true, CheckTKEYName: true, TKEYSelection: TKEYAll}} {
+			resp, err := client.newResponse(request, rr, "192.0.2.1:53")
+			if err == nil && (resp == nil || resp.TKEY == nil) {
+				t.Fatal("no error but no TKEY")
+			}
+		}
+
+		checkTSIGError(rr, nil)
+		serverTime(rr)
+		keepalive(rr)
+
+		if tkey, ok := firstTKEY(rr); ok {
+			VerifyExchange(tkey, TkeyModeGSS, GSS)
+		}
+	})
+}
+
+func firstTKEY(rr *dns.Msg) (*dns.TKEY, bool) {
+
+	for _, ans := range rr.Answer {
+		if tkey, ok := ans.(*dns.TKEY); ok {
+			return tkey, true
+		}
+	}
+
+	return nil, false
+}
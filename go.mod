@@ -3,11 +3,13 @@ module github.com/bodgit/tsig
 require (
 	github.com/alexbrainman/sspi v0.0.0-20180613141037-e580b900e9f5
 	github.com/enceve/crypto v0.0.0-20160707101852-34d48bb93815
-	github.com/hashicorp/go-multierror v1.0.0
+	github.com/hashicorp/go-multierror v1.1.1
+	github.com/jcmturner/gofork v1.0.0
 	github.com/jcmturner/gokrb5/v8 v8.4.1
 	github.com/miekg/dns v1.1.31
 	github.com/openshift/gssapi v0.0.0-20161010215902-5fb4217df13b
 	github.com/stretchr/testify v1.4.0
+	go.uber.org/goleak v1.1.10
 )
 
 go 1.13
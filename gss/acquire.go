@@ -0,0 +1,78 @@
+package gss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCredentialsTimeout is returned, wrapped with the timeout, when acquiring
+// credentials takes longer than the timeout set with WithCredentialsTimeout.
+// It points at the KDC, or whatever else the credentials come from, rather
+// than the DNS server which is reported with a tsig.TimeoutError.
+var ErrCredentialsTimeout = errors.New("timed out acquiring credentials")
+
+// WithCredentialsTimeout bounds acquiring the credentials to negotiate with,
+// such as reading a keytab and logging in to the KDC, separately from the
+// TKEY exchanges so a slow KDC fails with ErrCredentialsTimeout rather than
+// consuming the deadline of the whole negotiation. It applies to
+// AcquireCredentials and to each negotiation that has to acquire them. The
+// apcera implementation acquires credentials as part of initiating the
+// context so there it only applies to AcquireCredentials.
+func WithCredentialsTimeout(timeout time.Duration) Option {
+
+	return func(c *GSS) error {
+		if timeout < 0 {
+			return fmt.Errorf("credentials timeout must not be negative")
+		}
+		c.settings.credentialsTimeout = timeout
+		return nil
+	}
+}
+
+// acquireBounded runs acquire bounded by the timeout set with
+// WithCredentialsTimeout and the context. The GSS libraries can't be
+// interrupted so if either runs out acquire is left to finish in the
+// background, discard is then called to release what it acquired if it
+// succeeded.
+// It returns any error that occurred.
+func (c *GSS) acquireBounded(ctx context.Context, acquire func() error, discard func()) error {
+
+	timeout := c.settings.credentialsTimeout
+	if timeout == 0 && ctx.Done() == nil {
+		return acquire()
+	}
+
+	errc := make(chan error)
+	abandoned := make(chan struct{})
+
+	go func() {
+		err := acquire()
+		select {
+		case errc <- err:
+		case <-abandoned:
+			if err == nil && discard != nil {
+				discard()
+			}
+		}
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-expired:
+		close(abandoned)
+		return fmt.Errorf("%w after %v", ErrCredentialsTimeout, timeout)
+	case <-ctx.Done():
+		close(abandoned)
+		return ctx.Err()
+	}
+}
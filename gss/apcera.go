@@ -3,9 +3,10 @@
 package gss
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
@@ -15,18 +16,29 @@ import (
 	"github.com/openshift/gssapi"
 )
 
+// GSS-API supports the quality of protection of per-message tokens
+const qopSupported = true
+
+// Impersonation needs gss_acquire_cred_impersonate_name which isn't bound
+const impersonationSupported = false
+
 // GSS maps the TKEY name to the context that negotiated it as
 // well as any other internal state.
 type GSS struct {
-	m   sync.RWMutex
-	lib *gssapi.Lib
-	ctx map[string]*gssapi.CtxId
+	m        sync.RWMutex
+	lib      *gssapi.Lib
+	ctx      map[string]*gssapi.CtxId
+	settings settings
+	// cred is the current user's credential acquired by
+	// AcquireCredentials, valid until credExpiry
+	cred       *gssapi.CredId
+	credExpiry time.Time
 }
 
 // New performs any library initialization necessary.
 // It returns a context handle for any further functions along with any error
 // that occurred.
-func New() (*GSS, error) {
+func New(options ...Option) (*GSS, error) {
 
 	lib, err := gssapi.Load(nil)
 	if err != nil {
@@ -38,6 +50,10 @@ func New() (*GSS, error) {
 		ctx: make(map[string]*gssapi.CtxId),
 	}
 
+	if err := c.setOptions(options); err != nil {
+		return nil, multierror.Append(err, lib.Unload())
+	}
+
 	return c, nil
 }
 
@@ -46,7 +62,16 @@ func New() (*GSS, error) {
 // It returns any error that occurred.
 func (c *GSS) Close() error {
 
-	return multierror.Append(c.close(), c.lib.Unload())
+	errs := c.close()
+
+	c.m.Lock()
+	if c.cred != nil {
+		errs = multierror.Append(errs, c.cred.Release())
+		c.cred = nil
+	}
+	c.m.Unlock()
+
+	return multierror.Append(errs, c.lib.Unload())
 }
 
 // GenerateGSS generates the TSIG MAC based on the established context.
@@ -57,7 +82,7 @@ func (c *GSS) Close() error {
 // It returns the bytes for the TSIG MAC and any error that occurred.
 func (c *GSS) GenerateGSS(msg []byte, algorithm, name, secret string) ([]byte, error) {
 
-	if strings.ToLower(algorithm) != tsig.GSS {
+	if !tsig.IsGSS(algorithm) {
 		return nil, dns.ErrKeyAlg
 	}
 
@@ -75,7 +100,7 @@ func (c *GSS) GenerateGSS(msg []byte, algorithm, name, secret string) ([]byte, e
 	}
 	defer message.Release()
 
-	token, err := ctx.GetMIC(gssapi.GSS_C_QOP_DEFAULT, message)
+	token, err := ctx.GetMIC(gssapi.QOP(c.settings.qop), message)
 	if err != nil {
 		return nil, err
 	}
@@ -92,7 +117,7 @@ func (c *GSS) GenerateGSS(msg []byte, algorithm, name, secret string) ([]byte, e
 // It returns any error that occurred.
 func (c *GSS) VerifyGSS(stripped []byte, t *dns.TSIG, name, secret string) error {
 
-	if strings.ToLower(t.Algorithm) != tsig.GSS {
+	if !tsig.IsGSS(t.Algorithm) {
 		return dns.ErrKeyAlg
 	}
 
@@ -138,40 +163,59 @@ func (c *GSS) VerifyGSS(stripped []byte, t *dns.TSIG, name, secret string) error
 // occurred.
 func (c *GSS) NegotiateContext(host string) (*string, *time.Time, error) {
 
+	return c.negotiateWith(context.Background(), host, nil)
+}
+
+func (c *GSS) negotiateCurrentUser(ctx context.Context, host string) (*string, *time.Time, error) {
+
 	hostname, _ := tsig.SplitHostPort(host)
 
 	keyname := generateTKEYName(hostname)
 
 	buffer, err := c.lib.MakeBufferString(generateSPN(hostname))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, gssError(err)
 	}
 	defer buffer.Release()
 
 	service, err := buffer.Name(c.lib.GSS_KRB5_NT_PRINCIPAL_NAME)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, gssError(err)
 	}
 
 	var input *gssapi.Buffer
-	var ctx *gssapi.CtxId
+	var secctx *gssapi.CtxId
 	var tkey *dns.TKEY
 
-	for ok := true; ok; ok = c.lib.LastStatus.Major.ContinueNeeded() {
-		nctx, _, output, _, _, err := c.lib.InitSecContext(
-			c.lib.GSS_C_NO_CREDENTIAL,
-			ctx, // nil initially
+	var flags uint32
+
+	id := c.messageID()
+	algorithm := c.algorithm()
+	empty := c.emptyTokens()
+
+	cred := c.credential()
+
+	requested := uint32(gssapi.GSS_C_REPLAY_FLAG | gssapi.GSS_C_INTEG_FLAG)
+	if !c.settings.optionalMutual {
+		requested |= gssapi.GSS_C_MUTUAL_FLAG
+	}
+
+	for ok, round := true, 0; ok; ok, round = c.lib.LastStatus.Major.ContinueNeeded(), round+1 {
+		nctx, _, output, ret, _, err := c.lib.InitSecContext(
+			cred,
+			secctx, // nil initially
 			service,
 			c.lib.GSS_C_NO_OID,
-			gssapi.GSS_C_MUTUAL_FLAG|gssapi.GSS_C_REPLAY_FLAG|gssapi.GSS_C_INTEG_FLAG,
+			requested,
 			0,
 			c.lib.GSS_C_NO_CHANNEL_BINDINGS,
 			input)
 		defer output.Release()
-		ctx = nctx
+		secctx = nctx
+		flags = ret
 		if err != nil {
 			if !c.lib.LastStatus.Major.ContinueNeeded() {
-				return nil, nil, err
+				return nil, nil, gssError(err)
 			}
 		} else {
 			// There is no further token to send
@@ -179,47 +223,162 @@ func (c *GSS) NegotiateContext(host string) (*string, *time.Time, error) {
 		}
 
 		var errs error
+		var key []byte
 
-		// We don't care about non-TKEY answers, no additional RR's to send, and no signing
-		tkey, _, err = tsig.ExchangeTKEY(host, keyname, tsig.GSS, tsig.TkeyModeGSS, 3600, output.Bytes(), nil, nil, nil, nil)
+		tkey, key, err = c.exchange(ctx, host, keyname, algorithm, id, round, output.Bytes())
 		if err != nil {
 			errs = multierror.Append(errs, err)
-			errs = multierror.Append(errs, ctx.DeleteSecContext())
+			errs = multierror.Append(errs, secctx.DeleteSecContext())
 			return nil, nil, errs
 		}
 
-		if tkey.Header().Name != keyname {
-			errs = multierror.Append(errs, fmt.Errorf("TKEY name does not match"))
-			errs = multierror.Append(errs, ctx.DeleteSecContext())
-			return nil, nil, errs
-		}
+		keyname = tkey.Header().Name
+		algorithm = tkey.Algorithm
 
-		key, err := hex.DecodeString(tkey.Key)
-		if err != nil {
+		if err = empty.check(key); err != nil {
 			errs = multierror.Append(errs, err)
-			errs = multierror.Append(errs, ctx.DeleteSecContext())
+			errs = multierror.Append(errs, secctx.DeleteSecContext())
 			return nil, nil, errs
 		}
 
 		input, err = c.lib.MakeBufferBytes(key)
 		if err != nil {
 			errs = multierror.Append(errs, err)
-			errs = multierror.Append(errs, ctx.DeleteSecContext())
+			errs = multierror.Append(errs, secctx.DeleteSecContext())
 			return nil, nil, errs
 		}
 		defer input.Release()
 	}
 
+	if !c.settings.optionalMutual && flags&gssapi.GSS_C_MUTUAL_FLAG == 0 {
+		if err := secctx.DeleteSecContext(); err != nil {
+			return nil, nil, multierror.Append(ErrMutualAuth, err)
+		}
+		return nil, nil, ErrMutualAuth
+	}
+
+	// Kerberos only completes mutual authentication if the server holds
+	// the key of the requested principal
+	principal := generateSPN(hostname)
+	if err := c.checkServer(principal, flags&gssapi.GSS_C_MUTUAL_FLAG != 0); err != nil {
+		if derr := secctx.DeleteSecContext(); derr != nil {
+			return nil, nil, multierror.Append(err, derr)
+		}
+		return nil, nil, err
+	}
+
 	expiry := time.Unix(int64(tkey.Expiration), 0)
 
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	c.ctx[keyname] = ctx
+	c.settings.algorithms.Store(keyname, algorithm)
+	c.settings.flags.Store(keyname, Flags(flags)&(FlagMutual|FlagReplay|FlagSequence|FlagConf|FlagInteg))
+	c.settings.servers.Store(keyname, principal)
+	c.established(keyname, expiry)
+	c.ctx[keyname] = secctx
 
 	return &keyname, &expiry, nil
 }
 
+// gssError wraps a failed GSS-API call in a GSSError with the status the
+// library reported, the library describes both in the text of its error.
+func gssError(err error) error {
+
+	e := &GSSError{
+		Major: MajorFailure,
+		Err:   err,
+	}
+
+	var gerr *gssapi.Error
+	if errors.As(err, &gerr) {
+		e.Major = uint32(gerr.Major)
+		e.Minor = uint32(gerr.Minor)
+	}
+
+	e.MajorText = majorText(e.Major)
+
+	return e
+}
+
+func (c *GSS) acquireCredentials(host string, credentials *Credentials) error {
+
+	if credentials != nil {
+		return fmt.Errorf("not supported")
+	}
+
+	cred, mechs, lifetime, err := c.lib.AcquireCred(c.lib.GSS_C_NO_NAME(), 0, c.lib.GSS_C_NO_OID_SET, gssapi.GSS_C_INITIATE)
+	if err != nil {
+		return gssError(err)
+	}
+	defer mechs.Release()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// Another goroutine got there first
+	if c.cred != nil && c.now().Before(c.credExpiry) {
+		return cred.Release()
+	}
+
+	old := c.cred
+	c.cred = cred
+	c.credExpiry = c.now().Add(lifetime)
+
+	if old != nil {
+		return old.Release()
+	}
+
+	return nil
+}
+
+// validateCredentials acquires the default credentials of the current user
+// from the library, it can't tell the principal they are for.
+func (c *GSS) validateCredentials(credentials *Credentials) (*CredentialsInfo, error) {
+
+	if credentials != nil {
+		return nil, fmt.Errorf("not supported")
+	}
+
+	cred, mechs, lifetime, err := c.lib.AcquireCred(c.lib.GSS_C_NO_NAME(), 0, c.lib.GSS_C_NO_OID_SET, gssapi.GSS_C_INITIATE)
+	if err != nil {
+		return nil, gssError(err)
+	}
+	defer mechs.Release()
+	defer cred.Release()
+
+	return &CredentialsInfo{
+		Expiry: c.now().Add(lifetime),
+	}, nil
+}
+
+// credential returns the credential to initiate a context with. That
+// acquired by AcquireCredentials is used if there is one, it is acquired
+// again once it expires, otherwise the library picks the default.
+func (c *GSS) credential() *gssapi.CredId {
+
+	c.m.RLock()
+	cred, expiry := c.cred, c.credExpiry
+	c.m.RUnlock()
+
+	if cred == nil {
+		return c.lib.GSS_C_NO_CREDENTIAL
+	}
+
+	if c.now().Before(expiry) {
+		return cred
+	}
+
+	if err := c.acquireCredentials("", nil); err != nil {
+		return c.lib.GSS_C_NO_CREDENTIAL
+	}
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	return c.cred
+}
+
 // NegotiateContextWithCredentials exchanges RFC 2930 TKEY records with the
 // indicated DNS server to establish a security context using the provided
 // credentials.
@@ -227,6 +386,15 @@ func (c *GSS) NegotiateContext(host string) (*string, *time.Time, error) {
 // occurred.
 func (c *GSS) NegotiateContextWithCredentials(host, domain, username, password string) (*string, *time.Time, error) {
 
+	return c.negotiateWith(context.Background(), host, &Credentials{
+		Domain:   domain,
+		Username: username,
+		Password: password,
+	})
+}
+
+func (c *GSS) negotiateWithCredentials(ctx context.Context, host, domain, username, password string) (*string, *time.Time, error) {
+
 	return nil, nil, fmt.Errorf("not supported")
 }
 
@@ -237,6 +405,15 @@ func (c *GSS) NegotiateContextWithCredentials(host, domain, username, password s
 // occurred.
 func (c *GSS) NegotiateContextWithKeytab(host, domain, username, path string) (*string, *time.Time, error) {
 
+	return c.negotiateWith(context.Background(), host, &Credentials{
+		Domain:   domain,
+		Username: username,
+		Keytab:   path,
+	})
+}
+
+func (c *GSS) negotiateWithKeytab(ctx context.Context, host, domain, username, path string) (*string, *time.Time, error) {
+
 	return nil, nil, fmt.Errorf("not supported")
 }
 
@@ -259,6 +436,7 @@ func (c *GSS) DeleteContext(keyname *string) error {
 	}
 
 	delete(c.ctx, *keyname)
+	c.forget(*keyname)
 
 	return nil
 }
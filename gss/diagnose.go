@@ -0,0 +1,47 @@
+package gss
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bodgit/tsig"
+)
+
+// CheckCredentials is the name of the check of the GSS credentials made by
+// Diagnose.
+const CheckCredentials = "credentials"
+
+// Diagnose makes the checks of tsig.Client.Diagnose against the indicated
+// DNS server with tsig.DefaultClient, which negotiation uses, followed by a
+// check that the credentials NegotiateGSS would use with the context can be
+// acquired, see AcquireCredentials, whose hint is that of any GSSError. The
+// key is only used for the clock skew check and may be nil.
+// It returns the report.
+func (c *GSS) Diagnose(ctx context.Context, host string, key *tsig.TSIGKey) *tsig.Report {
+
+	report := tsig.DefaultClient.Diagnose(ctx, host, key)
+
+	credentials := c.credentials(ctx)
+
+	check := tsig.Check{
+		Name:   CheckCredentials,
+		Status: tsig.StatusPass,
+		Detail: "Acquired credentials for " + credentials.Principal(),
+	}
+
+	if err := c.AcquireCredentials(ctx, host); err != nil {
+		check.Status = tsig.StatusFail
+		check.Detail = "Couldn't acquire credentials for " + credentials.Principal()
+		check.Hint = "Check the KDC is reachable and the credentials are valid, for the current user that kinit has been run"
+		check.Err = err
+
+		var gerr *GSSError
+		if errors.As(err, &gerr) && gerr.Hint() != "" {
+			check.Hint = gerr.Hint()
+		}
+	}
+
+	report.Add(check)
+
+	return report
+}
@@ -0,0 +1,80 @@
+package gss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bodgit/tsig"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+)
+
+// Principal returns the user principal name of the credentials,
+// "username@DOMAIN", or "current user" for nil.
+func (c *Credentials) Principal() string {
+
+	if c == nil {
+		return "current user"
+	}
+
+	return c.Username + "@" + c.Domain
+}
+
+// NegotiateFallback negotiates a security context with the indicated DNS
+// server as NegotiateGSS does, trying each of the credentials in order, nil
+// meaning the current user, until one succeeds, for example a service
+// account followed by the machine account. It only moves on to the next
+// after an authentication failure, a GSSError, ErrCredentialsTimeout or the
+// server refusing the context with BADKEY or BADSIG; anything else, such as
+// the server being unreachable, is returned straight away as the next
+// credentials would fare no better. It makes at most one attempt with each
+// and stops early if the context is done.
+// It returns the negotiated TKEY name, expiration time, the credentials that
+// succeeded and any error that occurred, aggregating the failure of each
+// credentials tried.
+func (c *GSS) NegotiateFallback(ctx context.Context, host string, credentials ...*Credentials) (*string, *time.Time, *Credentials, error) {
+
+	if len(credentials) == 0 {
+		return nil, nil, nil, fmt.Errorf("no credentials to negotiate with")
+	}
+
+	var errs error
+
+	for _, creds := range credentials {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, multierror.Append(errs, err)
+		}
+
+		keyname, expiry, err := c.negotiateWith(ctx, host, creds)
+		if err == nil {
+			return keyname, expiry, creds, nil
+		}
+
+		errs = multierror.Append(errs, fmt.Errorf("%s: %w", creds.Principal(), err))
+
+		if !authFailure(err) {
+			break
+		}
+	}
+
+	return nil, nil, nil, errs
+}
+
+// authFailure reports whether negotiation failed because of the credentials,
+// so that others could succeed.
+func authFailure(err error) bool {
+
+	var gerr *GSSError
+	var terr *tsig.TKEYError
+
+	switch {
+	case errors.As(err, &gerr), errors.Is(err, ErrCredentialsTimeout):
+		return true
+	case errors.As(err, &terr):
+		return terr.Code == dns.RcodeBadKey || terr.Code == dns.RcodeBadSig
+	default:
+		return false
+	}
+}
@@ -3,10 +3,14 @@
 package gss
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"os/user"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,7 +21,9 @@ import (
 	"github.com/jcmturner/gokrb5/v8/credentials"
 	"github.com/jcmturner/gokrb5/v8/crypto"
 	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
 	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
 	"github.com/jcmturner/gokrb5/v8/keytab"
 	"github.com/jcmturner/gokrb5/v8/messages"
 	"github.com/jcmturner/gokrb5/v8/spnego"
@@ -25,25 +31,45 @@ import (
 	"github.com/miekg/dns"
 )
 
-type context struct {
+// The MIC tokens of RFC 4121 have no quality of protection
+const qopSupported = false
+
+// Impersonation is implemented with S4U2Self and S4U2Proxy exchanges
+const impersonationSupported = true
+
+type gssContext struct {
 	client *client.Client
+	// shared is set if the client was cached by AcquireCredentials and so
+	// outlives the context
+	shared bool
 	key    types.EncryptionKey
+	// subkey is set if key is the acceptor subkey from the AP-REP rather
+	// than the session key
+	subkey bool
 }
 
 // GSS maps the TKEY name to the context that negotiated it as
 // well as any other internal state.
 type GSS struct {
-	m   sync.RWMutex
-	ctx map[string]context
+	m        sync.RWMutex
+	ctx      map[string]gssContext
+	settings settings
+	// clients caches the clients acquired by AcquireCredentials
+	clients map[Credentials]*client.Client
 }
 
 // New performs any library initialization necessary.
 // It returns a context handle for any further functions along with any error
 // that occurred.
-func New() (*GSS, error) {
+func New(options ...Option) (*GSS, error) {
 
 	c := &GSS{
-		ctx: make(map[string]context),
+		ctx:     make(map[string]gssContext),
+		clients: make(map[Credentials]*client.Client),
+	}
+
+	if err := c.setOptions(options); err != nil {
+		return nil, err
 	}
 
 	return c, nil
@@ -54,7 +80,17 @@ func New() (*GSS, error) {
 // It returns any error that occurred.
 func (c *GSS) Close() error {
 
-	return c.close()
+	err := c.close()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for key, cl := range c.clients {
+		cl.Destroy()
+		delete(c.clients, key)
+	}
+
+	return err
 }
 
 // GenerateGSS generates the TSIG MAC based on the established context.
@@ -65,7 +101,7 @@ func (c *GSS) Close() error {
 // It returns the bytes for the TSIG MAC and any error that occurred.
 func (c *GSS) GenerateGSS(msg []byte, algorithm, name, secret string) ([]byte, error) {
 
-	if strings.ToLower(algorithm) != tsig.GSS {
+	if !tsig.IsGSS(algorithm) {
 		return nil, dns.ErrKeyAlg
 	}
 
@@ -78,10 +114,12 @@ func (c *GSS) GenerateGSS(msg []byte, algorithm, name, secret string) ([]byte, e
 	}
 
 	token := gssapi.MICToken{
-		Flags:     gssapi.MICTokenFlagAcceptorSubkey,
 		SndSeqNum: 0,
 		Payload:   msg,
 	}
+	if ctx.subkey {
+		token.Flags = gssapi.MICTokenFlagAcceptorSubkey
+	}
 
 	if err := token.SetChecksum(ctx.key, keyusage.GSSAPI_INITIATOR_SIGN); err != nil {
 		return nil, err
@@ -103,7 +141,7 @@ func (c *GSS) GenerateGSS(msg []byte, algorithm, name, secret string) ([]byte, e
 // It returns any error that occurred.
 func (c *GSS) VerifyGSS(stripped []byte, t *dns.TSIG, name, secret string) error {
 
-	if strings.ToLower(t.Algorithm) != tsig.GSS {
+	if !tsig.IsGSS(t.Algorithm) {
 		return dns.ErrKeyAlg
 	}
 
@@ -136,80 +174,160 @@ func (c *GSS) VerifyGSS(stripped []byte, t *dns.TSIG, name, secret string) error
 	return nil
 }
 
-func (c *GSS) negotiateContext(host string, cl *client.Client) (*string, *time.Time, error) {
+func (c *GSS) negotiateContext(ctx context.Context, host string, cl *client.Client, shared bool) (*string, *time.Time, error) {
 
 	hostname, _ := tsig.SplitHostPort(host)
 
 	keyname := generateTKEYName(hostname)
 
-	tkt, key, err := cl.GetServiceTicket(generateSPN(hostname))
+	var (
+		tkt  messages.Ticket
+		key  types.EncryptionKey
+		apcl = cl
+		err  error
+	)
+
+	if c.settings.impersonate != "" {
+		tkt, key, apcl, err = impersonate(cl, generateSPN(hostname), c.settings.impersonate)
+	} else {
+		tkt, key, err = cl.GetServiceTicket(generateSPN(hostname))
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, realmError(cl.Credentials.Domain(), gssError(MajorFailure, err))
+	}
+
+	principal := tkt.SName.PrincipalNameString() + "@" + tkt.Realm
+
+	var options []int
+	if !c.settings.optionalMutual {
+		options = append(options, gssapi.ContextFlagMutual)
 	}
 
-	apreq, err := spnego.NewKRB5TokenAPREQ(cl, tkt, key, []int{gssapi.ContextFlagInteg}, []int{gssapi.ContextFlagMutual})
+	apreq, err := spnego.NewKRB5TokenAPREQ(apcl, tkt, key, []int{gssapi.ContextFlagInteg}, options)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, gssError(MajorFailure, err)
 	}
 
 	b, err := apreq.Marshal()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, gssError(MajorFailure, err)
 	}
 
-	// We don't care about non-TKEY answers, no additional RR's to send, and no signing
-	tkey, _, err := tsig.ExchangeTKEY(host, keyname, tsig.GSS, tsig.TkeyModeGSS, 3600, b, nil, nil, nil, nil)
+	tkey, b, err := c.exchange(ctx, host, keyname, c.algorithm(), c.messageID(), 0, b)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if tkey.Header().Name != keyname {
-		return nil, nil, fmt.Errorf("TKEY name does not match")
-	}
+	keyname = tkey.Header().Name
 
-	b, err = hex.DecodeString(tkey.Key)
-	if err != nil {
-		return nil, nil, err
+	expiry := time.Unix(int64(tkey.Expiration), 0)
+
+	// Without mutual authentication the server needn't send an AP-REP and
+	// the session key is used instead
+	if len(b) == 0 {
+		if !c.settings.optionalMutual {
+			return nil, nil, ErrMutualAuth
+		}
+
+		if err := c.checkServer(principal, false); err != nil {
+			return nil, nil, err
+		}
+
+		c.m.Lock()
+		defer c.m.Unlock()
+
+		c.settings.algorithms.Store(keyname, tkey.Algorithm)
+		c.settings.flags.Store(keyname, FlagInteg)
+		c.settings.servers.Store(keyname, principal)
+		c.established(keyname, expiry)
+		c.ctx[keyname] = gssContext{
+			client: cl,
+			shared: shared,
+			key:    key,
+		}
+
+		return &keyname, &expiry, nil
 	}
 
 	var aprep spnego.KRB5Token
 	err = aprep.Unmarshal(b)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, gssError(MajorDefectiveToken, err)
 	}
 
 	if aprep.IsKRBError() {
-		return nil, nil, fmt.Errorf("received Kerberos error")
+		return nil, nil, gssError(MajorFailure, aprep.KRBError)
 	}
 
 	if !aprep.IsAPRep() {
-		return nil, nil, fmt.Errorf("didn't receive an AP_REP")
+		return nil, nil, gssError(MajorDefectiveToken, fmt.Errorf("didn't receive an AP_REP"))
 	}
 
 	b, err = crypto.DecryptEncPart(aprep.APRep.EncPart, key, keyusage.AP_REP_ENCPART)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, gssError(MajorDefectiveToken, err)
 	}
 
 	var payload messages.EncAPRepPart
 	err = payload.Unmarshal(b)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, gssError(MajorDefectiveToken, err)
 	}
 
-	expiry := time.Unix(int64(tkey.Expiration), 0)
+	if err := c.checkServer(principal, true); err != nil {
+		return nil, nil, err
+	}
 
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	c.ctx[keyname] = context{
+	c.settings.algorithms.Store(keyname, tkey.Algorithm)
+	c.settings.flags.Store(keyname, FlagMutual|FlagInteg)
+	c.settings.servers.Store(keyname, principal)
+	c.established(keyname, expiry)
+	c.ctx[keyname] = gssContext{
 		client: cl,
+		shared: shared,
 		key:    payload.Subkey,
+		subkey: true,
 	}
 
 	return &keyname, &expiry, nil
 }
 
+// krbErrorCode finds the code of a KRB-ERROR the Kerberos library has flattened
+// into the text of its own error
+var krbErrorCode = regexp.MustCompile(`KRB Error: \((\d+)\)`)
+
+// gssError wraps a failure of the Kerberos library in a GSSError with the
+// major status, the minor status is the Kerberos error code of any KRB-ERROR
+// it carries.
+func gssError(major uint32, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	e := &GSSError{
+		Major:     major,
+		MajorText: majorText(major),
+		Err:       err,
+	}
+
+	var krberr messages.KRBError
+	if errors.As(err, &krberr) {
+		e.Minor = krb5MinorBase + uint32(krberr.ErrorCode)
+		e.MinorText = errorcode.Lookup(krberr.ErrorCode)
+	} else if m := krbErrorCode.FindStringSubmatch(err.Error()); m != nil {
+		if code, perr := strconv.ParseInt(m[1], 10, 32); perr == nil {
+			e.Minor = krb5MinorBase + uint32(code)
+			e.MinorText = errorcode.Lookup(int32(code))
+		}
+	}
+
+	return e
+}
+
 func loadCache() (*credentials.CCache, error) {
 
 	u, err := user.Current()
@@ -264,75 +382,292 @@ func loadConfig() (*config.Config, error) {
 // occurred.
 func (c *GSS) NegotiateContext(host string) (*string, *time.Time, error) {
 
-	cache, err := loadCache()
+	return c.negotiateWith(context.Background(), host, nil)
+}
+
+func (c *GSS) negotiateCurrentUser(ctx context.Context, host string) (*string, *time.Time, error) {
+
+	return c.negotiate(ctx, host, nil)
+}
+
+// NegotiateContextWithCredentials exchanges RFC 2930 TKEY records with the
+// indicated DNS server to establish a security context using the provided
+// credentials.
+// The domain is the Kerberos realm, it is uppercased and if empty it is
+// derived from the domain of the host.
+// It returns the negotiated TKEY name, expiration time, and any error that
+// occurred.
+func (c *GSS) NegotiateContextWithCredentials(host, domain, username, password string) (*string, *time.Time, error) {
+
+	return c.negotiateWith(context.Background(), host, &Credentials{
+		Domain:   domain,
+		Username: username,
+		Password: password,
+	})
+}
+
+func (c *GSS) negotiateWithCredentials(ctx context.Context, host, domain, username, password string) (*string, *time.Time, error) {
+
+	return c.negotiate(ctx, host, &Credentials{
+		Domain:   domain,
+		Username: username,
+		Password: password,
+	})
+}
+
+// NegotiateContextWithKeytab exchanges RFC 2930 TKEY records with the
+// indicated DNS server to establish a security context using the provided
+// keytab.
+// The domain is the Kerberos realm, it is uppercased and if empty it is
+// derived from the domain of the host.
+// It returns the negotiated TKEY name, expiration time, and any error that
+// occurred.
+func (c *GSS) NegotiateContextWithKeytab(host, domain, username, path string) (*string, *time.Time, error) {
+
+	return c.negotiateWith(context.Background(), host, &Credentials{
+		Domain:   domain,
+		Username: username,
+		Keytab:   path,
+	})
+}
+
+func (c *GSS) negotiateWithKeytab(ctx context.Context, host, domain, username, path string) (*string, *time.Time, error) {
+
+	return c.negotiate(ctx, host, &Credentials{
+		Domain:   domain,
+		Username: username,
+		Keytab:   path,
+	})
+}
+
+func (c *GSS) negotiate(ctx context.Context, host string, credentials *Credentials) (*string, *time.Time, error) {
+
+	var cl *client.Client
+	var shared bool
+
+	err := c.acquireBounded(ctx, func() (err error) {
+		cl, shared, err = c.client(host, credentials)
+		return err
+	}, func() {
+		if !shared {
+			cl.Destroy()
+		}
+	})
 	if err != nil {
 		return nil, nil, err
 	}
 
+	return c.negotiateContext(ctx, host, cl, shared)
+}
+
+// cacheKey returns the key that credentials acquired by AcquireCredentials
+// are cached under, the realm is normalized as it may be derived from the
+// host. The current user is the zero value.
+func cacheKey(host string, credentials *Credentials) (Credentials, error) {
+
+	if credentials == nil {
+		return Credentials{}, nil
+	}
+
+	realm, err := normalizeRealm(credentials.Domain, host)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	key := *credentials
+	key.Domain = realm
+
+	return key, nil
+}
+
+// newClient returns a client logged in with the credentials identified by
+// the key, the current user's credential cache is used for the zero value.
+func newClient(key Credentials) (*client.Client, error) {
+
 	cfg, err := loadConfig()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	if key == (Credentials{}) {
+		cache, err := loadCache()
+		if err != nil {
+			return nil, gssError(MajorNoCred, err)
+		}
+
+		cl, err := client.NewFromCCache(cache, cfg, client.DisablePAFXFAST(true))
+		if err != nil {
+			return nil, gssError(MajorNoCred, err)
+		}
+
+		return cl, nil
 	}
 
-	cl, err := client.NewFromCCache(cache, cfg, client.DisablePAFXFAST(true))
+	cl, err := credentialsClient(key, cfg)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	return c.negotiateContext(host, cl)
+	if err := cl.Login(); err != nil {
+		return nil, realmError(key.Domain, gssError(MajorNoCred, err))
+	}
+
+	return cl, nil
 }
 
-// NegotiateContextWithCredentials exchanges RFC 2930 TKEY records with the
-// indicated DNS server to establish a security context using the provided
-// credentials.
-// It returns the negotiated TKEY name, expiration time, and any error that
-// occurred.
-func (c *GSS) NegotiateContextWithCredentials(host, domain, username, password string) (*string, *time.Time, error) {
+// credentialsClient returns a client for the password or keytab of the key
+// that has yet to log in.
+func credentialsClient(key Credentials, cfg *config.Config) (*client.Client, error) {
 
-	// Should I still initialise the credential cache?
+	if key.Keytab != "" {
+		kt, err := keytab.Load(key.Keytab)
+		if err != nil {
+			return nil, err
+		}
+
+		return client.NewWithKeytab(key.Username, key.Domain, kt, cfg, client.DisablePAFXFAST(true)), nil
+	}
+
+	return client.NewWithPassword(key.Username, key.Domain, key.Password, cfg, client.DisablePAFXFAST(true)), nil
+}
+
+func (c *GSS) validateCredentials(credentials *Credentials) (*CredentialsInfo, error) {
+
+	if credentials == nil {
+		cache, err := loadCache()
+		if err != nil {
+			return nil, gssError(MajorNoCred, err)
+		}
+
+		return c.validateCache(cache)
+	}
 
 	cfg, err := loadConfig()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	realm := credentials.Domain
+	if realm == "" {
+		if realm = cfg.LibDefaults.DefaultRealm; realm == "" {
+			return nil, errors.New("no realm given and no default realm configured")
+		}
 	}
 
-	cl := client.NewWithPassword(username, domain, password, cfg, client.DisablePAFXFAST(true))
+	key := *credentials
+	if key.Domain, err = normalizeRealm(realm, ""); err != nil {
+		return nil, err
+	}
 
-	err = cl.Login()
+	cl, err := credentialsClient(key, cfg)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	// The AS exchange is made directly rather than with Login as that
+	// doesn't expose when the TGT expires
+	req, err := messages.NewASReqForTGT(key.Domain, cfg, cl.Credentials.CName())
+	if err != nil {
+		return nil, err
+	}
+
+	rep, err := cl.ASExchange(key.Domain, req, 0)
+	if err != nil {
+		return nil, realmError(key.Domain, gssError(MajorNoCred, err))
 	}
 
-	return c.negotiateContext(host, cl)
+	return &CredentialsInfo{
+		Principal: key.Username + "@" + key.Domain,
+		Expiry:    rep.DecryptedEncPart.EndTime,
+	}, nil
 }
 
-// NegotiateContextWithKeytab exchanges RFC 2930 TKEY records with the
-// indicated DNS server to establish a security context using the provided
-// keytab.
-// It returns the negotiated TKEY name, expiration time, and any error that
-// occurred.
-func (c *GSS) NegotiateContextWithKeytab(host, domain, username, path string) (*string, *time.Time, error) {
+// validateCache checks the credential cache holds a TGT for the realm of
+// its principal that hasn't expired.
+func (c *GSS) validateCache(cache *credentials.CCache) (*CredentialsInfo, error) {
+
+	realm := cache.GetClientRealm()
+
+	tgt, ok := cache.GetEntry(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm))
+	if !ok {
+		return nil, gssError(MajorNoCred, fmt.Errorf("no TGT for %s in the credential cache", realm))
+	}
 
-	// Should I still initialise the credential cache?
+	if !c.now().Before(tgt.EndTime) {
+		return nil, gssError(MajorCredentialsExpired, fmt.Errorf("TGT for %s expired at %v", realm, tgt.EndTime))
+	}
 
-	kt, err := keytab.Load(path)
+	return &CredentialsInfo{
+		Principal: cache.GetClientPrincipalName().PrincipalNameString() + "@" + realm,
+		Expiry:    tgt.EndTime,
+	}, nil
+}
+
+// client returns a client for the credentials along with whether it is
+// shared, which it is if it was cached by AcquireCredentials. A shared client
+// whose TGT has expired and can't be renewed, as happens with a credential
+// cache, is replaced with a freshly acquired one.
+func (c *GSS) client(host string, credentials *Credentials) (*client.Client, bool, error) {
+
+	key, err := cacheKey(host, credentials)
 	if err != nil {
-		return nil, nil, err
+		return nil, false, err
 	}
 
-	cfg, err := loadConfig()
+	c.m.RLock()
+	cl, ok := c.clients[key]
+	c.m.RUnlock()
+
+	if ok && cl.AffirmLogin() == nil {
+		return cl, true, nil
+	}
+
+	fresh, err := newClient(key)
 	if err != nil {
-		return nil, nil, err
+		return nil, false, err
 	}
 
-	cl := client.NewWithKeytab(username, domain, kt, cfg, client.DisablePAFXFAST(true))
+	if !ok {
+		return fresh, false, nil
+	}
+
+	// The expired client isn't destroyed as a negotiation could still be
+	// using it, it holds no renewal goroutine as it can't renew anyway
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.clients[key] = fresh
 
-	err = cl.Login()
+	return fresh, true, nil
+}
+
+func (c *GSS) acquireCredentials(host string, credentials *Credentials) error {
+
+	key, err := cacheKey(host, credentials)
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+
+	cl, shared, err := c.client(host, credentials)
+	if err != nil || shared {
+		return err
 	}
 
-	return c.negotiateContext(host, cl)
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// Another goroutine got there first
+	if _, ok := c.clients[key]; ok {
+		cl.Destroy()
+		return nil
+	}
+
+	if c.clients == nil {
+		c.clients = make(map[Credentials]*client.Client)
+	}
+	c.clients[key] = cl
+
+	return nil
 }
 
 // DeleteContext deletes the active security context associated with the given
@@ -348,9 +683,12 @@ func (c *GSS) DeleteContext(keyname *string) error {
 		return fmt.Errorf("No such context")
 	}
 
-	ctx.client.Destroy()
+	if !ctx.shared {
+		ctx.client.Destroy()
+	}
 
 	delete(c.ctx, *keyname)
+	c.forget(*keyname)
 
 	return nil
 }
@@ -0,0 +1,181 @@
+// +build !windows,!apcera
+
+package gss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bodgit/tsig"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheKey(t *testing.T) {
+
+	key, err := cacheKey("ns.example.com", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, Credentials{}, key)
+
+	// The realm is derived from the host and normalized
+	key, err = cacheKey("ns.example.com", &Credentials{Username: "user", Password: "secret"})
+	assert.Nil(t, err)
+	assert.Equal(t, Credentials{Domain: "EXAMPLE.COM", Username: "user", Password: "secret"}, key)
+
+	other, err := cacheKey("ns.other.example.com", &Credentials{Domain: "example.com.", Username: "user", Password: "secret"})
+	assert.Nil(t, err)
+	assert.Equal(t, key, other)
+
+	_, err = cacheKey("192.0.2.1", &Credentials{Username: "user", Password: "secret"})
+	assert.NotNil(t, err)
+}
+
+func TestSharedClient(t *testing.T) {
+
+	c := &GSS{
+		ctx: map[string]gssContext{
+			// Destroying the zero client would panic
+			"test.example.com.": {client: &client.Client{}, shared: true},
+		},
+	}
+
+	keyname := "test.example.com."
+	assert.Nil(t, c.DeleteContext(&keyname))
+	assert.Len(t, c.ctx, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Equal(t, context.Canceled, c.AcquireCredentials(ctx, "ns.example.com"))
+}
+
+func TestValidateCache(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c, err := New(WithClock(func() time.Time { return now }))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	tgt := &credentials.Credential{EndTime: now.Add(time.Hour)}
+	tgt.Server.PrincipalName = types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/EXAMPLE.COM")
+
+	cache := &credentials.CCache{Credentials: []*credentials.Credential{tgt}}
+	cache.DefaultPrincipal.Realm = "EXAMPLE.COM"
+	cache.DefaultPrincipal.PrincipalName = types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "user")
+
+	info, err := c.validateCache(cache)
+	if assert.Nil(t, err) {
+		assert.Equal(t, &CredentialsInfo{Principal: "user@EXAMPLE.COM", Expiry: now.Add(time.Hour)}, info)
+	}
+
+	tgt.EndTime = now
+
+	_, err = c.validateCache(cache)
+	var gerr *GSSError
+	if assert.True(t, errors.As(err, &gerr)) {
+		assert.Equal(t, MajorCredentialsExpired, gerr.Major)
+		assert.Equal(t, CategoryCredentials, gerr.Category())
+	}
+
+	// No TGT for the realm of the principal
+	cache.DefaultPrincipal.Realm = "OTHER.EXAMPLE.COM"
+
+	_, err = c.validateCache(cache)
+	if assert.True(t, errors.As(err, &gerr)) {
+		assert.Equal(t, MajorNoCred, gerr.Major)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = c.ValidateCredentials(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestGSSErrorKerberos(t *testing.T) {
+
+	assert.Nil(t, gssError(MajorFailure, nil))
+
+	tables := []struct {
+		err   error
+		minor uint32
+		text  string
+	}{
+		{
+			messages.KRBError{ErrorCode: 37},
+			krb5MinorBase + 37,
+			"KRB_AP_ERR_SKEW",
+		},
+		{
+			fmt.Errorf("login failed: %w", messages.KRBError{ErrorCode: 37}),
+			krb5MinorBase + 37,
+			"KRB_AP_ERR_SKEW",
+		},
+		{
+			// gokrb5 usually flattens the KRBError into the text
+			errors.New("[Root cause: KDC_Error] KDC_Error: TGS Exchange Error: kerberos error response from KDC when requesting for DNS/ns.example.com: KRB Error: (7) KDC_ERR_S_PRINCIPAL_UNKNOWN Server not found in Kerberos database"),
+			krb5MinorBase + 7,
+			"KDC_ERR_S_PRINCIPAL_UNKNOWN",
+		},
+		{
+			errors.New("no route to host"),
+			0,
+			"",
+		},
+	}
+
+	for _, table := range tables {
+		err := gssError(MajorFailure, table.err)
+		var gerr *GSSError
+		if assert.True(t, errors.As(err, &gerr)) {
+			assert.Equal(t, MajorFailure, gerr.Major)
+			assert.Equal(t, table.minor, gerr.Minor)
+			assert.Contains(t, gerr.MinorText, table.text)
+			assert.Equal(t, table.err, errors.Unwrap(gerr))
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+
+	c := &GSS{
+		ctx: map[string]gssContext{},
+	}
+
+	expiry := time.Unix(1600000000, 0)
+
+	for _, keyname := range []string{"b.example.com.", "a.example.com."} {
+		c.ctx[keyname] = gssContext{client: &client.Client{}, shared: true}
+		c.settings.algorithms.Store(keyname, tsig.GSS)
+		c.settings.flags.Store(keyname, FlagMutual|FlagInteg)
+		c.settings.expiries.Store(keyname, expiry)
+	}
+
+	assert.Equal(t, []Key{
+		{Name: "a.example.com.", Algorithm: tsig.GSS, Expiry: expiry, Flags: FlagMutual | FlagInteg},
+		{Name: "b.example.com.", Algorithm: tsig.GSS, Expiry: expiry, Flags: FlagMutual | FlagInteg},
+	}, c.Keys())
+
+	// A cancelled context stops before deleting anything
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.NotNil(t, c.DeleteAll(ctx))
+	assert.Len(t, c.Keys(), 2)
+
+	assert.Nil(t, c.DeleteAll(context.Background()))
+	assert.Len(t, c.Keys(), 0)
+	assert.Len(t, c.ctx, 0)
+
+	assert.Nil(t, c.DeleteAll(context.Background()))
+}
@@ -78,14 +78,870 @@ uses native SSPI which has a similar API.
 package gss
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/bodgit/tsig"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/miekg/dns"
 )
 
+// Direction indicates whether a GSS token was sent to or received from the
+// server.
+type Direction int
+
+const (
+	// Outgoing tokens are sent to the server
+	Outgoing Direction = iota
+	// Incoming tokens are received from the server
+	Incoming
+)
+
+func (d Direction) String() string {
+
+	if d == Incoming {
+		return "incoming"
+	}
+
+	return "outgoing"
+}
+
+// TokenHook is called with a copy of each GSS token exchanged during
+// negotiation along with the zero-based round trip it belongs to.
+type TokenHook func(direction Direction, round int, token []byte)
+
+// settings holds the configuration common to every implementation
+type settings struct {
+	tokenHook   TokenHook
+	stableID    bool
+	credentials *Credentials
+	// algorithm is the algorithm name negotiation starts with, empty means
+	// tsig.GSS
+	algorithm string
+	// deletePolicy decides whether Update deletes the context, nil means
+	// DeleteAlways
+	deletePolicy DeletePolicy
+	// algorithms maps each negotiated key name to the algorithm name the
+	// server accepted
+	algorithms sync.Map
+	// optionalMutual allows a context without mutual authentication
+	optionalMutual bool
+	qop            uint32
+	// flags maps each negotiated key name to the flags of its context
+	flags sync.Map
+	// expiries maps each negotiated key name to the expiry of its context
+	expiries sync.Map
+	// impersonate is the user principal to negotiate on behalf of
+	impersonate string
+	// emptyTokenLimit is the number of consecutive empty tokens accepted
+	// from the server, zero means DefaultEmptyTokenLimit
+	emptyTokenLimit int
+	// now returns the current time, nil means time.Now
+	now func() time.Time
+	// events is the stream negotiation events are emitted to
+	events *tsig.EventStream
+	// lengthPrefix is the size of the length prefix of each token, zero
+	// means there isn't one
+	lengthPrefix int
+	// credentialsTimeout bounds acquiring credentials, zero means only the
+	// context passed in does
+	credentialsTimeout time.Duration
+	// allowedServers are the principals the server may authenticate as,
+	// empty means any
+	allowedServers []string
+	// servers maps each negotiated key name to the principal the server
+	// authenticated as
+	servers sync.Map
+	// origins maps each negotiated key name to the host and credentials it
+	// was negotiated with, for Refresh
+	origins sync.Map
+}
+
+// Option is used to configure the context handle returned by New.
+type Option func(*GSS) error
+
+// WithTokenHook sets a hook that observes every GSS token exchanged during
+// negotiation, for example to hex-dump them when diagnosing a failure.
+func WithTokenHook(hook TokenHook) Option {
+
+	return func(c *GSS) error {
+		c.settings.tokenHook = hook
+		return nil
+	}
+}
+
+// WithStableMessageID controls whether every message in a negotiation loop
+// reuses the same message Id. By default a fresh Id is generated for each
+// round trip which matches both nsupdate(1) and Windows clients talking to
+// Active Directory, however some servers correlate the round trips by Id.
+func WithStableMessageID(stable bool) Option {
+
+	return func(c *GSS) error {
+		c.settings.stableID = stable
+		return nil
+	}
+}
+
+// Credentials identifies the principal to negotiate a context as. If Keytab
+// is set it is the path to a keytab used instead of the password. Keytabs
+// are not supported by every implementation.
+type Credentials struct {
+	Domain   string
+	Username string
+	Password string
+	Keytab   string
+}
+
+type credentialsKey struct{}
+
+// ContextWithCredentials returns a copy of ctx carrying the credentials that
+// NegotiateGSS should use, for example in a service negotiating on behalf of
+// a different principal for each request.
+func ContextWithCredentials(ctx context.Context, credentials *Credentials) context.Context {
+
+	return context.WithValue(ctx, credentialsKey{}, credentials)
+}
+
+// CredentialsFromContext returns the credentials carried by ctx, if any.
+func CredentialsFromContext(ctx context.Context) (*Credentials, bool) {
+
+	credentials, ok := ctx.Value(credentialsKey{}).(*Credentials)
+
+	return credentials, ok && credentials != nil
+}
+
+// AcquireCredentials acquires the initiator credentials NegotiateGSS would
+// use with the context up front and caches them, so a latency sensitive
+// first negotiation doesn't pay for acquiring them. The host is only used to
+// derive the realm if the credentials don't name one. Later negotiations
+// with the same credentials reuse them and once they expire they are
+// transparently acquired again.
+// It returns any error that occurred.
+func (c *GSS) AcquireCredentials(ctx context.Context, host string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	credentials := c.credentials(ctx)
+
+	return c.acquireBounded(ctx, func() error {
+		return c.acquireCredentials(host, credentials)
+	}, nil)
+}
+
+// CredentialsInfo describes the credentials checked by ValidateCredentials.
+// Principal is the client principal they are for and Expiry when the TGT
+// expires, either is the zero value if the implementation can't tell.
+type CredentialsInfo struct {
+	Principal string
+	Expiry    time.Time
+}
+
+// ValidateCredentials acquires the initiator credentials NegotiateGSS would
+// use with the context and checks they are usable without contacting any
+// DNS server, so a service can verify its Kerberos setup at startup. With a
+// password or keytab a TGT is requested from the KDC, if the credentials
+// don't name a realm the default realm of the Kerberos configuration is
+// used. The credentials of the current user are checked for an unexpired
+// TGT. Nothing is cached, see AcquireCredentials for that. A rejection is
+// returned as a GSSError whose Category tells clock skew apart from an
+// unknown principal or bad password.
+// It returns the details of the credentials and any error that occurred.
+func (c *GSS) ValidateCredentials(ctx context.Context) (*CredentialsInfo, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	credentials := c.credentials(ctx)
+
+	var info *CredentialsInfo
+
+	err := c.acquireBounded(ctx, func() (err error) {
+		info, err = c.validateCredentials(credentials)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// WithCredentials sets the credentials NegotiateGSS uses when the context
+// doesn't carry any.
+func WithCredentials(credentials *Credentials) Option {
+
+	return func(c *GSS) error {
+		c.settings.credentials = credentials
+		return nil
+	}
+}
+
+// credentials returns the credentials to negotiate with, those carried by
+// the context take precedence over any configured with WithCredentials. nil
+// means the current user.
+func (c *GSS) credentials(ctx context.Context) *Credentials {
+
+	if credentials, ok := CredentialsFromContext(ctx); ok {
+		return credentials
+	}
+
+	return c.settings.credentials
+}
+
+// NegotiateGSS exchanges RFC 2930 TKEY records with the indicated DNS server
+// to establish a security context. The credentials are taken from the
+// context if it carries any, otherwise those set with WithCredentials are
+// used, otherwise the current user is used.
+// It returns the negotiated TKEY name, expiration time, and any error that
+// occurred.
+func (c *GSS) NegotiateGSS(ctx context.Context, host string) (*string, *time.Time, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return c.negotiateWith(ctx, host, c.credentials(ctx))
+}
+
+// origin is the host and credentials a context was negotiated with, nil
+// credentials means the current user.
+type origin struct {
+	host        string
+	credentials *Credentials
+}
+
+// negotiateWith negotiates with the credentials, nil means the current user,
+// and records them for Refresh.
+func (c *GSS) negotiateWith(ctx context.Context, host string, credentials *Credentials) (*string, *time.Time, error) {
+
+	var keyname *string
+	var expiry *time.Time
+	var err error
+
+	switch {
+	case credentials == nil:
+		keyname, expiry, err = c.negotiateCurrentUser(ctx, host)
+	case credentials.Keytab != "":
+		keyname, expiry, err = c.negotiateWithKeytab(ctx, host, credentials.Domain, credentials.Username, credentials.Keytab)
+	default:
+		keyname, expiry, err = c.negotiateWithCredentials(ctx, host, credentials.Domain, credentials.Username, credentials.Password)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	o := origin{host: host}
+	if credentials != nil {
+		copied := *credentials
+		o.credentials = &copied
+	}
+	c.settings.origins.Store(*keyname, o)
+
+	return keyname, expiry, nil
+}
+
+// Refresh negotiates a new security context with the server of the context
+// associated with the given TKEY name, using the same credentials, to replace
+// it before it expires. A security context can't be extended and each needs
+// a TKEY name of its own so the new context has a new name, the old context
+// is deleted with DeleteContext once the new one is established. Credentials
+// cached by AcquireCredentials are reused.
+// It returns the new TKEY name, expiration time, and any error that
+// occurred.
+func (c *GSS) Refresh(ctx context.Context, keyname string) (*string, *time.Time, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	v, ok := c.settings.origins.Load(keyname)
+	if !ok {
+		return nil, nil, fmt.Errorf("No such context")
+	}
+	o := v.(origin)
+
+	newname, expiry, err := c.negotiateWith(ctx, o.host, o.credentials)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The old context may have been deleted meanwhile which is just as well
+	c.DeleteContext(&keyname)
+
+	return newname, expiry, nil
+}
+
+// Flags describes the protection a negotiated security context provides, the
+// values match the GSS-API context flags of RFC 2744.
+type Flags uint32
+
+const (
+	// FlagMutual means the server authenticated itself to the client
+	FlagMutual Flags = 1 << (iota + 1)
+	// FlagReplay means replayed messages are detected
+	FlagReplay
+	// FlagSequence means out of sequence messages are detected
+	FlagSequence
+	// FlagConf means messages can be encrypted
+	FlagConf
+	// FlagInteg means messages can be signed
+	FlagInteg
+)
+
+// ErrMutualAuth is returned when mutual authentication is required but the
+// server didn't authenticate itself during negotiation.
+var ErrMutualAuth = errors.New("mutual authentication required but not provided by the server")
+
+// WithMutualAuth controls whether negotiation fails with ErrMutualAuth if
+// the server doesn't authenticate itself to the client. It is required by
+// default which matches what Active Directory expects.
+func WithMutualAuth(required bool) Option {
+
+	return func(c *GSS) error {
+		c.settings.optionalMutual = !required
+		return nil
+	}
+}
+
+// DefaultEmptyTokenLimit is the number of consecutive empty tokens accepted
+// from the server unless WithEmptyTokenLimit is used.
+const DefaultEmptyTokenLimit = 1
+
+// ErrEmptyTokens is returned, wrapped with the number of tokens, when the
+// server keeps answering with an empty token while the context still needs
+// one.
+var ErrEmptyTokens = errors.New("too many empty tokens from the server")
+
+// WithEmptyTokenLimit sets how many consecutive empty tokens the server may
+// answer with during negotiation. Depending on the server an empty token
+// either means it has nothing more to send as the context is complete or it
+// is an error, each one is handed to the GSS library which decides based on
+// the state of the context, however any more than the limit in a row fail
+// with ErrEmptyTokens so negotiation can't go round forever. It must be at
+// least one. The single round trip negotiation of the gokrb5 implementation
+// is never affected.
+func WithEmptyTokenLimit(limit int) Option {
+
+	return func(c *GSS) error {
+		if limit < 1 {
+			return fmt.Errorf("empty token limit must be at least one")
+		}
+		c.settings.emptyTokenLimit = limit
+		return nil
+	}
+}
+
+// emptyTokens counts the consecutive empty tokens received from the server
+// during one negotiation.
+type emptyTokens struct {
+	limit int
+	count int
+}
+
+func (c *GSS) emptyTokens() *emptyTokens {
+
+	limit := c.settings.emptyTokenLimit
+	if limit == 0 {
+		limit = DefaultEmptyTokenLimit
+	}
+
+	return &emptyTokens{limit: limit}
+}
+
+// check counts the token received from the server.
+// It returns an error if there have been too many empty tokens in a row.
+func (e *emptyTokens) check(token []byte) error {
+
+	if len(token) > 0 {
+		e.count = 0
+		return nil
+	}
+
+	if e.count++; e.count > e.limit {
+		return fmt.Errorf("%w, %d in a row", ErrEmptyTokens, e.count)
+	}
+
+	return nil
+}
+
+// WithQoP sets the quality of protection requested when signing messages,
+// the default of zero leaves it to the mechanism. Not every implementation
+// supports anything other than the default.
+func WithQoP(qop uint32) Option {
+
+	return func(c *GSS) error {
+		if qop != 0 && !qopSupported {
+			return fmt.Errorf("quality of protection is not supported")
+		}
+		c.settings.qop = qop
+		return nil
+	}
+}
+
+// WithImpersonation negotiates every context on behalf of the user principal,
+// given as "user" or "user@REALM", rather than as the credentials themselves.
+// The ticket to the DNS service is obtained with Kerberos constrained
+// delegation, S4U2Self followed by S4U2Proxy, so the credentials must be a
+// service account trusted to delegate to the DNS service. Not every
+// implementation supports it.
+func WithImpersonation(user string) Option {
+
+	return func(c *GSS) error {
+		if !impersonationSupported {
+			return fmt.Errorf("impersonation is not supported")
+		}
+		if strings.TrimSpace(user) == "" || strings.HasPrefix(user, "@") || strings.HasSuffix(user, "@") {
+			return fmt.Errorf("invalid user principal %q", user)
+		}
+		c.settings.impersonate = user
+		return nil
+	}
+}
+
+// S4UError is returned when the KDC refuses one of the constrained
+// delegation steps used by WithImpersonation, Step is either "S4U2Self" or
+// "S4U2Proxy". A failing S4U2Self usually means the user doesn't exist or
+// protocol transition isn't allowed, a failing S4U2Proxy usually means the
+// service isn't trusted to delegate to the DNS service.
+type S4UError struct {
+	Step string
+	User string
+	Err  error
+}
+
+func (e *S4UError) Error() string {
+
+	return fmt.Sprintf("%s for %s: %v", e.Step, e.User, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *S4UError) Unwrap() error {
+
+	return e.Err
+}
+
+// Flags returns the flags of the security context negotiated for the key
+// name and whether there is one.
+func (c *GSS) Flags(keyname string) (Flags, bool) {
+
+	if flags, ok := c.settings.flags.Load(keyname); ok {
+		return flags.(Flags), true
+	}
+
+	return 0, false
+}
+
+// WithAlgorithm sets the algorithm name negotiation starts with, it must be
+// either tsig.GSS or tsig.LegacyGSS. The default of tsig.GSS matches
+// nsupdate, which only uses tsig.LegacyGSS when run with -o. If the server
+// rejects the name the other one is tried and Algorithm reports whichever
+// the server accepted. The strength of the MAC isn't chosen by the name, it
+// follows from the session key the GSS mechanism negotiates, for Kerberos the
+// encryption types allowed by its configuration.
+func WithAlgorithm(algorithm string) Option {
+
+	return func(c *GSS) error {
+		if !tsig.IsGSS(algorithm) {
+			return fmt.Errorf("%s is not a GSS algorithm", algorithm)
+		}
+		c.settings.algorithm = strings.ToLower(algorithm)
+		return nil
+	}
+}
+
+// WithLegacyAlgorithm uses the tsig.LegacyGSS algorithm name that older
+// Windows servers expect rather than the RFC 3645 tsig.GSS name, it is the
+// same as WithAlgorithm(tsig.LegacyGSS).
+func WithLegacyAlgorithm() Option {
+
+	return WithAlgorithm(tsig.LegacyGSS)
+}
+
+// algorithm returns the algorithm name negotiation starts with.
+func (c *GSS) algorithm() string {
+
+	if c.settings.algorithm != "" {
+		return c.settings.algorithm
+	}
+
+	return tsig.GSS
+}
+
+// WithClock sets the function returning the current time that expiry times
+// are compared against, such as those of cached credentials, rather than
+// time.Now, for example to test behaviour near an expiry with a fake clock.
+func WithClock(now func() time.Time) Option {
+
+	return func(c *GSS) error {
+		c.settings.now = now
+		return nil
+	}
+}
+
+func (c *GSS) now() time.Time {
+
+	if c.settings.now != nil {
+		return c.settings.now()
+	}
+
+	return time.Now()
+}
+
+// Remaining returns how long is left until the security context expires,
+// which is negative once it has, according to the clock set by WithClock,
+// and whether the context is known.
+func (c *GSS) Remaining(keyname string) (time.Duration, bool) {
+
+	expiry, ok := c.settings.expiries.Load(keyname)
+	if !ok {
+		return 0, false
+	}
+
+	return expiry.(time.Time).Sub(c.now()), true
+}
+
+// Key describes a security context that has been negotiated and not yet
+// deleted.
+type Key struct {
+	Name      string
+	Algorithm string
+	Expiry    time.Time
+	Flags     Flags
+	// Server is the principal the server authenticated as, see
+	// ServerPrincipal
+	Server string
+}
+
+// SaveKey always fails with tsig.ErrNoSecret, a security context can't be
+// exported to restore after a restart, a new one must be negotiated instead.
+// It exists so GSS can be used in place of the dh package.
+func (c *GSS) SaveKey(keyname string) (*tsig.SavedKey, error) {
+
+	return nil, tsig.ErrNoSecret
+}
+
+// Keys returns every security context that has been negotiated and not yet
+// deleted, sorted by key name, including any past their expiry.
+func (c *GSS) Keys() []Key {
+
+	var keys []Key
+
+	c.settings.expiries.Range(func(k, v interface{}) bool {
+		keyname := k.(string)
+		flags, _ := c.Flags(keyname)
+		server, _ := c.ServerPrincipal(keyname)
+		keys = append(keys, Key{
+			Name:      keyname,
+			Algorithm: c.Algorithm(keyname),
+			Expiry:    v.(time.Time),
+			Flags:     flags,
+			Server:    server,
+		})
+		return true
+	})
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+
+	return keys
+}
+
+// DeleteAll deletes every security context returned by Keys with
+// DeleteContext, stopping early if the context is done.
+// It returns any error that occurred.
+func (c *GSS) DeleteAll(ctx context.Context) error {
+
+	var errs error
+
+	for _, key := range c.Keys() {
+		if err := ctx.Err(); err != nil {
+			return multierror.Append(errs, err)
+		}
+
+		keyname := key.Name
+		if err := c.DeleteContext(&keyname); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", keyname, err))
+		}
+	}
+
+	return errs
+}
+
+// Algorithm returns the algorithm name to use in the TSIG record of messages
+// signed with the negotiated key. If the server rejected the configured name
+// during negotiation but accepted the other one then that is returned
+// instead, otherwise it is the name set by WithAlgorithm.
+// Both names should be registered with GenerateGSS and VerifyGSS in the
+// TsigAlgorithm map of the DNS client.
+func (c *GSS) Algorithm(keyname string) string {
+
+	if algorithm, ok := c.settings.algorithms.Load(keyname); ok {
+		return algorithm.(string)
+	}
+
+	return c.algorithm()
+}
+
+// otherAlgorithm returns the alternative GSS algorithm name.
+func otherAlgorithm(algorithm string) string {
+
+	if strings.ToLower(algorithm) == tsig.LegacyGSS {
+		return tsig.GSS
+	}
+
+	return tsig.LegacyGSS
+}
+
+// rejectedAlgorithm returns whether the error means the server doesn't
+// recognise the algorithm name.
+func rejectedAlgorithm(err error) bool {
+
+	var uerr *tsig.UnsupportedError
+	var terr *tsig.TKEYError
+
+	return errors.As(err, &uerr) || (errors.As(err, &terr) && terr.Code == dns.RcodeBadAlg)
+}
+
+func (c *GSS) setOptions(options []Option) error {
+
+	for _, option := range options {
+		if err := option(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WithEvents sets the stream the events of each negotiation are emitted to,
+// each GSS token and each context established or deleted along with the
+// events of the TKEY exchanges. If the context passed to NegotiateGSS carries
+// another stream, see tsig.ContextWithEvents, the tokens and exchanges of
+// that negotiation are emitted to it instead.
+func WithEvents(stream *tsig.EventStream) Option {
+
+	return func(c *GSS) error {
+		c.settings.events = stream
+		return nil
+	}
+}
+
+// withEvents returns a copy of ctx carrying the stream set by WithEvents,
+// unless it already carries one.
+func (c *GSS) withEvents(ctx context.Context) context.Context {
+
+	if _, ok := tsig.EventsFromContext(ctx); ok || c.settings.events == nil {
+		return ctx
+	}
+
+	return tsig.ContextWithEvents(ctx, c.settings.events)
+}
+
+// established records the expiry of a newly negotiated context.
+func (c *GSS) established(keyname string, expiry time.Time) {
+
+	c.settings.expiries.Store(keyname, expiry)
+
+	c.settings.events.Emit(tsig.Event{
+		Type:    tsig.EventKeyEstablished,
+		KeyName: keyname,
+		Expiry:  expiry,
+	})
+}
+
+// forget removes everything recorded about a deleted context.
+func (c *GSS) forget(keyname string) {
+
+	c.settings.algorithms.Delete(keyname)
+	c.settings.flags.Delete(keyname)
+	c.settings.expiries.Delete(keyname)
+	c.settings.servers.Delete(keyname)
+	c.settings.origins.Delete(keyname)
+
+	c.settings.events.Emit(tsig.Event{
+		Type:    tsig.EventKeyDeleted,
+		KeyName: keyname,
+	})
+}
+
+// token passes a GSS token to the hook set by WithTokenHook and emits it as
+// an event.
+func (c *GSS) token(ctx context.Context, direction Direction, round int, token []byte) {
+
+	c.hook(direction, round, token)
+
+	if s, ok := tsig.EventsFromContext(ctx); ok {
+		s.Emit(tsig.Event{
+			Type:     tsig.EventToken,
+			Token:    append([]byte{}, token...),
+			Incoming: direction == Incoming,
+			Round:    round,
+		})
+	}
+}
+
+func (c *GSS) hook(direction Direction, round int, token []byte) {
+
+	if c.settings.tokenHook == nil {
+		return
+	}
+
+	dup := make([]byte, len(token))
+	copy(dup, token)
+
+	c.settings.tokenHook(direction, round, dup)
+}
+
+// messageID returns the message Id to use for every round trip of a
+// negotiation, zero means a fresh Id is generated for each message.
+func (c *GSS) messageID() uint16 {
+
+	var id uint16
+	for c.settings.stableID && id == 0 {
+		id = dns.Id()
+	}
+
+	return id
+}
+
+// exchange sends one GSS token to the server and returns the TKEY record in
+// the response along with the GSS token it carries. The server may choose a
+// different key name in the first response, the TKEY record owner name is the
+// key name that must be used from then on. Likewise if the server rejects the
+// algorithm name in the first round the other GSS algorithm name is tried,
+// the TKEY record algorithm is the name that must be used from then on.
+func (c *GSS) exchange(ctx context.Context, host, keyname, algorithm string, id uint16, round int, output []byte) (*dns.TKEY, []byte, error) {
+
+	ctx = c.withEvents(ctx)
+
+	c.token(ctx, Outgoing, round, output)
+
+	output, err := c.addLengthPrefix(output)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// We don't care about non-TKEY answers, no additional RR's to send, and no signing
+	req := &tsig.Request{
+		Host:      host,
+		KeyName:   keyname,
+		Algorithm: algorithm,
+		Mode:      tsig.TkeyModeGSS,
+		Lifetime:  3600,
+		Input:     output,
+		ID:        id,
+	}
+
+	resp, err := tsig.DefaultClient.Exchange(ctx, req)
+	if err != nil && round == 0 && rejectedAlgorithm(err) {
+		req.Algorithm = otherAlgorithm(algorithm)
+		resp, err = tsig.DefaultClient.Exchange(ctx, req)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if round > 0 && !strings.EqualFold(resp.KeyName, keyname) {
+		return nil, nil, fmt.Errorf("TKEY name does not match")
+	}
+
+	// Servers should echo the algorithm but fall back to what was sent
+	if !tsig.IsGSS(resp.TKEY.Algorithm) {
+		resp.TKEY.Algorithm = req.Algorithm
+	}
+
+	input, err := tsig.DecodeTKEYKey(resp.TKEY.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if input, err = c.stripLengthPrefix(input); err != nil {
+		return nil, nil, err
+	}
+
+	c.token(ctx, Incoming, round, input)
+
+	return resp.TKEY, input, nil
+}
+
+// RealmError is returned when negotiation fails because the KDC or the
+// Kerberos configuration doesn't recognise the realm.
+type RealmError struct {
+	Realm string
+	Err   error
+}
+
+func (e *RealmError) Error() string {
+
+	return fmt.Sprintf("realm %s: %v", e.Realm, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *RealmError) Unwrap() error {
+
+	return e.Err
+}
+
+// Markers of the realm-related failures reported by the Kerberos libraries
+var realmErrors = []string{
+	"KDC_ERR_WRONG_REALM",
+	"no KDCs defined in configuration for realm",
+	"maximum number of client referrals exceeded",
+}
+
+func realmError(realm string, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	for _, marker := range realmErrors {
+		if strings.Contains(err.Error(), marker) {
+			return &RealmError{Realm: realm, Err: err}
+		}
+	}
+
+	return err
+}
+
+// normalizeRealm returns the Kerberos realm uppercased per convention and
+// without any trailing dot. If the realm is empty it is derived from the
+// domain of the host, so "ns.example.com" implies "EXAMPLE.COM".
+func normalizeRealm(realm, host string) (string, error) {
+
+	if realm == "" {
+		hostname, _ := tsig.SplitHostPort(host)
+		hostname = strings.TrimSuffix(hostname, ".")
+		if net.ParseIP(hostname) != nil {
+			return "", fmt.Errorf("cannot derive realm from address %s", hostname)
+		}
+		labels := dns.SplitDomainName(hostname)
+		if len(labels) < 2 {
+			return "", fmt.Errorf("cannot derive realm from host %s", hostname)
+		}
+		realm = strings.Join(labels[1:], ".")
+	}
+
+	realm = strings.ToUpper(strings.TrimSuffix(realm, "."))
+
+	if realm == "" || strings.ContainsAny(realm, "/:@\\ \t") || strings.Contains(realm, "..") || strings.HasPrefix(realm, ".") {
+		return "", fmt.Errorf("invalid realm %q", realm)
+	}
+
+	return realm, nil
+}
+
 func generateTKEYName(host string) string {
 
 	seed := rand.NewSource(time.Now().UnixNano())
@@ -1,12 +1,81 @@
 package gss
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"regexp"
 	"testing"
+	"time"
 
+	"github.com/bodgit/tsig"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
+// gssReply returns a reply to the query with a GSS TKEY record for the key
+// name in the answer section, echoing the algorithm of the query.
+func gssReply(m *dns.Msg, name string) *dns.Msg {
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.TKEY{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTKEY,
+			Class:  dns.ClassANY,
+		},
+		Algorithm: m.Extra[0].(*dns.TKEY).Algorithm,
+		Mode:      tsig.TkeyModeGSS,
+	})
+
+	return r
+}
+
+// FakeServer answers every TKEY query with an empty GSS token and records
+// the message Ids it has seen. If Name is set the server chooses that key
+// name rather than the requested one, if Reject is set queries using that
+// algorithm are refused with BADALG
+type FakeServer struct {
+	Name   string
+	Reject string
+	ids    []uint16
+}
+
+func (s *FakeServer) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	s.ids = append(s.ids, m.Id)
+
+	name := m.Question[0].Name
+	if s.Name != "" {
+		name = s.Name
+	}
+
+	r := gssReply(m, name)
+
+	if m.Extra[0].(*dns.TKEY).Algorithm == s.Reject {
+		r.Answer[0].(*dns.TKEY).Error = dns.RcodeBadAlg
+	}
+
+	return r, 0, nil
+}
+
+// withFakeServer points tsig.DefaultClient at a FakeServer, the returned
+// function restores it
+func withFakeServer() (*FakeServer, func()) {
+
+	s := &FakeServer{}
+
+	client := tsig.DefaultClient
+	tsig.DefaultClient = &tsig.Client{Exchanger: s}
+
+	return s, func() {
+		tsig.DefaultClient = client
+	}
+}
+
 func TestGenerateTKEYName(t *testing.T) {
 
 	tkey := generateTKEYName("host.example.com")
@@ -21,3 +90,974 @@ func TestGenerateSPN(t *testing.T) {
 	spn = generateSPN("host.example.com.")
 	assert.Equal(t, "DNS/host.example.com", spn)
 }
+
+func TestNormalizeRealm(t *testing.T) {
+
+	cases := []struct {
+		realm, host, expected string
+		err                   bool
+	}{
+		{"example.com", "ns.example.com", "EXAMPLE.COM", false},
+		{"EXAMPLE.COM.", "ns.example.com", "EXAMPLE.COM", false},
+		{"", "ns.example.com.", "EXAMPLE.COM", false},
+		{"", "ns.ad.example.com:8053", "AD.EXAMPLE.COM", false},
+		{"", "localhost", "", true},
+		{"", "192.0.2.1", "", true},
+		{"example..com", "ns.example.com", "", true},
+		{"user@example.com", "ns.example.com", "", true},
+	}
+
+	for _, c := range cases {
+		realm, err := normalizeRealm(c.realm, c.host)
+		assert.Equal(t, c.expected, realm)
+		if c.err {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestRealmError(t *testing.T) {
+
+	err := realmError("EXAMPLE.COM", errors.New("no KDCs defined in configuration for realm EXAMPLE.COM"))
+
+	var rerr *RealmError
+	if assert.True(t, errors.As(err, &rerr)) {
+		assert.Equal(t, "EXAMPLE.COM", rerr.Realm)
+	}
+
+	other := errors.New("some other error")
+	assert.Equal(t, other, realmError("EXAMPLE.COM", other))
+	assert.Nil(t, realmError("EXAMPLE.COM", nil))
+}
+
+func TestTokenHook(t *testing.T) {
+
+	var seen []byte
+
+	c := &GSS{}
+	assert.Nil(t, c.setOptions([]Option{WithTokenHook(func(direction Direction, round int, token []byte) {
+		assert.Equal(t, Incoming, direction)
+		assert.Equal(t, 1, round)
+		seen = token
+		token[0] = 0
+	})}))
+
+	token := []byte{1, 2, 3}
+	c.hook(Incoming, 1, token)
+	assert.Equal(t, []byte{0, 2, 3}, seen)
+	assert.Equal(t, []byte{1, 2, 3}, token)
+
+	// No hook is a no-op
+	(&GSS{}).hook(Outgoing, 0, token)
+}
+
+func TestMessageID(t *testing.T) {
+
+	cases := []struct {
+		stable bool
+	}{
+		{false},
+		{true},
+	}
+
+	for _, tc := range cases {
+		s, restore := withFakeServer()
+
+		c := &GSS{}
+		assert.Nil(t, c.setOptions([]Option{WithStableMessageID(tc.stable)}))
+
+		id := c.messageID()
+		for round := 0; round < 3; round++ {
+			_, _, err := c.exchange(context.Background(), "192.0.2.1", "test.example.com.", tsig.GSS, id, round, []byte{1})
+			assert.Nil(t, err)
+		}
+
+		if assert.Len(t, s.ids, 3) {
+			if tc.stable {
+				assert.Equal(t, []uint16{id, id, id}, s.ids)
+			} else {
+				assert.Equal(t, uint16(0), id)
+				assert.False(t, s.ids[0] == s.ids[1] && s.ids[1] == s.ids[2])
+			}
+		}
+
+		restore()
+	}
+}
+
+func TestServerKeyName(t *testing.T) {
+
+	s, restore := withFakeServer()
+	defer restore()
+
+	s.Name = "server.example.com."
+
+	c := &GSS{}
+
+	// The server can choose the name in the first response
+	tkey, _, err := c.exchange(context.Background(), "192.0.2.1", "test.example.com.", tsig.GSS, 0, 0, []byte{1})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "server.example.com.", tkey.Header().Name)
+	}
+
+	_, _, err = c.exchange(context.Background(), "192.0.2.1", "SERVER.example.com.", tsig.GSS, 0, 1, []byte{1})
+	assert.Nil(t, err)
+
+	// But it mustn't change after that
+	_, _, err = c.exchange(context.Background(), "192.0.2.1", "test.example.com.", tsig.GSS, 0, 1, []byte{1})
+	assert.NotNil(t, err)
+}
+
+func TestCredentials(t *testing.T) {
+
+	configured := &Credentials{Domain: "EXAMPLE.COM", Username: "configured", Password: "secret"}
+	scoped := &Credentials{Domain: "EXAMPLE.COM", Username: "scoped", Keytab: "/etc/krb5.keytab"}
+
+	c := &GSS{}
+	assert.Nil(t, c.credentials(context.Background()))
+
+	assert.Nil(t, c.setOptions([]Option{WithCredentials(configured)}))
+	assert.Equal(t, configured, c.credentials(context.Background()))
+
+	// The context takes precedence
+	ctx := ContextWithCredentials(context.Background(), scoped)
+	assert.Equal(t, scoped, c.credentials(ctx))
+
+	creds, ok := CredentialsFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, scoped, creds)
+
+	_, ok = CredentialsFromContext(ContextWithCredentials(context.Background(), nil))
+	assert.False(t, ok)
+}
+
+func TestNegotiateGSSCancelled(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := (&GSS{}).NegotiateGSS(ctx, "ns.example.com")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestExchangeCancelled(t *testing.T) {
+
+	s, restore := withFakeServer()
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The context is passed through to the DNS client
+	_, _, err := (&GSS{}).exchange(ctx, "192.0.2.1", "test.example.com.", tsig.GSS, 0, 0, []byte{1})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Len(t, s.ids, 0)
+}
+
+func TestLegacyAlgorithm(t *testing.T) {
+
+	c := &GSS{}
+	assert.Equal(t, tsig.GSS, c.algorithm())
+	assert.Equal(t, tsig.GSS, c.Algorithm("test.example.com."))
+
+	assert.Nil(t, c.setOptions([]Option{WithLegacyAlgorithm()}))
+	assert.Equal(t, tsig.LegacyGSS, c.algorithm())
+
+	c.settings.algorithms.Store("test.example.com.", tsig.GSS)
+	assert.Equal(t, tsig.GSS, c.Algorithm("test.example.com."))
+	assert.Equal(t, tsig.LegacyGSS, c.Algorithm("other.example.com."))
+}
+
+func TestMutualAuth(t *testing.T) {
+
+	c := &GSS{}
+	assert.False(t, c.settings.optionalMutual)
+
+	assert.Nil(t, c.setOptions([]Option{WithMutualAuth(false)}))
+	assert.True(t, c.settings.optionalMutual)
+
+	assert.Nil(t, c.setOptions([]Option{WithMutualAuth(true)}))
+	assert.False(t, c.settings.optionalMutual)
+
+	_, ok := c.Flags("test.example.com.")
+	assert.False(t, ok)
+
+	c.settings.flags.Store("test.example.com.", FlagMutual|FlagInteg)
+	flags, ok := c.Flags("test.example.com.")
+	if assert.True(t, ok) {
+		assert.Equal(t, Flags(0x22), flags)
+	}
+}
+
+func TestQoP(t *testing.T) {
+
+	c := &GSS{}
+	assert.Nil(t, c.setOptions([]Option{WithQoP(0)}))
+
+	err := c.setOptions([]Option{WithQoP(1)})
+	if qopSupported {
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(1), c.settings.qop)
+	} else {
+		assert.NotNil(t, err)
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+
+	c := &GSS{}
+
+	err := c.setOptions([]Option{WithImpersonation("user@EXAMPLE.COM")})
+	if impersonationSupported {
+		assert.Nil(t, err)
+		assert.Equal(t, "user@EXAMPLE.COM", c.settings.impersonate)
+	} else {
+		assert.NotNil(t, err)
+	}
+
+	for _, user := range []string{"", " ", "@EXAMPLE.COM", "user@"} {
+		assert.NotNil(t, c.setOptions([]Option{WithImpersonation(user)}), user)
+	}
+
+	err = &S4UError{Step: "S4U2Proxy", User: "user@EXAMPLE.COM", Err: errors.New("KDC_ERR_BADOPTION")}
+	assert.Equal(t, "S4U2Proxy for user@EXAMPLE.COM: KDC_ERR_BADOPTION", err.Error())
+	assert.Equal(t, "KDC_ERR_BADOPTION", errors.Unwrap(err).Error())
+}
+
+func TestGSSError(t *testing.T) {
+
+	cause := errors.New("clock skew too great")
+
+	err := &GSSError{
+		Major:     MajorFailure,
+		Minor:     krb5MinorBase + 37,
+		MajorText: majorText(MajorFailure),
+		MinorText: "KRB_AP_ERR_SKEW",
+		Err:       cause,
+	}
+	assert.Equal(t, "gss: unspecified GSS failure, the minor status may provide more information (major 0xd0000), KRB_AP_ERR_SKEW (minor 0x96c73a25): clock skew too great", err.Error())
+	assert.Equal(t, cause, errors.Unwrap(err))
+
+	code, ok := err.KerberosError()
+	assert.True(t, ok)
+	assert.Equal(t, int32(37), code)
+
+	err = &GSSError{
+		Major:     MajorDefectiveToken,
+		Minor:     0x80090308,
+		MajorText: majorText(MajorDefectiveToken),
+		Err:       cause,
+	}
+	assert.Equal(t, "gss: a token was invalid (major 0x90000): clock skew too great", err.Error())
+
+	_, ok = err.KerberosError()
+	assert.False(t, ok)
+
+	// The calling and supplementary bits are ignored
+	assert.Equal(t, majorText(MajorNoCred), majorText(MajorNoCred|1))
+	assert.Equal(t, "unknown major status 0x1", majorText(1))
+}
+
+func TestGSSErrorCategory(t *testing.T) {
+
+	tables := []struct {
+		major, minor uint32
+		category     Category
+	}{
+		{MajorFailure, krb5MinorBase + 37, CategoryClockSkew},
+		{MajorFailure, krb5MinorBase + 7, CategoryBadSPN},
+		{MajorFailure, krb5MinorBase + 32, CategoryCredentials},
+		{MajorFailure, krb5MinorBase + 24, CategoryCredentials},
+		{MajorFailure, krb5MinorBase + 68, CategoryRealm},
+		{MajorFailure, 0x80090324, CategoryClockSkew},
+		{MajorBadName, 0x80090303, CategoryBadSPN},
+		{MajorFailure, 0x80090311, CategoryRealm},
+		// The minor status takes precedence over the major status
+		{MajorNoCred, krb5MinorBase + 37, CategoryClockSkew},
+		// An unknown minor status falls back to the major status
+		{MajorNoCred, krb5MinorBase + 60, CategoryCredentials},
+		{MajorCredentialsExpired | 1, 0, CategoryCredentials},
+		{MajorBadName, 0, CategoryBadSPN},
+		{MajorDefectiveToken, 0, CategoryServerRejected},
+		{MajorFailure, 0, CategoryUnknown},
+		{MajorFailure, 0x12345678, CategoryUnknown},
+	}
+
+	for _, table := range tables {
+		err := &GSSError{Major: table.major, Minor: table.minor}
+		assert.Equal(t, table.category, err.Category(), "%#x %#x", table.major, table.minor)
+		if table.category == CategoryUnknown {
+			assert.Equal(t, "", err.Hint())
+		} else {
+			assert.NotEqual(t, "", err.Hint())
+		}
+	}
+
+	assert.Equal(t, "clock skew", CategoryClockSkew.String())
+	assert.Equal(t, "server rejected", CategoryServerRejected.String())
+	assert.Equal(t, "unknown", Category(100).String())
+}
+
+func TestWithAlgorithm(t *testing.T) {
+
+	c := &GSS{}
+
+	assert.Nil(t, c.setOptions([]Option{WithAlgorithm("GSS.Microsoft.Com.")}))
+	assert.Equal(t, tsig.LegacyGSS, c.algorithm())
+
+	assert.Nil(t, c.setOptions([]Option{WithAlgorithm(tsig.GSS)}))
+	assert.Equal(t, tsig.GSS, c.algorithm())
+
+	for _, algorithm := range []string{"", "gss-tsig", dns.HmacSHA256} {
+		assert.NotNil(t, c.setOptions([]Option{WithAlgorithm(algorithm)}), algorithm)
+	}
+}
+
+func TestEmptyTokens(t *testing.T) {
+
+	s, restore := withFakeServer()
+	defer restore()
+
+	// negotiate runs the loop of a multi round trip implementation against
+	// the server which only ever sends empty tokens, the mechanism
+	// completes once it has been given that many
+	negotiate := func(c *GSS, complete int) (int, error) {
+		empty := c.emptyTokens()
+		for round := 0; ; round++ {
+			_, input, err := c.exchange(context.Background(), "192.0.2.1", "test.example.com.", tsig.GSS, 0, round, []byte{1})
+			if err != nil {
+				return round, err
+			}
+			if err := empty.check(input); err != nil {
+				return round, err
+			}
+			if round+1 == complete {
+				return round, nil
+			}
+		}
+	}
+
+	c := &GSS{}
+
+	// An empty token then the context is complete
+	round, err := negotiate(c, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, round)
+
+	// An empty token that isn't the end doesn't go round forever
+	round, err = negotiate(c, 0)
+	assert.True(t, errors.Is(err, ErrEmptyTokens))
+	assert.Equal(t, "too many empty tokens from the server, 2 in a row", err.Error())
+	assert.Equal(t, 1, round)
+	assert.Len(t, s.ids, 3)
+
+	assert.Nil(t, c.setOptions([]Option{WithEmptyTokenLimit(3)}))
+
+	round, err = negotiate(c, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, round)
+
+	round, err = negotiate(c, 0)
+	assert.True(t, errors.Is(err, ErrEmptyTokens))
+	assert.Equal(t, 3, round)
+
+	// Any token resets the count
+	empty := c.emptyTokens()
+	for _, token := range [][]byte{{}, {}, {}, {1}, {}, {}, {}} {
+		assert.Nil(t, empty.check(token))
+	}
+	assert.NotNil(t, empty.check(nil))
+
+	assert.NotNil(t, c.setOptions([]Option{WithEmptyTokenLimit(0)}))
+}
+
+func TestAlgorithmFallback(t *testing.T) {
+
+	s, restore := withFakeServer()
+	defer restore()
+
+	s.Reject = tsig.GSS
+
+	c := &GSS{}
+
+	// The server only accepts the legacy name
+	tkey, _, err := c.exchange(context.Background(), "192.0.2.1", "test.example.com.", tsig.GSS, 0, 0, []byte{1})
+	if assert.Nil(t, err) {
+		assert.Equal(t, tsig.LegacyGSS, tkey.Algorithm)
+	}
+	assert.Len(t, s.ids, 2)
+
+	// There's no fallback after the first round
+	_, _, err = c.exchange(context.Background(), "192.0.2.1", "test.example.com.", tsig.GSS, 0, 1, []byte{1})
+	assert.NotNil(t, err)
+	assert.Len(t, s.ids, 3)
+}
+
+func TestDeletePolicy(t *testing.T) {
+
+	failed := &UpdateError{Rcode: dns.RcodeRefused}
+	assert.Equal(t, "DNS error: REFUSED (5)", failed.Error())
+
+	assert.True(t, DeleteAlways(nil))
+	assert.True(t, DeleteAlways(failed))
+	assert.True(t, DeleteOnSuccess(nil))
+	assert.False(t, DeleteOnSuccess(failed))
+
+	keyname := "test.example.com."
+
+	cases := []struct {
+		policy DeletePolicy
+		err    error
+		kept   bool
+	}{
+		{nil, nil, false},
+		{nil, failed, false},
+		{DeleteOnSuccess, nil, false},
+		{DeleteOnSuccess, failed, true},
+	}
+
+	for _, tc := range cases {
+		c, err := New(WithDeletePolicy(tc.policy))
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		kept, err := c.finishUpdate(&keyname, tc.err)
+		if tc.kept {
+			assert.Equal(t, &keyname, kept)
+			assert.Equal(t, tc.err, err)
+		} else {
+			// There is no real context so deleting it fails, which shows
+			// it was attempted
+			assert.Nil(t, kept)
+			assert.NotNil(t, err)
+			if tc.err != nil {
+				assert.Contains(t, err.Error(), "REFUSED")
+			}
+		}
+	}
+}
+
+// FakeAddrResolver maps addresses to names and names to addresses
+type FakeAddrResolver struct {
+	Names map[string][]string
+	Addrs map[string][]string
+}
+
+func (r *FakeAddrResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+
+	names, ok := r.Names[addr]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	return names, nil
+}
+
+func (r *FakeAddrResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+
+	addrs, ok := r.Addrs[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	return addrs, nil
+}
+
+func TestSPNForAddress(t *testing.T) {
+
+	r := &FakeAddrResolver{
+		Names: map[string][]string{
+			"192.0.2.1":   {"ns.example.com."},
+			"192.0.2.2":   {"stale.example.com.", "ns2.example.com."},
+			"192.0.2.3":   {"spoofed.example.com."},
+			"192.0.2.4":   {},
+			"2001:db8::1": {"ns6.example.com."},
+		},
+		Addrs: map[string][]string{
+			"ns.example.com.":      {"192.0.2.1"},
+			"ns2.example.com.":     {"192.0.2.2"},
+			"spoofed.example.com.": {"198.51.100.1"},
+			"ns6.example.com.":     {"2001:0db8:0000:0000:0000:0000:0000:0001"},
+		},
+	}
+
+	cases := []struct {
+		addr    string
+		confirm bool
+		spn     string
+	}{
+		{"192.0.2.1", true, "DNS/ns.example.com"},
+		{"192.0.2.2", true, "DNS/ns2.example.com"},
+		{"192.0.2.2", false, "DNS/stale.example.com"},
+		{"192.0.2.3", true, ""},
+		{"192.0.2.3", false, "DNS/spoofed.example.com"},
+		{"192.0.2.4", false, ""},
+		{"192.0.2.5", false, ""},
+		{"2001:db8::1", true, "DNS/ns6.example.com"},
+		{"ns.example.com", false, ""},
+	}
+
+	for _, tc := range cases {
+		spn, err := SPNForAddress(context.Background(), r, tc.addr, tc.confirm)
+		if tc.spn == "" {
+			var serr *SPNError
+			if assert.True(t, errors.As(err, &serr)) {
+				assert.Equal(t, tc.addr, serr.Address)
+			}
+			continue
+		}
+		if assert.Nil(t, err) {
+			assert.Equal(t, tc.spn, spn)
+		}
+	}
+}
+
+func TestWithClock(t *testing.T) {
+
+	expiry := time.Unix(1600000000, 0)
+	now := expiry.Add(-time.Second)
+
+	c := &GSS{}
+	assert.Nil(t, c.setOptions([]Option{WithClock(func() time.Time { return now })}))
+
+	_, ok := c.Remaining("test.example.com.")
+	assert.False(t, ok)
+
+	c.settings.expiries.Store("test.example.com.", expiry)
+
+	remaining, ok := c.Remaining("test.example.com.")
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, remaining)
+
+	// Step the clock past the expiry
+	now = now.Add(2 * time.Second)
+
+	remaining, _ = c.Remaining("test.example.com.")
+	assert.Equal(t, -time.Second, remaining)
+}
+
+func TestEvents(t *testing.T) {
+
+	_, restore := withFakeServer()
+	defer restore()
+
+	stream := tsig.NewEventStream(0)
+
+	c := &GSS{}
+	assert.Nil(t, c.setOptions([]Option{WithEvents(stream)}))
+
+	_, _, err := c.exchange(context.Background(), "192.0.2.1", "test.example.com.", tsig.GSS, 0, 0, []byte{1})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	c.established("test.example.com.", time.Unix(1600000000, 0))
+	c.forget("test.example.com.")
+
+	var types []tsig.EventType
+	var incoming []bool
+	for len(stream.Events()) > 0 {
+		e := <-stream.Events()
+		types = append(types, e.Type)
+		if e.Type == tsig.EventToken {
+			incoming = append(incoming, e.Incoming)
+		}
+	}
+
+	assert.Equal(t, []tsig.EventType{
+		tsig.EventToken,
+		tsig.EventResolve,
+		tsig.EventSend,
+		tsig.EventReceive,
+		tsig.EventToken,
+		tsig.EventKeyEstablished,
+		tsig.EventKeyDeleted,
+	}, types)
+	assert.Equal(t, []bool{false, true}, incoming)
+}
+
+// prefixServer checks each token from the client is length-prefixed with a
+// single byte and answers with a length-prefixed token
+type prefixServer struct {
+	seen []byte
+}
+
+func (s *prefixServer) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	s.seen, _ = tsig.DecodeTKEYKey(m.Extra[0].(*dns.TKEY).Key)
+
+	r := gssReply(m, m.Question[0].Name)
+	r.Answer[0].(*dns.TKEY).Key = tsig.EncodeTKEYKey([]byte{2, 0xbe, 0xef})
+	r.Answer[0].(*dns.TKEY).KeySize = 3
+
+	return r, 0, nil
+}
+
+func TestLengthPrefix(t *testing.T) {
+
+	c := &GSS{}
+
+	for _, size := range []int{0, 3, 8} {
+		assert.NotNil(t, c.setOptions([]Option{WithLengthPrefix(size)}), size)
+	}
+
+	tables := []struct {
+		size   int
+		token  []byte
+		prefix []byte
+	}{
+		{1, []byte{0xde, 0xad}, []byte{2}},
+		{2, []byte{0xde, 0xad}, []byte{0, 2}},
+		{4, []byte{0xde, 0xad}, []byte{0, 0, 0, 2}},
+		{4, []byte{}, []byte{0, 0, 0, 0}},
+	}
+
+	for _, table := range tables {
+		assert.Nil(t, c.setOptions([]Option{WithLengthPrefix(table.size)}))
+
+		b, err := c.addLengthPrefix(table.token)
+		if assert.Nil(t, err) {
+			assert.Equal(t, append(table.prefix, table.token...), b)
+		}
+
+		token, err := c.stripLengthPrefix(b)
+		if assert.Nil(t, err) {
+			assert.Equal(t, table.token, token)
+		}
+	}
+
+	// Mismatched prefixes are rejected
+	assert.Nil(t, c.setOptions([]Option{WithLengthPrefix(2)}))
+	for _, b := range [][]byte{{0}, {0, 3, 0xde, 0xad}} {
+		_, err := c.stripLengthPrefix(b)
+		assert.NotNil(t, err)
+	}
+
+	// An empty key is an empty token
+	token, err := c.stripLengthPrefix([]byte{})
+	if assert.Nil(t, err) {
+		assert.Len(t, token, 0)
+	}
+
+	assert.Nil(t, c.setOptions([]Option{WithLengthPrefix(1)}))
+	_, err = c.addLengthPrefix(make([]byte, 256))
+	assert.NotNil(t, err)
+
+	// Off by default
+	b, err := (&GSS{}).addLengthPrefix([]byte{0xde, 0xad})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte{0xde, 0xad}, b)
+	}
+
+	s := &prefixServer{}
+
+	client := tsig.DefaultClient
+	tsig.DefaultClient = &tsig.Client{Exchanger: s}
+	defer func() {
+		tsig.DefaultClient = client
+	}()
+
+	_, input, err := c.exchange(context.Background(), "192.0.2.1", "test.example.com.", tsig.GSS, 0, 0, []byte{0xde, 0xad})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte{2, 0xde, 0xad}, s.seen)
+		assert.Equal(t, []byte{0xbe, 0xef}, input)
+	}
+}
+
+func TestSendUpdates(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			r := new(dns.Msg)
+			r.SetReply(m)
+			w.WriteMsg(r)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	c, err := New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	results, err := c.SendUpdates(context.Background(), l.Addr().String(), "test.example.com.", nil)
+	assert.Nil(t, err)
+	assert.Len(t, results, 0)
+
+	updates := []*tsig.Update{
+		{Zone: "example.com."},
+		{Zone: "example.com."},
+	}
+
+	// There is no context for the key name so signing the first update
+	// fails and the second is never sent
+	results, err = c.SendUpdates(context.Background(), l.Addr().String(), "test.example.com.", updates)
+	assert.NotNil(t, err)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, updates[0], results[0].Update)
+		assert.True(t, results[0].Sent)
+		assert.Equal(t, err, results[0].Err)
+		assert.Equal(t, updates[1], results[1].Update)
+		assert.False(t, results[1].Sent)
+		assert.Nil(t, results[1].Err)
+	}
+}
+
+func TestUpdatePTR(t *testing.T) {
+
+	c, err := New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	// The inputs are checked before anything is sent
+	assert.NotNil(t, c.UpdatePTR(context.Background(), "ns.example.com", "test.example.com.", "", nil, "host.example.com.", 300))
+	assert.NotNil(t, c.UpdatePTR(context.Background(), "ns.example.com", "test.example.com.", "", net.ParseIP("192.0.2.1"), "", 300))
+}
+
+func TestCredentialsTimeout(t *testing.T) {
+
+	_, err := New(WithCredentialsTimeout(-time.Second))
+	assert.NotNil(t, err)
+
+	c, err := New(WithCredentialsTimeout(10 * time.Millisecond))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	failed := errors.New("failed")
+	assert.Equal(t, failed, c.acquireBounded(context.Background(), func() error {
+		return failed
+	}, nil))
+
+	release := make(chan struct{})
+	discarded := make(chan struct{})
+
+	err = c.acquireBounded(context.Background(), func() error {
+		<-release
+		return nil
+	}, func() {
+		close(discarded)
+	})
+	assert.True(t, errors.Is(err, ErrCredentialsTimeout))
+	assert.Contains(t, err.Error(), "10ms")
+
+	// What was acquired after giving up is released
+	close(release)
+	<-discarded
+
+	c.settings.credentialsTimeout = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	release = make(chan struct{})
+	defer close(release)
+
+	assert.Equal(t, context.Canceled, c.acquireBounded(ctx, func() error {
+		<-release
+		return nil
+	}, nil))
+}
+
+func TestNegotiateFallback(t *testing.T) {
+
+	assert.Equal(t, "current user", (*Credentials)(nil).Principal())
+	assert.Equal(t, "user@EXAMPLE.COM", (&Credentials{Domain: "EXAMPLE.COM", Username: "user"}).Principal())
+
+	assert.True(t, authFailure(&GSSError{Major: MajorNoCred}))
+	assert.True(t, authFailure(&RealmError{Realm: "EXAMPLE.COM", Err: &GSSError{Major: MajorFailure}}))
+	assert.True(t, authFailure(fmt.Errorf("%w after 1s", ErrCredentialsTimeout)))
+	assert.True(t, authFailure(&tsig.TKEYError{Code: dns.RcodeBadKey}))
+	assert.False(t, authFailure(&tsig.TKEYError{Code: dns.RcodeBadAlg}))
+	assert.False(t, authFailure(context.DeadlineExceeded))
+
+	c := &GSS{}
+
+	_, _, _, err := c.NegotiateFallback(context.Background(), "ns.example.com")
+	assert.NotNil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, used, err := c.NegotiateFallback(ctx, "ns.example.com", nil, &Credentials{Domain: "EXAMPLE.COM", Username: "user"})
+	assert.Nil(t, used)
+	if assert.NotNil(t, err) {
+		assert.True(t, errors.Is(err.(*multierror.Error).Errors[0], context.Canceled))
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+
+	client := tsig.DefaultClient
+	tsig.DefaultClient = &tsig.Client{Resolver: &FakeAddrResolver{}}
+	defer func() {
+		tsig.DefaultClient = client
+	}()
+
+	c, err := New(WithCredentials(&Credentials{Domain: "EXAMPLE.COM", Username: "user", Keytab: "/nonexistent"}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	report := c.Diagnose(context.Background(), "ns.example.com", nil)
+	assert.True(t, report.Failed())
+
+	check, ok := report.Check(tsig.CheckResolve)
+	if assert.True(t, ok) {
+		assert.Equal(t, tsig.StatusFail, check.Status)
+	}
+
+	check, ok = report.Check(CheckCredentials)
+	if assert.True(t, ok) {
+		assert.Equal(t, tsig.StatusFail, check.Status)
+		assert.Equal(t, "Couldn't acquire credentials for user@EXAMPLE.COM", check.Detail)
+		assert.NotNil(t, check.Err)
+	}
+}
+
+func TestAllowedServers(t *testing.T) {
+
+	_, err := New(WithAllowedServers(""))
+	assert.NotNil(t, err)
+
+	c, err := New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	// Any server is allowed by default
+	assert.Nil(t, c.checkServer("DNS/ns.example.com@EXAMPLE.COM", false))
+
+	assert.Nil(t, c.setOptions([]Option{WithAllowedServers("DNS/ns1.example.com", "DNS/ns2.example.com@EXAMPLE.COM")}))
+
+	assert.Nil(t, c.checkServer("DNS/NS1.example.com@EXAMPLE.COM", true))
+	assert.Nil(t, c.checkServer("DNS/ns2.example.com@example.com", true))
+	assert.Nil(t, c.checkServer("DNS/ns1.example.com", true))
+
+	// The realm must match if it is included
+	assert.NotNil(t, c.checkServer("DNS/ns2.example.com@OTHER.COM", true))
+
+	err = c.checkServer("DNS/rogue.example.com@EXAMPLE.COM", true)
+	var serr *ServerError
+	if assert.True(t, errors.As(err, &serr)) {
+		assert.Equal(t, "DNS/rogue.example.com@EXAMPLE.COM", serr.Principal)
+		assert.Equal(t, "server authenticated as DNS/rogue.example.com@EXAMPLE.COM which is not one of the allowed servers [DNS/ns1.example.com, DNS/ns2.example.com@EXAMPLE.COM]", err.Error())
+	}
+
+	// Without mutual authentication the server hasn't proven who it is
+	err = c.checkServer("DNS/ns1.example.com@EXAMPLE.COM", false)
+	if assert.True(t, errors.As(err, &serr)) {
+		assert.False(t, serr.Mutual)
+	}
+
+	_, ok := c.ServerPrincipal("test.example.com.")
+	assert.False(t, ok)
+
+	c.settings.servers.Store("test.example.com.", "DNS/ns1.example.com@EXAMPLE.COM")
+	c.established("test.example.com.", time.Unix(1600000000, 0))
+
+	principal, ok := c.ServerPrincipal("test.example.com.")
+	assert.True(t, ok)
+	assert.Equal(t, "DNS/ns1.example.com@EXAMPLE.COM", principal)
+	if keys := c.Keys(); assert.Len(t, keys, 1) {
+		assert.Equal(t, "DNS/ns1.example.com@EXAMPLE.COM", keys[0].Server)
+	}
+
+	c.forget("test.example.com.")
+
+	_, ok = c.ServerPrincipal("test.example.com.")
+	assert.False(t, ok)
+}
+
+func TestVerifyKey(t *testing.T) {
+
+	c, err := New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	// Nothing is sent for a key that was never negotiated
+	status, err := c.VerifyKey(context.Background(), "ns.example.com", "test.example.com.", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, tsig.KeyUnknown, status)
+
+	c.established("test.example.com.", time.Now().Add(-time.Second))
+	defer c.forget("test.example.com.")
+
+	status, err = c.VerifyKey(context.Background(), "ns.example.com", "test.example.com.", "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, tsig.KeyExpired, status)
+}
+
+func TestTransfer(t *testing.T) {
+
+	c, err := New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	// The transfer is checked before anything is sent
+	_, err = c.Transfer(context.Background(), "ns.example.com", "test.example.com.", &tsig.Transfer{})
+	assert.NotNil(t, err)
+
+	_, err = c.TransferRecords(context.Background(), "ns.example.com", "test.example.com.", &tsig.Transfer{})
+	assert.NotNil(t, err)
+}
+
+func TestRefresh(t *testing.T) {
+
+	c, err := New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	// Only a context negotiated by this client can be refreshed
+	_, _, err = c.Refresh(context.Background(), "test.example.com.")
+	assert.NotNil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = c.Refresh(ctx, "test.example.com.")
+	assert.Equal(t, context.Canceled, err)
+
+	c.established("test.example.com.", time.Now().Add(time.Hour))
+	c.settings.origins.Store("test.example.com.", origin{
+		host: "ns.example.com",
+		credentials: &Credentials{
+			Username: "user",
+			Domain:   "EXAMPLE.COM",
+			Keytab:   "/nonexistent",
+		},
+	})
+	defer c.forget("test.example.com.")
+
+	// A failed renegotiation leaves the old context alone
+	_, _, err = c.Refresh(context.Background(), "test.example.com.")
+	assert.NotNil(t, err)
+	if keys := c.Keys(); assert.Len(t, keys, 1) {
+		assert.Equal(t, "test.example.com.", keys[0].Name)
+	}
+}
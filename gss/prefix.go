@@ -0,0 +1,84 @@
+package gss
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// WithLengthPrefix makes negotiation put the length of each GSS token,
+// big-endian in size bytes, before it in the TKEY key field and expect the
+// server to do the same, stripping it before the token is handed to the GSS
+// library. It is a compatibility shim for nonstandard servers that
+// length-prefix the token. RFC 3645 carries the token as is and neither BIND
+// nor Active Directory use a prefix so it is off by default. The size must
+// be one, two or four. An empty key field from the server is still treated
+// as an empty token.
+func WithLengthPrefix(size int) Option {
+
+	return func(c *GSS) error {
+		switch size {
+		case 1, 2, 4:
+		default:
+			return fmt.Errorf("length prefix must be one, two or four bytes")
+		}
+		c.settings.lengthPrefix = size
+		return nil
+	}
+}
+
+// addLengthPrefix returns the token prefixed with its length if
+// WithLengthPrefix is set.
+func (c *GSS) addLengthPrefix(token []byte) ([]byte, error) {
+
+	size := c.settings.lengthPrefix
+	if size == 0 {
+		return token, nil
+	}
+
+	if max := uint64(1)<<(8*uint(size)) - 1; uint64(len(token)) > max {
+		return nil, fmt.Errorf("token of %d bytes is too long for a %d byte length prefix", len(token), size)
+	}
+
+	b := make([]byte, size+len(token))
+	switch size {
+	case 1:
+		b[0] = byte(len(token))
+	case 2:
+		binary.BigEndian.PutUint16(b, uint16(len(token)))
+	case 4:
+		binary.BigEndian.PutUint32(b, uint32(len(token)))
+	}
+	copy(b[size:], token)
+
+	return b, nil
+}
+
+// stripLengthPrefix returns the token without its length prefix if
+// WithLengthPrefix is set, checking the prefix matches.
+func (c *GSS) stripLengthPrefix(b []byte) ([]byte, error) {
+
+	size := c.settings.lengthPrefix
+	if size == 0 || len(b) == 0 {
+		return b, nil
+	}
+
+	if len(b) < size {
+		return nil, fmt.Errorf("token of %d bytes is too short for a %d byte length prefix", len(b), size)
+	}
+
+	var length uint64
+	switch size {
+	case 1:
+		length = uint64(b[0])
+	case 2:
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		length = uint64(binary.BigEndian.Uint32(b))
+	}
+
+	if length != uint64(len(b)-size) {
+		return nil, fmt.Errorf("token length prefix of %d does not match %d bytes", length, len(b)-size)
+	}
+
+	return b[size:], nil
+}
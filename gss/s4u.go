@@ -0,0 +1,199 @@
+// +build !windows,!apcera
+
+package gss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/crypto/rfc4757"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// The KDC option requesting a ticket for the client of the additional
+// ticket, RFC 4120 section 5.4.1 and MS-SFU section 2.2.3
+const cnameInAddlTkt = 14
+
+// paForUser is the PA-FOR-USER pre-authentication data of MS-SFU section
+// 2.2.1 naming the user the service wants a ticket for
+type paForUser struct {
+	UserName    types.PrincipalName `asn1:"explicit,tag:0"`
+	UserRealm   string              `asn1:"generalstring,explicit,tag:1"`
+	Cksum       types.Checksum      `asn1:"explicit,tag:2"`
+	AuthPackage string              `asn1:"generalstring,explicit,tag:3"`
+}
+
+// splitPrincipal splits "user@REALM" into the principal name and realm, the
+// given realm is used if there isn't one.
+func splitPrincipal(user, realm string) (types.PrincipalName, string) {
+
+	if i := strings.LastIndex(user, "@"); i >= 0 {
+		user, realm = user[:i], user[i+1:]
+	}
+
+	return types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user), strings.ToUpper(realm)
+}
+
+// newPAForUser returns the PA-FOR-USER data for the user, the checksum is
+// keyed with the session key of the TGT it is sent with.
+func newPAForUser(user types.PrincipalName, realm string, key types.EncryptionKey) (types.PAData, error) {
+
+	auth := "Kerberos"
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, user.NameType); err != nil {
+		return types.PAData{}, err
+	}
+	for _, s := range user.NameString {
+		b.WriteString(s)
+	}
+	b.WriteString(realm)
+	b.WriteString(auth)
+
+	cksum, err := rfc4757.Checksum(key.KeyValue, keyusage.KERB_NON_KERB_CKSUM_SALT, b.Bytes())
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	value, err := asn1.Marshal(paForUser{
+		UserName:  user,
+		UserRealm: realm,
+		Cksum: types.Checksum{
+			CksumType: chksumtype.KERB_CHECKSUM_HMAC_MD5,
+			Checksum:  cksum,
+		},
+		AuthPackage: auth,
+	})
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	return types.PAData{
+		PADataType:  patype.PA_FOR_USER,
+		PADataValue: value,
+	}, nil
+}
+
+// signTGSReq replaces the authenticator of the request so it covers the
+// request body as modified and names the service, the request body names
+// the user instead so gokrb5 accepts the reply which is issued to the user.
+func signTGSReq(req *messages.TGSReq, service types.PrincipalName, tgt messages.Ticket, key types.EncryptionKey) error {
+
+	b, err := req.ReqBody.Marshal()
+	if err != nil {
+		return err
+	}
+
+	etype, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return err
+	}
+
+	cb, err := etype.GetChecksumHash(key.KeyValue, b, keyusage.TGS_REQ_PA_TGS_REQ_AP_REQ_AUTHENTICATOR_CHKSUM)
+	if err != nil {
+		return err
+	}
+
+	auth, err := types.NewAuthenticator(tgt.Realm, service)
+	if err != nil {
+		return err
+	}
+	auth.Cksum = types.Checksum{
+		CksumType: etype.GetHashID(),
+		Checksum:  cb,
+	}
+
+	apreq, err := messages.NewAPReq(tgt, key, auth)
+	if err != nil {
+		return err
+	}
+
+	apb, err := apreq.Marshal()
+	if err != nil {
+		return err
+	}
+
+	req.PAData = types.PADataSequence{
+		types.PAData{
+			PADataType:  patype.PA_TGS_REQ,
+			PADataValue: apb,
+		},
+	}
+
+	return nil
+}
+
+// impersonate obtains a ticket to the SPN for the user on behalf of the
+// service authenticated by the client, first a forwardable ticket to the
+// service itself with S4U2Self then a ticket to the SPN with S4U2Proxy.
+// It returns the ticket, its session key, a client for the user to build the
+// AP-REQ with, and any error that occurred.
+func impersonate(cl *client.Client, spn, user string) (messages.Ticket, types.EncryptionKey, *client.Client, error) {
+
+	realm := cl.Credentials.Domain()
+	service := cl.Credentials.CName()
+	cname, crealm := splitPrincipal(user, realm)
+
+	tgt, key, err := cl.GetServiceTicket("krbtgt/" + realm)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, nil, err
+	}
+
+	tgsReq, err := messages.NewTGSReq(service, realm, cl.Config, tgt, key, service, false)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, nil, err
+	}
+	tgsReq.ReqBody.CName = cname
+	types.SetFlag(&tgsReq.ReqBody.KDCOptions, flags.Forwardable)
+
+	if err = signTGSReq(&tgsReq, service, tgt, key); err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, nil, err
+	}
+
+	pa, err := newPAForUser(cname, crealm, key)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, nil, err
+	}
+	tgsReq.PAData = append(tgsReq.PAData, pa)
+
+	_, self, err := cl.TGSExchange(tgsReq, realm, tgt, key, 0)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, nil, &S4UError{Step: "S4U2Self", User: user, Err: err}
+	}
+
+	princ := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, spn)
+
+	tgsReq, err = messages.NewTGSReq(service, realm, cl.Config, tgt, key, princ, false)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, nil, err
+	}
+	tgsReq.ReqBody.CName = cname
+	tgsReq.ReqBody.AdditionalTickets = []messages.Ticket{self.Ticket}
+	types.SetFlag(&tgsReq.ReqBody.KDCOptions, cnameInAddlTkt)
+
+	if err = signTGSReq(&tgsReq, service, tgt, key); err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, nil, err
+	}
+
+	_, proxy, err := cl.TGSExchange(tgsReq, realm, tgt, key, 0)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, nil, &S4UError{Step: "S4U2Proxy", User: user, Err: err}
+	}
+
+	// The authenticator of the AP-REQ must name the user of the ticket
+	creds := credentials.New(cname.PrincipalNameString(), crealm)
+	creds.SetCName(cname)
+
+	return proxy.Ticket, proxy.DecryptedEncPart.Key, &client.Client{Credentials: creds, Config: cl.Config}, nil
+}
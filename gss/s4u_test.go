@@ -0,0 +1,72 @@
+// +build !windows,!apcera
+
+package gss
+
+import (
+	"testing"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitPrincipal(t *testing.T) {
+
+	cases := []struct {
+		user, realm string
+		name        []string
+		wantRealm   string
+	}{
+		{"user", "EXAMPLE.COM", []string{"user"}, "EXAMPLE.COM"},
+		{"user@other.example.com", "EXAMPLE.COM", []string{"user"}, "OTHER.EXAMPLE.COM"},
+		{"host/ns.example.com@EXAMPLE.COM", "", []string{"host", "ns.example.com"}, "EXAMPLE.COM"},
+	}
+
+	for _, tc := range cases {
+		name, realm := splitPrincipal(tc.user, tc.realm)
+		assert.Equal(t, nametype.KRB_NT_PRINCIPAL, name.NameType)
+		assert.Equal(t, tc.name, name.NameString)
+		assert.Equal(t, tc.wantRealm, realm)
+	}
+}
+
+func TestPAForUser(t *testing.T) {
+
+	key := types.EncryptionKey{
+		KeyType:  etypeID.AES256_CTS_HMAC_SHA1_96,
+		KeyValue: make([]byte, 32),
+	}
+
+	user, realm := splitPrincipal("user@EXAMPLE.COM", "")
+
+	pa, err := newPAForUser(user, realm, key)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, patype.PA_FOR_USER, pa.PADataType)
+
+	var decoded paForUser
+	_, err = asn1.Unmarshal(pa.PADataValue, &decoded)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"user"}, decoded.UserName.NameString)
+		assert.Equal(t, "EXAMPLE.COM", decoded.UserRealm)
+		assert.Equal(t, "Kerberos", decoded.AuthPackage)
+		assert.Equal(t, chksumtype.KERB_CHECKSUM_HMAC_MD5, decoded.Cksum.CksumType)
+		assert.Len(t, decoded.Cksum.Checksum, 16)
+	}
+
+	// The checksum covers the user
+	other, realm := splitPrincipal("other@EXAMPLE.COM", "")
+
+	pa2, err := newPAForUser(other, realm, key)
+	if assert.Nil(t, err) {
+		var decoded2 paForUser
+		if _, err = asn1.Unmarshal(pa2.PADataValue, &decoded2); assert.Nil(t, err) {
+			assert.NotEqual(t, decoded.Cksum.Checksum, decoded2.Cksum.Checksum)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package gss
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ServerError is returned when the server authenticated as a principal that
+// isn't one of those set with WithAllowedServers, or didn't authenticate
+// itself at all.
+type ServerError struct {
+	// Principal is who the server authenticated as
+	Principal string
+	// Mutual is whether the server authenticated itself
+	Mutual  bool
+	Allowed []string
+}
+
+func (e *ServerError) Error() string {
+
+	if !e.Mutual {
+		return fmt.Sprintf("server didn't authenticate itself as %s, an allowed server requires mutual authentication", e.Principal)
+	}
+
+	return fmt.Sprintf("server authenticated as %s which is not one of the allowed servers [%s]", e.Principal, strings.Join(e.Allowed, ", "))
+}
+
+// WithAllowedServers fails negotiation with a ServerError unless the server
+// authenticates as one of the service principals, such as
+// "DNS/ns1.example.com". They are compared ignoring case and any realm that
+// the allowed name doesn't include. This catches a server that was reached
+// by mistake, for example through a stale SRV record, even though Kerberos
+// itself succeeded. It requires mutual authentication, as otherwise the
+// server hasn't proven who it is, regardless of WithMutualAuth. The context
+// the server has established is left to expire.
+func WithAllowedServers(principals ...string) Option {
+
+	return func(c *GSS) error {
+		for _, principal := range principals {
+			if principal == "" {
+				return fmt.Errorf("allowed server principal must not be empty")
+			}
+		}
+		c.settings.allowedServers = principals
+		return nil
+	}
+}
+
+// ServerPrincipal returns the principal the server authenticated as when the
+// context for the key name was negotiated, whether or not WithAllowedServers
+// is used. Without mutual authentication it is the principal that was
+// requested.
+// It returns the principal and whether the key name is known.
+func (c *GSS) ServerPrincipal(keyname string) (string, bool) {
+
+	principal, ok := c.settings.servers.Load(keyname)
+	if !ok {
+		return "", false
+	}
+
+	return principal.(string), true
+}
+
+// checkServer checks the principal the server authenticated as against
+// those set with WithAllowedServers, mutual is whether it authenticated
+// itself.
+// It returns a ServerError if the server isn't allowed.
+func (c *GSS) checkServer(principal string, mutual bool) error {
+
+	allowed := c.settings.allowedServers
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	if !mutual {
+		return &ServerError{Principal: principal, Allowed: allowed}
+	}
+
+	for _, a := range allowed {
+		p := principal
+		if !strings.Contains(a, "@") {
+			p = strings.SplitN(p, "@", 2)[0]
+		}
+		if strings.EqualFold(a, p) {
+			return nil
+		}
+	}
+
+	return &ServerError{Principal: principal, Mutual: true, Allowed: allowed}
+}
@@ -0,0 +1,77 @@
+package gss
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// AddrResolver is the interface used by SPNForAddress to look up the names
+// of an address and confirm them, it is satisfied by *net.Resolver.
+type AddrResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// SPNError is returned when no SPN can be derived for an address.
+type SPNError struct {
+	Address string
+	Err     error
+}
+
+func (e *SPNError) Error() string {
+
+	return fmt.Sprintf("cannot determine the SPN for %s: %v", e.Address, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *SPNError) Unwrap() error {
+
+	return e.Err
+}
+
+// SPNForAddress derives the DNS/<fqdn> service principal name for the server
+// at the IP address by looking up its PTR records, net.DefaultResolver is used
+// if the resolver is nil. If confirm is set a name is only used if it
+// resolves back to the address, which guards against spoofed PTR records but
+// fails in environments without consistent reverse zones.
+// It returns the SPN and any error that occurred.
+func SPNForAddress(ctx context.Context, r AddrResolver, addr string, confirm bool) (string, error) {
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", &SPNError{Address: addr, Err: fmt.Errorf("not an IP address")}
+	}
+
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	names, err := r.LookupAddr(ctx, addr)
+	if err != nil {
+		return "", &SPNError{Address: addr, Err: err}
+	}
+
+	for _, name := range names {
+		if !confirm {
+			return generateSPN(name), nil
+		}
+
+		addrs, err := r.LookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			if ip.Equal(net.ParseIP(a)) {
+				return generateSPN(name), nil
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		return "", &SPNError{Address: addr, Err: fmt.Errorf("no PTR records")}
+	}
+
+	return "", &SPNError{Address: addr, Err: fmt.Errorf("no PTR record resolves back to the address")}
+}
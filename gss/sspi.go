@@ -3,10 +3,13 @@
 package gss
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/alexbrainman/sspi"
@@ -16,20 +19,44 @@ import (
 	"github.com/miekg/dns"
 )
 
+// SSPI supports the quality of protection of signatures
+const qopSupported = true
+
+// Impersonation needs an S4U logon which isn't implemented
+const impersonationSupported = false
+
+// sspiFlags maps the SSPI context requirements to the equivalent GSS-API
+// context flags
+var sspiFlags = map[uint32]Flags{
+	sspi.ISC_REQ_MUTUAL_AUTH:     FlagMutual,
+	sspi.ISC_REQ_REPLAY_DETECT:   FlagReplay,
+	sspi.ISC_REQ_SEQUENCE_DETECT: FlagSequence,
+	sspi.ISC_REQ_CONFIDENTIALITY: FlagConf,
+	sspi.ISC_REQ_INTEGRITY:       FlagInteg,
+}
+
 // GSS maps the TKEY name to the context that negotiated it as
 // well as any other internal state.
 type GSS struct {
-	m   sync.RWMutex
-	ctx map[string]*negotiate.ClientContext
+	m        sync.RWMutex
+	ctx      map[string]*negotiate.ClientContext
+	settings settings
+	// creds caches the credentials acquired by AcquireCredentials
+	creds map[Credentials]*sspi.Credentials
 }
 
 // New performs any library initialization necessary.
 // It returns a context handle for any further functions along with any error
 // that occurred.
-func New() (*GSS, error) {
+func New(options ...Option) (*GSS, error) {
 
 	c := &GSS{
-		ctx: make(map[string]*negotiate.ClientContext),
+		ctx:   make(map[string]*negotiate.ClientContext),
+		creds: make(map[Credentials]*sspi.Credentials),
+	}
+
+	if err := c.setOptions(options); err != nil {
+		return nil, err
 	}
 
 	return c, nil
@@ -40,7 +67,19 @@ func New() (*GSS, error) {
 // It returns any error that occurred.
 func (c *GSS) Close() error {
 
-	return c.close()
+	errs := c.close()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for key, creds := range c.creds {
+		if err := creds.Release(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		delete(c.creds, key)
+	}
+
+	return errs
 }
 
 // GenerateGSS generates the TSIG MAC based on the established context.
@@ -51,7 +90,7 @@ func (c *GSS) Close() error {
 // It returns the bytes for the TSIG MAC and any error that occurred.
 func (c *GSS) GenerateGSS(msg []byte, algorithm, name, secret string) ([]byte, error) {
 
-	if strings.ToLower(algorithm) != tsig.GSS {
+	if !tsig.IsGSS(algorithm) {
 		return nil, dns.ErrKeyAlg
 	}
 
@@ -63,7 +102,7 @@ func (c *GSS) GenerateGSS(msg []byte, algorithm, name, secret string) ([]byte, e
 		return nil, dns.ErrSecret
 	}
 
-	token, err := ctx.MakeSignature(msg, 0, 0)
+	token, err := ctx.MakeSignature(msg, c.settings.qop, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +118,7 @@ func (c *GSS) GenerateGSS(msg []byte, algorithm, name, secret string) ([]byte, e
 // It returns any error that occurred.
 func (c *GSS) VerifyGSS(stripped []byte, t *dns.TSIG, name, secret string) error {
 
-	if strings.ToLower(t.Algorithm) != tsig.GSS {
+	if !tsig.IsGSS(t.Algorithm) {
 		return dns.ErrKeyAlg
 	}
 
@@ -104,59 +143,93 @@ func (c *GSS) VerifyGSS(stripped []byte, t *dns.TSIG, name, secret string) error
 	return nil
 }
 
-func (c *GSS) negotiateContext(host string, creds *sspi.Credentials) (*string, *time.Time, error) {
+func (c *GSS) negotiateContext(ctx context.Context, host string, creds *sspi.Credentials) (*string, *time.Time, error) {
 
 	hostname, _ := tsig.SplitHostPort(host)
 
 	keyname := generateTKEYName(hostname)
 
-	ctx, output, err := negotiate.NewClientContext(creds, generateSPN(hostname))
+	requested := uint32(sspi.ISC_REQ_CONNECTION | sspi.ISC_REQ_INTEGRITY)
+	if !c.settings.optionalMutual {
+		requested |= sspi.ISC_REQ_MUTUAL_AUTH
+	}
+
+	secctx, output, err := negotiate.NewClientContextWithFlags(creds, generateSPN(hostname), requested)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, gssError(err)
 	}
 
 	var completed bool
 	var tkey *dns.TKEY
 
-	for ok := false; !ok; ok = completed {
+	id := c.messageID()
+	algorithm := c.algorithm()
+	empty := c.emptyTokens()
+
+	for ok, round := false, 0; !ok; ok, round = completed, round+1 {
 
 		var errs error
+		var input []byte
 
-		// We don't care about non-TKEY answers, no additional RR's to send, and no signing
-		tkey, _, err = tsig.ExchangeTKEY(host, keyname, tsig.GSS, tsig.TkeyModeGSS, 3600, output, nil, nil, nil, nil)
+		tkey, input, err = c.exchange(ctx, host, keyname, algorithm, id, round, output)
 		if err != nil {
 			errs = multierror.Append(errs, err)
-			errs = multierror.Append(errs, ctx.Release())
+			errs = multierror.Append(errs, secctx.Release())
 			return nil, nil, errs
 		}
 
-		if tkey.Header().Name != keyname {
-			errs = multierror.Append(errs, fmt.Errorf("TKEY name does not match"))
-			errs = multierror.Append(errs, ctx.Release())
-			return nil, nil, errs
-		}
+		keyname = tkey.Header().Name
+		algorithm = tkey.Algorithm
 
-		input, err := hex.DecodeString(tkey.Key)
-		if err != nil {
+		if err = empty.check(input); err != nil {
 			errs = multierror.Append(errs, err)
-			errs = multierror.Append(errs, ctx.Release())
+			errs = multierror.Append(errs, secctx.Release())
 			return nil, nil, errs
 		}
 
-		completed, output, err = ctx.Update(input)
+		completed, output, err = secctx.Update(input)
 		if err != nil {
-			errs = multierror.Append(errs, err)
-			errs = multierror.Append(errs, ctx.Release())
+			errs = multierror.Append(errs, gssError(err))
+			errs = multierror.Append(errs, secctx.Release())
 			return nil, nil, errs
 		}
 	}
 
+	if !c.settings.optionalMutual && secctx.VerifySelectiveFlags(sspi.ISC_REQ_MUTUAL_AUTH) != nil {
+		if err := secctx.Release(); err != nil {
+			return nil, nil, multierror.Append(ErrMutualAuth, err)
+		}
+		return nil, nil, ErrMutualAuth
+	}
+
+	// Only the flags that were requested can be checked
+	var flags Flags
+	for f, flag := range sspiFlags {
+		if secctx.VerifySelectiveFlags(f) == nil {
+			flags |= flag
+		}
+	}
+
+	// Kerberos only completes mutual authentication if the server holds
+	// the key of the requested principal
+	principal := generateSPN(hostname)
+	if err := c.checkServer(principal, flags&FlagMutual != 0); err != nil {
+		if derr := secctx.Release(); derr != nil {
+			return nil, nil, multierror.Append(err, derr)
+		}
+		return nil, nil, err
+	}
+
 	expiry := time.Unix(int64(tkey.Expiration), 0)
 
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	c.ctx[keyname] = ctx
+	c.settings.algorithms.Store(keyname, algorithm)
+	c.settings.flags.Store(keyname, flags)
+	c.settings.servers.Store(keyname, principal)
+	c.established(keyname, expiry)
+	c.ctx[keyname] = secctx
 
 	return &keyname, &expiry, nil
 }
@@ -167,13 +240,12 @@ func (c *GSS) negotiateContext(host string, creds *sspi.Credentials) (*string, *
 // occurred.
 func (c *GSS) NegotiateContext(host string) (*string, *time.Time, error) {
 
-	creds, err := negotiate.AcquireCurrentUserCredentials()
-	if err != nil {
-		return nil, nil, err
-	}
-	defer creds.Release()
+	return c.negotiateWith(context.Background(), host, nil)
+}
+
+func (c *GSS) negotiateCurrentUser(ctx context.Context, host string) (*string, *time.Time, error) {
 
-	return c.negotiateContext(host, creds)
+	return c.negotiate(ctx, host, nil)
 }
 
 // NegotiateContextWithCredentials exchanges RFC 2930 TKEY records with the
@@ -183,13 +255,184 @@ func (c *GSS) NegotiateContext(host string) (*string, *time.Time, error) {
 // occurred.
 func (c *GSS) NegotiateContextWithCredentials(host, domain, username, password string) (*string, *time.Time, error) {
 
-	creds, err := negotiate.AcquireUserCredentials(domain, username, password)
+	return c.negotiateWith(context.Background(), host, &Credentials{
+		Domain:   domain,
+		Username: username,
+		Password: password,
+	})
+}
+
+func (c *GSS) negotiateWithCredentials(ctx context.Context, host, domain, username, password string) (*string, *time.Time, error) {
+
+	return c.negotiate(ctx, host, &Credentials{
+		Domain:   domain,
+		Username: username,
+		Password: password,
+	})
+}
+
+func (c *GSS) negotiate(ctx context.Context, host string, credentials *Credentials) (*string, *time.Time, error) {
+
+	var creds *sspi.Credentials
+	var shared bool
+
+	err := c.acquireBounded(ctx, func() (err error) {
+		creds, shared, err = c.credentialsHandle(credentials)
+		return err
+	}, func() {
+		if !shared {
+			creds.Release()
+		}
+	})
 	if err != nil {
 		return nil, nil, err
 	}
+	if !shared {
+		defer creds.Release()
+	}
+
+	return c.negotiateContext(ctx, host, creds)
+}
+
+// sspiMajors maps the SECURITY_STATUS values with a GSS-API equivalent,
+// anything else is reported as MajorFailure
+var sspiMajors = map[syscall.Errno]uint32{
+	0x80090303: MajorBadName,        // SEC_E_TARGET_UNKNOWN
+	0x80090322: MajorBadName,        // SEC_E_WRONG_PRINCIPAL
+	0x8009030e: MajorNoCred,         // SEC_E_NO_CREDENTIALS
+	0x80090308: MajorDefectiveToken, // SEC_E_INVALID_TOKEN
+	0x80090317: MajorContextExpired, // SEC_E_CONTEXT_EXPIRED
+}
+
+// gssError wraps a failed SSPI call in a GSSError, the SECURITY_STATUS is
+// reported as the minor status.
+func gssError(err error) error {
+
+	e := &GSSError{
+		Major: MajorFailure,
+		Err:   err,
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if major, ok := sspiMajors[errno]; ok {
+			e.Major = major
+		}
+		e.Minor = uint32(errno)
+		e.MinorText = errno.Error()
+	}
+
+	e.MajorText = majorText(e.Major)
+
+	return e
+}
+
+// acquire acquires the credentials identified by the key, the current user
+// is the zero value.
+func acquire(key Credentials) (*sspi.Credentials, error) {
+
+	switch {
+	case key == (Credentials{}):
+		return negotiate.AcquireCurrentUserCredentials()
+	case key.Keytab != "":
+		return nil, fmt.Errorf("not supported")
+	default:
+		return negotiate.AcquireUserCredentials(key.Domain, key.Username, key.Password)
+	}
+}
+
+// credentialsHandle returns the credentials to negotiate with along with
+// whether they are shared, which they are if they were cached by
+// AcquireCredentials. Shared credentials that have expired are replaced with
+// freshly acquired ones.
+func (c *GSS) credentialsHandle(credentials *Credentials) (*sspi.Credentials, bool, error) {
+
+	var key Credentials
+	if credentials != nil {
+		key = *credentials
+	}
+
+	c.m.RLock()
+	creds, ok := c.creds[key]
+	c.m.RUnlock()
+
+	if ok && c.now().Before(creds.Expiry()) {
+		return creds, true, nil
+	}
+
+	fresh, err := acquire(key)
+	if err != nil {
+		return nil, false, gssError(err)
+	}
+
+	if !ok {
+		return fresh, false, nil
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.creds[key] = fresh
+
+	// The expired credentials are of no further use
+	creds.Release()
+
+	return fresh, true, nil
+}
+
+func (c *GSS) acquireCredentials(host string, credentials *Credentials) error {
+
+	var key Credentials
+	if credentials != nil {
+		key = *credentials
+	}
+
+	creds, shared, err := c.credentialsHandle(credentials)
+	if err != nil || shared {
+		return err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// Another goroutine got there first
+	if _, ok := c.creds[key]; ok {
+		return creds.Release()
+	}
+
+	if c.creds == nil {
+		c.creds = make(map[Credentials]*sspi.Credentials)
+	}
+	c.creds[key] = creds
+
+	return nil
+}
+
+// validateCredentials acquires a credentials handle, SSPI doesn't contact
+// the KDC until a context is initiated so this only checks the credentials
+// can be acquired.
+func (c *GSS) validateCredentials(credentials *Credentials) (*CredentialsInfo, error) {
+
+	var key Credentials
+	if credentials != nil {
+		key = *credentials
+	}
+
+	creds, err := acquire(key)
+	if err != nil {
+		return nil, gssError(err)
+	}
 	defer creds.Release()
 
-	return c.negotiateContext(host, creds)
+	principal := key.Username
+	if key.Domain != "" {
+		principal += "@" + strings.ToUpper(key.Domain)
+	}
+
+	return &CredentialsInfo{
+		Principal: principal,
+		Expiry:    creds.Expiry(),
+	}, nil
 }
 
 // NegotiateContextWithKeytab exchanges RFC 2930 TKEY records with the
@@ -199,6 +442,15 @@ func (c *GSS) NegotiateContextWithCredentials(host, domain, username, password s
 // occurred.
 func (c *GSS) NegotiateContextWithKeytab(host, domain, username, path string) (*string, *time.Time, error) {
 
+	return c.negotiateWith(context.Background(), host, &Credentials{
+		Domain:   domain,
+		Username: username,
+		Keytab:   path,
+	})
+}
+
+func (c *GSS) negotiateWithKeytab(ctx context.Context, host, domain, username, path string) (*string, *time.Time, error) {
+
 	return nil, nil, fmt.Errorf("not supported")
 }
 
@@ -221,6 +473,7 @@ func (c *GSS) DeleteContext(keyname *string) error {
 	}
 
 	delete(c.ctx, *keyname)
+	c.forget(*keyname)
 
 	return nil
 }
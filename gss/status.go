@@ -0,0 +1,223 @@
+package gss
+
+import (
+	"fmt"
+)
+
+// The routine errors of a GSS-API major status, RFC 2744 section 3.9.1
+const (
+	MajorBadMech uint32 = (iota + 1) << 16
+	MajorBadName
+	MajorBadNameType
+	MajorBadBindings
+	MajorBadStatus
+	MajorBadSig
+	MajorNoCred
+	MajorNoContext
+	MajorDefectiveToken
+	MajorDefectiveCredential
+	MajorCredentialsExpired
+	MajorContextExpired
+	MajorFailure
+	MajorBadQoP
+	MajorUnauthorized
+	MajorUnavailable
+	MajorDuplicateElement
+	MajorNameNotMN
+)
+
+// routineErrorMask selects the routine error of a major status
+const routineErrorMask = 0x00ff0000
+
+var majorTexts = map[uint32]string{
+	MajorBadMech:             "an unsupported mechanism was requested",
+	MajorBadName:             "an invalid name was supplied",
+	MajorBadNameType:         "a supplied name was of an unsupported type",
+	MajorBadBindings:         "incorrect channel bindings were supplied",
+	MajorBadStatus:           "an invalid status code was supplied",
+	MajorBadSig:              "a token had an invalid MIC",
+	MajorNoCred:              "no credentials were supplied, or the credentials were unavailable or inaccessible",
+	MajorNoContext:           "no context has been established",
+	MajorDefectiveToken:      "a token was invalid",
+	MajorDefectiveCredential: "a credential was invalid",
+	MajorCredentialsExpired:  "the referenced credentials have expired",
+	MajorContextExpired:      "the context has expired",
+	MajorFailure:             "unspecified GSS failure, the minor status may provide more information",
+	MajorBadQoP:              "the quality-of-protection requested could not be provided",
+	MajorUnauthorized:        "the operation is forbidden by local security policy",
+	MajorUnavailable:         "the operation or option is unavailable",
+	MajorDuplicateElement:    "the requested credential element already exists",
+	MajorNameNotMN:           "the provided name was not a mechanism name",
+}
+
+// krb5MinorBase is the base of the com_err table of Kerberos errors, a minor
+// status of the Kerberos mechanism is this plus the RFC 4120 error code
+const krb5MinorBase uint32 = 0x96c73a00
+
+// GSSError is returned when a GSS-API call fails while negotiating a context.
+// Major is the GSS-API major status and Minor the mechanism specific minor
+// status, with a description of each. The Kerberos implementations report
+// the Kerberos error code as the minor status, see KerberosError, whereas
+// SSPI reports its SECURITY_STATUS.
+type GSSError struct {
+	Major     uint32
+	Minor     uint32
+	MajorText string
+	MinorText string
+	Err       error
+}
+
+func (e *GSSError) Error() string {
+
+	if e.MinorText != "" {
+		return fmt.Sprintf("gss: %s (major %#x), %s (minor %#x): %v", e.MajorText, e.Major, e.MinorText, e.Minor, e.Err)
+	}
+
+	return fmt.Sprintf("gss: %s (major %#x): %v", e.MajorText, e.Major, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *GSSError) Unwrap() error {
+
+	return e.Err
+}
+
+// KerberosError returns the RFC 4120 error code carried by the minor status,
+// such as 37 for KRB_AP_ERR_SKEW or 7 for KDC_ERR_S_PRINCIPAL_UNKNOWN, and
+// whether it carries one.
+func (e *GSSError) KerberosError() (int32, bool) {
+
+	if e.Minor < krb5MinorBase || e.Minor > krb5MinorBase+0xff {
+		return 0, false
+	}
+
+	return int32(e.Minor - krb5MinorBase), true
+}
+
+// majorText describes the routine error of the major status.
+func majorText(major uint32) string {
+
+	if text, ok := majorTexts[major&routineErrorMask]; ok {
+		return text
+	}
+
+	return fmt.Sprintf("unknown major status %#x", major)
+}
+
+// Category is the kind of problem a GSSError most likely comes down to, so
+// an operator can be told what to fix rather than given the status codes.
+type Category int
+
+const (
+	// CategoryUnknown is a failure that doesn't match any other category
+	CategoryUnknown Category = iota
+	// CategoryClockSkew is the clocks of the client, KDC or server being
+	// too far apart
+	CategoryClockSkew
+	// CategoryBadSPN is the service principal of the server being unknown
+	// or not matching the key the server holds
+	CategoryBadSPN
+	// CategoryCredentials is the credentials of the client being missing,
+	// expired or rejected by the KDC
+	CategoryCredentials
+	// CategoryRealm is the realm being unknown to the KDC or the Kerberos
+	// configuration
+	CategoryRealm
+	// CategoryServerRejected is the server refusing the security context
+	CategoryServerRejected
+)
+
+func (c Category) String() string {
+
+	switch c {
+	case CategoryClockSkew:
+		return "clock skew"
+	case CategoryBadSPN:
+		return "bad SPN"
+	case CategoryCredentials:
+		return "credentials"
+	case CategoryRealm:
+		return "realm"
+	case CategoryServerRejected:
+		return "server rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// krb5Categories maps RFC 4120 error codes to their category
+var krb5Categories = map[int32]Category{
+	6:  CategoryCredentials,    // KDC_ERR_C_PRINCIPAL_UNKNOWN
+	7:  CategoryBadSPN,         // KDC_ERR_S_PRINCIPAL_UNKNOWN
+	18: CategoryCredentials,    // KDC_ERR_CLIENT_REVOKED
+	23: CategoryCredentials,    // KDC_ERR_KEY_EXPIRED
+	24: CategoryCredentials,    // KDC_ERR_PREAUTH_FAILED
+	32: CategoryCredentials,    // KRB_AP_ERR_TKT_EXPIRED
+	33: CategoryClockSkew,      // KRB_AP_ERR_TKT_NYV
+	37: CategoryClockSkew,      // KRB_AP_ERR_SKEW
+	40: CategoryBadSPN,         // KRB_AP_ERR_NOT_US
+	41: CategoryBadSPN,         // KRB_AP_ERR_MODIFIED
+	44: CategoryServerRejected, // KRB_AP_ERR_REPEAT
+	68: CategoryRealm,          // KDC_ERR_WRONG_REALM
+}
+
+// sspiCategories maps the SECURITY_STATUS minor status of SSPI to their
+// category
+var sspiCategories = map[uint32]Category{
+	0x80090324: CategoryClockSkew,      // SEC_E_TIME_SKEW
+	0x80090303: CategoryBadSPN,         // SEC_E_TARGET_UNKNOWN
+	0x80090322: CategoryBadSPN,         // SEC_E_WRONG_PRINCIPAL
+	0x8009030e: CategoryCredentials,    // SEC_E_NO_CREDENTIALS
+	0x8009030c: CategoryCredentials,    // SEC_E_LOGON_DENIED
+	0x80090311: CategoryRealm,          // SEC_E_NO_AUTHENTICATING_AUTHORITY
+	0x8009030d: CategoryCredentials,    // SEC_E_UNKNOWN_CREDENTIALS
+	0x80090308: CategoryServerRejected, // SEC_E_INVALID_TOKEN
+}
+
+// majorCategories maps the routine error of a major status to its category
+var majorCategories = map[uint32]Category{
+	MajorBadName:             CategoryBadSPN,
+	MajorNoCred:              CategoryCredentials,
+	MajorDefectiveCredential: CategoryCredentials,
+	MajorCredentialsExpired:  CategoryCredentials,
+	MajorBadSig:              CategoryServerRejected,
+	MajorDefectiveToken:      CategoryServerRejected,
+	MajorUnauthorized:        CategoryServerRejected,
+}
+
+var categoryHints = map[Category]string{
+	CategoryClockSkew:      "Synchronise the clocks of this host, the KDC and the DNS server, for example with NTP, Kerberos rejects a skew of more than five minutes",
+	CategoryBadSPN:         "Check the DNS/ principal of the server exists in the KDC and matches the keytab of the DNS server, and that the server is given by its host name rather than an alias or address",
+	CategoryCredentials:    "Check the credentials exist and are still valid, for the current user that kinit has been run and the ticket hasn't expired",
+	CategoryRealm:          "Check the realm is correct and that the Kerberos configuration has KDCs for it",
+	CategoryServerRejected: "Check the DNS server is configured for GSS-TSIG and can verify tickets for its principal, for BIND that tkey-gssapi-keytab or tkey-gssapi-credential is set",
+}
+
+// Category returns the kind of problem the failure most likely comes down
+// to, judged by the Kerberos error or SECURITY_STATUS of the minor status
+// and failing that the major status.
+func (e *GSSError) Category() Category {
+
+	if code, ok := e.KerberosError(); ok {
+		if category, ok := krb5Categories[code]; ok {
+			return category
+		}
+	}
+
+	if category, ok := sspiCategories[e.Minor]; ok {
+		return category
+	}
+
+	if category, ok := majorCategories[e.Major&routineErrorMask]; ok {
+		return category
+	}
+
+	return CategoryUnknown
+}
+
+// Hint suggests how to fix the failure based on its Category, it is empty
+// if the category is unknown.
+func (e *GSSError) Hint() string {
+
+	return categoryHints[e.Category()]
+}
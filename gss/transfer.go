@@ -0,0 +1,46 @@
+package gss
+
+import (
+	"context"
+	"net"
+
+	"github.com/bodgit/tsig"
+	"github.com/miekg/dns"
+)
+
+// Transfer performs the zone transfer from the indicated DNS server signed
+// with the security context already negotiated for the key name, see
+// tsig.SignedTransfer, verifying each message of the response signed by the
+// server with the context as well.
+// It returns the channel the records are delivered on as they arrive, see
+// client.Client.TransferContext, and any error that occurred starting the
+// transfer.
+func (c *GSS) Transfer(ctx context.Context, host, keyname string, t *tsig.Transfer) (chan *dns.Envelope, error) {
+
+	algorithm := c.Algorithm(keyname)
+
+	msg, err := tsig.SignedTransfer(t, keyname, algorithm, 300)
+	if err != nil {
+		return nil, err
+	}
+
+	cl := c.updateClient(keyname, algorithm)
+
+	hostname, port := tsig.SplitHostPort(host)
+
+	return cl.TransferContext(ctx, msg, net.JoinHostPort(hostname, port))
+}
+
+// TransferRecords performs the zone transfer as Transfer does however the
+// records are collected rather than delivered as they arrive.
+// It returns every record in the order received and any error that
+// occurred.
+func (c *GSS) TransferRecords(ctx context.Context, host, keyname string, t *tsig.Transfer) ([]dns.RR, error) {
+
+	env, err := c.Transfer(ctx, host, keyname, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return tsig.TransferRecords(env)
+}
@@ -0,0 +1,258 @@
+package gss
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bodgit/tsig"
+	"github.com/bodgit/tsig/client"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+)
+
+// DeletePolicy decides whether the security context negotiated by Update is
+// deleted once the update has been sent, err is the outcome of sending it.
+type DeletePolicy func(err error) bool
+
+// DeleteAlways deletes the context whatever the outcome of the update, it is
+// the default.
+func DeleteAlways(err error) bool {
+
+	return true
+}
+
+// DeleteOnSuccess only deletes the context if the update succeeded. After a
+// failure the context is kept so the update can be retried with SendUpdate,
+// the caller is then responsible for deleting it with DeleteContext or Close
+// and it can't be used past its expiry time regardless.
+func DeleteOnSuccess(err error) bool {
+
+	return err == nil
+}
+
+// WithDeletePolicy sets the policy Update uses to decide whether to delete
+// the context after sending the update.
+func WithDeletePolicy(policy DeletePolicy) Option {
+
+	return func(c *GSS) error {
+		c.settings.deletePolicy = policy
+		return nil
+	}
+}
+
+// UpdateError is returned when the server answers an update with an error.
+type UpdateError struct {
+	Rcode int
+}
+
+func (e *UpdateError) Error() string {
+
+	return fmt.Sprintf("DNS error: %s (%d)", dns.RcodeToString[e.Rcode], e.Rcode)
+}
+
+// UpdateResult is the outcome of one of the updates sent by SendUpdates.
+type UpdateResult struct {
+	Update *tsig.Update
+	// Sent is whether sending the update was attempted, those after the
+	// first to fail aren't
+	Sent bool
+	// Err is why the update failed, nil if the server applied it
+	Err error
+}
+
+// updateClient returns a client that signs with the security context
+// negotiated for the key name.
+func (c *GSS) updateClient(keyname, algorithm string) *client.Client {
+
+	cl := &client.Client{}
+	cl.Net = "tcp"
+	cl.TsigAlgorithm = map[string]*client.TsigAlgorithm{
+		algorithm: {
+			Generate: c.GenerateGSS,
+			Verify:   c.VerifyGSS,
+		},
+	}
+	cl.TsigSecret = map[string]string{keyname: ""}
+
+	return cl
+}
+
+// checkUpdate turns the response to an update into an error.
+func checkUpdate(rr *dns.Msg, err error) error {
+
+	if err != nil {
+		return err
+	}
+
+	if rr.Rcode != dns.RcodeSuccess {
+		return &UpdateError{Rcode: rr.Rcode}
+	}
+
+	return nil
+}
+
+// SendUpdate sends the update to the indicated DNS server signed with the
+// security context already negotiated for the key name.
+// It returns any error that occurred.
+func (c *GSS) SendUpdate(ctx context.Context, host, keyname string, u *tsig.Update) error {
+
+	algorithm := c.Algorithm(keyname)
+
+	msg, err := tsig.SignedUpdate(u, keyname, algorithm, 300)
+	if err != nil {
+		return err
+	}
+
+	cl := c.updateClient(keyname, algorithm)
+
+	hostname, port := tsig.SplitHostPort(host)
+
+	rr, _, err := cl.ExchangeContext(ctx, msg, net.JoinHostPort(hostname, port))
+
+	return checkUpdate(rr, err)
+}
+
+// VerifyKey checks the indicated DNS server still accepts the security
+// context negotiated for the key name with a signed SOA query for the zone,
+// see tsig.VerifyKey, as the server can forget a context before it expires.
+// Nothing is sent if the context has expired or was never negotiated, which
+// is reported as tsig.KeyUnknown.
+// It returns the status of the key and any error that occurred.
+func (c *GSS) VerifyKey(ctx context.Context, host, keyname, zone string) (tsig.KeyStatus, error) {
+
+	expiry, ok := c.settings.expiries.Load(keyname)
+	if !ok {
+		return tsig.KeyUnknown, nil
+	}
+
+	algorithm := c.Algorithm(keyname)
+	cl := c.updateClient(keyname, algorithm)
+
+	hostname, port := tsig.SplitHostPort(host)
+
+	return tsig.VerifyKey(ctx, cl, net.JoinHostPort(hostname, port), zone, keyname, algorithm, expiry.(time.Time))
+}
+
+// UpdatePTR sends an update to the indicated DNS server, signed with the
+// security context already negotiated for the key name, that adds a PTR
+// record in the reverse zone for the IP address pointing at the host name,
+// see tsig.PTRUpdate.
+// It returns any error that occurred.
+func (c *GSS) UpdatePTR(ctx context.Context, host, keyname, zone string, ip net.IP, hostname string, ttl uint32) error {
+
+	u, err := tsig.PTRUpdate(zone, ip, hostname, ttl)
+	if err != nil {
+		return err
+	}
+
+	return c.SendUpdate(ctx, host, keyname, u)
+}
+
+// SendUpdates sends the updates in order to the indicated DNS server over a
+// single connection, so they all reach the same server, each signed with the
+// security context already negotiated for the key name. It stops at the
+// first update that fails, leaving the rest unsent, however the server
+// applies each update on its own so those already sent remain applied. For
+// all or nothing put the changes in a single Update, which RFC 2136 requires
+// the server to apply atomically.
+// It returns the result of each update and the error of the one that failed,
+// if any.
+func (c *GSS) SendUpdates(ctx context.Context, host, keyname string, updates []*tsig.Update) ([]UpdateResult, error) {
+
+	results := make([]UpdateResult, len(updates))
+	for i, u := range updates {
+		results[i].Update = u
+	}
+
+	if len(updates) == 0 {
+		return results, nil
+	}
+
+	algorithm := c.Algorithm(keyname)
+	cl := c.updateClient(keyname, algorithm)
+
+	hostname, port := tsig.SplitHostPort(host)
+
+	conn, err := cl.DialContext(ctx, net.JoinHostPort(hostname, port))
+	if err != nil {
+		return results, err
+	}
+	defer conn.Close()
+
+	for i, u := range updates {
+		msg, err := tsig.SignedUpdate(u, keyname, algorithm, 300)
+		if err != nil {
+			results[i].Err = err
+			return results, err
+		}
+
+		results[i].Sent = true
+
+		rr, _, err := cl.ExchangeWithConnContext(ctx, msg, conn)
+		if err = checkUpdate(rr, err); err != nil {
+			results[i].Err = err
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+// Update negotiates a security context with the indicated DNS server as
+// NegotiateGSS does, sends the update signed with it and then deletes the
+// context unless the policy set with WithDeletePolicy decides otherwise.
+// It returns the key name if the context was kept, and any error that
+// occurred.
+func (c *GSS) Update(ctx context.Context, host string, u *tsig.Update) (*string, error) {
+
+	keyname, _, err := c.NegotiateGSS(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.finishUpdate(keyname, c.SendUpdate(ctx, host, *keyname, u))
+}
+
+// Updates negotiates a security context with the indicated DNS server as
+// NegotiateGSS does, sends the updates signed with it as SendUpdates does
+// and then deletes the context unless the policy set with WithDeletePolicy
+// decides otherwise.
+// It returns the key name if the context was kept, the result of each update
+// and any error that occurred.
+func (c *GSS) Updates(ctx context.Context, host string, updates []*tsig.Update) (*string, []UpdateResult, error) {
+
+	keyname, _, err := c.NegotiateGSS(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results, err := c.SendUpdates(ctx, host, *keyname, updates)
+
+	keyname, err = c.finishUpdate(keyname, err)
+
+	return keyname, results, err
+}
+
+// finishUpdate applies the delete policy to the context used for an update.
+func (c *GSS) finishUpdate(keyname *string, err error) (*string, error) {
+
+	policy := c.settings.deletePolicy
+	if policy == nil {
+		policy = DeleteAlways
+	}
+
+	if !policy(err) {
+		return keyname, err
+	}
+
+	if derr := c.DeleteContext(keyname); derr != nil {
+		if err == nil {
+			return nil, derr
+		}
+		return nil, multierror.Append(err, derr)
+	}
+
+	return nil, err
+}
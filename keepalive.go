@@ -0,0 +1,111 @@
+package tsig
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// edns0 returns the OPT record of the query, adding one if there isn't one
+// already.
+func edns0(msg *dns.Msg) *dns.OPT {
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{
+			Hdr: dns.RR_Header{
+				Name:   ".",
+				Rrtype: dns.TypeOPT,
+			},
+		}
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		msg.Extra = append(msg.Extra, opt)
+	}
+
+	return opt
+}
+
+// forceEdns0 ensures the query has exactly one OPT record and that it is
+// EDNS version 0.
+func forceEdns0(msg *dns.Msg) error {
+
+	var n int
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			n++
+		}
+	}
+
+	if n > 1 {
+		return fmt.Errorf("Query has %d OPT records, at most one is allowed", n)
+	}
+
+	if version := edns0(msg).Version(); version != 0 {
+		return fmt.Errorf("OPT record has EDNS version %d, version 0 is required", version)
+	}
+
+	return nil
+}
+
+// setKeepalive advertises RFC 7828 EDNS TCP keepalive in the query, the
+// timeout is left empty as a client must not send one. The option is built
+// by hand as the dns package doesn't pack dns.EDNS0_TCP_KEEPALIVE correctly.
+func setKeepalive(msg *dns.Msg) {
+
+	opt := edns0(msg)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: dns.EDNS0TCPKEEPALIVE,
+	})
+}
+
+// keepalive returns the idle timeout the server set in its response, or
+// zero if it didn't set one.
+func keepalive(rr *dns.Msg) time.Duration {
+
+	opt := rr.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+
+	for _, o := range opt.Option {
+		var timeout uint16
+		switch k := o.(type) {
+		case *dns.EDNS0_TCP_KEEPALIVE:
+			timeout = k.Timeout
+		case *dns.EDNS0_LOCAL:
+			// The dns package doesn't unpack the option itself
+			if k.Code != dns.EDNS0TCPKEEPALIVE || len(k.Data) != 2 {
+				continue
+			}
+			timeout = binary.BigEndian.Uint16(k.Data)
+		default:
+			continue
+		}
+
+		// The timeout is in units of 100 milliseconds
+		return time.Duration(timeout) * 100 * time.Millisecond
+	}
+
+	return 0
+}
+
+// keepaliveExpiry returns when a connection that last answered at the given
+// time should be closed to stay ahead of the idle timeout the server
+// advertised, the zero time means there is no limit.
+func keepaliveExpiry(answered time.Time, timeout time.Duration) time.Time {
+
+	if timeout <= 0 {
+		return time.Time{}
+	}
+
+	// Leave some margin for the time the next query takes to arrive
+	return answered.Add(timeout * 9 / 10)
+}
+
+func (c *Client) keepaliveNet() bool {
+
+	return c.TCPKeepalive && (c.Net == "" || strings.HasPrefix(c.Net, "tcp"))
+}
@@ -0,0 +1,155 @@
+package tsig
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveKeepalive answers TKEY queries on the connection until it is closed,
+// setting the given keepalive timeout in each response if it is non-zero.
+func serveKeepalive(conn net.Conn, timeout uint16) {
+
+	defer conn.Close()
+
+	co := &dns.Conn{Conn: conn}
+
+	for {
+		m, err := co.ReadMsg()
+		if err != nil {
+			return
+		}
+
+		r := tkeyReply(m, m.Question[0].Name)
+		if timeout != 0 {
+			opt := edns0(r)
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+				Code: dns.EDNS0TCPKEEPALIVE,
+				Data: []byte{byte(timeout >> 8), byte(timeout)},
+			})
+		}
+
+		if err := co.WriteMsg(r); err != nil {
+			return
+		}
+	}
+}
+
+func TestSetKeepalive(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	cases := []struct {
+		client    *Client
+		keepalive bool
+	}{
+		{&Client{}, false},
+		{&Client{TCPKeepalive: true}, true},
+		{&Client{TCPKeepalive: true, Net: "tcp-tls"}, true},
+		{&Client{TCPKeepalive: true, Net: "udp"}, false},
+	}
+
+	for _, tc := range cases {
+		msg, err := tc.client.newMsg(request)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		opt := msg.IsEdns0()
+		if !tc.keepalive {
+			assert.Nil(t, opt)
+			continue
+		}
+		if assert.NotNil(t, opt) && assert.Len(t, opt.Option, 1) {
+			assert.Equal(t, uint16(dns.EDNS0TCPKEEPALIVE), opt.Option[0].Option())
+		}
+
+		// On the wire the option has no data
+		b, err := msg.Pack()
+		if assert.Nil(t, err) {
+			assert.Equal(t, []byte{0x00, 0x0b, 0x00, 0x00}, b[len(b)-4:])
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go serveKeepalive(server, 25)
+
+	resp, err := (&Client{TCPKeepalive: true}).ExchangeConn(context.Background(), client, &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, 2500*time.Millisecond, resp.KeepAlive)
+	}
+
+	now := time.Unix(1600000000, 0)
+	assert.Equal(t, time.Time{}, keepaliveExpiry(now, 0))
+	assert.Equal(t, now.Add(9*time.Second), keepaliveExpiry(now, 10*time.Second))
+}
+
+func TestExchangeBatchKeepalive(t *testing.T) {
+
+	cases := []struct {
+		timeout uint16
+		dials   int
+	}{
+		// No timeout so the connection is reused
+		{0, 1},
+		// The clock moves past the timeout between each request
+		{10, 3},
+	}
+
+	for _, tc := range cases {
+		var m sync.Mutex
+		now := time.Now()
+		dials := 0
+
+		client := &Client{
+			Resolver:     &FakeResolver{Addrs: []string{"192.0.2.1"}},
+			TCPKeepalive: true,
+			Now: func() time.Time {
+				m.Lock()
+				defer m.Unlock()
+				now = now.Add(time.Second)
+				return now
+			},
+			dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dials++
+				c, s := net.Pipe()
+				go serveKeepalive(s, tc.timeout)
+				return c, nil
+			},
+		}
+
+		reqs := make([]*Request, 3)
+		for i := range reqs {
+			reqs[i] = &Request{
+				KeyName:   "test.example.com.",
+				Algorithm: GSS,
+				Mode:      TkeyModeGSS,
+				Lifetime:  3600,
+			}
+		}
+
+		_, err := client.ExchangeBatch(context.Background(), "ns.example.com", reqs, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.dials, dials)
+	}
+}
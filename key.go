@@ -0,0 +1,28 @@
+package tsig
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// EncodeTKEYKey returns the key field of a TKEY record carrying b, such as a
+// GSS token, which the dns package holds as hex. The KeySize of the record
+// must be set to the length of b.
+func EncodeTKEYKey(b []byte) string {
+
+	return hex.EncodeToString(b)
+}
+
+// DecodeTKEYKey returns the bytes carried by the key field of a TKEY record,
+// such as a GSS token, upper or lower case hex is accepted.
+// It returns the bytes and any error that occurred, for example if the key
+// isn't valid hex or has an odd length.
+func DecodeTKEYKey(key string) ([]byte, error) {
+
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("TKEY key is not valid hex: %w", err)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,56 @@
+package tsig
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTKEYKey(t *testing.T) {
+
+	tables := []struct {
+		key   string
+		token []byte
+		err   error
+	}{
+		{"", []byte{}, nil},
+		{"deadbeef", []byte{0xde, 0xad, 0xbe, 0xef}, nil},
+		{"DEADBEEF", []byte{0xde, 0xad, 0xbe, 0xef}, nil},
+		{"deadbee", nil, hex.ErrLength},
+		{"deadbeeg", nil, hex.InvalidByteError('g')},
+	}
+
+	for _, table := range tables {
+		token, err := DecodeTKEYKey(table.key)
+		if table.err != nil {
+			assert.True(t, errors.Is(err, table.err), table.key)
+			continue
+		}
+		if assert.Nil(t, err, table.key) {
+			assert.Equal(t, table.token, token)
+		}
+	}
+
+	// Encoding round trips
+	for _, token := range [][]byte{{}, {0x00}, {0xde, 0xad, 0xbe, 0xef}} {
+		b, err := DecodeTKEYKey(EncodeTKEYKey(token))
+		if assert.Nil(t, err) {
+			assert.Equal(t, token, b)
+		}
+	}
+
+	// Queries carry the input with the same codec
+	msg, err := (&Client{}).newMsg(&Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+		Input:     []byte{0xde, 0xad, 0xbe, 0xef},
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, EncodeTKEYKey([]byte{0xde, 0xad, 0xbe, 0xef}), msg.Extra[0].(*dns.TKEY).Key)
+	}
+}
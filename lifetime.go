@@ -0,0 +1,55 @@
+package tsig
+
+import (
+	"math"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// lifetimeFudge is the fudge queries are signed with, the clocks of the
+// client and server may differ by this much either way.
+const lifetimeFudge = 300 * time.Second
+
+// SuggestLifetime returns the lifetime in seconds to request for a key that
+// will sign the given number of updates, each expected to take perUpdate
+// including any waiting between them. On top of the work it allows a
+// quarter as much again as a margin, the fudge either side for clock skew,
+// and MinRemainingLifetime, so the key doesn't expire part way through a
+// batch without being much longer lived than needed. It is never less than
+// MinLifetime, or DefaultMinLifetime if that is zero.
+func (c *Client) SuggestLifetime(updates int, perUpdate time.Duration) uint32 {
+
+	if updates < 0 {
+		updates = 0
+	}
+
+	if perUpdate < 0 {
+		perUpdate = 0
+	}
+
+	work := float64(updates) * perUpdate.Seconds()
+
+	seconds := math.Ceil(work*1.25 + 2*lifetimeFudge.Seconds() + float64(c.MinRemainingLifetime))
+
+	switch {
+	case seconds > math.MaxUint32:
+		return math.MaxUint32
+	case seconds < float64(c.minLifetime()):
+		return c.minLifetime()
+	default:
+		return uint32(seconds)
+	}
+}
+
+// grantedLifetime returns the window in seconds from the inception to the
+// expiration of the key the server granted, zero if the expiration is
+// before the inception.
+func grantedLifetime(tkey *dns.TKEY) uint32 {
+
+	if tkey.Expiration < tkey.Inception {
+		return 0
+	}
+
+	return tkey.Expiration - tkey.Inception
+}
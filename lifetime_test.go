@@ -0,0 +1,107 @@
+package tsig
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuggestLifetime(t *testing.T) {
+
+	tables := []struct {
+		client    *Client
+		updates   int
+		perUpdate time.Duration
+		lifetime  uint32
+	}{
+		// Only the skew either side
+		{&Client{}, 0, 0, 600},
+		{&Client{}, -1, -time.Second, 600},
+		{&Client{}, 100, time.Second, 725},
+		{&Client{}, 3, 333 * time.Millisecond, 602},
+		{&Client{MinRemainingLifetime: 60}, 100, time.Second, 785},
+		{&Client{MinLifetime: 3600}, 100, time.Second, 3600},
+		{&Client{}, math.MaxInt32, time.Hour, math.MaxUint32},
+	}
+
+	for _, table := range tables {
+		assert.Equal(t, table.lifetime, table.client.SuggestLifetime(table.updates, table.perUpdate))
+	}
+}
+
+func TestLifetimeClamped(t *testing.T) {
+
+	now := time.Unix(1600000000, 0)
+	granted := uint32(1800)
+
+	stream := NewEventStream(0)
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			r := tkeyReply(m, m.Question[0].Name)
+			tkey := r.Answer[0].(*dns.TKEY)
+			if tkey.Mode != TkeyModeDelete {
+				tkey.Inception = uint32(now.Unix())
+				tkey.Expiration = tkey.Inception + granted
+			}
+			return r, nil
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		Events:   stream,
+		Now: func() time.Time {
+			return now
+		},
+	}
+
+	tables := []struct {
+		mode      uint16
+		lifetime  uint32
+		requested uint32
+		granted   uint32
+		clamped   bool
+	}{
+		{TkeyModeGSS, 3600, 3600, 1800, true},
+		{TkeyModeGSS, 1800, 1800, 1800, false},
+		{TkeyModeGSS, 900, 900, 1800, false},
+		{TkeyModeDelete, 3600, 0, 0, false},
+	}
+
+	for _, table := range tables {
+		resp, err := client.Exchange(context.Background(), &Request{
+			Host:      "ns.example.com",
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      table.mode,
+			Lifetime:  table.lifetime,
+		})
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		assert.Equal(t, table.requested, resp.RequestedLifetime)
+		assert.Equal(t, table.granted, resp.GrantedLifetime)
+		assert.Equal(t, table.clamped, resp.LifetimeClamped)
+
+		var clamped []Event
+		for len(stream.Events()) > 0 {
+			if e := <-stream.Events(); e.Type == EventLifetimeClamped {
+				clamped = append(clamped, e)
+			}
+		}
+
+		if !table.clamped {
+			assert.Len(t, clamped, 0)
+			continue
+		}
+
+		if assert.Len(t, clamped, 1) {
+			assert.Equal(t, "test.example.com.", clamped[0].KeyName)
+			assert.Equal(t, "192.0.2.1:53", clamped[0].Address)
+			assert.Equal(t, 30*time.Minute, clamped[0].Duration)
+			assert.Equal(t, now.Add(30*time.Minute).Unix(), clamped[0].Expiry.Unix())
+		}
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Package negotiate establishes a TSIG key with a DNS server using whichever
+TKEY mode works, for callers who don't mind how the key is negotiated as
+long as it is done securely.
+
+Example client:
+
+        import (
+                "context"
+
+                "github.com/bodgit/tsig/negotiate"
+                "github.com/miekg/dns"
+        )
+
+        func main() {
+                // Fall back to Diffie-Hellman signed with an existing key
+                key, err := negotiate.Negotiate(context.Background(), "ns.example.com", negotiate.WithDH(nil, "tsig.example.com.", dns.HmacSHA256, "k9uK5qsPfbBxvVuldwzYww=="))
+                if err != nil {
+                        panic(err)
+                }
+                defer key.Delete()
+
+                // Sign with key.TSIGKey(), a GSS key also needs key.GSS
+                // to generate and verify the signatures
+        }
+*/
+package negotiate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bodgit/tsig"
+	"github.com/bodgit/tsig/dh"
+	"github.com/bodgit/tsig/gss"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// DefaultModes is the order the modes are tried in unless WithModes is
+// given, GSS first as it needs no existing key.
+var DefaultModes = []uint16{tsig.TkeyModeGSS, tsig.TkeyModeDH}
+
+// Key is a key negotiated by Negotiate.
+type Key struct {
+	// Mode is the TKEY mode that succeeded
+	Mode      uint16
+	Name      string
+	Algorithm string
+	Expiry    time.Time
+	// Secret is the base64 encoded secret of a Diffie-Hellman key, a GSS
+	// key has none
+	Secret string
+	// GSS is the handle holding the security context of a GSS key, it
+	// provides the functions to sign and verify with, see
+	// gss.GSS.GenerateGSS
+	GSS *gss.GSS
+	// DH is the handle holding a Diffie-Hellman key
+	DH *dh.DH
+	// close closes the handle if Negotiate created it
+	close bool
+}
+
+// TSIGKey returns the key to sign a tsig.Request with.
+func (k *Key) TSIGKey() *tsig.TSIGKey {
+
+	return &tsig.TSIGKey{
+		Name:      k.Name,
+		Algorithm: k.Algorithm,
+		Secret:    k.Secret,
+	}
+}
+
+// Delete revokes the key, closing its handle if Negotiate created it.
+// It returns any error that occurred.
+func (k *Key) Delete() error {
+
+	name := k.Name
+
+	var err error
+	switch {
+	case k.GSS != nil:
+		if err = k.GSS.DeleteContext(&name); err == nil && k.close {
+			err = k.GSS.Close()
+		}
+	case k.DH != nil:
+		if err = k.DH.DeleteKey(&name); err == nil && k.close {
+			err = k.DH.Close()
+		}
+	}
+
+	return err
+}
+
+type settings struct {
+	modes []uint16
+	gss   *gss.GSS
+	dh    *dh.DH
+	// useDH is set once WithDH has given the existing key to sign with
+	useDH                bool
+	name, algorithm, mac string
+}
+
+// Option is used to configure Negotiate.
+type Option func(*settings) error
+
+// WithModes sets the order the modes are tried in rather than DefaultModes,
+// only tsig.TkeyModeGSS and tsig.TkeyModeDH are supported.
+func WithModes(modes ...uint16) Option {
+
+	return func(s *settings) error {
+		if len(modes) == 0 {
+			return errors.New("No modes")
+		}
+		for _, mode := range modes {
+			if _, ok := negotiators[mode]; !ok {
+				return fmt.Errorf("Unsupported mode %s", tsig.ModeString(mode))
+			}
+		}
+		s.modes = modes
+		return nil
+	}
+}
+
+// WithGSS sets the handle used to negotiate a GSS key, a new one is created
+// with gss.New if nil or not given.
+func WithGSS(g *gss.GSS) Option {
+
+	return func(s *settings) error {
+		s.gss = g
+		return nil
+	}
+}
+
+// WithDH sets the handle used to negotiate a Diffie-Hellman key, a new one
+// is created with dh.New if nil, along with the existing TSIG key name,
+// algorithm and MAC the negotiation is signed with. Diffie-Hellman is
+// skipped without it.
+func WithDH(d *dh.DH, name, algorithm, mac string) Option {
+
+	return func(s *settings) error {
+		s.dh = d
+		s.useDH = true
+		s.name, s.algorithm, s.mac = name, algorithm, mac
+		return nil
+	}
+}
+
+// negotiators negotiate a key with each supported mode
+var negotiators = map[uint16]func(context.Context, string, *settings) (*Key, error){
+	tsig.TkeyModeGSS: negotiateGSS,
+	tsig.TkeyModeDH:  negotiateDH,
+}
+
+func negotiateGSS(ctx context.Context, host string, s *settings) (*Key, error) {
+
+	key := &Key{Mode: tsig.TkeyModeGSS, GSS: s.gss}
+
+	if key.GSS == nil {
+		g, err := gss.New()
+		if err != nil {
+			return nil, err
+		}
+		key.GSS, key.close = g, true
+	}
+
+	// Don't bother the server if there are no credentials to use
+	keyname, expiry, err := func() (*string, *time.Time, error) {
+		if err := key.GSS.AcquireCredentials(ctx, host); err != nil {
+			return nil, nil, err
+		}
+		return key.GSS.NegotiateGSS(ctx, host)
+	}()
+	if err != nil {
+		if key.close {
+			key.GSS.Close()
+		}
+		return nil, err
+	}
+
+	key.Name, key.Expiry = *keyname, *expiry
+	key.Algorithm = key.GSS.Algorithm(*keyname)
+
+	return key, nil
+}
+
+func negotiateDH(ctx context.Context, host string, s *settings) (*Key, error) {
+
+	if !s.useDH {
+		return nil, errors.New("No existing key to sign with, see WithDH")
+	}
+
+	key := &Key{Mode: tsig.TkeyModeDH, DH: s.dh}
+
+	if key.DH == nil {
+		d, err := dh.New()
+		if err != nil {
+			return nil, err
+		}
+		key.DH, key.close = d, true
+	}
+
+	keyname, mac, expiry, err := key.DH.NegotiateKey(host, s.name, s.algorithm, s.mac)
+	if err != nil {
+		if key.close {
+			key.DH.Close()
+		}
+		return nil, err
+	}
+
+	key.Name, key.Secret, key.Expiry = *keyname, *mac, *expiry
+	key.Algorithm = key.DH.Algorithm(*keyname)
+
+	return key, nil
+}
+
+// Negotiate establishes a key with the indicated DNS server trying each mode
+// in turn, see WithModes, until one succeeds. GSS is only attempted if the
+// credentials can be acquired and Diffie-Hellman only if WithDH is given.
+// It stops early if the context is done.
+// It returns the key, whose Mode is the mode that succeeded, and any error
+// that occurred, aggregating the failure of each mode tried.
+func Negotiate(ctx context.Context, host string, options ...Option) (*Key, error) {
+
+	s := &settings{modes: DefaultModes}
+
+	for _, option := range options {
+		if err := option(s); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs error
+	for _, mode := range s.modes {
+		if err := ctx.Err(); err != nil {
+			return nil, multierror.Append(errs, err)
+		}
+
+		key, err := negotiators[mode](ctx, host, s)
+		if err == nil {
+			return key, nil
+		}
+
+		errs = multierror.Append(errs, fmt.Errorf("%s: %v", tsig.ModeString(mode), err))
+	}
+
+	return nil, errs
+}
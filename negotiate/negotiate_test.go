@@ -0,0 +1,140 @@
+package negotiate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bodgit/tsig"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+)
+
+// withNegotiators replaces the negotiators, the returned function restores
+// them
+func withNegotiators(n map[uint16]func(context.Context, string, *settings) (*Key, error)) func() {
+
+	saved := negotiators
+	negotiators = n
+
+	return func() {
+		negotiators = saved
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+
+	var tried []uint16
+
+	fail := func(mode uint16) func(context.Context, string, *settings) (*Key, error) {
+		return func(context.Context, string, *settings) (*Key, error) {
+			tried = append(tried, mode)
+			return nil, errors.New("failed")
+		}
+	}
+	succeed := func(mode uint16) func(context.Context, string, *settings) (*Key, error) {
+		return func(context.Context, string, *settings) (*Key, error) {
+			tried = append(tried, mode)
+			return &Key{Mode: mode, Name: "test.example.com."}, nil
+		}
+	}
+
+	tables := []struct {
+		name        string
+		negotiators map[uint16]func(context.Context, string, *settings) (*Key, error)
+		options     []Option
+		mode        uint16
+		tried       []uint16
+		errs        int
+	}{
+		{
+			"gss",
+			map[uint16]func(context.Context, string, *settings) (*Key, error){
+				tsig.TkeyModeGSS: succeed(tsig.TkeyModeGSS),
+				tsig.TkeyModeDH:  succeed(tsig.TkeyModeDH),
+			},
+			nil,
+			tsig.TkeyModeGSS,
+			[]uint16{tsig.TkeyModeGSS},
+			0,
+		},
+		{
+			"fallback",
+			map[uint16]func(context.Context, string, *settings) (*Key, error){
+				tsig.TkeyModeGSS: fail(tsig.TkeyModeGSS),
+				tsig.TkeyModeDH:  succeed(tsig.TkeyModeDH),
+			},
+			nil,
+			tsig.TkeyModeDH,
+			[]uint16{tsig.TkeyModeGSS, tsig.TkeyModeDH},
+			0,
+		},
+		{
+			"preference",
+			map[uint16]func(context.Context, string, *settings) (*Key, error){
+				tsig.TkeyModeGSS: succeed(tsig.TkeyModeGSS),
+				tsig.TkeyModeDH:  succeed(tsig.TkeyModeDH),
+			},
+			[]Option{WithModes(tsig.TkeyModeDH, tsig.TkeyModeGSS)},
+			tsig.TkeyModeDH,
+			[]uint16{tsig.TkeyModeDH},
+			0,
+		},
+		{
+			"all fail",
+			map[uint16]func(context.Context, string, *settings) (*Key, error){
+				tsig.TkeyModeGSS: fail(tsig.TkeyModeGSS),
+				tsig.TkeyModeDH:  fail(tsig.TkeyModeDH),
+			},
+			nil,
+			0,
+			[]uint16{tsig.TkeyModeGSS, tsig.TkeyModeDH},
+			2,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			defer withNegotiators(table.negotiators)()
+			tried = nil
+
+			key, err := Negotiate(context.Background(), "ns.example.com", table.options...)
+			assert.Equal(t, table.tried, tried)
+
+			if table.errs > 0 {
+				if assert.NotNil(t, err) {
+					assert.Len(t, err.(*multierror.Error).Errors, table.errs)
+					assert.Contains(t, err.Error(), "gss: failed")
+				}
+				return
+			}
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, table.mode, key.Mode)
+			}
+		})
+	}
+}
+
+func TestNegotiateOptions(t *testing.T) {
+
+	_, err := Negotiate(context.Background(), "ns.example.com", WithModes())
+	assert.NotNil(t, err)
+
+	_, err = Negotiate(context.Background(), "ns.example.com", WithModes(tsig.TkeyModeServer))
+	assert.NotNil(t, err)
+
+	// Diffie-Hellman is skipped without an existing key
+	_, err = Negotiate(context.Background(), "ns.example.com", WithModes(tsig.TkeyModeDH))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "WithDH")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = Negotiate(ctx, "ns.example.com")
+	if assert.NotNil(t, err) {
+		assert.True(t, errors.Is(err.(*multierror.Error).Errors[0], context.Canceled))
+	}
+}
@@ -0,0 +1,165 @@
+package tsig
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AddressOrder is the interface used by a Client to decide the order the
+// addresses a host resolves to are tried in and to learn how each attempt
+// went, so that over time the addresses that answer reliably can be tried
+// first. Implementations must be safe for concurrent use.
+type AddressOrder interface {
+	// Order returns the addresses of the host in the order to try them,
+	// addrs is in the order the resolver returned them and must not be
+	// modified
+	Order(host string, addrs []string) []string
+	// Report is called with the outcome of each attempt against an
+	// address, err is nil if it answered. Attempts abandoned because the
+	// exchange was cancelled or another address answered first are not
+	// reported
+	Report(addr string, err error)
+}
+
+// LeastRecentFailure is an AddressOrder that tries the addresses that have
+// not failed first, in resolver order, followed by those that have with the
+// one that failed longest ago first. An address is forgotten once it answers.
+// The zero value is ready to use.
+type LeastRecentFailure struct {
+	// Now returns the time a failure is recorded at, time.Now is used if
+	// nil
+	Now func() time.Time
+
+	mu       sync.Mutex
+	failures map[string]time.Time
+}
+
+// Order implements AddressOrder.
+func (l *LeastRecentFailure) Order(host string, addrs []string) []string {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ordered := make([]string, len(addrs))
+	copy(ordered, addrs)
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ti, fi := l.failures[ordered[i]]
+		tj, fj := l.failures[ordered[j]]
+		if !fi || !fj {
+			return !fi && fj
+		}
+		return ti.Before(tj)
+	})
+
+	return ordered
+}
+
+// Report implements AddressOrder.
+func (l *LeastRecentFailure) Report(addr string, err error) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err == nil {
+		delete(l.failures, addr)
+		return
+	}
+
+	if l.failures == nil {
+		l.failures = make(map[string]time.Time)
+	}
+
+	now := time.Now
+	if l.Now != nil {
+		now = l.Now
+	}
+
+	l.failures[addr] = now()
+}
+
+// orderAddresses applies the AddressOrder of the Client, if any.
+func (c *Client) orderAddresses(host string, addrs []string) []string {
+
+	if c.AddressOrder == nil {
+		return addrs
+	}
+
+	return c.AddressOrder.Order(host, addrs)
+}
+
+// report passes the outcome of an attempt to the AddressOrder of the Client,
+// if any.
+func (c *Client) report(addr string, err error) {
+
+	if c.AddressOrder != nil {
+		c.AddressOrder.Report(addr, err)
+	}
+}
+
+// allowAddresses returns those of the addresses within the AllowedNetworks
+// of the Client, if set, or a NotAllowedError if there were addresses but
+// none of them are. An address that isn't an IP address can't be checked so
+// is never allowed.
+func (c *Client) allowAddresses(host string, addrs []string) ([]string, error) {
+
+	if len(c.AllowedNetworks) == 0 || len(addrs) == 0 {
+		return addrs, nil
+	}
+
+	allowed := make([]string, 0, len(addrs))
+	var skipped []string
+
+	for _, addr := range addrs {
+		if c.allowed(addr) {
+			allowed = append(allowed, addr)
+		} else {
+			skipped = append(skipped, addr)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil, &NotAllowedError{
+			Host:      host,
+			Addresses: skipped,
+		}
+	}
+
+	return allowed, nil
+}
+
+// allowed returns whether the address, ignoring any IPv6 zone, is within one
+// of the AllowedNetworks.
+func (c *Client) allowed(addr string) bool {
+
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range c.AllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// limitAddresses returns the first MaxAddresses of the addresses and whether
+// any were dropped.
+func (c *Client) limitAddresses(addrs []string) ([]string, bool) {
+
+	if c.MaxAddresses <= 0 || len(addrs) <= c.MaxAddresses {
+		return addrs, false
+	}
+
+	return addrs[:c.MaxAddresses], true
+}
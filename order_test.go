@@ -0,0 +1,189 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeastRecentFailure(t *testing.T) {
+
+	now := time.Unix(1600000000, 0)
+
+	order := &LeastRecentFailure{
+		Now: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+	}
+
+	addrs := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}
+
+	// No history so resolver order is kept
+	assert.Equal(t, addrs, order.Order("ns.example.com", addrs))
+
+	order.Report("192.0.2.2", errors.New("failed"))
+	order.Report("192.0.2.1", errors.New("failed"))
+	order.Report("192.0.2.4", nil)
+
+	assert.Equal(t, []string{"192.0.2.3", "192.0.2.4", "192.0.2.2", "192.0.2.1"}, order.Order("ns.example.com", addrs))
+
+	// Answering clears the failure
+	order.Report("192.0.2.2", nil)
+
+	assert.Equal(t, []string{"192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.1"}, order.Order("ns.example.com", addrs))
+
+	// The input is untouched
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}, addrs)
+}
+
+func TestExchangeAddressOrder(t *testing.T) {
+
+	var attempted []string
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			attempted = append(attempted, address)
+			if address == "192.0.2.1:53" {
+				return nil, errors.New("failed")
+			}
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver:     &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2"}},
+		AddressOrder: &LeastRecentFailure{},
+	}
+
+	request := &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	resp, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "192.0.2.2:53", resp.Address)
+	}
+	assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, attempted)
+
+	// The failed address is now tried last
+	attempted = nil
+
+	resp, err = client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "192.0.2.2:53", resp.Address)
+	}
+	assert.Equal(t, []string{"192.0.2.2:53"}, attempted)
+}
+
+func TestMaxAddresses(t *testing.T) {
+
+	var attempted []string
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			attempted = append(attempted, address)
+			if address != "192.0.2.4:53" {
+				return nil, errors.New("failed")
+			}
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver:     &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}},
+		AddressOrder: &LeastRecentFailure{},
+		MaxAddresses: 2,
+	}
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	_, err := client.Exchange(context.Background(), request)
+
+	var lerr *AddressLimitError
+	if assert.True(t, errors.As(err, &lerr)) {
+		assert.Equal(t, "ns.example.com", lerr.Host)
+		assert.Equal(t, 2, lerr.Limit)
+		assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, lerr.Addresses)
+		assert.Len(t, lerr.Err.(*multierror.Error).Errors, 2)
+	}
+	assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, attempted)
+
+	// The failures move the untried addresses within the limit
+	attempted = nil
+
+	resp, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "192.0.2.4:53", resp.Address)
+	}
+	assert.Equal(t, []string{"192.0.2.3:53", "192.0.2.4:53"}, attempted)
+
+	attempts, err := client.Attempts(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Len(t, attempts, 2)
+	}
+
+	client.MaxAddresses = 0
+
+	attempts, err = client.Attempts(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Len(t, attempts, 4)
+	}
+}
+
+func TestAllowedNetworks(t *testing.T) {
+
+	var attempted []string
+
+	_, allowed, _ := net.ParseCIDR("192.0.2.0/25")
+	_, allowed6, _ := net.ParseCIDR("2001:db8::/32")
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			attempted = append(attempted, address)
+			return nil, errors.New("failed")
+		}),
+		Resolver:        &FakeResolver{Addrs: []string{"192.0.2.200", "192.0.2.1", "198.51.100.1", "fe80::1%eth0", "2001:db8::1", "ns"}},
+		AllowedNetworks: []*net.IPNet{allowed, allowed6},
+	}
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	_, err := client.Exchange(context.Background(), request)
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"192.0.2.1:53", "[2001:db8::1]:53"}, attempted)
+
+	attempts, err := client.Attempts(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Len(t, attempts, 2)
+	}
+
+	client.Resolver = &FakeResolver{Addrs: []string{"192.0.2.200", "198.51.100.1"}}
+	attempted = nil
+
+	_, err = client.Exchange(context.Background(), request)
+
+	var aerr *NotAllowedError
+	if assert.True(t, errors.As(err, &aerr)) {
+		assert.Equal(t, "ns.example.com", aerr.Host)
+		assert.Equal(t, []string{"192.0.2.200", "198.51.100.1"}, aerr.Addresses)
+	}
+	assert.True(t, errors.Is(err, ErrNoAddresses))
+	assert.Len(t, attempted, 0)
+}
@@ -0,0 +1,34 @@
+package tsig
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// The pprof labels set on the work of each exchange if ProfileLabels is set.
+const (
+	// LabelHost is the host of the request, or the remote address of the
+	// connection given to ExchangeConn
+	LabelHost = "tsig.host"
+	// LabelMode is the TKEY mode of the request, such as "gss"
+	LabelMode = "tsig.mode"
+	// LabelName is the Name of the Client, it is only set if there is one
+	LabelName = "tsig.client"
+)
+
+// profile runs f with the pprof labels of the exchange if ProfileLabels is
+// set, otherwise it just runs f.
+func (c *Client) profile(ctx context.Context, host string, mode uint16, f func(context.Context)) {
+
+	if !c.ProfileLabels {
+		f(ctx)
+		return
+	}
+
+	labels := []string{LabelHost, host, LabelMode, ModeString(mode)}
+	if c.Name != "" {
+		labels = append(labels, LabelName, c.Name)
+	}
+
+	pprof.Do(ctx, pprof.Labels(labels...), f)
+}
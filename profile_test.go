@@ -0,0 +1,102 @@
+package tsig
+
+import (
+	"context"
+	"runtime/pprof"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// LabelClient records the pprof labels of the context each query is sent
+// with
+type LabelClient struct {
+	labels map[string]string
+}
+
+func (c *LabelClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	return c.ExchangeContext(context.Background(), m, address)
+}
+
+func (c *LabelClient) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	c.labels = map[string]string{}
+	pprof.ForLabels(ctx, func(key, value string) bool {
+		c.labels[key] = value
+		return true
+	})
+
+	return tkeyReply(m, m.Question[0].Name), 0, nil
+}
+
+func TestProfileLabels(t *testing.T) {
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	for _, enabled := range []bool{false, true} {
+		ex := &LabelClient{}
+
+		client := &Client{
+			Exchanger:     ex,
+			Resolver:      &FakeResolver{Addrs: []string{"192.0.2.1"}},
+			ProfileLabels: enabled,
+		}
+
+		_, err := client.Exchange(context.Background(), request)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		if enabled {
+			assert.Equal(t, map[string]string{LabelHost: "ns.example.com", LabelMode: "gss"}, ex.labels)
+		} else {
+			assert.Len(t, ex.labels, 0)
+		}
+	}
+}
+
+func TestClientName(t *testing.T) {
+
+	ex := &LabelClient{}
+	stream := NewEventStream(0)
+
+	client := &Client{
+		Name:          "primary",
+		Exchanger:     ex,
+		Resolver:      &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		ProfileLabels: true,
+		Events:        stream,
+	}
+
+	_, err := client.Exchange(context.Background(), &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, map[string]string{LabelHost: "ns.example.com", LabelMode: "gss", LabelName: "primary"}, ex.labels)
+
+	timeout := time.After(time.Second)
+	for n := 0; n < 3; n++ {
+		select {
+		case e := <-stream.Events():
+			assert.Equal(t, "primary", e.Client)
+		case <-timeout:
+			t.Fatal("missing events")
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package tsig
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ReverseZone returns the reverse zone usually delegated for the IP address,
+// the /24 under in-addr.arpa for IPv4 and the /64 under ip6.arpa for IPv6.
+// It returns the zone and any error that occurred.
+func ReverseZone(ip net.IP) (string, error) {
+
+	if ip.To4() != nil {
+		return NetworkReverseZone(ip, 24)
+	}
+
+	return NetworkReverseZone(ip, 64)
+}
+
+// NetworkReverseZone returns the reverse zone of the network with the given
+// prefix length that the IP address is in, for finding the server to
+// negotiate a key with to update it. Reverse zones can only be delegated on
+// octet boundaries under in-addr.arpa and nibble boundaries under ip6.arpa
+// so a network between them is in the zone of the shorter prefix, such as
+// the /16 zone for a /20, except for an IPv4 network longer than /24 which
+// uses the RFC 2317 classless zone named after its first address and prefix
+// length, such as 64/26.2.0.192.in-addr.arpa. for 192.0.2.64/26.
+// It returns the zone and any error that occurred, including for a prefix
+// length outside the range of the address family.
+func NetworkReverseZone(ip net.IP, prefix int) (string, error) {
+
+	bits, size := 128, 4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, size = ip4, 32, 8
+	}
+
+	if prefix < 0 || prefix > bits {
+		return "", fmt.Errorf("Invalid prefix length %d for %d-bit address", prefix, bits)
+	}
+
+	name, err := reverseName(ip.Mask(net.CIDRMask(prefix, bits)))
+	if err != nil {
+		return "", err
+	}
+
+	// Drop the labels below the boundary
+	labels := (bits - prefix + prefix%size) / size
+	zone := strings.SplitAfterN(name, ".", labels+1)[labels]
+
+	if size == 8 && prefix > 24 && prefix%size != 0 {
+		return fmt.Sprintf("%d/%d.%s", ip.Mask(net.CIDRMask(prefix, bits))[3], prefix, zone), nil
+	}
+
+	return zone, nil
+}
+
+func reverseName(ip net.IP) (string, error) {
+
+	if ip.To16() == nil {
+		return "", fmt.Errorf("Invalid IP address %q", ip.String())
+	}
+
+	return dns.ReverseAddr(ip.String())
+}
+
+// PTRUpdate returns an update to the reverse zone that adds a PTR record for
+// the in-addr.arpa or ip6.arpa name of the IP address pointing at the host
+// name. If zone is empty the zone returned by ReverseZone is used, otherwise
+// the reverse name must be within it. Any other PTR records of the name are
+// kept; the server applies the removals of an Update after its inserts so
+// clearing them takes an earlier update with the name in RemoveRRset.
+// It returns the update and any error that occurred.
+func PTRUpdate(zone string, ip net.IP, hostname string, ttl uint32) (*Update, error) {
+
+	name, err := reverseName(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	if zone == "" {
+		if zone, err = ReverseZone(ip); err != nil {
+			return nil, err
+		}
+	}
+	zone = dns.Fqdn(zone)
+
+	if !dns.IsSubDomain(zone, name) {
+		return nil, fmt.Errorf("Reverse name %s is not within zone %s", name, zone)
+	}
+
+	if _, ok := dns.IsDomainName(hostname); !ok || hostname == "" || hostname == "." {
+		return nil, fmt.Errorf("Invalid host name %q", hostname)
+	}
+
+	return &Update{
+		Zone: zone,
+		Insert: []dns.RR{
+			&dns.PTR{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypePTR,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				Ptr: dns.Fqdn(hostname),
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,105 @@
+package tsig
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseZone(t *testing.T) {
+
+	tables := []struct {
+		ip   net.IP
+		zone string
+	}{
+		{net.ParseIP("192.0.2.1"), "2.0.192.in-addr.arpa."},
+		{net.ParseIP("2001:db8::1"), "0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+
+	for _, table := range tables {
+		zone, err := ReverseZone(table.ip)
+		assert.Nil(t, err)
+		assert.Equal(t, table.zone, zone)
+	}
+
+	_, err := ReverseZone(nil)
+	assert.NotNil(t, err)
+}
+
+func TestNetworkReverseZone(t *testing.T) {
+
+	tables := []struct {
+		ip     string
+		prefix int
+		zone   string
+	}{
+		{"192.0.2.1", 32, "1.2.0.192.in-addr.arpa."},
+		{"192.0.2.1", 24, "2.0.192.in-addr.arpa."},
+		{"192.0.2.1", 16, "0.192.in-addr.arpa."},
+		{"192.0.18.1", 20, "0.192.in-addr.arpa."},
+		{"192.0.2.1", 8, "192.in-addr.arpa."},
+		{"192.0.2.1", 0, "in-addr.arpa."},
+		{"192.0.2.100", 26, "64/26.2.0.192.in-addr.arpa."},
+		{"192.0.2.1", 25, "0/25.2.0.192.in-addr.arpa."},
+		{"2001:db8::1", 64, "0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{"2001:db8::1", 32, "8.b.d.0.1.0.0.2.ip6.arpa."},
+		{"2001:db8::1", 30, "b.d.0.1.0.0.2.ip6.arpa."},
+		{"2001:db8:1234::1", 48, "4.3.2.1.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{"2001:db8::1", 0, "ip6.arpa."},
+	}
+
+	for _, table := range tables {
+		zone, err := NetworkReverseZone(net.ParseIP(table.ip), table.prefix)
+		if assert.Nil(t, err, table.ip) {
+			assert.Equal(t, table.zone, zone, table.ip)
+		}
+	}
+
+	for _, prefix := range []int{-1, 33} {
+		_, err := NetworkReverseZone(net.ParseIP("192.0.2.1"), prefix)
+		assert.NotNil(t, err)
+	}
+
+	_, err := NetworkReverseZone(net.ParseIP("2001:db8::1"), 129)
+	assert.NotNil(t, err)
+
+	_, err = NetworkReverseZone(nil, 24)
+	assert.NotNil(t, err)
+}
+
+func TestPTRUpdate(t *testing.T) {
+
+	u, err := PTRUpdate("", net.ParseIP("192.0.2.1"), "host.example.com", 300)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "2.0.192.in-addr.arpa.", u.Zone)
+		if assert.Len(t, u.Insert, 1) {
+			assert.Equal(t, "1.2.0.192.in-addr.arpa.\t300\tIN\tPTR\thost.example.com.", u.Insert[0].String())
+		}
+
+		msg, err := u.Msg()
+		if assert.Nil(t, err) {
+			assert.Equal(t, "2.0.192.in-addr.arpa.", msg.Question[0].Name)
+			assert.Len(t, msg.Ns, 1)
+		}
+	}
+
+	u, err = PTRUpdate("8.b.d.0.1.0.0.2.ip6.arpa", net.ParseIP("2001:db8::1"), "host.example.com.", 300)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "8.b.d.0.1.0.0.2.ip6.arpa.", u.Zone)
+		if assert.Len(t, u.Insert, 1) {
+			assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", u.Insert[0].Header().Name)
+			assert.Equal(t, "host.example.com.", u.Insert[0].(*dns.PTR).Ptr)
+		}
+	}
+
+	_, err = PTRUpdate("", nil, "host.example.com.", 300)
+	assert.NotNil(t, err)
+
+	_, err = PTRUpdate("3.0.192.in-addr.arpa.", net.ParseIP("192.0.2.1"), "host.example.com.", 300)
+	assert.NotNil(t, err)
+
+	_, err = PTRUpdate("", net.ParseIP("192.0.2.1"), "", 300)
+	assert.NotNil(t, err)
+}
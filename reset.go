@@ -0,0 +1,51 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultResetRetries is the number of times a query is resent to the same
+// address after the connection was reset unless ResetRetries is set.
+const DefaultResetRetries = 1
+
+func (c *Client) resetRetries() int {
+
+	switch {
+	case c.ResetRetries < 0:
+		return 0
+	case c.ResetRetries > 0:
+		return c.ResetRetries
+	default:
+		return DefaultResetRetries
+	}
+}
+
+// isReset reports whether the error is the connection being closed or reset
+// by the server, which some servers do to the first connection under load.
+func isReset(err error) bool {
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errConnReset)
+}
+
+// retryResets wraps send so the query is resent to the same address for as
+// long as the connection is reset up to the number of ResetRetries, rather
+// than moving on to the next address straight away. Each retry waits for as
+// long as the Backoff chooses first.
+func (c *Client) retryResets(ctx context.Context, send func(now time.Time) (*dns.Msg, error)) func(now time.Time) (*dns.Msg, error) {
+
+	return func(now time.Time) (*dns.Msg, error) {
+		rr, err := send(now)
+		for i := 0; i < c.resetRetries() && isReset(err) && ctx.Err() == nil; i++ {
+			if sleep(ctx, c.retryWait(i)) != nil {
+				break
+			}
+			rr, err = send(now)
+		}
+		return rr, err
+	}
+}
@@ -0,0 +1,100 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsReset(t *testing.T) {
+
+	tables := []struct {
+		err   error
+		reset bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", errConnReset)}, true},
+		{syscall.ECONNREFUSED, false},
+		{errors.New("failed"), false},
+	}
+
+	for _, table := range tables {
+		assert.Equal(t, table.reset, isReset(table.err), fmt.Sprint(table.err))
+	}
+}
+
+func TestExchangeRetryReset(t *testing.T) {
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	tables := []struct {
+		retries int
+		resets  int
+		sent    int
+		err     bool
+	}{
+		// The first connection is reset
+		{0, 1, 2, false},
+		{-1, 1, 1, true},
+		{0, 2, 2, true},
+		{2, 2, 3, false},
+	}
+
+	for _, table := range tables {
+		var sent int
+
+		client := &Client{
+			Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+				sent++
+				if sent <= table.resets {
+					return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", errConnReset)}
+				}
+				return tkeyReply(m, m.Question[0].Name), nil
+			}),
+			Resolver:     &FakeResolver{Addrs: []string{"192.0.2.1"}},
+			ResetRetries: table.retries,
+		}
+
+		_, err := client.Exchange(context.Background(), request)
+		if table.err {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, table.sent, sent)
+	}
+
+	// Other errors move straight on to the next address
+	var sent []string
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			sent = append(sent, address)
+			if address == "192.0.2.1:53" {
+				return nil, errors.New("failed")
+			}
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2"}},
+	}
+
+	_, err := client.Exchange(context.Background(), request)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, sent)
+}
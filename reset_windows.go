@@ -0,0 +1,9 @@
+// +build windows
+
+package tsig
+
+import (
+	"syscall"
+)
+
+var errConnReset = syscall.WSAECONNRESET
@@ -0,0 +1,205 @@
+package tsig
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Secret holds sensitive key material such as a negotiated TSIG secret. It is
+// backed by a []byte rather than a string because Go strings are immutable
+// and can't be reliably wiped, the bytes can be overwritten with Zero once
+// the secret is no longer needed.
+//
+// Any copy made with Base64, or by retaining the result of Bytes, is outside
+// the control of Zero.
+type Secret struct {
+	b []byte
+}
+
+// NewSecret returns a Secret that takes ownership of b, the caller shouldn't
+// retain or modify it.
+func NewSecret(b []byte) *Secret {
+
+	return &Secret{b: b}
+}
+
+// Bytes returns the underlying bytes of the secret without copying them. It
+// returns nil once the secret has been zeroed.
+func (s *Secret) Bytes() []byte {
+
+	return s.b
+}
+
+// Base64 returns the secret in the base64 form the dns package expects in
+// its TsigSecret maps. The returned string can't be zeroed so its use should
+// be kept to where a string is unavoidable.
+func (s *Secret) Base64() string {
+
+	return base64.StdEncoding.EncodeToString(s.b)
+}
+
+// String avoids the secret being printed by accident.
+func (s *Secret) String() string {
+
+	return "[secret]"
+}
+
+// Zero overwrites the secret with zeros and releases it, it is safe to call
+// more than once.
+func (s *Secret) Zero() {
+
+	for i := range s.b {
+		s.b[i] = 0
+	}
+	s.b = nil
+}
+
+// Destroy is the same as Zero, for callers that release resources with
+// Destroy.
+func (s *Secret) Destroy() {
+
+	s.Zero()
+}
+
+// ErrNoSecret is returned by NewKeyFile for a GSS key, its secret is the
+// GSS security context which can't be exported.
+var ErrNoSecret = errors.New("GSS keys have no secret to export")
+
+// KeyFile is a negotiated key in the form other tools expect, the secret is
+// base64 encoded as for the TsigSecret maps of the dns package.
+type KeyFile struct {
+	Name      string
+	Algorithm string
+	Secret    string
+}
+
+// NewKeyFile returns the key file for the key negotiated with the given key
+// name and algorithm, such as by DH.NegotiateKeySecret, the secret itself is
+// left untouched so it can still be zeroed.
+// It returns the key file and any error that occurred, which is ErrNoSecret
+// for a GSS algorithm.
+func NewKeyFile(name, algorithm string, secret *Secret) (*KeyFile, error) {
+
+	if IsGSS(algorithm) {
+		return nil, ErrNoSecret
+	}
+
+	if secret == nil || len(secret.Bytes()) == 0 {
+		return nil, errors.New("No secret for the key")
+	}
+
+	return &KeyFile{
+		Name:      name,
+		Algorithm: algorithm,
+		Secret:    secret.Base64(),
+	}, nil
+}
+
+// TSIGKey returns the key to sign a Request with.
+func (k *KeyFile) TSIGKey() *TSIGKey {
+
+	return &TSIGKey{
+		Name:      k.Name,
+		Algorithm: k.Algorithm,
+		Secret:    k.Secret,
+	}
+}
+
+// String renders the key as a key statement in the format of a BIND key
+// file, as read by nsupdate -k and named. Unlike Secret it includes the
+// secret so shouldn't be logged.
+func (k *KeyFile) String() string {
+
+	return fmt.Sprintf("key \"%s\" {\n\talgorithm %s;\n\tsecret \"%s\";\n};\n", k.Name, strings.TrimSuffix(k.Algorithm, "."), k.Secret)
+}
+
+// SavedKeyVersion is the version of the encoding written by
+// SavedKey.MarshalBinary.
+const SavedKeyVersion = 1
+
+// SavedKey is a negotiated key along with the server it was negotiated with
+// and when it expires, so it can be persisted and restored after a restart
+// rather than negotiating a new key, see DH.SaveKey and DH.RestoreKey. The
+// secret is only base64 encoded by MarshalBinary so it can still be zeroed.
+type SavedKey struct {
+	Name      string
+	Algorithm string
+	Secret    *Secret
+	Host      string
+	Expiry    time.Time
+}
+
+type savedKey struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Algorithm string    `json:"algorithm"`
+	Secret    []byte    `json:"secret"`
+	Host      string    `json:"host"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// MarshalBinary encodes the key, including its secret so the result should
+// be stored with the same care as a key file.
+// It returns the encoded key and any error that occurred, which is
+// ErrNoSecret for a GSS algorithm.
+func (k *SavedKey) MarshalBinary() ([]byte, error) {
+
+	if IsGSS(k.Algorithm) {
+		return nil, ErrNoSecret
+	}
+
+	if k.Secret == nil || len(k.Secret.Bytes()) == 0 {
+		return nil, errors.New("No secret for the key")
+	}
+
+	return json.Marshal(&savedKey{
+		Version:   SavedKeyVersion,
+		Name:      k.Name,
+		Algorithm: k.Algorithm,
+		Secret:    k.Secret.Bytes(),
+		Host:      k.Host,
+		Expiry:    k.Expiry,
+	})
+}
+
+// UnmarshalBinary decodes a key encoded by MarshalBinary, the caller should
+// zero data afterwards as it holds the encoded secret.
+// It returns any error that occurred, including for a version newer than
+// SavedKeyVersion.
+func (k *SavedKey) UnmarshalBinary(data []byte) error {
+
+	var saved savedKey
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	if saved.Version < 1 || saved.Version > SavedKeyVersion {
+		return fmt.Errorf("Unsupported saved key version %d", saved.Version)
+	}
+
+	if IsGSS(saved.Algorithm) {
+		return ErrNoSecret
+	}
+
+	if saved.Name == "" || saved.Algorithm == "" {
+		return errors.New("Saved key has no name or algorithm")
+	}
+
+	if len(saved.Secret) == 0 {
+		return errors.New("Saved key has no valid secret")
+	}
+
+	*k = SavedKey{
+		Name:      saved.Name,
+		Algorithm: saved.Algorithm,
+		Secret:    NewSecret(saved.Secret),
+		Host:      saved.Host,
+		Expiry:    saved.Expiry,
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package tsig
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecret(t *testing.T) {
+
+	b := []byte{0x93, 0xdb, 0x8a, 0xe6}
+
+	s := NewSecret(b)
+	assert.Equal(t, []byte{0x93, 0xdb, 0x8a, 0xe6}, s.Bytes())
+	assert.Equal(t, "k9uK5g==", s.Base64())
+	assert.Equal(t, "[secret]", fmt.Sprint(s))
+
+	s.Zero()
+	assert.Nil(t, s.Bytes())
+	assert.Equal(t, []byte{0, 0, 0, 0}, b)
+	assert.Equal(t, "", s.Base64())
+}
+
+func TestSecretDestroy(t *testing.T) {
+
+	b := []byte{0x93, 0xdb, 0x8a, 0xe6}
+
+	s := NewSecret(b)
+	s.Destroy()
+	assert.Nil(t, s.Bytes())
+	assert.Equal(t, []byte{0, 0, 0, 0}, b)
+}
+
+func TestKeyFile(t *testing.T) {
+
+	s := NewSecret([]byte{0x93, 0xdb, 0x8a, 0xe6})
+
+	k, err := NewKeyFile("test.example.com.", dns.HmacSHA256, s)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "key \"test.example.com.\" {\n\talgorithm hmac-sha256;\n\tsecret \"k9uK5g==\";\n};\n", k.String())
+		assert.Equal(t, &TSIGKey{Name: "test.example.com.", Algorithm: dns.HmacSHA256, Secret: "k9uK5g=="}, k.TSIGKey())
+		assert.Nil(t, k.TSIGKey().Validate())
+	}
+
+	// The key file has its own copy
+	s.Zero()
+	assert.Equal(t, "k9uK5g==", k.Secret)
+
+	_, err = NewKeyFile("test.example.com.", GSS, s)
+	assert.Equal(t, ErrNoSecret, err)
+
+	_, err = NewKeyFile("test.example.com.", LegacyGSS, nil)
+	assert.Equal(t, ErrNoSecret, err)
+
+	_, err = NewKeyFile("test.example.com.", dns.HmacSHA256, s)
+	assert.NotNil(t, err)
+}
+
+func TestSavedKey(t *testing.T) {
+
+	expiry := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := &SavedKey{
+		Name:      "test.example.com.",
+		Algorithm: dns.HmacSHA256,
+		Secret:    NewSecret([]byte{0x93, 0xdb, 0x8a, 0xe6}),
+		Host:      "ns.example.com",
+		Expiry:    expiry,
+	}
+
+	b, err := key.MarshalBinary()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Contains(t, string(b), `"version":1`)
+	assert.Contains(t, string(b), `"secret":"k9uK5g=="`)
+
+	restored := new(SavedKey)
+	if assert.Nil(t, restored.UnmarshalBinary(b)) {
+		assert.Equal(t, key.Name, restored.Name)
+		assert.Equal(t, key.Algorithm, restored.Algorithm)
+		assert.Equal(t, key.Secret.Bytes(), restored.Secret.Bytes())
+		assert.Equal(t, key.Host, restored.Host)
+		assert.True(t, expiry.Equal(restored.Expiry))
+	}
+
+	_, err = (&SavedKey{Name: "test.example.com.", Algorithm: GSS}).MarshalBinary()
+	assert.Equal(t, ErrNoSecret, err)
+
+	_, err = (&SavedKey{Name: "test.example.com.", Algorithm: dns.HmacSHA256}).MarshalBinary()
+	assert.NotNil(t, err)
+
+	tables := []string{
+		`not json`,
+		`{"version":2,"name":"test.example.com.","algorithm":"hmac-sha256.","secret":"k9uK5g=="}`,
+		`{"name":"test.example.com.","algorithm":"hmac-sha256.","secret":"k9uK5g=="}`,
+		`{"version":1,"name":"test.example.com.","algorithm":"gss-tsig"}`,
+		`{"version":1,"algorithm":"hmac-sha256.","secret":"k9uK5g=="}`,
+		`{"version":1,"name":"test.example.com.","algorithm":"hmac-sha256."}`,
+		`{"version":1,"name":"test.example.com.","algorithm":"hmac-sha256.","secret":"not base64"}`,
+	}
+
+	for _, table := range tables {
+		assert.NotNil(t, new(SavedKey).UnmarshalBinary([]byte(table)), table)
+	}
+}
@@ -0,0 +1,197 @@
+package tsig
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SRVSelector orders the targets of an SRV lookup into the order they should
+// be tried in, it may also drop targets. The records must not be modified.
+type SRVSelector func(records []*dns.SRV) []*dns.SRV
+
+// WeightedSRV is the default SRVSelector, it orders the records by priority
+// and orders those of equal priority at random in proportion to their weight
+// as RFC 2782 describes.
+func WeightedSRV(records []*dns.SRV) []*dns.SRV {
+
+	sorted := make([]*dns.SRV, len(records))
+	copy(sorted, records)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	ordered := make([]*dns.SRV, 0, len(sorted))
+
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		ordered = append(ordered, weighted(sorted[start:end])...)
+		start = end
+	}
+
+	return ordered
+}
+
+// weighted orders records of the same priority using the RFC 2782 weighted
+// random selection, records with a weight of zero have a small chance of
+// being picked before the others.
+func weighted(records []*dns.SRV) []*dns.SRV {
+
+	remaining := make([]*dns.SRV, len(records))
+	copy(remaining, records)
+
+	// RFC 2782 has records with a weight of zero placed first so they can
+	// still be picked when the running sum is zero
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return remaining[i].Weight == 0 && remaining[j].Weight != 0
+	})
+
+	ordered := make([]*dns.SRV, 0, len(records))
+
+	for len(remaining) > 0 {
+		total := 0
+		for _, r := range remaining {
+			total += int(r.Weight)
+		}
+
+		n := rand.Intn(total + 1)
+
+		i, sum := 0, 0
+		for ; i < len(remaining); i++ {
+			sum += int(remaining[i].Weight)
+			if sum >= n {
+				break
+			}
+		}
+
+		ordered = append(ordered, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+
+	return ordered
+}
+
+// maxAliases is how many CNAME records are followed from an SRV target
+const maxAliases = 8
+
+// AliasError is returned for an SRV target that is a CNAME when
+// ForbidAliasTargets is set, RFC 2782 requires the target to be the
+// canonical name.
+type AliasError struct {
+	Target    string
+	Canonical string
+}
+
+func (e *AliasError) Error() string {
+
+	return fmt.Sprintf("SRV target %s is an alias for %s", e.Target, e.Canonical)
+}
+
+// canonicalTarget follows any chain of CNAME records from the SRV target.
+// It returns the canonical name and any error that occurred.
+func (c *Client) canonicalTarget(ctx context.Context, target string) (string, error) {
+
+	name := dns.Fqdn(target)
+
+	for i := 0; i <= maxAliases; i++ {
+		rr, err := c.query(ctx, name, dns.TypeCNAME)
+		if err != nil {
+			return "", err
+		}
+
+		next := ""
+		for _, ans := range rr.Answer {
+			if cname, ok := ans.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname.Target
+				break
+			}
+		}
+
+		if next == "" {
+			return name, nil
+		}
+
+		name = next
+	}
+
+	return "", fmt.Errorf("More than %d aliases for SRV target %s", maxAliases, target)
+}
+
+// ServerForSRV finds the DNS server to send TKEY queries and updates to from
+// the SRV records of the name, for example "_dns-update._udp.example.com"
+// which DNS-SD uses to advertise the server accepting updates for a zone.
+// The targets are tried in
+// the order chosen by SRVSelector, or WeightedSRV if it is nil, and the first
+// reachable one is returned with the port from its SRV record. A target of
+// "." means the service is decidedly not available.
+//
+// A target that is a CNAME is replaced by its canonical name, unless
+// ForbidAliasTargets is set in which case it is skipped. This matters for
+// GSS as the SPN is derived from the server name and Active Directory only
+// registers the DNS/<host> SPN of each domain controller under its own
+// host name, which is also what it always uses as the SRV target.
+// It returns the chosen server and any error that occurred.
+func (c *Client) ServerForSRV(ctx context.Context, name string) (string, error) {
+
+	name = dns.Fqdn(name)
+
+	rr, err := c.query(ctx, name, dns.TypeSRV)
+	if err != nil {
+		return "", err
+	}
+
+	records := []*dns.SRV{}
+	for _, ans := range rr.Answer {
+		if srv, ok := ans.(*dns.SRV); ok {
+			records = append(records, srv)
+		}
+	}
+
+	if len(records) == 1 && records[0].Target == "." {
+		return "", fmt.Errorf("Service %s is not available", name)
+	}
+
+	selector := c.SRVSelector
+	if selector == nil {
+		selector = WeightedSRV
+	}
+
+	records = selector(records)
+
+	if len(records) == 0 {
+		return "", fmt.Errorf("No SRV records found for %s", name)
+	}
+
+	var errs []error
+	for _, srv := range records {
+		target, err := c.canonicalTarget(ctx, srv.Target)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", srv.Target, err))
+			continue
+		}
+
+		if c.ForbidAliasTargets && !strings.EqualFold(target, dns.Fqdn(srv.Target)) {
+			errs = append(errs, &AliasError{Target: srv.Target, Canonical: target})
+			continue
+		}
+
+		server := net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))
+		err = c.reachable(ctx, server)
+		if err == nil {
+			return server, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", srv.Target, err))
+	}
+
+	return "", c.aggregate(errs)
+}
@@ -0,0 +1,181 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedSRV(t *testing.T) {
+
+	records := []*dns.SRV{
+		{Target: "c.example.com.", Priority: 20, Weight: 0},
+		{Target: "a.example.com.", Priority: 10, Weight: 100},
+		{Target: "b.example.com.", Priority: 10, Weight: 0},
+		{Target: "d.example.com.", Priority: 20, Weight: 10},
+	}
+
+	first := map[string]int{}
+
+	for i := 0; i < 1000; i++ {
+		ordered := WeightedSRV(records)
+		if !assert.Len(t, ordered, 4) {
+			return
+		}
+
+		// Priority is strict
+		for _, srv := range ordered[:2] {
+			assert.Equal(t, uint16(10), srv.Priority)
+		}
+		for _, srv := range ordered[2:] {
+			assert.Equal(t, uint16(20), srv.Priority)
+		}
+
+		first[ordered[0].Target]++
+	}
+
+	// The heavier target usually wins but not always
+	assert.True(t, first["a.example.com."] > first["b.example.com."])
+	assert.True(t, first["b.example.com."] > 0)
+
+	// The records aren't reordered in place
+	assert.Equal(t, "c.example.com.", records[0].Target)
+}
+
+func TestServerForSRV(t *testing.T) {
+
+	answers := func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = append(r.Answer, mustRR(t, "_dns-update._udp.example.com. 300 SRV 10 0 5353 ns1.example.com."))
+		r.Answer = append(r.Answer, mustRR(t, "_dns-update._udp.example.com. 300 SRV 20 0 53 ns2.example.com."))
+		return r, nil
+	}
+
+	dialed := []string{}
+
+	client := &Client{
+		Nameserver: "192.0.2.53",
+		Exchanger:  FuncClient(answers),
+		Resolver: MapResolver{
+			"ns1.example.com.": {"192.0.2.1"},
+			"ns2.example.com.": {"192.0.2.2"},
+		},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		},
+	}
+
+	server, err := client.ServerForSRV(context.Background(), "_dns-update._udp.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "ns1.example.com.:5353", server)
+	assert.Equal(t, []string{"192.0.2.1:5353"}, dialed)
+
+	// A custom selector can prefer another target
+	dialed = []string{}
+	client.SRVSelector = func(records []*dns.SRV) []*dns.SRV {
+		return []*dns.SRV{records[1]}
+	}
+
+	server, err = client.ServerForSRV(context.Background(), "_dns-update._udp.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "ns2.example.com.:53", server)
+	assert.Equal(t, []string{"192.0.2.2:53"}, dialed)
+
+	// Nothing is selected
+	client.SRVSelector = func(records []*dns.SRV) []*dns.SRV {
+		return nil
+	}
+
+	_, err = client.ServerForSRV(context.Background(), "_dns-update._udp.example.com")
+	assert.NotNil(t, err)
+
+	// The service is explicitly unavailable
+	client.SRVSelector = nil
+	client.Exchanger = FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = append(r.Answer, mustRR(t, "_dns-update._udp.example.com. 300 SRV 0 0 0 ."))
+		return r, nil
+	})
+
+	_, err = client.ServerForSRV(context.Background(), "_dns-update._udp.example.com")
+	assert.NotNil(t, err)
+
+	// Unreachable targets are skipped
+	client.Exchanger = FuncClient(answers)
+	client.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "192.0.2.1:5353" {
+			return nil, errors.New("connection refused")
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+
+	server, err = client.ServerForSRV(context.Background(), "_dns-update._udp.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "ns2.example.com.:53", server)
+}
+
+func TestServerForSRVAlias(t *testing.T) {
+
+	exchanger := FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		switch {
+		case m.Question[0].Qtype == dns.TypeSRV:
+			r.Answer = append(r.Answer, mustRR(t, "_dns-update._udp.example.com. 300 SRV 10 0 53 alias.example.com."))
+		case m.Question[0].Name == "alias.example.com.":
+			r.Answer = append(r.Answer, mustRR(t, "alias.example.com. 300 CNAME other.example.com."))
+		case m.Question[0].Name == "other.example.com.":
+			r.Answer = append(r.Answer, mustRR(t, "other.example.com. 300 CNAME ns1.example.com."))
+		case m.Question[0].Name == "loop.example.com.":
+			r.Answer = append(r.Answer, mustRR(t, "loop.example.com. 300 CNAME loop.example.com."))
+		}
+		return r, nil
+	})
+
+	var dialed []string
+
+	client := &Client{
+		Nameserver: "192.0.2.53",
+		Exchanger:  exchanger,
+		Resolver: MapResolver{
+			"ns1.example.com.": {"192.0.2.1"},
+		},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		},
+	}
+
+	// The chain is followed to the canonical name
+	server, err := client.ServerForSRV(context.Background(), "_dns-update._udp.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "ns1.example.com.:53", server)
+	assert.Equal(t, []string{"192.0.2.1:53"}, dialed)
+
+	client.ForbidAliasTargets = true
+
+	_, err = client.ServerForSRV(context.Background(), "_dns-update._udp.example.com")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "SRV target alias.example.com. is an alias for ns1.example.com.")
+	}
+
+	_, err = client.canonicalTarget(context.Background(), "loop.example.com.")
+	assert.NotNil(t, err)
+
+	target, err := client.canonicalTarget(context.Background(), "ns1.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "ns1.example.com.", target)
+}
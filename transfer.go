@@ -0,0 +1,75 @@
+package tsig
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Transfer describes a zone transfer, an AXFR of the whole zone or an RFC
+// 1995 IXFR of the changes since a serial.
+type Transfer struct {
+	Zone string
+	// IXFR requests only the changes since Serial, the server may still
+	// send the whole zone
+	IXFR   bool
+	Serial uint32
+}
+
+// Msg builds the AXFR or IXFR query for the transfer.
+// It returns the message and any error that occurred.
+func (t *Transfer) Msg() (*dns.Msg, error) {
+
+	if t.Zone == "" {
+		return nil, fmt.Errorf("No zone to transfer")
+	}
+
+	msg := new(dns.Msg)
+
+	if t.IXFR {
+		msg.SetIxfr(dns.Fqdn(t.Zone), t.Serial, ".", ".")
+	} else {
+		msg.SetAxfr(dns.Fqdn(t.Zone))
+	}
+
+	return msg, nil
+}
+
+// SignedTransfer builds the transfer query and attaches a TSIG record for the
+// given key name and algorithm, the query is signed when it is sent and
+// client.Client.TransferContext then verifies each message of the response.
+// It returns the message and any error that occurred.
+func SignedTransfer(t *Transfer, keyname, algorithm string, fudge uint16) (*dns.Msg, error) {
+
+	msg, err := t.Msg()
+	if err != nil {
+		return nil, err
+	}
+
+	msg.SetTsig(keyname, algorithm, fudge, time.Now().Unix())
+
+	return msg, nil
+}
+
+// TransferRecords reads the envelopes of a zone transfer, such as those
+// returned by client.Client.TransferContext, until the channel is closed.
+// It returns every record in the order received and any error that ended
+// the transfer.
+func TransferRecords(env <-chan *dns.Envelope) ([]dns.RR, error) {
+
+	var rrs []dns.RR
+	var err error
+
+	for e := range env {
+		if e.Error != nil {
+			if err == nil {
+				err = e.Error
+			}
+			continue
+		}
+		rrs = append(rrs, e.RR...)
+	}
+
+	return rrs, err
+}
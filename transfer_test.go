@@ -0,0 +1,245 @@
+package tsig
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bodgit/tsig/client"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const transferSecret = "k9uK5qsPfbBxvVuldwzYww=="
+
+// chainSigner signs the messages of the response to a zone transfer like a
+// server, the MAC also covers the unsigned messages sent since the last
+// signed one which follow the previous MAC
+type chainSigner struct {
+	mac      string
+	unsigned []byte
+}
+
+func (s *chainSigner) Sign(msg []byte, rr *dns.TSIG) ([]byte, error) {
+
+	n := 0
+	if s.mac != "" {
+		n = 2 + len(s.mac)/2
+	}
+
+	buf := append(append(append([]byte(nil), msg[:n]...), s.unsigned...), msg[n:]...)
+
+	return client.HmacSigner{Secret: transferSecret}.Sign(buf, rr)
+}
+
+// serveTransfer answers one zone transfer over TCP with a message for each
+// of the answers, signed if the query was unless the index is in unsigned
+func serveTransfer(t *testing.T, answers [][]dns.RR, unsigned map[int]bool) string {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer l.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		co := &dns.Conn{Conn: conn, TsigSecret: map[string]string{"test.example.com.": transferSecret}}
+
+		// Answer even if the query doesn't verify
+		q, _ := co.ReadMsg()
+		if q == nil {
+			return
+		}
+
+		qt := q.IsTsig()
+		s := &chainSigner{}
+		if qt != nil {
+			s.mac = qt.MAC
+		}
+
+		for i, answer := range answers {
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Answer = answer
+
+			var out []byte
+			if qt == nil || unsigned[i] {
+				out, _ = r.Pack()
+				s.unsigned = append(s.unsigned, out...)
+			} else {
+				r.SetTsig(qt.Hdr.Name, qt.Algorithm, 300, time.Now().Unix())
+				var mac string
+				out, mac, _ = client.TsigGenerateWithSigner(r, s, s.mac, i > 0)
+				s.mac, s.unsigned = mac, nil
+			}
+
+			if _, err := co.Write(out); err != nil {
+				return
+			}
+		}
+
+		// Hold the connection open until the client is done with it
+		co.ReadMsg()
+	}()
+
+	return l.Addr().String()
+}
+
+func transferRRs(records ...string) []dns.RR {
+
+	rrs := make([]dns.RR, 0, len(records))
+	for _, s := range records {
+		rr, _ := dns.NewRR(s)
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+func TestTransfer(t *testing.T) {
+
+	soa := "example.com. 300 SOA ns.example.com. hostmaster.example.com. 10 3600 600 86400 300"
+	a := func(i int) string {
+		return fmt.Sprintf("host%d.example.com. 300 A 192.0.2.%d", i, i)
+	}
+
+	zone := [][]dns.RR{
+		transferRRs(soa, a(1)),
+		transferRRs(a(2)),
+		transferRRs(a(3)),
+		transferRRs(a(4), soa),
+	}
+
+	tables := []struct {
+		name     string
+		answers  [][]dns.RR
+		unsigned map[int]bool
+		secret   string
+		sign     bool
+		ixfr     bool
+		records  int
+		err      bool
+	}{
+		{"signed", zone, nil, transferSecret, true, false, 6, false},
+		{"unsigned middle", zone, map[int]bool{1: true, 2: true}, transferSecret, true, false, 6, false},
+		{"unsigned last", zone, map[int]bool{3: true}, transferSecret, true, false, 4, true},
+		{"unsigned first", zone, map[int]bool{0: true}, transferSecret, true, false, 0, true},
+		{"wrong secret", zone, nil, "c2VjcmV0", true, false, 0, true},
+		{"unsigned query", zone, nil, transferSecret, false, false, 6, false},
+		{"ixfr up to date", [][]dns.RR{transferRRs(soa)}, nil, transferSecret, true, true, 1, false},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			address := serveTransfer(t, table.answers, table.unsigned)
+
+			cl := &client.Client{}
+			cl.Net = "tcp"
+			cl.TsigSecret = map[string]string{"test.example.com.": table.secret}
+
+			transfer := &Transfer{Zone: "example.com", IXFR: table.ixfr, Serial: 10}
+
+			msg, err := transfer.Msg()
+			if table.sign {
+				msg, err = SignedTransfer(transfer, "test.example.com.", dns.HmacSHA256, 300)
+			}
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			env, err := cl.TransferContext(context.Background(), msg, address)
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			rrs, err := TransferRecords(env)
+			if table.err {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Len(t, rrs, table.records)
+		})
+	}
+}
+
+func TestTransferCancel(t *testing.T) {
+
+	// The server stalls after the first message
+	address := serveTransfer(t, [][]dns.RR{transferRRs("example.com. 300 SOA ns.example.com. hostmaster.example.com. 10 3600 600 86400 300")}, nil)
+
+	cl := &client.Client{}
+	cl.Net = "tcp"
+	cl.ReadTimeout = time.Minute
+
+	msg, err := (&Transfer{Zone: "example.com"}).Msg()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	env, err := cl.TransferContext(ctx, msg, address)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	if e := <-env; !assert.Nil(t, e.Error) {
+		return
+	}
+
+	cancel()
+
+	select {
+	case e, ok := <-env:
+		if assert.True(t, ok) {
+			assert.Equal(t, context.Canceled, e.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer not cancelled")
+	}
+
+	_, ok := <-env
+	assert.False(t, ok)
+}
+
+func TestTransferMsg(t *testing.T) {
+
+	_, err := (&Transfer{}).Msg()
+	assert.NotNil(t, err)
+
+	msg, err := (&Transfer{Zone: "example.com"}).Msg()
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.TypeAXFR, msg.Question[0].Qtype)
+		assert.Equal(t, "example.com.", msg.Question[0].Name)
+	}
+
+	msg, err = (&Transfer{Zone: "example.com", IXFR: true, Serial: 10}).Msg()
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.TypeIXFR, msg.Question[0].Qtype)
+		if assert.Len(t, msg.Ns, 1) {
+			assert.Equal(t, uint32(10), msg.Ns[0].(*dns.SOA).Serial)
+		}
+	}
+
+	// Only TCP and transfers are supported
+	cl := &client.Client{}
+	_, err = cl.TransferContext(context.Background(), msg, "192.0.2.1:53")
+	assert.NotNil(t, err)
+
+	cl.Net = "tcp"
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeSOA)
+	_, err = cl.TransferContext(context.Background(), query, "192.0.2.1:53")
+	assert.NotNil(t, err)
+}
@@ -1,21 +1,36 @@
 package tsig
 
 import (
-	"encoding/hex"
+	"context"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
-	c "github.com/bodgit/tsig/client"
 	"github.com/miekg/dns"
 )
 
 const (
 	// GSS is the RFC 3645 defined algorithm name
 	GSS = "gss-tsig."
+	// LegacyGSS is the algorithm name used by older Windows servers before
+	// RFC 3645 was published
+	LegacyGSS = "gss.microsoft.com."
 )
 
+// IsGSS returns whether the algorithm is either GSS or LegacyGSS, case is
+// ignored.
+func IsGSS(algorithm string) bool {
+
+	switch strings.ToLower(algorithm) {
+	case GSS, LegacyGSS:
+		return true
+	default:
+		return false
+	}
+}
+
 const (
 	_ uint16 = iota // Reserved, RFC 2930, section 2.5
 	// TkeyModeServer is used for server assigned keying
@@ -30,143 +45,189 @@ const (
 	TkeyModeDelete
 )
 
-// Exchanger is the interface a DNS client is expected to implement.
-type Exchanger interface {
-	Exchange(*dns.Msg, string) (*dns.Msg, time.Duration, error)
+// modes lists every TKEY mode defined by RFC 2930 along with a
+// human-readable name
+var modes = []struct {
+	mode uint16
+	name string
+}{
+	{0, "reserved"},
+	{TkeyModeServer, "server"},
+	{TkeyModeDH, "dh"},
+	{TkeyModeGSS, "gss"},
+	{TkeyModeResolver, "resolver"},
+	{TkeyModeDelete, "delete"},
 }
 
-func calculateTimes(mode uint16, lifetime uint32) (uint32, uint32, error) {
+// SupportedModes returns the TKEY modes that can be used with ExchangeTKEY,
+// which are those the package knows how to calculate the key validity for.
+func SupportedModes() []uint16 {
 
-	switch mode {
-	case TkeyModeDH:
-		fallthrough
-	case TkeyModeGSS:
-		now := time.Now().Unix()
-		return uint32(now), uint32(now) + lifetime, nil
-	case TkeyModeDelete:
-		return 0, 0, nil
-	default:
-		return 0, 0, fmt.Errorf("Unsupported TKEY mode %d", mode)
+	supported := []uint16{}
+	for _, m := range modes {
+		if _, _, err := calculateTimes(m.mode, 0); err == nil {
+			supported = append(supported, m.mode)
+		}
 	}
+
+	return supported
 }
 
-// SplitHostPort attempts to split a "hostname:port" string and return them
-// as separate strings. If the host cannot be split then it is returned with
-// the default DNS port "53".
-func SplitHostPort(host string) (string, string) {
+// SupportedModeNames returns the human-readable names of the modes returned
+// by SupportedModes, in the same order.
+func SupportedModeNames() []string {
 
-	hostname, port, err := net.SplitHostPort(host)
-	if err != nil {
-		return host, "53"
+	names := []string{}
+	for _, mode := range SupportedModes() {
+		names = append(names, ModeString(mode))
 	}
 
-	return hostname, port
+	return names
 }
 
-func exchangeTKEY(client Exchanger, host, keyname, algorithm string, mode uint16, lifetime uint32, input []byte, extra []dns.RR, tsigname, tsigalgo, tsigmac *string) (*dns.TKEY, []dns.RR, error) {
-
-	hostname, port := SplitHostPort(host)
+// ModeString returns the human-readable name of the TKEY mode, such as "gss"
+// for TkeyModeGSS. Undefined modes are rendered as their number.
+func ModeString(mode uint16) string {
 
-	msg := &dns.Msg{
-		MsgHdr: dns.MsgHdr{
-			RecursionDesired: false,
-		},
-		Question: make([]dns.Question, 1),
-		Extra:    make([]dns.RR, 1),
+	for _, m := range modes {
+		if m.mode == mode {
+			return m.name
+		}
 	}
 
-	msg.Question[0] = dns.Question{
-		Name:   keyname,
-		Qtype:  dns.TypeTKEY,
-		Qclass: dns.ClassANY,
-	}
+	return strconv.Itoa(int(mode))
+}
 
-	msg.Id = dns.Id()
+// ParseMode returns the TKEY mode for the given name as returned by
+// ModeString, case is ignored. A decimal mode number is also accepted.
+// It returns the mode and any error that occurred.
+func ParseMode(s string) (uint16, error) {
 
-	inception, expiration, err := calculateTimes(mode, lifetime)
-	if err != nil {
-		return nil, nil, err
+	for _, m := range modes {
+		if strings.EqualFold(m.name, s) {
+			return m.mode, nil
+		}
 	}
 
-	msg.Extra[0] = &dns.TKEY{
-		Hdr: dns.RR_Header{
-			Name:   keyname,
-			Rrtype: dns.TypeTKEY,
-			Class:  dns.ClassANY,
-			Ttl:    0,
-		},
-		Algorithm:  algorithm,
-		Mode:       mode,
-		Inception:  inception,
-		Expiration: expiration,
-		KeySize:    uint16(len(input)),
-		Key:        hex.EncodeToString(input),
+	// Undefined modes are rendered by ModeString as their number
+	if mode, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return uint16(mode), nil
 	}
 
-	msg.Extra = append(msg.Extra, extra...)
+	return 0, fmt.Errorf("Unknown TKEY mode %q", s)
+}
 
-	if strings.ToLower(algorithm) != GSS && tsigname != nil && tsigalgo != nil && tsigmac != nil {
-		msg.SetTsig(*tsigname, *tsigalgo, 300, time.Now().Unix())
+// SupportedAlgorithms returns the TSIG algorithms that can be used to sign
+// messages, which are GSS, LegacyGSS and the HMAC algorithms implemented by
+// the github.com/bodgit/tsig/client package.
+func SupportedAlgorithms() []string {
+
+	return []string{
+		GSS,
+		LegacyGSS,
+		dns.HmacMD5,
+		dns.HmacSHA1,
+		dns.HmacSHA256,
+		dns.HmacSHA512,
 	}
+}
 
-	rr, _, err := client.Exchange(msg, net.JoinHostPort(hostname, port))
-	if err != nil {
-		return nil, nil, err
-	}
+// Exchanger is the interface a DNS client is expected to implement.
+type Exchanger interface {
+	Exchange(*dns.Msg, string) (*dns.Msg, time.Duration, error)
+}
+
+// TimesFunc derives the inception and expiration times of a TKEY query from
+// the mode, the current time and the requested lifetime in seconds.
+type TimesFunc func(mode uint16, now time.Time, lifetime uint32) (inception, expiration uint32)
+
+// DefaultTimes is the TimesFunc used unless another is configured. DH and GSS
+// keys start now and expire after the lifetime, both times are zero for key
+// deletion.
+func DefaultTimes(mode uint16, now time.Time, lifetime uint32) (uint32, uint32) {
 
-	if rr.Rcode != dns.RcodeSuccess {
-		return nil, nil, fmt.Errorf("DNS error: %s (%d)", dns.RcodeToString[rr.Rcode], rr.Rcode)
+	switch mode {
+	case TkeyModeDH, TkeyModeGSS:
+		return uint32(now.Unix()), uint32(now.Unix()) + lifetime
+	default:
+		return 0, 0
 	}
+}
 
-	additional := []dns.RR{}
+func calculateTimes(mode uint16, lifetime uint32) (uint32, uint32, error) {
 
-	var tkey *dns.TKEY
+	return calculateTimesWith(DefaultTimes, mode, time.Now(), lifetime)
+}
 
-	for _, ans := range rr.Answer {
-		switch t := ans.(type) {
-		case *dns.TKEY:
-			// There mustn't be more than one TKEY answer RR
-			if tkey != nil {
-				return nil, nil, fmt.Errorf("Multiple TKEY responses")
-			}
-			tkey = t
-		default:
-			additional = append(additional, ans)
-		}
+// calculateTimesWith rejects unsupported modes and otherwise uses f to derive
+// the times, checking the expiration isn't before the inception.
+func calculateTimesWith(f TimesFunc, mode uint16, now time.Time, lifetime uint32) (uint32, uint32, error) {
+
+	switch mode {
+	case TkeyModeDH, TkeyModeGSS, TkeyModeDelete:
+	default:
+		return 0, 0, fmt.Errorf("Unsupported TKEY mode %d", mode)
+	}
+
+	if f == nil {
+		f = DefaultTimes
 	}
 
-	// There should always be at least a TKEY answer RR
-	if tkey == nil {
-		return nil, nil, fmt.Errorf("Received no TKEY response")
+	inception, expiration := f(mode, now, lifetime)
+	if mode != TkeyModeDelete && expiration < inception {
+		return 0, 0, fmt.Errorf("TKEY expiration %d is before inception %d", expiration, inception)
 	}
 
-	if tkey.Error != 0 {
-		return nil, nil, fmt.Errorf("TKEY error: %s (%d)", dns.RcodeToString[int(tkey.Error)], tkey.Error)
+	return inception, expiration, nil
+}
+
+// SplitHostPort attempts to split a "hostname:port" string and return them
+// as separate strings. If the host cannot be split then it is returned with
+// the default DNS port "53".
+func SplitHostPort(host string) (string, string) {
+
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host, "53"
 	}
 
-	return tkey, additional, nil
+	return hostname, port
 }
 
 // ExchangeTKEY exchanges TKEY records with the given host using the given
 // key name, algorithm, mode, and lifetime with the provided input payload.
 // Any additional DNS records are also sent and the exchange can be secured
-// with TSIG if a key name, algorithm and MAC are provided.
+// with TSIG if an algorithm and MAC are provided, the TSIG key name is the
+// key name unless one is also provided.
 // The TKEY record is returned along with any other DNS records in the
 // response along with any error that occurred.
+// It uses DefaultClient, see Client.Exchange for more control.
 func ExchangeTKEY(host, keyname, algorithm string, mode uint16, lifetime uint32, input []byte, extra []dns.RR, tsigname, tsigalgo, tsigmac *string) (*dns.TKEY, []dns.RR, error) {
 
-	client := c.Client{}
+	req := &Request{
+		Host:      host,
+		KeyName:   keyname,
+		Algorithm: algorithm,
+		Mode:      mode,
+		Lifetime:  lifetime,
+		Input:     input,
+		Extra:     extra,
+	}
 
-	// Use TCP regardless; TKEY queries can be in the range of ~ 1800 bytes
-	client.Net = "tcp"
+	if tsigalgo != nil && tsigmac != nil {
+		req.TSIG = &TSIGKey{
+			Algorithm: *tsigalgo,
+			Secret:    *tsigmac,
+		}
+		if tsigname != nil {
+			req.TSIG.Name = *tsigname
+		}
+	}
 
-	// nsupdate(1) intentionally ignores the TSIG on the TKEY response for GSS
-	if strings.ToLower(algorithm) == GSS {
-		client.TsigAlgorithm = map[string]*c.TsigAlgorithm{GSS: {Generate: nil, Verify: nil}}
-		client.TsigSecret = map[string]string{keyname: ""}
-	} else if tsigname != nil && tsigmac != nil {
-		client.TsigSecret = map[string]string{*tsigname: *tsigmac}
+	resp, err := DefaultClient.Exchange(context.Background(), req)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return exchangeTKEY(&client, host, keyname, algorithm, mode, lifetime, input, extra, tsigname, tsigalgo, tsigmac)
+	return resp.TKEY, resp.Additional, nil
 }
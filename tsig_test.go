@@ -1,13 +1,61 @@
 package tsig
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"testing"
 	"time"
 
+	c "github.com/bodgit/tsig/client"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
 )
 
+// tkeyReply returns a reply to the query with a GSS TKEY record for the key
+// name in the answer section echoing the mode of the query, if the query is
+// nil the reply is otherwise empty and uses GSS mode.
+func tkeyReply(m *dns.Msg, name string) *dns.Msg {
+
+	mode := TkeyModeGSS
+
+	r := new(dns.Msg)
+	if m != nil {
+		r.SetReply(m)
+		for _, rr := range m.Extra {
+			if t, ok := rr.(*dns.TKEY); ok {
+				mode = t.Mode
+			}
+		}
+	}
+	r.Answer = append(r.Answer, &dns.TKEY{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTKEY,
+			Class:  dns.ClassANY,
+		},
+		Algorithm: GSS,
+		Mode:      mode,
+	})
+
+	return r
+}
+
 type FakeClient struct {
 	Msg      *dns.Msg
 	Duration time.Duration
@@ -23,6 +71,38 @@ func (c *FakeClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Durati
 	return c.Msg, c.Duration, nil
 }
 
+type FakeResolver struct {
+	Addrs []string
+	Err   error
+}
+
+func (r *FakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+
+	if r.Err != nil {
+		return nil, r.Err
+	}
+
+	return r.Addrs, nil
+}
+
+// SlowClient blocks every exchange until the context is done.
+type SlowClient struct {
+	Addresses []string
+}
+
+func (c *SlowClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	return c.ExchangeContext(context.Background(), m, address)
+}
+
+func (c *SlowClient) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	c.Addresses = append(c.Addresses, address)
+	<-ctx.Done()
+
+	return nil, 0, ctx.Err()
+}
+
 func TestCalculateTimes(t *testing.T) {
 
 	lifetime := uint32(3600)
@@ -44,6 +124,101 @@ func TestCalculateTimes(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestCalculateTimesWith(t *testing.T) {
+
+	now := time.Unix(1600000000, 0)
+
+	skewed := func(mode uint16, now time.Time, lifetime uint32) (uint32, uint32) {
+		return uint32(now.Unix()) - 300, uint32(now.Unix()) + lifetime
+	}
+
+	t0, t1, err := calculateTimesWith(skewed, TkeyModeGSS, now, 3600)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1600000000-300), t0)
+	assert.Equal(t, uint32(1600000000+3600), t1)
+
+	backwards := func(mode uint16, now time.Time, lifetime uint32) (uint32, uint32) {
+		return uint32(now.Unix()), uint32(now.Unix()) - lifetime
+	}
+
+	_, _, err = calculateTimesWith(backwards, TkeyModeGSS, now, 3600)
+	assert.NotNil(t, err)
+
+	// Deletion doesn't care
+	_, _, err = calculateTimesWith(backwards, TkeyModeDelete, now, 3600)
+	assert.Nil(t, err)
+
+	_, _, err = calculateTimesWith(skewed, TkeyModeServer, now, 3600)
+	assert.NotNil(t, err)
+
+	// nil uses DefaultTimes
+	t0, t1, err = calculateTimesWith(nil, TkeyModeDH, now, 3600)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1600000000), t0)
+	assert.Equal(t, uint32(1600000000+3600), t1)
+}
+
+func TestSupportedModes(t *testing.T) {
+
+	assert.Equal(t, []uint16{TkeyModeDH, TkeyModeGSS, TkeyModeDelete}, SupportedModes())
+	assert.Equal(t, []string{"dh", "gss", "delete"}, SupportedModeNames())
+}
+
+func TestModeString(t *testing.T) {
+
+	modes := map[uint16]string{
+		0:                "reserved",
+		TkeyModeServer:   "server",
+		TkeyModeDH:       "dh",
+		TkeyModeGSS:      "gss",
+		TkeyModeResolver: "resolver",
+		TkeyModeDelete:   "delete",
+	}
+
+	for mode, name := range modes {
+		assert.Equal(t, name, ModeString(mode))
+
+		parsed, err := ParseMode(name)
+		assert.Nil(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+
+	assert.Equal(t, "42", ModeString(42))
+
+	mode, err := ParseMode(ModeString(42))
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(42), mode)
+
+	_, err = ParseMode("65536")
+	assert.NotNil(t, err)
+
+	mode, err = ParseMode("GSS")
+	assert.Nil(t, err)
+	assert.Equal(t, TkeyModeGSS, mode)
+
+	_, err = ParseMode("bogus")
+	assert.NotNil(t, err)
+}
+
+func TestSupportedAlgorithms(t *testing.T) {
+
+	algorithms := SupportedAlgorithms()
+	assert.Contains(t, algorithms, GSS)
+	assert.Contains(t, algorithms, LegacyGSS)
+	assert.Contains(t, algorithms, dns.HmacSHA256)
+}
+
+func TestIsGSS(t *testing.T) {
+
+	assert.True(t, IsGSS(GSS))
+	assert.True(t, IsGSS("GSS.Microsoft.com."))
+	assert.False(t, IsGSS(dns.HmacMD5))
+
+	algorithms, _ := IgnoreResponseTSIG("test.example.com.")
+	assert.Contains(t, algorithms, GSS)
+	assert.Contains(t, algorithms, LegacyGSS)
+}
+
 func TestSplitHostPort(t *testing.T) {
 
 	host, port := SplitHostPort("host.example.com.")
@@ -76,16 +251,7 @@ func TestExchangeTKEY(t *testing.T) {
 
 	cases := []struct {
 		client             FakeClient
-		host               string
-		keyname            string
-		algorithm          string
-		mode               uint16
-		lifetime           uint32
-		input              []byte
-		extra              []dns.RR
-		tsigname           *string
-		tsigalgo           *string
-		tsigmac            *string
+		request            Request
 		expectedTKEY       *dns.TKEY
 		expectedAdditional []dns.RR
 		expectedErr        error
@@ -100,21 +266,2697 @@ func TestExchangeTKEY(t *testing.T) {
 				Duration: 0,
 				Err:      nil,
 			},
-			host:               "ns.example.com.",
-			keyname:            "test.example.com.",
-			algorithm:          GSS,
-			mode:               TkeyModeGSS,
-			lifetime:           3600,
+			request: Request{
+				Host:      "ns.example.com.",
+				KeyName:   "test.example.com.",
+				Algorithm: GSS,
+				Mode:      TkeyModeGSS,
+				Lifetime:  3600,
+			},
 			expectedTKEY:       goodTKEY,
 			expectedAdditional: []dns.RR{},
 			expectedErr:        nil,
 		},
 	}
 
+	client := &Client{
+		Resolver: &FakeResolver{
+			Addrs: []string{"192.0.2.1"},
+		},
+	}
+
 	for _, c := range cases {
-		tkey, additional, err := exchangeTKEY(&c.client, c.host, c.keyname, c.algorithm, c.mode, c.lifetime, c.input, c.extra, c.tsigname, c.tsigalgo, c.tsigmac)
-		assert.Equal(t, c.expectedTKEY, tkey)
-		assert.Equal(t, c.expectedAdditional, additional)
+		resp, err := client.exchange(context.Background(), &c.client, &c.request)
 		assert.Equal(t, c.expectedErr, err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, c.expectedTKEY, resp.TKEY)
+			assert.Equal(t, c.expectedAdditional, resp.Additional)
+			assert.Equal(t, "192.0.2.1:53", resp.Address)
+		}
+	}
+}
+
+func TestExchangeTotalTimeout(t *testing.T) {
+
+	client := &Client{
+		Timeout:      50 * time.Millisecond,
+		TotalTimeout: 120 * time.Millisecond,
+		Resolver: &FakeResolver{
+			Addrs: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"},
+		},
+	}
+
+	request := &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	slow := &SlowClient{}
+
+	_, err := client.exchange(context.Background(), slow, request)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	var terr *TimeoutError
+	if assert.True(t, errors.As(err, &terr)) {
+		assert.Equal(t, "ns.example.com.", terr.Host)
+		assert.Equal(t, slow.Addresses, terr.Addresses)
+		assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"}, terr.Addresses)
+	}
+}
+
+func TestDNSClient(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+	}
+
+	client := &Client{}
+
+	cl := client.dnsClient(request)
+	assert.Equal(t, "tcp", cl.Net)
+	if assert.Contains(t, cl.TsigAlgorithm, GSS) {
+		assert.Nil(t, cl.TsigAlgorithm[GSS].Generate)
+		assert.Nil(t, cl.TsigAlgorithm[GSS].Verify)
+	}
+	assert.Equal(t, map[string]string{"test.example.com.": ""}, cl.TsigSecret)
+
+	algorithms := map[string]*c.TsigAlgorithm{GSS: {}}
+	secrets := map[string]string{"other.example.com.": ""}
+
+	client.GSSResponseTSIG = func(keyname string) (map[string]*c.TsigAlgorithm, map[string]string) {
+		return algorithms, secrets
+	}
+
+	cl = client.dnsClient(request)
+	assert.Equal(t, algorithms, cl.TsigAlgorithm)
+	assert.Equal(t, secrets, cl.TsigSecret)
+
+	// Non-GSS requests use the TSIG key, if any
+	request = &Request{
+		KeyName:   ".",
+		Algorithm: dns.HmacMD5,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	cl = client.dnsClient(request)
+	assert.Nil(t, cl.TsigAlgorithm)
+	assert.Equal(t, map[string]string{"tsig.example.com.": "k9uK5qsPfbBxvVuldwzYww=="}, cl.TsigSecret)
+}
+
+func TestResponseTSIGMaps(t *testing.T) {
+
+	ignore := &c.TsigAlgorithm{}
+	verify := &c.TsigAlgorithm{Verify: func([]byte, *dns.TSIG, string, string) error { return nil }}
+
+	client := &Client{
+		TsigAlgorithm: map[string]*c.TsigAlgorithm{LegacyGSS: verify, dns.HmacSHA256: ignore},
+		TsigSecret:    map[string]string{"other.example.com.": "c2VjcmV0"},
+	}
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+	}
+
+	// The caller supplied entries are merged over IgnoreResponseTSIG
+	cl := client.dnsClient(request)
+	assert.Len(t, cl.TsigAlgorithm, 3)
+	assert.Equal(t, verify, cl.TsigAlgorithm[LegacyGSS])
+	assert.Equal(t, ignore, cl.TsigAlgorithm[dns.HmacSHA256])
+	assert.Contains(t, cl.TsigAlgorithm, GSS)
+	assert.Equal(t, map[string]string{"test.example.com.": "", "other.example.com.": "c2VjcmV0"}, cl.TsigSecret)
+
+	// The maps of the Client itself are untouched
+	assert.Len(t, client.TsigAlgorithm, 2)
+	assert.Len(t, client.TsigSecret, 1)
+
+	// They take precedence over the TSIG key of the request
+	client.TsigSecret["tsig.example.com."] = "b3ZlcnJpZGRlbg=="
+	request = &Request{
+		KeyName:   ".",
+		Algorithm: dns.HmacSHA256,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacSHA256,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	cl = client.dnsClient(request)
+	assert.Equal(t, map[string]*c.TsigAlgorithm{LegacyGSS: verify, dns.HmacSHA256: ignore}, cl.TsigAlgorithm)
+	assert.Equal(t, "b3ZlcnJpZGRlbg==", cl.TsigSecret["tsig.example.com."])
+
+	m := new(dns.Msg)
+	m.SetTsig("tsig.example.com.", dns.HmacSHA256, 300, 0)
+	assert.Equal(t, TSIGIgnored, client.tsigStatus(request, m))
+
+	tables := []struct {
+		algorithms map[string]*c.TsigAlgorithm
+		secrets    map[string]string
+	}{
+		{map[string]*c.TsigAlgorithm{"hmac-sha256": ignore}, nil},
+		{map[string]*c.TsigAlgorithm{dns.HmacSHA256: nil}, nil},
+		{nil, map[string]string{"tsig.example.com": ""}},
+		{nil, map[string]string{"tsig.example.com.": "not base64"}},
+	}
+
+	for _, table := range tables {
+		client := &Client{TsigAlgorithm: table.algorithms, TsigSecret: table.secrets}
+		_, err := client.newMsg(request)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestTSIGName(t *testing.T) {
+
+	client := &Client{}
+
+	// An empty name is the key name
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacSHA256,
+		Mode:      TkeyModeDelete,
+		TSIG: &TSIGKey{
+			Algorithm: dns.HmacSHA256,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	msg, err := client.newMsg(request)
+	if assert.Nil(t, err) {
+		sign(msg, request, time.Now())
+		if assert.NotNil(t, msg.IsTsig()) {
+			assert.Equal(t, "test.example.com.", msg.IsTsig().Hdr.Name)
+		}
+	}
+	assert.Equal(t, map[string]string{"test.example.com.": "k9uK5qsPfbBxvVuldwzYww=="}, client.dnsClient(request).TsigSecret)
+
+	// Otherwise the names can differ unless they're checked
+	request.TSIG.Name = "tsig.example.com."
+
+	_, err = client.newMsg(request)
+	assert.Nil(t, err)
+
+	client.CheckTSIGName = true
+
+	_, err = client.newMsg(request)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "tsig.example.com.")
+	}
+
+	request.TSIG.Name = "TEST.example.com."
+
+	_, err = client.newMsg(request)
+	assert.Nil(t, err)
+
+	// GSS requests aren't signed so there's nothing to check
+	request.TSIG.Name = "tsig.example.com."
+	request.Algorithm, request.Mode, request.Lifetime = GSS, TkeyModeGSS, 3600
+
+	_, err = client.newMsg(request)
+	assert.Nil(t, err)
+}
+
+func TestRequireAuthentication(t *testing.T) {
+
+	key := &TSIGKey{
+		Name:      "tsig.example.com.",
+		Algorithm: dns.HmacMD5,
+		Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+	}
+
+	tables := []struct {
+		algorithm string
+		mode      uint16
+		key       *TSIGKey
+		err       bool
+	}{
+		{GSS, TkeyModeGSS, nil, false},
+		{LegacyGSS, TkeyModeGSS, nil, false},
+		{dns.HmacMD5, TkeyModeDH, key, false},
+		{dns.HmacMD5, TkeyModeDelete, key, false},
+		{dns.HmacMD5, TkeyModeDH, nil, true},
+		{dns.HmacMD5, TkeyModeDelete, nil, true},
+		// GSS requests are never signed
+		{GSS, TkeyModeDelete, key, true},
+	}
+
+	for _, table := range tables {
+		request := &Request{
+			KeyName:   "test.example.com.",
+			Algorithm: table.algorithm,
+			Mode:      table.mode,
+			Lifetime:  3600,
+			TSIG:      table.key,
+		}
+
+		// Permissive by default
+		_, err := (&Client{}).newMsg(request)
+		assert.Nil(t, err)
+
+		_, err = (&Client{RequireAuthentication: true}).newMsg(request)
+		if table.err {
+			assert.Equal(t, ErrUnauthenticated, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestNewMsgID(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+		ID:        1234,
+	}
+
+	msg, err := newMsg(request, nil, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1234), msg.Id)
+
+	request.ID = 0
+
+	msg, err = newMsg(request, nil, time.Now())
+	assert.Nil(t, err)
+	assert.NotNil(t, msg)
+}
+
+func TestNewMsgOversizedInput(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+		Input:     make([]byte, 70000),
+	}
+
+	_, err := newMsg(request, nil, time.Now())
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "Key data of 70000 bytes exceeds the TKEY maximum of 65535 bytes", err.Error())
+	}
+
+	request.Input = make([]byte, 65535)
+
+	msg, err := newMsg(request, nil, time.Now())
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint16(65535), msg.Extra[0].(*dns.TKEY).KeySize)
+	}
+}
+
+func TestValidateTKEY(t *testing.T) {
+
+	input := []byte{0xde, 0xad, 0xbe, 0xef}
+
+	cases := []struct {
+		tkey *dns.TKEY
+		err  bool
+	}{
+		{&dns.TKEY{KeySize: 4, Key: "deadbeef"}, false},
+		{&dns.TKEY{KeySize: 3, Key: "deadbeef"}, true},
+		{&dns.TKEY{KeySize: 4, Key: "deadbee"}, true},
+		{&dns.TKEY{KeySize: 4, Key: "deadbeee"}, true},
+		{&dns.TKEY{KeySize: 4, Key: "zzzzzzzz"}, true},
+	}
+
+	for _, tc := range cases {
+		err := validateTKEY(tc.tkey, input)
+		if tc.err {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+
+	assert.Nil(t, validateTKEY(&dns.TKEY{}, nil))
+}
+
+func TestExchangeConn(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+
+		co := &dns.Conn{
+			Conn:       server,
+			TsigSecret: map[string]string{"tsig.example.com.": "k9uK5qsPfbBxvVuldwzYww=="},
+		}
+
+		m, err := co.ReadMsg()
+		if err != nil {
+			return
+		}
+
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = append(r.Answer, &dns.TKEY{
+			Hdr: dns.RR_Header{
+				Name:   m.Question[0].Name,
+				Rrtype: dns.TypeTKEY,
+				Class:  dns.ClassANY,
+			},
+			Algorithm: m.IsTsig().Hdr.Name,
+			Mode:      TkeyModeDH,
+		})
+
+		co.WriteMsg(r)
+	}()
+
+	request := &Request{
+		Host:      "ignored.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	resp, err := (&Client{}).ExchangeConn(context.Background(), client, request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "test.example.com.", resp.TKEY.Hdr.Name)
+		// The request was signed with the TSIG key
+		assert.Equal(t, "tsig.example.com.", resp.TKEY.Algorithm)
+		assert.Equal(t, "pipe", resp.Address)
+	}
+}
+
+func TestVerifyExchange(t *testing.T) {
+
+	cases := []struct {
+		tkey   *dns.TKEY
+		mode   uint16
+		algo   string
+		errors int
+	}{
+		{&dns.TKEY{Algorithm: GSS, Mode: TkeyModeGSS, KeySize: 4, Key: "deadbeef"}, TkeyModeGSS, GSS, 0},
+		{&dns.TKEY{Algorithm: "GSS-TSIG.", Mode: TkeyModeGSS}, TkeyModeGSS, "gss-tsig", 0},
+		{&dns.TKEY{Algorithm: dns.HmacMD5, Mode: TkeyModeDH, KeySize: 16, Key: "000102030405060708090a0b0c0d0e0f"}, TkeyModeDH, dns.HmacMD5, 0},
+		{&dns.TKEY{Algorithm: LegacyGSS, Mode: TkeyModeGSS}, TkeyModeGSS, GSS, 1},
+		{&dns.TKEY{Algorithm: GSS, Mode: TkeyModeDH}, TkeyModeGSS, GSS, 1},
+		{&dns.TKEY{Algorithm: GSS, Mode: TkeyModeGSS, KeySize: 3, Key: "deadbeef"}, TkeyModeGSS, GSS, 1},
+		{&dns.TKEY{Algorithm: GSS, Mode: TkeyModeGSS, Key: "zz"}, TkeyModeGSS, GSS, 1},
+		{&dns.TKEY{Algorithm: GSS, Mode: TkeyModeGSS, OtherLen: 2, OtherData: "00"}, TkeyModeGSS, GSS, 1},
+		{&dns.TKEY{Algorithm: GSS, Mode: TkeyModeGSS, Error: dns.RcodeBadKey}, TkeyModeGSS, GSS, 1},
+		{&dns.TKEY{Algorithm: dns.HmacMD5, Mode: TkeyModeDH, KeySize: 1}, TkeyModeGSS, GSS, 3},
+	}
+
+	for _, tc := range cases {
+		err := VerifyExchange(tc.tkey, tc.mode, tc.algo)
+		if tc.errors == 0 {
+			assert.Nil(t, err)
+			continue
+		}
+		if assert.NotNil(t, err) {
+			assert.Len(t, err.(*multierror.Error).Errors, tc.errors)
+		}
+	}
+
+	assert.NotNil(t, VerifyExchange(nil, TkeyModeGSS, GSS))
+}
+
+func TestCheckStrict(t *testing.T) {
+
+	now := time.Unix(1600000000, 0)
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	tkey := func(name, algorithm string, mode uint16, inception, expiration int64) *dns.TKEY {
+		return &dns.TKEY{
+			Hdr: dns.RR_Header{
+				Name: name,
+			},
+			Algorithm:  algorithm,
+			Mode:       mode,
+			Inception:  uint32(now.Unix() + inception),
+			Expiration: uint32(now.Unix() + expiration),
+		}
+	}
+
+	cases := []struct {
+		tkey *dns.TKEY
+		err  bool
+	}{
+		{tkey("test.example.com.", GSS, TkeyModeGSS, 0, 3600), false},
+		{tkey("TEST.example.com.", GSS, TkeyModeGSS, -60, 3600), false},
+		{tkey("other.example.com.", GSS, TkeyModeGSS, 0, 3600), true},
+		{tkey("test.example.com.", dns.HmacMD5, TkeyModeGSS, 0, 3600), true},
+		{tkey("test.example.com.", GSS, TkeyModeDH, 0, 3600), true},
+		{tkey("test.example.com.", GSS, TkeyModeGSS, 3600, 3600), true},
+		{tkey("test.example.com.", GSS, TkeyModeGSS, -3600, -60), true},
+		{tkey("test.example.com.", GSS, TkeyModeGSS, 600, 3600), true},
+	}
+
+	for _, tc := range cases {
+		err := checkStrict(request, tc.tkey, now)
+		if tc.err {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestStrictRequest(t *testing.T) {
+
+	client := &Client{Strict: true}
+
+	_, err := client.newMsg(&Request{
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+	})
+	assert.NotNil(t, err)
+
+	_, err = client.newMsg(&Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	})
+	assert.Nil(t, err)
+}
+
+func TestMinLifetime(t *testing.T) {
+
+	cases := []struct {
+		client   *Client
+		mode     uint16
+		lifetime uint32
+		err      bool
+	}{
+		{&Client{}, TkeyModeGSS, 0, true},
+		{&Client{}, TkeyModeDH, 0, true},
+		{&Client{}, TkeyModeGSS, 1, false},
+		// Deletion requests carry no lifetime
+		{&Client{}, TkeyModeDelete, 0, false},
+		{&Client{MinLifetime: 60}, TkeyModeGSS, 30, true},
+		{&Client{MinLifetime: 60}, TkeyModeGSS, 60, false},
+	}
+
+	for _, tc := range cases {
+		_, err := tc.client.newMsg(&Request{
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      tc.mode,
+			Lifetime:  tc.lifetime,
+		})
+		if tc.err {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+
+	assert.Equal(t, uint32(DefaultMinLifetime), (&Client{}).minLifetime())
+}
+
+func TestResponseKeyName(t *testing.T) {
+
+	msg := new(dns.Msg)
+	msg.Answer = append(msg.Answer, &dns.TKEY{
+		Hdr: dns.RR_Header{
+			Name:   "server.example.com.",
+			Rrtype: dns.TypeTKEY,
+			Class:  dns.ClassANY,
+		},
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+	})
+
+	client := &Client{
+		Exchanger: &FakeClient{Msg: msg},
+		Resolver:  &FakeResolver{Addrs: []string{"192.0.2.1"}},
+	}
+
+	resp, err := client.Exchange(context.Background(), &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "server.example.com.", resp.KeyName)
+	}
+}
+
+func TestUnsupportedError(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	cases := []struct {
+		rcode       int
+		unsupported bool
+	}{
+		{dns.RcodeFormatError, true},
+		{dns.RcodeNotImplemented, true},
+		{dns.RcodeRefused, false},
+	}
+
+	for _, tc := range cases {
+		msg := new(dns.Msg)
+		msg.Rcode = tc.rcode
+
+		_, err := (&Client{}).newResponse(request, msg, "192.0.2.1:53")
+		assert.NotNil(t, err)
+
+		var uerr *UnsupportedError
+		if tc.unsupported && assert.True(t, errors.As(err, &uerr)) {
+			assert.Equal(t, GSS, uerr.Algorithm)
+			assert.Equal(t, TkeyModeGSS, uerr.Mode)
+			assert.Equal(t, tc.rcode, uerr.Rcode)
+			assert.Contains(t, err.Error(), "gss-tsig. algorithm in gss mode")
+		} else if !tc.unsupported {
+			assert.False(t, errors.As(err, &uerr))
+		}
+	}
+}
+
+func TestKeyNameError(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	msg := new(dns.Msg)
+	msg.Rcode = dns.RcodeNameError
+
+	_, err := (&Client{}).newResponse(request, msg, "192.0.2.1:53")
+
+	var kerr *KeyNameError
+	if assert.True(t, errors.As(err, &kerr)) {
+		assert.Equal(t, "test.example.com.", kerr.KeyName)
+		assert.Contains(t, err.Error(), "NXDOMAIN (3) for key name test.example.com.")
+	}
+}
+
+func TestAddressError(t *testing.T) {
+
+	tserr := &TSIGError{Code: dns.RcodeBadKey}
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			return nil, tserr
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2"}},
+	}
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	_, err := client.Exchange(context.Background(), request)
+
+	errs := Errors(err)
+	if !assert.Len(t, errs, 2) {
+		return
+	}
+
+	for i, address := range []string{"192.0.2.1:53", "192.0.2.2:53"} {
+		var aerr *AddressError
+		if assert.True(t, errors.As(errs[i], &aerr)) {
+			assert.Equal(t, "ns.example.com", aerr.Host)
+			assert.Equal(t, address, aerr.Address)
+			assert.Contains(t, errs[i].Error(), address)
+			assert.Equal(t, error(tserr), errors.Unwrap(errs[i]))
+		}
+	}
+
+	var terr *TSIGError
+	assert.True(t, errors.As(errs[0], &terr))
+	assert.True(t, IsUnknownKey(err))
+}
+
+func TestTKEYError(t *testing.T) {
+
+	msg := tkeyReply(nil, "test.example.com.")
+	tkey := msg.Answer[0].(*dns.TKEY)
+	tkey.Error = dns.RcodeBadKey
+	tkey.OtherLen = 4
+	tkey.OtherData = "96c73a8a"
+
+	_, _, err := parseResponse(msg, TKEYStrict)
+
+	var terr *TKEYError
+	if assert.True(t, errors.As(err, &terr)) {
+		assert.Equal(t, uint16(dns.RcodeBadKey), terr.Code)
+		assert.Equal(t, []byte{0x96, 0xc7, 0x3a, 0x8a}, terr.OtherData)
+		status, ok := terr.MinorStatus()
+		assert.True(t, ok)
+		assert.Equal(t, uint32(0x96c73a8a), status)
+		assert.Equal(t, "TKEY error: BADKEY (17), other data: 96c73a8a", err.Error())
+	}
+
+	terr = &TKEYError{Code: dns.RcodeBadTime}
+	assert.Equal(t, "TKEY error: BADTIME (18)", terr.Error())
+	_, ok := terr.MinorStatus()
+	assert.False(t, ok)
+}
+
+func TestTSIGError(t *testing.T) {
+
+	request := &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	tables := []struct {
+		code  uint16
+		other string
+		text  string
+	}{
+		{dns.RcodeBadSig, "", "TSIG error: BADSIG (16)"},
+		{dns.RcodeBadKey, "", "TSIG error: BADKEY (17)"},
+		{dns.RcodeBadTime, "00005f5e1000", "TSIG error: BADTIME (18)"},
+		{dns.RcodeBadTrunc, "", "TSIG error: BADTRUNC (22)"},
+	}
+
+	for _, table := range tables {
+		msg := tkeyReply(nil, "test.example.com.")
+		msg.Extra = append(msg.Extra, &dns.TSIG{
+			Hdr: dns.RR_Header{
+				Name:   "test.example.com.",
+				Rrtype: dns.TypeTSIG,
+				Class:  dns.ClassANY,
+			},
+			Algorithm: GSS,
+			Error:     table.code,
+			OtherLen:  uint16(len(table.other) / 2),
+			OtherData: table.other,
+		})
+
+		client := &Client{
+			Exchanger:     &FakeClient{Msg: msg},
+			Resolver:      &FakeResolver{Addrs: []string{"192.0.2.1"}},
+			BadTimeJitter: -1,
+		}
+
+		// The response code is NOERROR so it's accepted by default, except
+		// BADTIME which fails once the retry is rejected too
+		_, err := client.Exchange(context.Background(), request)
+		if table.code == dns.RcodeBadTime {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+
+		client.CheckTSIGError = true
+
+		_, err = client.Exchange(context.Background(), request)
+		if !assert.IsType(t, &multierror.Error{}, err) {
+			continue
+		}
+		var terr *TSIGError
+		if assert.True(t, errors.As(err.(*multierror.Error).Errors[0], &terr)) {
+			assert.Equal(t, table.code, terr.Code)
+			assert.Equal(t, table.other, hex.EncodeToString(terr.OtherData))
+			assert.Equal(t, table.text, terr.Error())
+		}
+	}
+
+	// No TSIG error leaves the response alone
+	msg := tkeyReply(nil, "test.example.com.")
+	rr, err := checkTSIGError(msg, nil)
+	assert.Equal(t, msg, rr)
+	assert.Nil(t, err)
+}
+
+func TestIsUnknownKey(t *testing.T) {
+
+	tables := []struct {
+		err     error
+		unknown bool
+	}{
+		{&KeyNameError{KeyName: "test.example.com."}, true},
+		{&TKEYError{Code: dns.RcodeBadKey}, true},
+		{&TKEYError{Code: dns.RcodeBadName}, true},
+		{&TKEYError{Code: dns.RcodeBadTime}, false},
+		{&TSIGError{Code: dns.RcodeBadKey}, true},
+		{&TSIGError{Code: dns.RcodeBadSig}, false},
+		{multierror.Append(errors.New("connection refused"), &TKEYError{Code: dns.RcodeBadKey}), true},
+		{multierror.Append(errors.New("connection refused")), false},
+		{errors.New("connection refused"), false},
+		{nil, false},
+	}
+
+	for _, table := range tables {
+		assert.Equal(t, table.unknown, IsUnknownKey(table.err), table.err)
+	}
+}
+
+// RaceClient answers each address after its delay unless the context is done
+// first.
+type RaceClient struct {
+	Delays map[string]time.Duration
+}
+
+func (c *RaceClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	return c.ExchangeContext(context.Background(), m, address)
+}
+
+func (c *RaceClient) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	select {
+	case <-time.After(c.Delays[address]):
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.TKEY{
+		Hdr: dns.RR_Header{
+			Name:   m.Question[0].Name,
+			Rrtype: dns.TypeTKEY,
+			Class:  dns.ClassANY,
+		},
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+	})
+
+	return r, c.Delays[address], nil
+}
+
+func TestExchangeParallel(t *testing.T) {
+
+	defer goleak.VerifyNone(t)
+
+	request := &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	cases := []struct {
+		delays  map[string]time.Duration
+		winners []string
+	}{
+		{
+			map[string]time.Duration{
+				"192.0.2.1:53": time.Second,
+				"192.0.2.2:53": time.Millisecond,
+			},
+			[]string{"192.0.2.2:53"},
+		},
+		{
+			// Both answer at once, either may win but only one does
+			map[string]time.Duration{
+				"192.0.2.1:53": time.Millisecond,
+				"192.0.2.2:53": time.Millisecond,
+			},
+			[]string{"192.0.2.1:53", "192.0.2.2:53"},
+		},
+	}
+
+	for _, tc := range cases {
+		client := &Client{
+			Resolver:  &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2"}},
+			Exchanger: &RaceClient{Delays: tc.delays},
+			Parallel:  true,
+		}
+
+		start := time.Now()
+
+		resp, err := client.Exchange(context.Background(), request)
+		if assert.Nil(t, err) {
+			assert.Contains(t, tc.winners, resp.Address)
+			assert.Len(t, resp.Msg.Answer, 1)
+		}
+
+		// The slow attempt was cancelled rather than waited for
+		assert.True(t, time.Since(start) < time.Second)
+	}
+}
+
+func TestExchangeFailures(t *testing.T) {
+
+	request := &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	for _, parallel := range []bool{false, true} {
+		client := &Client{
+			Resolver: &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+			Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+				switch address {
+				case "192.0.2.3:53":
+					// Answer once the others have failed
+					time.Sleep(50 * time.Millisecond)
+					return tkeyReply(m, m.Question[0].Name), nil
+				default:
+					return nil, errors.New("connection refused")
+				}
+			}),
+			Parallel: parallel,
+		}
+
+		resp, err := client.Exchange(context.Background(), request)
+		if assert.Nil(t, err) {
+			assert.Equal(t, "192.0.2.3:53", resp.Address)
+			if assert.Len(t, resp.Failures, 2) {
+				addresses := []string{resp.Failures[0].Address, resp.Failures[1].Address}
+				assert.ElementsMatch(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, addresses)
+				assert.EqualError(t, resp.Failures[0].Err, "connection refused")
+			}
+		}
+	}
+
+	// Nothing failed
+	client := &Client{
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+	}
+
+	resp, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Nil(t, resp.Failures)
+	}
+}
+
+// SocketClient is an Exchanger that addresses each attempt with only the
+// host, such as a socket path, recording what it was sent to.
+type SocketClient struct {
+	FakeClient
+	addresses []string
+}
+
+func (c *SocketClient) FormatAddress(addr, port string) string {
+
+	return addr
+}
+
+func (c *SocketClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	c.addresses = append(c.addresses, address)
+
+	return c.FakeClient.Exchange(m, address)
+}
+
+func TestFormatAddress(t *testing.T) {
+
+	tables := []struct {
+		net     string
+		addr    string
+		address string
+	}{
+		{"", "192.0.2.1", "192.0.2.1:53"},
+		{"tcp", "2001:db8::1", "[2001:db8::1]:53"},
+		{"tcp-tls", "192.0.2.1", "192.0.2.1:53"},
+		{"unix", "/run/named.sock", "/run/named.sock"},
+	}
+
+	for _, table := range tables {
+		assert.Equal(t, table.address, (&Client{Net: table.net}).formatAddress(nil, table.addr, "53"))
+	}
+
+	ex := &SocketClient{FakeClient: FakeClient{Msg: tkeyReply(nil, "test.example.com.")}}
+
+	client := &Client{
+		Exchanger: ex,
+		Resolver:  &FakeResolver{Addrs: []string{"/run/named.sock"}},
+	}
+
+	resp, err := client.Exchange(context.Background(), &Request{
+		Host:      "localhost",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "/run/named.sock", resp.Address)
+	}
+	assert.Equal(t, []string{"/run/named.sock"}, ex.addresses)
+}
+
+func TestMinRemainingLifetime(t *testing.T) {
+
+	now := time.Unix(1600000000, 0)
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	msg := tkeyReply(nil, "test.example.com.")
+	tkey := msg.Answer[0].(*dns.TKEY)
+	tkey.Inception = uint32(now.Unix())
+	tkey.Expiration = uint32(now.Add(10 * time.Minute).Unix())
+
+	// Off by default
+	_, err := (&Client{Now: func() time.Time { return now }}).newResponse(request, msg, "192.0.2.1:53")
+	assert.Nil(t, err)
+
+	client := &Client{
+		Now:                  func() time.Time { return now },
+		MinRemainingLifetime: 600,
+	}
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	assert.Nil(t, err)
+
+	client.MinRemainingLifetime = 3600
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	var lerr *LifetimeError
+	if assert.True(t, errors.As(err, &lerr)) {
+		assert.Equal(t, 10*time.Minute, lerr.Remaining)
+		assert.Equal(t, time.Hour, lerr.Minimum)
+		assert.Equal(t, "TKEY expires at 2020-09-13 12:36:40 +0000 UTC leaving 10m0s, less than the minimum of 1h0m0s", err.Error())
+	}
+
+	// Deleting a key grants nothing so isn't checked
+	request.Mode = TkeyModeDelete
+	msg.Answer[0].(*dns.TKEY).Mode = TkeyModeDelete
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	assert.Nil(t, err)
+}
+
+func TestClockSkew(t *testing.T) {
+
+	now := time.Unix(1600000000, 0)
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	msg := tkeyReply(nil, "test.example.com.")
+	tkey := msg.Answer[0].(*dns.TKEY)
+	tkey.Inception = uint32(now.Add(10 * time.Minute).Unix())
+	tkey.Expiration = uint32(now.Add(time.Hour).Unix())
+
+	client := &Client{Now: func() time.Time { return now }}
+
+	// Ten minutes is beyond the default
+	_, err := client.newResponse(request, msg, "192.0.2.1:53")
+	var verr *KeyValidityError
+	if assert.True(t, errors.As(err, &verr)) {
+		assert.True(t, verr.NotYetValid())
+		assert.False(t, verr.Expired())
+		assert.Equal(t, DefaultClockSkew, verr.Skew)
+		assert.Equal(t, "TKEY is not yet valid, inception 2020-09-13 12:36:40 +0000 UTC is more than 5m0s after 2020-09-13 12:26:40 +0000 UTC", err.Error())
+	}
+
+	client.ClockSkew = 15 * time.Minute
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	assert.Nil(t, err)
+
+	client.ClockSkew = -1
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	assert.Nil(t, err)
+
+	// Deleting a key grants nothing so isn't checked
+	client.ClockSkew = 0
+	request.Mode = TkeyModeDelete
+	tkey.Mode = TkeyModeDelete
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	assert.Nil(t, err)
+
+	// Strict mode tells an expired key apart
+	request.Mode = TkeyModeGSS
+	tkey.Mode = TkeyModeGSS
+	tkey.Inception = uint32(now.Add(-2 * time.Hour).Unix())
+	tkey.Expiration = uint32(now.Add(-time.Hour).Unix())
+	client.Strict = true
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	if assert.True(t, errors.As(err, &verr)) {
+		assert.False(t, verr.NotYetValid())
+		assert.True(t, verr.Expired())
+		assert.Equal(t, "TKEY already expired at 2020-09-13 11:26:40 +0000 UTC", err.Error())
+	}
+}
+
+func TestRequireAuthoritative(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	msg := new(dns.Msg)
+	msg.Answer = append(msg.Answer, &dns.TKEY{
+		Hdr: dns.RR_Header{
+			Name:   "test.example.com.",
+			Rrtype: dns.TypeTKEY,
+			Class:  dns.ClassANY,
+		},
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+	})
+
+	// Off by default
+	_, err := (&Client{}).newResponse(request, msg, "192.0.2.1:53")
+	assert.Nil(t, err)
+
+	client := &Client{RequireAuthoritative: true}
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	assert.NotNil(t, err)
+
+	msg.Authoritative = true
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	assert.Nil(t, err)
+
+	// Errors from the server take precedence
+	msg.Authoritative = false
+	msg.Rcode = dns.RcodeNotImplemented
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	var uerr *UnsupportedError
+	assert.True(t, errors.As(err, &uerr))
+
+	msg.Rcode = dns.RcodeSuccess
+	msg.Answer[0].(*dns.TKEY).Error = dns.RcodeBadKey
+
+	_, err = client.newResponse(request, msg, "192.0.2.1:53")
+	var terr *TKEYError
+	assert.True(t, errors.As(err, &terr))
+}
+
+func TestCheckTKEYName(t *testing.T) {
+
+	tables := []struct {
+		client *Client
+		mode   uint16
+		name   string
+		err    bool
+	}{
+		// Off by default
+		{&Client{}, TkeyModeDelete, "other.example.com.", false},
+		{&Client{CheckTKEYName: true}, TkeyModeDelete, "other.example.com.", true},
+		{&Client{CheckTKEYName: true}, TkeyModeDelete, "TEST.example.com.", false},
+		{&Client{CheckTKEYName: true}, TkeyModeResolver, "other.example.com.", true},
+		// The server may choose the name
+		{&Client{CheckTKEYName: true}, TkeyModeGSS, "other.example.com.", false},
+		{&Client{CheckTKEYName: true}, TkeyModeDH, "other.example.com.", false},
+		{&Client{CheckTKEYName: true}, TkeyModeServer, "other.example.com.", false},
+		{&Client{CheckTKEYName: true, TKEYNameModes: []uint16{}}, TkeyModeGSS, "other.example.com.", true},
+		{&Client{CheckTKEYName: true, TKEYNameModes: []uint16{TkeyModeDelete}}, TkeyModeDelete, "other.example.com.", false},
+	}
+
+	for _, table := range tables {
+		msg := tkeyReply(nil, table.name)
+		msg.Answer[0].(*dns.TKEY).Mode = table.mode
+
+		_, err := table.client.newResponse(&Request{
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      table.mode,
+			Lifetime:  3600,
+		}, msg, "192.0.2.1:53")
+		if table.err {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestModeError(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	// The server chose server assigned keying
+	msg := tkeyReply(nil, "test.example.com.")
+	msg.Answer[0].(*dns.TKEY).Mode = TkeyModeServer
+
+	_, err := (&Client{}).newResponse(request, msg, "192.0.2.1:53")
+	var merr *ModeError
+	if assert.True(t, errors.As(err, &merr)) {
+		assert.Equal(t, TkeyModeGSS, merr.Requested)
+		assert.Equal(t, TkeyModeServer, merr.Returned)
+		assert.Equal(t, "TKEY mode gss was requested but the server returned server", err.Error())
+	}
+
+	resp, err := (&Client{AllowModeChange: true}).newResponse(request, msg, "192.0.2.1:53")
+	if assert.Nil(t, err) {
+		assert.Equal(t, TkeyModeServer, resp.TKEY.Mode)
+	}
+}
+
+func TestVerifyResponseTSIG(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	// The server answers without signing the response
+	exchange := func(client *Client) (*Response, error) {
+		a, b := net.Pipe()
+		defer a.Close()
+
+		go func() {
+			defer b.Close()
+
+			co := &dns.Conn{
+				Conn:       b,
+				TsigSecret: map[string]string{request.TSIG.Name: request.TSIG.Secret},
+			}
+			m, err := co.ReadMsg()
+			if err != nil {
+				return
+			}
+
+			r := tkeyReply(m, m.Question[0].Name)
+			r.Answer[0].(*dns.TKEY).Algorithm = dns.HmacMD5
+			r.Answer[0].(*dns.TKEY).Mode = TkeyModeDH
+			co.WriteMsg(r)
+		}()
+
+		return client.ExchangeConn(context.Background(), a, request)
+	}
+
+	// Off by default
+	resp, err := exchange(&Client{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, TSIGUnsigned, resp.TSIG)
+	}
+
+	client := &Client{VerifyResponseTSIG: true}
+
+	_, err = exchange(client)
+	assert.True(t, errors.Is(err, ErrResponseNotSigned))
+
+	// GSS negotiation is never signed
+	_, err = client.newResponse(&Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}, tkeyReply(nil, "test.example.com."), "192.0.2.1:53")
+	assert.Nil(t, err)
+}
+
+func TestPack(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+		Input:     []byte{0xde, 0xad, 0xbe, 0xef},
+		ID:        1234,
+	}
+
+	b, err := (&Client{}).Pack(request)
+	assert.Nil(t, err)
+
+	msg := new(dns.Msg)
+	if assert.Nil(t, msg.Unpack(b)) {
+		assert.Equal(t, uint16(1234), msg.Id)
+		assert.Nil(t, msg.IsTsig())
+		if assert.Len(t, msg.Extra, 1) {
+			assert.Equal(t, "deadbeef", msg.Extra[0].(*dns.TKEY).Key)
+		}
+	}
+
+	request = &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	b, err = (&Client{}).Pack(request)
+	assert.Nil(t, err)
+
+	// The TSIG RR is present and signed correctly
+	msg = new(dns.Msg)
+	if assert.Nil(t, msg.Unpack(b)) && assert.NotNil(t, msg.IsTsig()) {
+		assert.Equal(t, "tsig.example.com.", msg.IsTsig().Hdr.Name)
+		assert.Nil(t, dns.TsigVerify(b, "k9uK5qsPfbBxvVuldwzYww==", "", false))
+	}
+
+	// With a fixed clock and Id the bytes are stable
+	now := time.Now()
+	client := &Client{
+		Now: func() time.Time {
+			return now
+		},
+	}
+	request.ID = 1234
+
+	b, err = client.Pack(request)
+	assert.Nil(t, err)
+
+	again, err := client.Pack(request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, b, again)
+	}
+
+	msg = new(dns.Msg)
+	if assert.Nil(t, msg.Unpack(b)) && assert.NotNil(t, msg.IsTsig()) {
+		assert.Equal(t, uint64(now.Unix()), msg.IsTsig().TimeSigned)
+		assert.Equal(t, uint32(now.Unix()), msg.Extra[0].(*dns.TKEY).Inception)
+	}
+
+	// A TSIG record added by PreSend to a request without a TSIG key
+	request.TSIG = nil
+	client.PreSend = func(m *dns.Msg) {
+		m.SetTsig("tsig.example.com.", dns.HmacMD5, 300, now.Unix())
+	}
+
+	_, err = client.Pack(request)
+	assert.NotNil(t, err)
+
+	client.TSIGSigner = c.HmacSigner{Secret: "k9uK5qsPfbBxvVuldwzYww=="}
+
+	b, err = client.Pack(request)
+	if assert.Nil(t, err) {
+		assert.Nil(t, dns.TsigVerify(b, "k9uK5qsPfbBxvVuldwzYww==", "", false))
+	}
+}
+
+func TestCompress(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+		Input:     []byte{0xde, 0xad, 0xbe, 0xef},
+		ID:        1234,
+	}
+
+	name := []byte("\x04test\x07example\x03com\x00")
+
+	tables := []struct {
+		compress bool
+		names    int
+	}{
+		// The TKEY owner name repeats the question
+		{false, 2},
+		// The TKEY owner name points back to the question
+		{true, 1},
+	}
+
+	for _, table := range tables {
+		msg, err := (&Client{Compress: table.compress}).newMsg(request)
+		if assert.Nil(t, err) {
+			assert.Equal(t, table.compress, msg.Compress)
+		}
+
+		b, err := (&Client{Compress: table.compress}).Pack(request)
+		if assert.Nil(t, err) {
+			assert.Equal(t, table.names, bytes.Count(b, name))
+		}
+	}
+}
+
+func TestForceEDNS0(t *testing.T) {
+
+	opt := func(version uint8) *dns.OPT {
+		o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		o.SetVersion(version)
+		return o
+	}
+
+	tables := []struct {
+		force bool
+		extra []dns.RR
+		opts  int
+		err   bool
+	}{
+		{false, nil, 0, false},
+		{true, nil, 1, false},
+		{true, []dns.RR{opt(0)}, 1, false},
+		{true, []dns.RR{opt(1)}, 0, true},
+		{true, []dns.RR{opt(0), opt(0)}, 0, true},
+		// Off by default so nothing is checked
+		{false, []dns.RR{opt(1)}, 1, false},
+	}
+
+	for _, table := range tables {
+		msg, err := (&Client{ForceEDNS0: table.force}).newMsg(&Request{
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+			Extra:     table.extra,
+		})
+		if table.err {
+			assert.NotNil(t, err)
+			continue
+		}
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		var opts int
+		for _, rr := range msg.Extra {
+			if o, ok := rr.(*dns.OPT); ok {
+				opts++
+				if table.force {
+					assert.Equal(t, uint8(0), o.Version())
+				}
+			}
+		}
+		assert.Equal(t, table.opts, opts)
+	}
+}
+
+func TestExtraOrder(t *testing.T) {
+
+	extra := mustRR(t, "test.example.com. 300 IN A 192.0.2.1")
+
+	for _, first := range []bool{false, true} {
+		request := &Request{
+			KeyName:    "test.example.com.",
+			Algorithm:  dns.HmacMD5,
+			Mode:       TkeyModeDH,
+			Lifetime:   3600,
+			Extra:      []dns.RR{extra},
+			ExtraFirst: first,
+			TSIG: &TSIGKey{
+				Name:      "tsig.example.com.",
+				Algorithm: dns.HmacMD5,
+				Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+			},
+		}
+
+		// EDNS0 is added to the query too
+		b, err := (&Client{TCPKeepalive: true}).Pack(request)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		msg := new(dns.Msg)
+		if !assert.Nil(t, msg.Unpack(b)) || !assert.Len(t, msg.Extra, 4) {
+			continue
+		}
+
+		tkey := 0
+		if first {
+			tkey = 1
+		}
+		assert.IsType(t, &dns.TKEY{}, msg.Extra[tkey])
+		assert.IsType(t, &dns.A{}, msg.Extra[1-tkey])
+
+		// The TSIG RR is always last
+		assert.IsType(t, &dns.TSIG{}, msg.Extra[len(msg.Extra)-1])
+	}
+
+	// A TSIG RR can't be smuggled in with the extras
+	_, err := (&Client{}).Pack(&Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+		Extra: []dns.RR{&dns.TSIG{
+			Hdr: dns.RR_Header{
+				Name:   "tsig.example.com.",
+				Rrtype: dns.TypeTSIG,
+				Class:  dns.ClassANY,
+			},
+			Algorithm: dns.HmacMD5,
+		}},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestTLSConfig(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+	}
+
+	config := &tls.Config{ServerName: "ns.example.com"}
+
+	client := &Client{
+		Net:       "tcp-tls",
+		TLSConfig: config,
+	}
+
+	assert.Equal(t, config, client.dnsClient(request).TLSConfig)
+
+	called := false
+	client.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		called = true
+		return nil
+	}
+
+	cl := client.dnsClient(request)
+	if assert.NotNil(t, cl.TLSConfig) && assert.NotNil(t, cl.TLSConfig.VerifyPeerCertificate) {
+		assert.Equal(t, "ns.example.com", cl.TLSConfig.ServerName)
+		assert.Nil(t, cl.TLSConfig.VerifyPeerCertificate(nil, nil))
+		assert.True(t, called)
+	}
+
+	// The caller's configuration is untouched
+	assert.Nil(t, config.VerifyPeerCertificate)
+
+	// TLS settings are ignored otherwise
+	client.Net = "tcp"
+	assert.Nil(t, client.dnsClient(request).TLSConfig)
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ns.example.com"},
+		DNSNames:     []string{"ns.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveTLS accepts a single connection on the loopback listener, completes
+// the server side of a TLS handshake then discards anything read until the
+// client closes the connection. A real socket is used rather than net.Pipe as
+// the latter is unbuffered so a client aborting the handshake part way
+// through the server flight would deadlock. The deadline stops either side
+// blocking forever.
+func serveTLS(l net.Listener, cert tls.Certificate) {
+
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	server := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err := server.Handshake(); err != nil {
+		return
+	}
+
+	io.Copy(ioutil.Discard, server)
+}
+
+func TestVerifyPeerCertificate(t *testing.T) {
+
+	cert := selfSignedCertificate(t)
+	pin := sha256.Sum256(cert.Certificate[0])
+
+	pinned := func(pin [sha256.Size]byte) func([][]byte, [][]*x509.Certificate) error {
+		return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || sha256.Sum256(rawCerts[0]) != pin {
+				return errors.New("certificate not pinned")
+			}
+			return nil
+		}
+	}
+
+	cases := []struct {
+		pin [sha256.Size]byte
+		err bool
+	}{
+		{pin, false},
+		{[sha256.Size]byte{}, true},
+	}
+
+	for _, tc := range cases {
+		client := &Client{
+			Net:      "tcp-tls",
+			Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+			// The certificate is self-signed so only the pin is checked
+			TLSConfig:             &tls.Config{InsecureSkipVerify: true},
+			VerifyPeerCertificate: pinned(tc.pin),
+			dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				assert.Equal(t, "tcp", network)
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					return nil, err
+				}
+				go serveTLS(l, cert)
+				return net.Dial("tcp", l.Addr().String())
+			},
+		}
+
+		conn, err := client.dialHost(context.Background(), "ns.example.com")
+		if tc.err {
+			assert.NotNil(t, err)
+		} else if assert.Nil(t, err) {
+			conn.Close()
+		}
+	}
+}
+
+func TestExchangeRetryTSIG(t *testing.T) {
+
+	request := &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	extra := []int{}
+
+	client := &Client{
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		// Fails without stripping the TSIG RR like a failed dial would
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			extra = append(extra, len(m.Extra))
+			if m.IsTsig() == nil {
+				return nil, errors.New("not signed")
+			}
+			return nil, errors.New("connection refused")
+		}),
+	}
+
+	_, err := client.Exchange(context.Background(), request)
+	assert.NotNil(t, err)
+	assert.NotContains(t, err.Error(), "not signed")
+
+	// Every attempt has the TKEY RR and exactly one TSIG RR
+	assert.Equal(t, []int{2, 2, 2}, extra)
+}
+
+func TestExchangeNoAddresses(t *testing.T) {
+
+	client := &Client{
+		Resolver:  &FakeResolver{Addrs: []string{}},
+		Exchanger: &FakeClient{},
+	}
+
+	_, err := client.Exchange(context.Background(), &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	})
+	if assert.NotNil(t, err) {
+		assert.True(t, errors.Is(err, ErrNoAddresses))
+		assert.Equal(t, "No addresses for ns.example.com.", err.Error())
+	}
+
+	// Dialing directly fails the same way
+	_, err = client.dialHost(context.Background(), "ns.example.com.")
+	assert.True(t, errors.Is(err, ErrNoAddresses))
+}
+
+// CountingSigner signs with HMAC and counts the messages it has signed
+type CountingSigner struct {
+	c.HmacSigner
+	signed int
+}
+
+func (s *CountingSigner) Sign(msg []byte, rr *dns.TSIG) ([]byte, error) {
+
+	s.signed++
+
+	return s.HmacSigner.Sign(msg, rr)
+}
+
+func TestPreSend(t *testing.T) {
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	var signed bool
+	var sent *dns.Msg
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			sent = m
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		PreSend: func(m *dns.Msg) {
+			signed = m.IsTsig() != nil
+			m.CheckingDisabled = true
+		},
+	}
+
+	_, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.True(t, signed)
+		assert.True(t, sent.CheckingDisabled)
+	}
+
+	// What would be sent includes the changes
+	b, err := client.Pack(request)
+	if assert.Nil(t, err) {
+		m := new(dns.Msg)
+		if assert.Nil(t, m.Unpack(b)) {
+			assert.True(t, m.CheckingDisabled)
+		}
+	}
+}
+
+func TestTSIGSigner(t *testing.T) {
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+		},
+	}
+
+	signer := &CountingSigner{HmacSigner: c.HmacSigner{Secret: "k9uK5qsPfbBxvVuldwzYww=="}}
+
+	b, err := (&Client{TSIGSigner: signer}).Pack(request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 1, signer.signed)
+		assert.Nil(t, dns.TsigVerify(b, "k9uK5qsPfbBxvVuldwzYww==", "", false))
+	}
+
+	// The default HMAC signer matches the dns package, including when
+	// chaining from a previous MAC
+	for _, requestMAC := range []string{"", "0123456789abcdef0123456789abcdef"} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeSOA)
+		msg.SetTsig("tsig.example.com.", dns.HmacMD5, 300, 1600000000)
+
+		want, wantMAC, err := dns.TsigGenerate(msg.Copy(), "k9uK5qsPfbBxvVuldwzYww==", requestMAC, false)
+		assert.Nil(t, err)
+
+		got, gotMAC, err := c.TsigGenerateWithSigner(msg, c.HmacSigner{Secret: "k9uK5qsPfbBxvVuldwzYww=="}, requestMAC, false)
+		if assert.Nil(t, err) {
+			assert.Equal(t, want, got)
+			assert.Equal(t, wantMAC, gotMAC)
+		}
+	}
+}
+
+func TestTKEYSelection(t *testing.T) {
+
+	msg := tkeyReply(nil, "first.example.com.")
+	msg.Answer = append(msg.Answer, mustRR(t, "test.example.com. 300 IN A 192.0.2.1"))
+	msg.Answer = append(msg.Answer, tkeyReply(nil, "last.example.com.").Answer...)
+
+	cases := []struct {
+		selection TKEYSelection
+		name      string
+		err       bool
+	}{
+		{TKEYStrict, "", true},
+		{TKEYFirst, "first.example.com.", false},
+		{TKEYLast, "last.example.com.", false},
+		{TKEYAll, "first.example.com.", false},
+	}
+
+	for _, tc := range cases {
+		tkey, additional, err := parseResponse(msg, tc.selection)
+		if tc.err {
+			assert.NotNil(t, err)
+			continue
+		}
+		if assert.Nil(t, err) {
+			assert.Equal(t, tc.name, tkey.Hdr.Name)
+			// Only the non-TKEY answers are returned
+			assert.Len(t, additional, 1)
+		}
+	}
+
+	// A single TKEY answer is accepted by every strategy
+	for _, selection := range []TKEYSelection{TKEYStrict, TKEYFirst, TKEYLast, TKEYAll} {
+		tkey, _, err := parseResponse(tkeyReply(nil, "test.example.com."), selection)
+		if assert.Nil(t, err) {
+			assert.Equal(t, "test.example.com.", tkey.Hdr.Name)
+		}
+	}
+
+	// Every TKEY answer is only returned with TKEYAll
+	for _, selection := range []TKEYSelection{TKEYFirst, TKEYAll} {
+		client := &Client{
+			Exchanger:     &FakeClient{Msg: msg},
+			Resolver:      &FakeResolver{Addrs: []string{"192.0.2.1"}},
+			TKEYSelection: selection,
+		}
+
+		resp, err := client.Exchange(context.Background(), &Request{
+			Host:      "ns.example.com.",
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+		})
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.Equal(t, "first.example.com.", resp.KeyName)
+		if selection == TKEYAll {
+			if assert.Len(t, resp.TKEYs, 2) {
+				assert.Equal(t, "first.example.com.", resp.TKEYs[0].Hdr.Name)
+				assert.Equal(t, "last.example.com.", resp.TKEYs[1].Hdr.Name)
+			}
+		} else {
+			assert.Nil(t, resp.TKEYs)
+		}
+	}
+}
+
+func TestTSIGStatus(t *testing.T) {
+
+	secret := "k9uK5qsPfbBxvVuldwzYww=="
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+
+		co := &dns.Conn{
+			Conn:       server,
+			TsigSecret: map[string]string{"tsig.example.com.": secret},
+		}
+
+		m, err := co.ReadMsg()
+		if err != nil {
+			return
+		}
+
+		// Sign the response chained from the request MAC
+		r := tkeyReply(m, m.Question[0].Name)
+		r.Answer[0].(*dns.TKEY).Algorithm = dns.HmacMD5
+		r.Answer[0].(*dns.TKEY).Mode = TkeyModeDH
+		r.SetTsig("tsig.example.com.", dns.HmacMD5, 300, time.Now().Unix())
+
+		b, _, err := dns.TsigGenerate(r, secret, m.IsTsig().MAC, false)
+		if err != nil {
+			return
+		}
+
+		co.Write(b)
+	}()
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    secret,
+		},
+	}
+
+	resp, err := (&Client{}).ExchangeConn(context.Background(), client, request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, TSIGVerified, resp.TSIG)
+	}
+
+	gss := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	signed := tkeyReply(nil, "test.example.com.")
+	signed.SetTsig("test.example.com.", GSS, 300, time.Now().Unix())
+
+	cases := []struct {
+		client *Client
+		req    *Request
+		msg    *dns.Msg
+		status TSIGStatus
+	}{
+		{&Client{}, gss, tkeyReply(nil, "test.example.com."), TSIGUnsigned},
+		{&Client{}, gss, signed, TSIGIgnored},
+		{
+			&Client{
+				GSSResponseTSIG: func(keyname string) (map[string]*c.TsigAlgorithm, map[string]string) {
+					return map[string]*c.TsigAlgorithm{GSS: {Verify: func([]byte, *dns.TSIG, string, string) error { return nil }}}, map[string]string{keyname: ""}
+				},
+			},
+			gss, signed, TSIGVerified,
+		},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.status, tc.client.tsigStatus(tc.req, tc.msg))
+	}
+
+	// A custom Exchanger may or may not have verified the response
+	resp, err = (&Client{
+		Exchanger: &FakeClient{Msg: signed},
+		Resolver:  &FakeResolver{Addrs: []string{"192.0.2.1"}},
+	}).Exchange(context.Background(), &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, TSIGUnchecked, resp.TSIG)
+		assert.Equal(t, "not verified (custom exchanger)", resp.TSIG.String())
+	}
+
+	assert.Equal(t, "not verified (GSS ignore)", TSIGIgnored.String())
+}
+
+func TestTSIGKeyValidate(t *testing.T) {
+
+	cases := []struct {
+		key   TSIGKey
+		field string
+	}{
+		{TSIGKey{"tsig.example.com.", dns.HmacSHA256, "k9uK5qsPfbBxvVuldwzYww=="}, ""},
+		{TSIGKey{"tsig.example.com.", "HMAC-SHA256.", "k9uK5qsPfbBxvVuldwzYww=="}, ""},
+		{TSIGKey{"tsig.example.com.", GSS, ""}, ""},
+		{TSIGKey{"tsig.example.com", dns.HmacSHA256, "k9uK5qsPfbBxvVuldwzYww=="}, "Name"},
+		{TSIGKey{"", dns.HmacSHA256, "k9uK5qsPfbBxvVuldwzYww=="}, "Name"},
+		{TSIGKey{"tsig.example.com.", "hmac-bogus.", "k9uK5qsPfbBxvVuldwzYww=="}, "Algorithm"},
+		{TSIGKey{"tsig.example.com.", dns.HmacSHA256, ""}, "Secret"},
+		{TSIGKey{"tsig.example.com.", dns.HmacSHA256, "not base64!"}, "Secret"},
+		{TSIGKey{"tsig.example.com.", GSS, "k9uK5qsPfbBxvVuldwzYww=="}, "Secret"},
+	}
+
+	for _, tc := range cases {
+		err := tc.key.Validate()
+		if tc.field == "" {
+			assert.Nil(t, err)
+			continue
+		}
+
+		var kerr *TSIGKeyError
+		if assert.True(t, errors.As(err, &kerr)) {
+			assert.Equal(t, tc.field, kerr.Field)
+		}
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+
+	// A GSS token close to the protocol limit
+	key := make([]byte, 60000)
+
+	reply := func(m *dns.Msg) *dns.Msg {
+		r := tkeyReply(m, m.Question[0].Name)
+		tkey := r.Answer[0].(*dns.TKEY)
+		tkey.KeySize = uint16(len(key))
+		tkey.Key = hex.EncodeToString(key)
+		return r
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("test.example.com.", dns.TypeTKEY)
+	b, err := reply(m).Pack()
+	if !assert.Nil(t, err) {
+		return
+	}
+	size := len(b)
+
+	cases := []struct {
+		max int
+		err bool
+	}{
+		{0, false},
+		{size, false},
+		{size - 1, true},
+	}
+
+	for _, tc := range cases {
+		conn, server := net.Pipe()
+
+		go func() {
+			defer server.Close()
+			co := &dns.Conn{Conn: server}
+			m, err := co.ReadMsg()
+			if err != nil {
+				return
+			}
+			co.WriteMsg(reply(m))
+		}()
+
+		resp, err := (&Client{MaxResponseSize: tc.max}).ExchangeConn(context.Background(), conn, &Request{
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+		})
+		conn.Close()
+
+		if tc.err {
+			var serr *c.MsgSizeError
+			if assert.True(t, errors.As(err, &serr)) {
+				assert.Equal(t, size, serr.Size)
+				assert.Equal(t, tc.max, serr.Max)
+			}
+			continue
+		}
+		if assert.Nil(t, err) {
+			assert.Equal(t, uint16(len(key)), resp.TKEY.KeySize)
+		}
+	}
+}
+
+// SleepyResolver resolves after a delay
+type SleepyResolver struct {
+	FakeResolver
+	Delay time.Duration
+}
+
+func (r *SleepyResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+
+	time.Sleep(r.Delay)
+
+	return r.FakeResolver.LookupHost(ctx, host)
+}
+
+func TestTimings(t *testing.T) {
+
+	delay := 10 * time.Millisecond
+
+	request := &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	client := &Client{
+		Resolver: &SleepyResolver{FakeResolver{Addrs: []string{"192.0.2.1"}}, delay},
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			time.Sleep(2 * delay)
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+	}
+
+	resp, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.True(t, resp.Timings.Resolve >= delay)
+		// A custom Exchanger does its own dialing
+		assert.Equal(t, time.Duration(0), resp.Timings.Dial)
+		assert.True(t, resp.Timings.Exchange >= 2*delay)
+	}
+
+	// The Client dials for batches
+	client = &Client{
+		Resolver: &SleepyResolver{FakeResolver{Addrs: []string{"192.0.2.1"}}, delay},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			time.Sleep(2 * delay)
+			c, s := net.Pipe()
+			go serveTKEY(s)
+			return c, nil
+		},
+	}
+
+	results, err := client.ExchangeBatch(context.Background(), "ns.example.com", []*Request{request, request}, 1)
+	if assert.Nil(t, err) && assert.Len(t, results, 2) {
+		first := results[0].Response.Timings
+		assert.True(t, first.Resolve >= delay)
+		assert.True(t, first.Dial >= 2*delay)
+		assert.True(t, first.Exchange > 0)
+
+		// The connection is reused
+		second := results[1].Response.Timings
+		assert.Equal(t, time.Duration(0), second.Resolve)
+		assert.Equal(t, time.Duration(0), second.Dial)
+		assert.True(t, second.Exchange > 0)
+	}
+}
+
+func TestResetTSIG(t *testing.T) {
+
+	now := time.Unix(1600000000, 0)
+
+	client := &Client{
+		Now: func() time.Time {
+			return now
+		},
+	}
+
+	request := &Request{
+		KeyName:   "test.example.com.",
+		Algorithm: dns.HmacMD5,
+		Mode:      TkeyModeDH,
+		Lifetime:  3600,
+		TSIG: &TSIGKey{
+			Name:      "tsig.example.com.",
+			Algorithm: dns.HmacMD5,
+			Secret:    "k9uK5qsPfbBxvVuldwzYww==",
+		},
+	}
+
+	msg, err := client.newMsg(request)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	client.ResetTSIG(msg, request)
+	if assert.Len(t, msg.Extra, 2) && assert.NotNil(t, msg.IsTsig()) {
+		assert.Equal(t, uint64(1600000000), msg.IsTsig().TimeSigned)
+		assert.Equal(t, uint16(300), msg.IsTsig().Fudge)
+	}
+
+	// Signing again replaces the TSIG RR rather than adding another
+	now = now.Add(time.Minute)
+	client.ResetTSIG(msg, request)
+	if assert.Len(t, msg.Extra, 2) && assert.NotNil(t, msg.IsTsig()) {
+		assert.Equal(t, uint64(1600000060), msg.IsTsig().TimeSigned)
+	}
+
+	// As if a send stripped it
+	msg.Extra = msg.Extra[:1]
+	client.ResetTSIG(msg, request)
+	assert.NotNil(t, msg.IsTsig())
+
+	// GSS requests are only stripped
+	request.Algorithm = GSS
+	client.ResetTSIG(msg, request)
+	assert.Len(t, msg.Extra, 1)
+	assert.Nil(t, msg.IsTsig())
+}
+
+func TestFreshRetryID(t *testing.T) {
+
+	request := &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+		ID:        1234,
+	}
+
+	for _, fresh := range []bool{false, true} {
+		var ids []uint16
+
+		client := &Client{
+			Resolver: &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+			Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+				ids = append(ids, m.Id)
+				if len(ids) < 3 {
+					return nil, errors.New("connection refused")
+				}
+				return tkeyReply(m, m.Question[0].Name), nil
+			}),
+			FreshRetryID: fresh,
+		}
+
+		resp, err := client.Exchange(context.Background(), request)
+		if !assert.Nil(t, err) || !assert.Len(t, ids, 3) {
+			continue
+		}
+
+		// The response answers the last attempt
+		assert.Equal(t, ids[2], resp.Msg.Id)
+
+		if fresh {
+			assert.Equal(t, uint16(1234), ids[0])
+			assert.NotEqual(t, ids[0], ids[1])
+			assert.NotEqual(t, ids[1], ids[2])
+			assert.NotEqual(t, ids[0], ids[2])
+		} else {
+			assert.Equal(t, []uint16{1234, 1234, 1234}, ids)
+		}
+	}
+}
+
+// serveLargeTKEY answers every TKEY query over TCP on the loopback with a
+// TKEY record carrying a key of the given size, the returned function stops
+// the server.
+func serveLargeTKEY(tb testing.TB, size int) (string, func()) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	key := hex.EncodeToString(make([]byte, size))
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			r := tkeyReply(m, m.Question[0].Name)
+			tkey := r.Answer[0].(*dns.TKEY)
+			tkey.Key = key
+			tkey.KeySize = uint16(size)
+			w.WriteMsg(r)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go server.ActivateAndServe()
+	<-started
+
+	return l.Addr().String(), func() {
+		server.Shutdown()
+	}
+}
+
+func exchangeLargeTKEY(client *Client, address string) (*Response, error) {
+
+	host, port, _ := net.SplitHostPort(address)
+
+	client.Resolver = &FakeResolver{Addrs: []string{host}}
+
+	return client.Exchange(context.Background(), &Request{
+		Host:      net.JoinHostPort("ns.example.com", port),
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+		Input:     make([]byte, 32768),
+	})
+}
+
+func TestBufferSizes(t *testing.T) {
+
+	address, stop := serveLargeTKEY(t, 60000)
+	defer stop()
+
+	resp, err := exchangeLargeTKEY(&Client{ReadBufferSize: 1 << 20, WriteBufferSize: 1 << 20}, address)
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint16(60000), resp.TKEY.KeySize)
+	}
+
+	// Connections without socket buffers are left alone
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	assert.Nil(t, c.SetBuffers(a, 1<<20, 1<<20))
+
+	conn, err := net.Dial("tcp", address)
+	if assert.Nil(t, err) {
+		defer conn.Close()
+		assert.Nil(t, c.SetBuffers(conn, 1<<16, 0))
+	}
+}
+
+// noDelayConn records whether Nagle's algorithm was disabled
+type noDelayConn struct {
+	net.Conn
+	noDelay bool
+}
+
+func (c *noDelayConn) SetNoDelay(noDelay bool) error {
+
+	c.noDelay = noDelay
+
+	return nil
+}
+
+func TestTCPNoDelay(t *testing.T) {
+
+	for _, noDelay := range []bool{false, true} {
+		var spy *noDelayConn
+
+		client := &Client{
+			Resolver:   &FakeResolver{Addrs: []string{"192.0.2.1"}},
+			TCPNoDelay: noDelay,
+			dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				a, b := net.Pipe()
+				b.Close()
+				spy = &noDelayConn{Conn: a}
+				return spy, nil
+			},
+		}
+
+		conn, err := client.dialHost(context.Background(), "ns.example.com")
+		if assert.Nil(t, err) {
+			conn.Close()
+			assert.Equal(t, noDelay, spy.noDelay)
+		}
+	}
+
+	// The DNS client dialing for exchanges
+	address, stop := serveLargeTKEY(t, 16)
+	defer stop()
+
+	_, err := exchangeLargeTKEY(&Client{TCPNoDelay: true}, address)
+	assert.Nil(t, err)
+}
+
+func BenchmarkBufferSizes(b *testing.B) {
+
+	address, stop := serveLargeTKEY(b, 60000)
+	defer stop()
+
+	for _, size := range []int{0, 1 << 16, 1 << 20} {
+		b.Run(fmt.Sprintf("buffer-%d", size), func(b *testing.B) {
+			client := &Client{ReadBufferSize: size, WriteBufferSize: size}
+			for i := 0; i < b.N; i++ {
+				if _, err := exchangeLargeTKEY(client, address); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseTLS(t *testing.T) {
+
+	cert := selfSignedCertificate(t)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Net:      "tcp-tls",
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			w.WriteMsg(tkeyReply(m, m.Question[0].Name))
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	request := &Request{
+		Host:      net.JoinHostPort("ns.example.com", port),
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	client := &Client{
+		Net:      "tcp-tls",
+		Resolver: &FakeResolver{Addrs: []string{host}},
+		// The certificate is self-signed
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	resp, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) && assert.NotNil(t, resp.TLS) {
+		assert.True(t, resp.TLS.Version >= tls.VersionTLS12)
+		if assert.Len(t, resp.TLS.PeerCertificates, 1) {
+			assert.Equal(t, "ns.example.com", resp.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	}
+
+	// A handshake below the minimum version of the server is refused
+	client.TLSConfig = &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}
+	_, err = client.Exchange(context.Background(), request)
+	assert.NotNil(t, err)
+
+	// Plaintext has no TLS state
+	address, stop := serveLargeTKEY(t, 16)
+	defer stop()
+
+	resp, err = exchangeLargeTKEY(&Client{}, address)
+	if assert.Nil(t, err) {
+		assert.Nil(t, resp.TLS)
+	}
+}
+
+func TestTLSCipherSuites(t *testing.T) {
+
+	cert := selfSignedCertificate(t)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Net:      "tcp-tls",
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			w.WriteMsg(tkeyReply(m, m.Question[0].Name))
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	request := &Request{
+		Host:      net.JoinHostPort("ns.example.com", port),
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	client := &Client{
+		Net:             "tcp-tls",
+		Resolver:        &FakeResolver{Addrs: []string{host}},
+		TLSConfig:       &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12},
+		TLSCipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+	}
+
+	// Only the allowed suite is offered
+	resp, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) && assert.NotNil(t, resp.TLS) {
+		assert.Equal(t, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, resp.TLS.CipherSuite)
+	}
+
+	// The TLS 1.3 suites can't be restricted so are caught afterwards
+	client.TLSConfig = &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13}
+
+	_, err = client.Exchange(context.Background(), request)
+	if assert.NotNil(t, err) {
+		suiteErr := new(CipherSuiteError)
+		if assert.True(t, errors.As(err.(*multierror.Error).Errors[0], &suiteErr)) {
+			assert.Equal(t, uint16(tls.VersionTLS13), suiteErr.Version)
+		}
+	}
+
+	client.TLSCipherSuites = append(client.TLSCipherSuites, tls.TLS_AES_128_GCM_SHA256, tls.TLS_AES_256_GCM_SHA384, tls.TLS_CHACHA20_POLY1305_SHA256)
+
+	resp, err = client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) && assert.NotNil(t, resp.TLS) {
+		assert.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+	}
+
+	// The TLSConfig of the Client itself is untouched
+	assert.Nil(t, client.TLSConfig.CipherSuites)
+}
+
+func TestWireSizes(t *testing.T) {
+
+	address, stop := serveLargeTKEY(t, 1024)
+	defer stop()
+
+	client := &Client{}
+
+	resp, err := exchangeLargeTKEY(client, address)
+	if assert.Nil(t, err) {
+		b, err := client.Pack(&Request{
+			KeyName:   "test.example.com.",
+			Algorithm: GSS,
+			Mode:      TkeyModeGSS,
+			Lifetime:  3600,
+			Input:     make([]byte, 32768),
+		})
+		if assert.Nil(t, err) {
+			assert.Equal(t, len(b), resp.RequestSize)
+		}
+
+		b, err = resp.Msg.Pack()
+		if assert.Nil(t, err) {
+			assert.Equal(t, len(b), resp.ResponseSize)
+		}
+	}
+
+	// Nothing is known about what a custom Exchanger sent
+	resp, err = (&Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			return tkeyReply(m, m.Question[0].Name), nil
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+	}).Exchange(context.Background(), &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, 0, resp.RequestSize)
+		assert.Equal(t, 0, resp.ResponseSize)
+	}
+}
+
+func TestAdditionalFunc(t *testing.T) {
+
+	var records []dns.RR
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			r := tkeyReply(m, m.Question[0].Name)
+			for i := 1; i <= 3; i++ {
+				rr, _ := dns.NewRR(fmt.Sprintf("test.example.com. 300 A 192.0.2.%d", i))
+				r.Answer = append(r.Answer, rr)
+			}
+			return r, nil
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		AdditionalFunc: func(rr dns.RR) error {
+			records = append(records, rr)
+			return nil
+		},
+	}
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	resp, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Nil(t, resp.Additional)
+		assert.Len(t, resp.Msg.Answer, 4)
+	}
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, "192.0.2.3", records[2].(*dns.A).A.String())
+	}
+
+	// An error stops the calls and fails the exchange
+	records = nil
+	failed := errors.New("failed")
+	client.AdditionalFunc = func(rr dns.RR) error {
+		records = append(records, rr)
+		return failed
+	}
+
+	_, err = client.Exchange(context.Background(), request)
+	assert.Equal(t, failed, err)
+	assert.Len(t, records, 1)
+}
+
+func TestMaxAdditional(t *testing.T) {
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			r := new(dns.Msg)
+			r.SetReply(m)
+			for i := 1; i <= 5; i++ {
+				rr, _ := dns.NewRR(fmt.Sprintf("test.example.com. 300 A 192.0.2.%d", i))
+				r.Answer = append(r.Answer, rr)
+				// The TKEY needn't be first
+				if i == 2 {
+					r.Answer = append(r.Answer, tkeyReply(m, m.Question[0].Name).Answer...)
+				}
+			}
+			return r, nil
+		}),
+		Resolver:      &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		MaxAdditional: 3,
+	}
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	resp, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.NotNil(t, resp.TKEY)
+		assert.Equal(t, 2, resp.AdditionalDiscarded)
+		if assert.Len(t, resp.Additional, 3) {
+			assert.Equal(t, "192.0.2.3", resp.Additional[2].(*dns.A).A.String())
+		}
+		assert.Len(t, resp.Msg.Answer, 4)
+		assert.IsType(t, &dns.TKEY{}, resp.Msg.Answer[2])
+	}
+
+	rr, _ := dns.NewRR("test.example.com. 300 A 192.0.2.1")
+
+	// The size cap applies too and whichever is reached first wins
+	client.MaxAdditionalSize = 2*dns.Len(rr) + 1
+
+	resp, err = client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 3, resp.AdditionalDiscarded)
+		assert.Len(t, resp.Additional, 2)
+	}
+
+	client.MaxAdditional, client.MaxAdditionalSize = 0, 0
+
+	resp, err = client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 0, resp.AdditionalDiscarded)
+		assert.Len(t, resp.Additional, 5)
+		assert.Len(t, resp.Msg.Answer, 6)
+	}
+}
+
+func TestResponseOPT(t *testing.T) {
+
+	now := time.Unix(1600000000, 0)
+
+	client := &Client{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			r := tkeyReply(m, m.Question[0].Name)
+			tkey := r.Answer[0].(*dns.TKEY)
+			tkey.Inception = uint32(now.Unix())
+			tkey.Expiration = tkey.Inception + 3600
+			r.SetEdns0(1232, true)
+			return r, nil
+		}),
+		Resolver: &FakeResolver{Addrs: []string{"192.0.2.1"}},
+		Now: func() time.Time {
+			return now
+		},
+	}
+
+	request := &Request{
+		Host:      "ns.example.com",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+	}
+
+	// An unexpected OPT is kept
+	resp, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) && assert.NotNil(t, resp.OPT) {
+		assert.True(t, resp.OPT.Do())
+		assert.Equal(t, uint16(1232), resp.OPT.UDPSize())
+	}
+
+	// Unless strict
+	client.Strict = true
+
+	_, err = client.Exchange(context.Background(), request)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "EDNS0 OPT")
+	}
+
+	client.ForceEDNS0 = true
+
+	resp, err = client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.NotNil(t, resp.OPT)
+	}
+
+	client.Exchanger = FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return tkeyReply(m, m.Question[0].Name), nil
+	})
+	client.Strict = false
+
+	resp, err = client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Nil(t, resp.OPT)
 	}
 }
@@ -0,0 +1,252 @@
+package tsig
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// PrerequisiteType identifies one of the RFC 2136, section 2.4 prerequisite
+// conditions.
+type PrerequisiteType int
+
+const (
+	_ PrerequisiteType = iota
+	// RRsetExists requires the RRset to exist regardless of its value, RFC
+	// 2136, section 2.4.1
+	RRsetExists
+	// RRsetExistsValue requires the RRset to exist with exactly the given
+	// values, RFC 2136, section 2.4.2
+	RRsetExistsValue
+	// RRsetDoesNotExist requires the RRset to not exist, RFC 2136, section
+	// 2.4.3
+	RRsetDoesNotExist
+	// NameInUse requires the name to own at least one RR, RFC 2136, section
+	// 2.4.4
+	NameInUse
+	// NameNotInUse requires the name to own no RRs, RFC 2136, section 2.4.5
+	NameNotInUse
+)
+
+// Prerequisite is a condition that must hold on the server for an update to
+// be applied. Only the owner name and type of each RR are used except for
+// RRsetExistsValue which also compares the RR data.
+type Prerequisite struct {
+	Type PrerequisiteType
+	RRs  []dns.RR
+}
+
+// Update describes an RFC 2136 dynamic update to a zone. The prerequisites
+// are placed in the Answer section and the updates in the Authority section
+// of the resulting message.
+type Update struct {
+	Zone          string
+	Prerequisites []Prerequisite
+	Insert        []dns.RR
+	Remove        []dns.RR
+	RemoveRRset   []dns.RR
+	RemoveName    []dns.RR
+}
+
+// copyRRs returns deep copies of the RRs as the dns.Msg update helpers
+// modify the headers in place.
+func copyRRs(rrs []dns.RR) []dns.RR {
+
+	copies := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		copies[i] = dns.Copy(rr)
+	}
+
+	return copies
+}
+
+// Msg builds the update message, the prerequisites and updates are validated
+// to be in the correct sections and within the zone.
+// It returns the message and any error that occurred.
+func (u *Update) Msg() (*dns.Msg, error) {
+
+	if u.Zone == "" {
+		return nil, fmt.Errorf("No zone to update")
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(u.Zone))
+
+	for _, p := range u.Prerequisites {
+		rrs := copyRRs(p.RRs)
+		switch p.Type {
+		case RRsetExists:
+			msg.RRsetUsed(rrs)
+		case RRsetExistsValue:
+			// Used doesn't zero the TTL unlike the other helpers
+			for _, rr := range rrs {
+				rr.Header().Ttl = 0
+			}
+			msg.Used(rrs)
+		case RRsetDoesNotExist:
+			msg.RRsetNotUsed(rrs)
+		case NameInUse:
+			msg.NameUsed(rrs)
+		case NameNotInUse:
+			msg.NameNotUsed(rrs)
+		default:
+			return nil, fmt.Errorf("Unsupported prerequisite type %d", p.Type)
+		}
+	}
+
+	msg.Insert(copyRRs(u.Insert))
+	msg.Remove(copyRRs(u.Remove))
+	msg.RemoveRRset(copyRRs(u.RemoveRRset))
+	msg.RemoveName(copyRRs(u.RemoveName))
+
+	if err := validateUpdate(msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// validateUpdate checks the prerequisite section, (Answer), and the update
+// section, (Authority), of an update message are well-formed according to RFC
+// 2136, sections 2.4 and 2.5.
+func validateUpdate(msg *dns.Msg) error {
+
+	if msg.Opcode != dns.OpcodeUpdate {
+		return fmt.Errorf("Not an update message")
+	}
+
+	if len(msg.Question) != 1 || msg.Question[0].Qtype != dns.TypeSOA {
+		return fmt.Errorf("Update must have a single SOA zone section")
+	}
+
+	zone := msg.Question[0].Name
+	class := msg.Question[0].Qclass
+
+	for _, rr := range msg.Answer {
+		h := rr.Header()
+		if !dns.IsSubDomain(zone, h.Name) {
+			return fmt.Errorf("Prerequisite %s is outside zone %s", h.Name, zone)
+		}
+		if h.Ttl != 0 {
+			return fmt.Errorf("Prerequisite %s must have a zero TTL", h.Name)
+		}
+		switch h.Class {
+		case dns.ClassANY, dns.ClassNONE:
+			if _, ok := rr.(*dns.ANY); !ok {
+				return fmt.Errorf("Prerequisite %s must not have RDATA", h.Name)
+			}
+		case class:
+		default:
+			return fmt.Errorf("Prerequisite %s has invalid class %s", h.Name, dns.ClassToString[h.Class])
+		}
+	}
+
+	for _, rr := range msg.Ns {
+		h := rr.Header()
+		if !dns.IsSubDomain(zone, h.Name) {
+			return fmt.Errorf("Update %s is outside zone %s", h.Name, zone)
+		}
+		switch h.Class {
+		case dns.ClassANY:
+			if _, ok := rr.(*dns.ANY); !ok || h.Ttl != 0 {
+				return fmt.Errorf("Update %s deleting an RRset must have no RDATA and a zero TTL", h.Name)
+			}
+		case dns.ClassNONE:
+			if h.Ttl != 0 {
+				return fmt.Errorf("Update %s deleting an RR must have a zero TTL", h.Name)
+			}
+		case class:
+			if h.Rrtype == dns.TypeANY {
+				return fmt.Errorf("Update %s cannot add a record of type ANY", h.Name)
+			}
+		default:
+			return fmt.Errorf("Update %s has invalid class %s", h.Name, dns.ClassToString[h.Class])
+		}
+	}
+
+	for _, rr := range msg.Extra {
+		switch rr.(type) {
+		case *dns.OPT:
+		default:
+			return fmt.Errorf("Unexpected %s record in additional section", dns.TypeToString[rr.Header().Rrtype])
+		}
+	}
+
+	return nil
+}
+
+// SignedUpdate builds the update message and attaches a TSIG record for the
+// given key name and algorithm so the whole message including any
+// prerequisites is signed when it is sent.
+// It returns the message and any error that occurred.
+func SignedUpdate(u *Update, keyname, algorithm string, fudge uint16) (*dns.Msg, error) {
+
+	msg, err := u.Msg()
+	if err != nil {
+		return nil, err
+	}
+
+	msg.SetTsig(keyname, algorithm, fudge, time.Now().Unix())
+
+	return msg, nil
+}
+
+// CheckWritable sends an update to the server at address that changes
+// nothing, its only prerequisite is that the zone SOA exists, signed with
+// the given key name and algorithm to find out whether the key is allowed to
+// update the zone before making any real changes. The Exchanger must be set
+// up to sign with the key, as for any other update, and the context is only
+// used if it implements ContextExchanger. Servers that check permission for
+// each record updated, such as BIND with an update-policy, may accept an
+// update with no records for any key they can authenticate.
+// It returns true if the server accepted the update, false if it refused it,
+// and any error that occurred including any other response code as a
+// DNSError.
+func CheckWritable(ctx context.Context, ex Exchanger, address, zone, keyname, algorithm string) (bool, error) {
+
+	zone = dns.Fqdn(zone)
+
+	u := &Update{
+		Zone: zone,
+		Prerequisites: []Prerequisite{
+			{
+				Type: RRsetExists,
+				RRs: []dns.RR{
+					&dns.SOA{
+						Hdr: dns.RR_Header{
+							Name:   zone,
+							Rrtype: dns.TypeSOA,
+							Class:  dns.ClassINET,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	msg, err := SignedUpdate(u, keyname, algorithm, 300)
+	if err != nil {
+		return false, err
+	}
+
+	var rr *dns.Msg
+	if cex, ok := ex.(ContextExchanger); ok {
+		rr, _, err = cex.ExchangeContext(ctx, msg, address)
+	} else {
+		rr, _, err = ex.Exchange(msg, address)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch rr.Rcode {
+	case dns.RcodeSuccess:
+		return true, nil
+	case dns.RcodeRefused:
+		return false, nil
+	default:
+		return false, &DNSError{Rcode: rr.Rcode}
+	}
+}
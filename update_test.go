@@ -0,0 +1,181 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rr
+}
+
+func TestUpdateMsg(t *testing.T) {
+
+	insert := mustRR(t, "test.example.com. 300 A 192.0.2.1")
+
+	u := &Update{
+		Zone: "example.com",
+		Prerequisites: []Prerequisite{
+			{
+				Type: NameNotInUse,
+				RRs:  []dns.RR{insert},
+			},
+		},
+		Insert: []dns.RR{insert},
+	}
+
+	msg, err := u.Msg()
+	assert.Nil(t, err)
+	assert.Equal(t, dns.OpcodeUpdate, msg.Opcode)
+	assert.Equal(t, "example.com.", msg.Question[0].Name)
+
+	// Prerequisites go in the Answer section
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, "test.example.com.", msg.Answer[0].Header().Name)
+	assert.Equal(t, uint16(dns.ClassNONE), msg.Answer[0].Header().Class)
+	assert.Equal(t, dns.TypeANY, msg.Answer[0].Header().Rrtype)
+
+	// Updates go in the Authority section
+	assert.Len(t, msg.Ns, 1)
+	assert.Equal(t, dns.TypeA, msg.Ns[0].Header().Rrtype)
+	assert.Equal(t, uint32(300), msg.Ns[0].Header().Ttl)
+
+	// The caller's record is untouched
+	assert.Equal(t, uint16(dns.ClassINET), insert.Header().Class)
+}
+
+func TestUpdateMsgInvalid(t *testing.T) {
+
+	cases := []*Update{
+		{},
+		{
+			Zone:   "example.com.",
+			Insert: []dns.RR{mustRR(t, "test.example.net. 300 A 192.0.2.1")},
+		},
+		{
+			Zone: "example.com.",
+			Prerequisites: []Prerequisite{
+				{
+					Type: RRsetExists,
+					RRs:  []dns.RR{mustRR(t, "test.example.net. 300 A 192.0.2.1")},
+				},
+			},
+		},
+		{
+			Zone: "example.com.",
+			Prerequisites: []Prerequisite{
+				{
+					RRs: []dns.RR{mustRR(t, "test.example.com. 300 A 192.0.2.1")},
+				},
+			},
+		},
+	}
+
+	for _, u := range cases {
+		_, err := u.Msg()
+		assert.NotNil(t, err)
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+
+	msg := new(dns.Msg)
+	msg.SetUpdate("example.com.")
+	msg.Answer = append(msg.Answer, mustRR(t, "test.example.com. 300 A 192.0.2.1"))
+	assert.NotNil(t, validateUpdate(msg))
+
+	msg = new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeSOA)
+	assert.NotNil(t, validateUpdate(msg))
+}
+
+func TestSignedUpdate(t *testing.T) {
+
+	u := &Update{
+		Zone: "example.com.",
+		Prerequisites: []Prerequisite{
+			{
+				Type: RRsetExistsValue,
+				RRs:  []dns.RR{mustRR(t, "test.example.com. 300 A 192.0.2.1")},
+			},
+		},
+		Remove: []dns.RR{mustRR(t, "test.example.com. 300 A 192.0.2.1")},
+	}
+
+	msg, err := SignedUpdate(u, "test.example.com.", GSS, 300)
+	assert.Nil(t, err)
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, uint16(dns.ClassINET), msg.Answer[0].Header().Class)
+	assert.Equal(t, uint32(0), msg.Answer[0].Header().Ttl)
+	assert.Len(t, msg.Ns, 1)
+	assert.Equal(t, uint16(dns.ClassNONE), msg.Ns[0].Header().Class)
+
+	tsig := msg.IsTsig()
+	if assert.NotNil(t, tsig) {
+		assert.Equal(t, "test.example.com.", tsig.Hdr.Name)
+		assert.Equal(t, GSS, tsig.Algorithm)
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+
+	tables := []struct {
+		rcode    int
+		writable bool
+		err      bool
+	}{
+		{dns.RcodeSuccess, true, false},
+		{dns.RcodeRefused, false, false},
+		{dns.RcodeNotAuth, false, true},
+	}
+
+	for _, table := range tables {
+		var sent *dns.Msg
+		ex := FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			sent = m
+			r := new(dns.Msg)
+			r.SetRcode(m, table.rcode)
+			return r, nil
+		})
+
+		writable, err := CheckWritable(context.Background(), ex, "192.0.2.1:53", "example.com", "test.example.com.", GSS)
+		assert.Equal(t, table.writable, writable)
+		if table.err {
+			var derr *DNSError
+			if assert.True(t, errors.As(err, &derr)) {
+				assert.Equal(t, table.rcode, derr.Rcode)
+			}
+		} else {
+			assert.Nil(t, err)
+		}
+
+		// The update only has the SOA prerequisite and is signed
+		if assert.NotNil(t, sent) {
+			assert.Equal(t, dns.OpcodeUpdate, sent.Opcode)
+			assert.Equal(t, "example.com.", sent.Question[0].Name)
+			if assert.Len(t, sent.Answer, 1) {
+				h := sent.Answer[0].Header()
+				assert.Equal(t, "example.com.", h.Name)
+				assert.Equal(t, dns.TypeSOA, h.Rrtype)
+				assert.Equal(t, uint16(dns.ClassANY), h.Class)
+			}
+			assert.Len(t, sent.Ns, 0)
+			assert.NotNil(t, sent.IsTsig())
+		}
+	}
+
+	_, err := CheckWritable(context.Background(), FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return nil, errors.New("failed")
+	}), "192.0.2.1:53", "example.com.", "test.example.com.", GSS)
+	assert.NotNil(t, err)
+}
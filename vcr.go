@@ -0,0 +1,225 @@
+package tsig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Recording is one query and its response as captured by a Recorder. The
+// messages are kept in wire format so any TSIG record, and the GSS tokens
+// carried by the TKEY records, are replayed exactly as they were sent.
+type Recording struct {
+	Address  string `json:"address"`
+	Query    []byte `json:"query"`
+	Response []byte `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Recorder is an Exchanger that passes each query on to another Exchanger
+// and captures the query and response, set it as the Exchanger of a Client,
+// including the DefaultClient used for GSS negotiation, to record a session
+// with a real server.
+type Recorder struct {
+	// Exchanger sends the queries, a DNS client is used if nil
+	Exchanger Exchanger
+
+	m          sync.Mutex
+	recordings []Recording
+}
+
+// Exchange implements Exchanger.
+func (r *Recorder) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	return r.ExchangeContext(context.Background(), m, address)
+}
+
+// ExchangeContext implements ContextExchanger, the context is passed on if
+// the underlying Exchanger supports it.
+func (r *Recorder) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	query, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ex := r.Exchanger
+	if ex == nil {
+		ex = new(dns.Client)
+	}
+
+	var (
+		rr  *dns.Msg
+		rtt time.Duration
+	)
+
+	if cex, ok := ex.(ContextExchanger); ok {
+		rr, rtt, err = cex.ExchangeContext(ctx, m, address)
+	} else {
+		rr, rtt, err = ex.Exchange(m, address)
+	}
+
+	recording := Recording{
+		Address: address,
+		Query:   query,
+	}
+
+	if rr != nil {
+		response, perr := rr.Pack()
+		if perr != nil {
+			return nil, 0, perr
+		}
+		recording.Response = response
+	}
+
+	if err != nil {
+		recording.Error = err.Error()
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.recordings = append(r.recordings, recording)
+
+	return rr, rtt, err
+}
+
+// Recordings returns a copy of what has been captured so far, in the order
+// the queries were sent.
+func (r *Recorder) Recordings() []Recording {
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return append([]Recording(nil), r.recordings...)
+}
+
+// Save writes what has been captured so far as JSON, NewReplayer reads it
+// back.
+// It returns any error that occurred.
+func (r *Recorder) Save(w io.Writer) error {
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+
+	return enc.Encode(r.Recordings())
+}
+
+// ErrReplayExhausted is returned by a Replayer when a query is sent after
+// every recording has been served.
+var ErrReplayExhausted = errors.New("No recorded exchanges left to replay")
+
+// ReplayError is returned by a Replayer when a query doesn't ask the same
+// question as the next recording.
+type ReplayError struct {
+	Index    int
+	Expected dns.Question
+	Got      dns.Question
+}
+
+func (e *ReplayError) Error() string {
+
+	return fmt.Sprintf("Recorded exchange %d expected %s but got %s", e.Index, strings.TrimPrefix(e.Expected.String(), ";"), strings.TrimPrefix(e.Got.String(), ";"))
+}
+
+// Replayer is an Exchanger that answers queries from the recordings of a
+// Recorder without any network access. Recordings are served in order and
+// each query must ask the same question as the one recorded, the address is
+// ignored. The Id of each response is rewritten to match the query as a
+// replayed session generates fresh Ids, likewise any TSIG record in the
+// response is served as recorded so it won't verify against the new query
+// however a Client doesn't verify responses from a custom Exchanger.
+// Recorded errors are replayed with the same text but not the same type.
+type Replayer struct {
+	m          sync.Mutex
+	recordings []Recording
+	next       int
+}
+
+// NewReplayer reads recordings written by Recorder.Save.
+// It returns the Replayer and any error that occurred.
+func NewReplayer(rd io.Reader) (*Replayer, error) {
+
+	var recordings []Recording
+	if err := json.NewDecoder(rd).Decode(&recordings); err != nil {
+		return nil, err
+	}
+
+	return NewReplayerFromRecordings(recordings), nil
+}
+
+// NewReplayerFromRecordings returns a Replayer serving the given recordings.
+func NewReplayerFromRecordings(recordings []Recording) *Replayer {
+
+	return &Replayer{
+		recordings: append([]Recording(nil), recordings...),
+	}
+}
+
+// Exchange implements Exchanger.
+func (r *Replayer) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.next >= len(r.recordings) {
+		return nil, 0, ErrReplayExhausted
+	}
+
+	index := r.next
+	recording := r.recordings[index]
+
+	query := new(dns.Msg)
+	if err := query.Unpack(recording.Query); err != nil {
+		return nil, 0, err
+	}
+
+	if len(query.Question) != 1 || len(m.Question) != 1 || !sameQuestion(query.Question[0], m.Question[0]) {
+		e := &ReplayError{Index: index}
+		if len(query.Question) > 0 {
+			e.Expected = query.Question[0]
+		}
+		if len(m.Question) > 0 {
+			e.Got = m.Question[0]
+		}
+		return nil, 0, e
+	}
+
+	r.next++
+
+	var rr *dns.Msg
+	if recording.Response != nil {
+		rr = new(dns.Msg)
+		if err := rr.Unpack(recording.Response); err != nil {
+			return nil, 0, err
+		}
+		rr.Id = m.Id
+	}
+
+	if recording.Error != "" {
+		return rr, 0, errors.New(recording.Error)
+	}
+
+	return rr, 0, nil
+}
+
+// Remaining returns the number of recordings that haven't been served yet.
+func (r *Replayer) Remaining() int {
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return len(r.recordings) - r.next
+}
+
+func sameQuestion(a, b dns.Question) bool {
+
+	return strings.EqualFold(a.Name, b.Name) && a.Qtype == b.Qtype && a.Qclass == b.Qclass
+}
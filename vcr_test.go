@@ -0,0 +1,130 @@
+package tsig
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordReplay(t *testing.T) {
+
+	recorder := &Recorder{
+		Exchanger: FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+			if address == "192.0.2.1:53" {
+				return nil, errors.New("connection refused")
+			}
+			return tkeyReply(m, "server.example.com."), nil
+		}),
+	}
+
+	request := &Request{
+		Host:      "ns.example.com.",
+		KeyName:   "test.example.com.",
+		Algorithm: GSS,
+		Mode:      TkeyModeGSS,
+		Lifetime:  3600,
+		Input:     []byte{0xde, 0xad, 0xbe, 0xef},
+	}
+
+	client := &Client{
+		Exchanger: recorder,
+		Resolver:  &FakeResolver{Addrs: []string{"192.0.2.1", "192.0.2.2"}},
+	}
+
+	recorded, err := client.Exchange(context.Background(), request)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	recordings := recorder.Recordings()
+	if assert.Len(t, recordings, 2) {
+		assert.Equal(t, "192.0.2.1:53", recordings[0].Address)
+		assert.Equal(t, "connection refused", recordings[0].Error)
+		assert.Nil(t, recordings[0].Response)
+		assert.Equal(t, "192.0.2.2:53", recordings[1].Address)
+		assert.Empty(t, recordings[1].Error)
+	}
+
+	var b bytes.Buffer
+	if !assert.Nil(t, recorder.Save(&b)) {
+		return
+	}
+
+	replayer, err := NewReplayer(&b)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 2, replayer.Remaining())
+
+	// No network access and a different resolver order
+	client = &Client{
+		Exchanger: replayer,
+		Resolver:  &FakeResolver{Addrs: []string{"198.51.100.1", "198.51.100.2"}},
+	}
+
+	replayed, err := client.Exchange(context.Background(), request)
+	if assert.Nil(t, err) {
+		assert.Equal(t, recorded.KeyName, replayed.KeyName)
+		assert.Equal(t, recorded.TKEY.String(), replayed.TKEY.String())
+		assert.Equal(t, "198.51.100.2:53", replayed.Address)
+	}
+	assert.Equal(t, 0, replayer.Remaining())
+
+	// Everything has been served
+	_, err = client.Exchange(context.Background(), request)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), ErrReplayExhausted.Error())
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+
+	m := new(dns.Msg)
+	m.SetQuestion("test.example.com.", dns.TypeTKEY)
+
+	query, err := m.Pack()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	response, err := tkeyReply(m, "test.example.com.").Pack()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	replayer := NewReplayerFromRecordings([]Recording{
+		{
+			Address:  "192.0.2.1:53",
+			Query:    query,
+			Response: response,
+		},
+	})
+
+	other := new(dns.Msg)
+	other.SetQuestion("other.example.com.", dns.TypeTKEY)
+
+	_, _, err = replayer.Exchange(other, "192.0.2.1:53")
+	if assert.NotNil(t, err) {
+		var e *ReplayError
+		if assert.True(t, errors.As(err, &e)) {
+			assert.Equal(t, 0, e.Index)
+			assert.Equal(t, "test.example.com.", e.Expected.Name)
+			assert.Equal(t, "other.example.com.", e.Got.Name)
+		}
+	}
+	assert.Equal(t, 1, replayer.Remaining())
+
+	// Names match regardless of case and the Id follows the query
+	again := new(dns.Msg)
+	again.SetQuestion("TEST.example.com.", dns.TypeTKEY)
+
+	rr, _, err := replayer.Exchange(again, "192.0.2.1:53")
+	if assert.Nil(t, err) {
+		assert.Equal(t, again.Id, rr.Id)
+		assert.Len(t, rr.Answer, 1)
+	}
+}
@@ -0,0 +1,85 @@
+package tsig
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// KeyStatus is whether the server still accepts a negotiated key, see
+// VerifyKey.
+type KeyStatus int
+
+const (
+	// KeyValid means the server accepted the key and signed its answer
+	KeyValid KeyStatus = iota
+	// KeyExpired means the key is past its expiry so wasn't checked
+	KeyExpired
+	// KeyUnknown means the server no longer knows the key, or no longer
+	// has the same secret for it
+	KeyUnknown
+)
+
+func (s KeyStatus) String() string {
+
+	switch s {
+	case KeyValid:
+		return "valid"
+	case KeyExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// VerifyKey sends a SOA query for the zone to the server at address signed
+// with the given key name and algorithm to check the server still accepts
+// the key, as it can forget a key before it expires, for example after
+// being restarted. The Exchanger must be set up to sign with the key and
+// verify the response with it, as for CheckWritable, and the context is
+// only used if it implements ContextExchanger. If expiry isn't zero and has
+// passed nothing is sent.
+// It returns the status of the key and any error that occurred, including
+// the server rejecting the query for another reason as a TSIGError or
+// DNSError, in which case the status is KeyUnknown.
+func VerifyKey(ctx context.Context, ex Exchanger, address, zone, keyname, algorithm string, expiry time.Time) (KeyStatus, error) {
+
+	if !expiry.IsZero() && !time.Now().Before(expiry) {
+		return KeyExpired, nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	msg.SetTsig(keyname, algorithm, 300, time.Now().Unix())
+
+	var rr *dns.Msg
+	var err error
+	if cex, ok := ex.(ContextExchanger); ok {
+		rr, _, err = cex.ExchangeContext(ctx, msg, address)
+	} else {
+		rr, _, err = ex.Exchange(msg, address)
+	}
+
+	// The server doesn't sign a rejection so it fails to verify
+	if rr != nil {
+		if t := rr.IsTsig(); t != nil && (t.Error == dns.RcodeBadKey || t.Error == dns.RcodeBadSig) {
+			return KeyUnknown, nil
+		}
+	}
+
+	if rr, err = checkTSIGError(rr, err); err != nil {
+		return KeyUnknown, err
+	}
+
+	switch {
+	case rr.Rcode == dns.RcodeNotAuth:
+		return KeyUnknown, nil
+	case rr.Rcode != dns.RcodeSuccess:
+		return KeyUnknown, &DNSError{Rcode: rr.Rcode}
+	case rr.IsTsig() == nil:
+		return KeyUnknown, ErrResponseNotSigned
+	default:
+		return KeyValid, nil
+	}
+}
@@ -0,0 +1,107 @@
+package tsig
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// tsigReply returns a reply to the query with a TSIG record carrying the
+// TSIG error
+func tsigReply(m *dns.Msg, rcode int, code uint16) *dns.Msg {
+
+	r := new(dns.Msg)
+	r.SetRcode(m, rcode)
+	r.Extra = append(r.Extra, &dns.TSIG{
+		Hdr: dns.RR_Header{
+			Name:   m.IsTsig().Hdr.Name,
+			Rrtype: dns.TypeTSIG,
+			Class:  dns.ClassANY,
+		},
+		Algorithm: m.IsTsig().Algorithm,
+		Fudge:     300,
+		OrigId:    m.Id,
+		Error:     code,
+	})
+
+	return r
+}
+
+func TestVerifyKey(t *testing.T) {
+
+	failed := errors.New("failed")
+
+	tables := map[string]struct {
+		reply  func(*dns.Msg) (*dns.Msg, error)
+		status KeyStatus
+		err    bool
+	}{
+		"valid": {
+			reply:  func(m *dns.Msg) (*dns.Msg, error) { return tsigReply(m, dns.RcodeSuccess, 0), nil },
+			status: KeyValid,
+		},
+		"bad key": {
+			reply:  func(m *dns.Msg) (*dns.Msg, error) { return tsigReply(m, dns.RcodeNotAuth, dns.RcodeBadKey), failed },
+			status: KeyUnknown,
+		},
+		"bad signature": {
+			reply:  func(m *dns.Msg) (*dns.Msg, error) { return tsigReply(m, dns.RcodeNotAuth, dns.RcodeBadSig), nil },
+			status: KeyUnknown,
+		},
+		"bad time": {
+			reply:  func(m *dns.Msg) (*dns.Msg, error) { return tsigReply(m, dns.RcodeNotAuth, dns.RcodeBadTime), nil },
+			status: KeyUnknown,
+			err:    true,
+		},
+		"unsigned": {
+			reply: func(m *dns.Msg) (*dns.Msg, error) {
+				r := new(dns.Msg)
+				r.SetReply(m)
+				return r, nil
+			},
+			status: KeyUnknown,
+			err:    true,
+		},
+		"unreachable": {
+			reply:  func(m *dns.Msg) (*dns.Msg, error) { return nil, failed },
+			status: KeyUnknown,
+			err:    true,
+		},
+	}
+
+	for name, table := range tables {
+		t.Run(name, func(t *testing.T) {
+
+			var sent *dns.Msg
+			ex := FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+				sent = m
+				return table.reply(m)
+			})
+
+			status, err := VerifyKey(context.Background(), ex, "192.0.2.1:53", "example.com", "test.example.com.", GSS, time.Now().Add(time.Hour))
+			assert.Equal(t, table.status, status)
+			assert.Equal(t, table.err, err != nil)
+
+			if assert.NotNil(t, sent) {
+				assert.Equal(t, "example.com.", sent.Question[0].Name)
+				assert.Equal(t, dns.TypeSOA, sent.Question[0].Qtype)
+				assert.Equal(t, "test.example.com.", sent.IsTsig().Hdr.Name)
+			}
+		})
+	}
+
+	// Nothing is sent for an expired key
+	ex := FuncClient(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		t.Fatal("query sent")
+		return nil, nil
+	})
+
+	status, err := VerifyKey(context.Background(), ex, "192.0.2.1:53", "example.com", "test.example.com.", GSS, time.Now().Add(-time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, KeyExpired, status)
+	assert.Equal(t, "expired", status.String())
+}